@@ -0,0 +1,59 @@
+// Package broker is an interface used for asynchronous messaging
+package broker
+
+import (
+	"errors"
+)
+
+var (
+	// Not connected error when the broker is used before Connect
+	ErrNotConnected = errors.New("not connected")
+)
+
+// Broker is an interface used for asynchronous messaging.
+type Broker interface {
+	Init(...Option) error
+	Options() Options
+	Address() string
+	Connect() error
+	Disconnect() error
+	Publisher
+	Subscribe(topic string, h Handler, opts ...SubscribeOption) (Subscriber, error)
+	String() string
+}
+
+// Connectivity is implemented by the brokers which report whether they are
+// connected, a broker shared by several servers is left connected by them
+type Connectivity interface {
+	Connected() bool
+}
+
+// Publisher publishes messages to a topic
+type Publisher interface {
+	Publish(topic string, m *Message, opts ...PublishOption) error
+}
+
+// Handler is used to process messages via a subscription of a topic.
+// The handler is passed a publication interface which contains the
+// message and optional Ack method to acknowledge receipt of the message.
+type Handler func(Event) error
+
+type Message struct {
+	Header map[string]string
+	Body   []byte
+}
+
+// Event is given to a subscription handler for processing
+type Event interface {
+	Topic() string
+	Message() *Message
+	Ack() error
+	Error() error
+}
+
+// Subscriber is a convenience return type for the Subscribe method
+type Subscriber interface {
+	Options() SubscribeOptions
+	Topic() string
+	Unsubscribe() error
+}
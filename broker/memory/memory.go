@@ -0,0 +1,211 @@
+// Package memory provides a memory broker
+package memory
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/broker"
+)
+
+type memoryBroker struct {
+	opts broker.Options
+
+	addr string
+	sync.RWMutex
+	connected bool
+	// topic -> subscribers
+	subscribers map[string][]*memorySubscriber
+}
+
+type memoryEvent struct {
+	topic   string
+	err     error
+	message *broker.Message
+}
+
+type memorySubscriber struct {
+	id      string
+	topic   string
+	handler broker.Handler
+	opts    broker.SubscribeOptions
+	broker  *memoryBroker
+}
+
+func (m *memoryBroker) Options() broker.Options {
+	return m.opts
+}
+
+func (m *memoryBroker) Address() string {
+	return m.addr
+}
+
+func (m *memoryBroker) Connect() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.connected {
+		return nil
+	}
+
+	m.addr = uuid.New().String()
+	m.connected = true
+
+	return nil
+}
+
+func (m *memoryBroker) Connected() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.connected
+}
+
+func (m *memoryBroker) Disconnect() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.connected {
+		return nil
+	}
+
+	m.connected = false
+	m.subscribers = make(map[string][]*memorySubscriber)
+
+	return nil
+}
+
+func (m *memoryBroker) Init(opts ...broker.Option) error {
+	for _, o := range opts {
+		o(&m.opts)
+	}
+	return nil
+}
+
+// Publish delivers the message to every subscriber of the topic without a queue
+// and to one random subscriber of every queue
+func (m *memoryBroker) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	m.RLock()
+	if !m.connected {
+		m.RUnlock()
+		return broker.ErrNotConnected
+	}
+
+	subs := m.subscribers[topic]
+	m.RUnlock()
+
+	// queue -> subscribers
+	queues := make(map[string][]*memorySubscriber)
+	var receivers []*memorySubscriber
+
+	for _, sub := range subs {
+		if len(sub.opts.Queue) == 0 {
+			receivers = append(receivers, sub)
+			continue
+		}
+		queues[sub.opts.Queue] = append(queues[sub.opts.Queue], sub)
+	}
+
+	for _, q := range queues {
+		receivers = append(receivers, q[rand.Intn(len(q))])
+	}
+
+	for _, sub := range receivers {
+		p := &memoryEvent{
+			topic:   topic,
+			message: msg,
+		}
+
+		if p.err = sub.handler(p); p.err != nil {
+			if eh := m.opts.ErrorHandler; eh != nil {
+				log.Debugf("[memory] broker %s handler failed: %v", topic, p.err)
+				eh(p)
+				continue
+			}
+			return p.err
+		}
+	}
+
+	return nil
+}
+
+func (m *memoryBroker) Subscribe(topic string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.connected {
+		return nil, broker.ErrNotConnected
+	}
+
+	sub := &memorySubscriber{
+		id:      uuid.New().String(),
+		topic:   topic,
+		handler: handler,
+		opts:    broker.NewSubscribeOptions(opts...),
+		broker:  m,
+	}
+
+	m.subscribers[topic] = append(m.subscribers[topic], sub)
+
+	return sub, nil
+}
+
+func (m *memoryBroker) String() string {
+	return "memory"
+}
+
+func (m *memoryEvent) Topic() string {
+	return m.topic
+}
+
+func (m *memoryEvent) Message() *broker.Message {
+	return m.message
+}
+
+func (m *memoryEvent) Ack() error {
+	return nil
+}
+
+func (m *memoryEvent) Error() error {
+	return m.err
+}
+
+func (m *memorySubscriber) Options() broker.SubscribeOptions {
+	return m.opts
+}
+
+func (m *memorySubscriber) Topic() string {
+	return m.topic
+}
+
+func (m *memorySubscriber) Unsubscribe() error {
+	m.broker.Lock()
+	defer m.broker.Unlock()
+
+	subs := m.broker.subscribers[m.topic]
+	for i, sub := range subs {
+		if sub.id == m.id {
+			// copy so that publishes in flight keep their list
+			newSubs := make([]*memorySubscriber, 0, len(subs)-1)
+			newSubs = append(newSubs, subs[:i]...)
+			newSubs = append(newSubs, subs[i+1:]...)
+			m.broker.subscribers[m.topic] = newSubs
+			break
+		}
+	}
+
+	return nil
+}
+
+func NewBroker(opts ...broker.Option) broker.Broker {
+	var options broker.Options
+	for _, o := range opts {
+		o(&options)
+	}
+
+	return &memoryBroker{
+		opts:        options,
+		subscribers: make(map[string][]*memorySubscriber),
+	}
+}
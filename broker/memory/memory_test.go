@@ -0,0 +1,108 @@
+package memory
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sumlookup/mini/broker"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	b := NewBroker()
+
+	if err := b.Publish("test", &broker.Message{}); err != broker.ErrNotConnected {
+		t.Fatalf("Expected %v, got %v", broker.ErrNotConnected, err)
+	}
+
+	if err := b.Connect(); err != nil {
+		t.Fatalf("Unexpected connect error %v", err)
+	}
+
+	topic := "test"
+	count := 10
+
+	var received int
+	fn := func(p broker.Event) error {
+		received++
+		return nil
+	}
+
+	sub, err := b.Subscribe(topic, fn)
+	if err != nil {
+		t.Fatalf("Unexpected error subscribing %v", err)
+	}
+
+	for i := 0; i < count; i++ {
+		message := &broker.Message{
+			Header: map[string]string{
+				"foo": "bar",
+				"id":  fmt.Sprintf("%d", i),
+			},
+			Body: []byte(`hello world`),
+		}
+
+		if err := b.Publish(topic, message); err != nil {
+			t.Fatalf("Unexpected error publishing %d", i)
+		}
+	}
+
+	if received != count {
+		t.Fatalf("Expected %d messages, got %d", count, received)
+	}
+
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected error unsubscribing from %s: %v", topic, err)
+	}
+
+	if err := b.Publish(topic, &broker.Message{}); err != nil {
+		t.Fatalf("Unexpected error publishing %v", err)
+	}
+
+	if received != count {
+		t.Fatalf("Expected no messages after unsubscribe, got %d", received-count)
+	}
+
+	if err := b.Disconnect(); err != nil {
+		t.Fatalf("Unexpected connect error %v", err)
+	}
+}
+
+func TestMemoryBrokerQueue(t *testing.T) {
+	b := NewBroker()
+
+	if err := b.Connect(); err != nil {
+		t.Fatalf("Unexpected connect error %v", err)
+	}
+	defer b.Disconnect()
+
+	count := 20
+	received := make(map[string]int)
+
+	subscribe := func(name string, opts ...broker.SubscribeOption) {
+		_, err := b.Subscribe("test", func(p broker.Event) error {
+			received[name]++
+			return nil
+		}, opts...)
+		if err != nil {
+			t.Fatalf("Unexpected error subscribing %v", err)
+		}
+	}
+
+	subscribe("queue-1", broker.Queue("queue"))
+	subscribe("queue-2", broker.Queue("queue"))
+	subscribe("all")
+
+	for i := 0; i < count; i++ {
+		if err := b.Publish("test", &broker.Message{Body: []byte(`hello world`)}); err != nil {
+			t.Fatalf("Unexpected error publishing %d", i)
+		}
+	}
+
+	if received["all"] != count {
+		t.Fatalf("Expected %d messages without a queue, got %d", count, received["all"])
+	}
+
+	if q := received["queue-1"] + received["queue-2"]; q != count {
+		t.Fatalf("Expected %d messages shared by the queue, got %d", count, q)
+	}
+}
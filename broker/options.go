@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+)
+
+type Options struct {
+	Addrs     []string
+	Secure    bool
+	TLSConfig *tls.Config
+	// ErrorHandler is called with the events whose handler failed
+	ErrorHandler Handler
+	// Other options for implementations of the interface
+	// can be stored in a context
+	Context context.Context
+}
+
+type PublishOptions struct {
+	// Other options for implementations of the interface
+	// can be stored in a context
+	Context context.Context
+}
+
+type SubscribeOptions struct {
+	// AutoAck acknowledges the message once the handler returns without an error
+	AutoAck bool
+	// Subscribers with the same queue name share the subscription,
+	// every message is delivered to one of them
+	Queue string
+	// Other options for implementations of the interface
+	// can be stored in a context
+	Context context.Context
+}
+
+type Option func(*Options)
+
+type PublishOption func(*PublishOptions)
+
+type SubscribeOption func(*SubscribeOptions)
+
+// NewSubscribeOptions returns the subscribe options with AutoAck enabled
+func NewSubscribeOptions(opts ...SubscribeOption) SubscribeOptions {
+	opt := SubscribeOptions{
+		AutoAck: true,
+	}
+
+	for _, o := range opts {
+		o(&opt)
+	}
+
+	return opt
+}
+
+// Addrs sets the host addresses to be used by the broker
+func Addrs(addrs ...string) Option {
+	return func(o *Options) {
+		o.Addrs = addrs
+	}
+}
+
+// ErrorHandler will catch all broker errors that cant be handled
+// in normal way, for example Codec errors
+func ErrorHandler(h Handler) Option {
+	return func(o *Options) {
+		o.ErrorHandler = h
+	}
+}
+
+// Secure communication with the broker
+func Secure(b bool) Option {
+	return func(o *Options) {
+		o.Secure = b
+	}
+}
+
+// Specify TLS Config
+func TLSConfig(t *tls.Config) Option {
+	return func(o *Options) {
+		o.TLSConfig = t
+	}
+}
+
+// PublishContext set context
+func PublishContext(ctx context.Context) PublishOption {
+	return func(o *PublishOptions) {
+		o.Context = ctx
+	}
+}
+
+// DisableAutoAck will disable auto acking of messages
+// after they have been handled.
+func DisableAutoAck() SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.AutoAck = false
+	}
+}
+
+// Queue sets the name of the queue to share messages on
+func Queue(name string) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Queue = name
+	}
+}
+
+// SubscribeContext set context
+func SubscribeContext(ctx context.Context) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Context = ctx
+	}
+}
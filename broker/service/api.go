@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// The broker service messages are sent with the json codec so
+// they don't need generated code.
+
+// Message is a broker message
+type Message struct {
+	Header map[string]string `json:"header,omitempty"`
+	Body   []byte            `json:"body,omitempty"`
+}
+
+// PublishRequest publishes the message to the topic
+type PublishRequest struct {
+	Topic   string   `json:"topic"`
+	Message *Message `json:"message"`
+}
+
+// PublishResponse is returned once the message is queued for the subscribers
+type PublishResponse struct{}
+
+// SubscribeRequest opens a subscription with the first request sent on the
+// stream, the following requests acknowledge the received events
+type SubscribeRequest struct {
+	// Id of the subscriber, a subscriber reconnecting with the same id
+	// receives the events which were not acknowledged before it disconnected
+	Id string `json:"id,omitempty"`
+	// Topic may contain wildcards, * matches a single segment
+	// of a dot separated topic and > matches the remaining ones
+	Topic string `json:"topic,omitempty"`
+	// Queue shares the events between the subscribers of the same queue
+	Queue string `json:"queue,omitempty"`
+	// Ack are the ids of the handled events
+	Ack []string `json:"ack,omitempty"`
+	// Nack are the ids of the events the subscriber failed to handle,
+	// they are delivered again
+	Nack []string `json:"nack,omitempty"`
+	// Unsubscribe ends the subscription instead of keeping
+	// the events for the subscriber to reconnect
+	Unsubscribe bool `json:"unsubscribe,omitempty"`
+}
+
+// Event is a message delivered to a subscriber
+type Event struct {
+	Id      string   `json:"id"`
+	Topic   string   `json:"topic"`
+	Message *Message `json:"message"`
+}
+
+// BrokerServer is the server API of the broker service
+type BrokerServer interface {
+	Publish(context.Context, *PublishRequest) (*PublishResponse, error)
+	Subscribe(Broker_SubscribeServer) error
+}
+
+// Broker_SubscribeServer is the server side of a subscription
+type Broker_SubscribeServer interface {
+	Send(*Event) error
+	Recv() (*SubscribeRequest, error)
+	grpc.ServerStream
+}
+
+type brokerSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *brokerSubscribeServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *brokerSubscribeServer) Recv() (*SubscribeRequest, error) {
+	m := new(SubscribeRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func publishHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).Publish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mini.broker.Broker/Publish",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).Publish(ctx, req.(*PublishRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func subscribeHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(BrokerServer).Subscribe(&brokerSubscribeServer{stream})
+}
+
+// serviceDesc describes the mini.broker.Broker grpc service
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "mini.broker.Broker",
+	HandlerType: (*BrokerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Publish",
+			Handler:    publishHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       subscribeHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+// RegisterBrokerServer registers the broker service on the grpc server
+func RegisterBrokerServer(s *grpc.Server, srv BrokerServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
@@ -0,0 +1,476 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/server"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// DefaultMaxInflight is the number of events a subscriber may hold without acknowledging them
+	DefaultMaxInflight = 64
+	// DefaultMaxPending is the number of events kept for a subscription, the oldest are dropped
+	DefaultMaxPending = 1024
+	// DefaultSubscriptionTimeout is how long the events are kept for a disconnected subscriber
+	DefaultSubscriptionTimeout = time.Minute
+	// DefaultRedeliveryBackoff is the wait before a failed event is delivered again,
+	// it doubles with every failed delivery up to DefaultMaxRedeliveryBackoff
+	DefaultRedeliveryBackoff = 100 * time.Millisecond
+	// DefaultMaxRedeliveryBackoff caps the wait before a failed event is delivered again
+	DefaultMaxRedeliveryBackoff = 30 * time.Second
+	// DefaultMaxDeliveries is the number of failed deliveries after which an event is dead
+	DefaultMaxDeliveries = 10
+
+	// OriginalTopicHeader holds the topic a dead event was published to
+	OriginalTopicHeader = "Original-Topic"
+
+	errUnsubscribed = errors.New("unsubscribed")
+)
+
+type HandlerOptions struct {
+	MaxInflight         int
+	MaxPending          int
+	SubscriptionTimeout time.Duration
+	RedeliveryBackoff   time.Duration
+	MaxDeliveries       int
+	// DeadLetterTopic receives the dead events, they are dropped without it
+	DeadLetterTopic string
+}
+
+type HandlerOption func(*HandlerOptions)
+
+// MaxInflight limits the events a subscriber holds without acknowledging them
+func MaxInflight(n int) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.MaxInflight = n
+	}
+}
+
+// MaxPending limits the events kept for a subscription
+func MaxPending(n int) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.MaxPending = n
+	}
+}
+
+// SubscriptionTimeout is how long the events of a subscription are kept
+// after its last subscriber disconnected
+func SubscriptionTimeout(d time.Duration) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.SubscriptionTimeout = d
+	}
+}
+
+// RedeliveryBackoff is the wait before an event a subscriber failed to handle
+// is delivered again, it doubles with every failed delivery
+func RedeliveryBackoff(d time.Duration) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.RedeliveryBackoff = d
+	}
+}
+
+// MaxDeliveries is the number of failed deliveries after which an event is dead
+func MaxDeliveries(n int) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.MaxDeliveries = n
+	}
+}
+
+// DeadLetterTopic publishes the dead events to the topic with their original
+// topic in the OriginalTopicHeader
+func DeadLetterTopic(topic string) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.DeadLetterTopic = topic
+	}
+}
+
+// Handler is the broker service. Events are delivered at least once, an event
+// is kept until a subscriber acknowledges it. The events a subscriber failed to
+// handle or didn't acknowledge before it disconnected are delivered again, the
+// failed ones after a backoff until they are dead.
+type Handler struct {
+	opts HandlerOptions
+
+	sync.Mutex
+	// key -> subscription
+	subscriptions map[string]*subscription
+}
+
+// subscription queues the events of a topic for a queue, or a single subscriber
+// without a queue. The connected members take the events one at a time.
+type subscription struct {
+	key     string
+	topic   string
+	pending []*Event
+	members map[*member]bool
+	expire  *time.Timer
+	// event id -> failed deliveries
+	failures map[string]int
+}
+
+// member is a connected subscriber
+type member struct {
+	// wakes the member up when there are events to send
+	wake chan struct{}
+	// sent but not acknowledged
+	inflight []*Event
+}
+
+func (m *member) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscription) notify() {
+	for m := range s.members {
+		m.notify()
+	}
+}
+
+// NewHandler returns the broker service handler
+func NewHandler(opts ...HandlerOption) *Handler {
+	options := HandlerOptions{
+		MaxInflight:         DefaultMaxInflight,
+		MaxPending:          DefaultMaxPending,
+		SubscriptionTimeout: DefaultSubscriptionTimeout,
+		RedeliveryBackoff:   DefaultRedeliveryBackoff,
+		MaxDeliveries:       DefaultMaxDeliveries,
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	return &Handler{
+		opts:          options,
+		subscriptions: make(map[string]*subscription),
+	}
+}
+
+// Register adds the broker service to the server so it is registered with the
+// server's registry and found by the broker clients through their selector
+func Register(srv *server.Server, h *Handler) {
+	RegisterBrokerServer(srv.Server(), h)
+	srv.AddHandler(h)
+}
+
+// Publish queues the message for every subscription whose topic matches
+func (h *Handler) Publish(ctx context.Context, req *PublishRequest) (*PublishResponse, error) {
+	if len(req.Topic) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "topic is required")
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.publish(req.Topic, req.Message)
+
+	return &PublishResponse{}, nil
+}
+
+// publish queues the message for the matching subscriptions, the lock is held
+func (h *Handler) publish(topic string, msg *Message) {
+	event := &Event{
+		Id:      uuid.New().String(),
+		Topic:   topic,
+		Message: msg,
+	}
+
+	for _, s := range h.subscriptions {
+		if !match(s.topic, topic) {
+			continue
+		}
+
+		s.pending = append(s.pending, event)
+		if len(s.pending) > h.opts.MaxPending {
+			log.Warnf("[broker] subscription %s of %s is full, dropping event %s", s.key, s.topic, s.pending[0].Id)
+			delete(s.failures, s.pending[0].Id)
+			s.pending = s.pending[1:]
+		}
+
+		s.notify()
+	}
+}
+
+// Subscribe streams the events of the subscription opened by the first request
+func (h *Handler) Subscribe(stream Broker_SubscribeServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	if len(req.Topic) == 0 {
+		return status.Error(codes.InvalidArgument, "topic is required")
+	}
+
+	s, m := h.join(req)
+
+	// acks and the unsubscribe request are read in the background
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if len(req.Ack) > 0 {
+				h.ack(s, m, req.Ack)
+			}
+			if len(req.Nack) > 0 {
+				h.nack(s, m, req.Nack)
+			}
+			if req.Unsubscribe {
+				errCh <- errUnsubscribed
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			h.leave(s, m, false)
+			return stream.Context().Err()
+		case err := <-errCh:
+			h.leave(s, m, err == errUnsubscribed)
+			if err == errUnsubscribed || err == io.EOF {
+				return nil
+			}
+			return err
+		case <-m.wake:
+		}
+
+		for e := h.next(s, m); e != nil; e = h.next(s, m) {
+			if err := stream.Send(e); err != nil {
+				h.leave(s, m, false)
+				return err
+			}
+		}
+	}
+}
+
+// key returns the subscription key of the request. Subscribers without a queue
+// have their own subscription which they get back when they reconnect.
+func key(req *SubscribeRequest) string {
+	if len(req.Queue) > 0 {
+		return req.Topic + "\x00queue\x00" + req.Queue
+	}
+	return req.Topic + "\x00id\x00" + req.Id
+}
+
+func (h *Handler) join(req *SubscribeRequest) (*subscription, *member) {
+	if len(req.Queue) == 0 && len(req.Id) == 0 {
+		req.Id = uuid.New().String()
+	}
+
+	k := key(req)
+
+	h.Lock()
+	defer h.Unlock()
+
+	s, ok := h.subscriptions[k]
+	if !ok {
+		s = &subscription{
+			key:      k,
+			topic:    req.Topic,
+			members:  make(map[*member]bool),
+			failures: make(map[string]int),
+		}
+		h.subscriptions[k] = s
+	}
+
+	if s.expire != nil {
+		s.expire.Stop()
+		s.expire = nil
+	}
+
+	m := &member{
+		wake: make(chan struct{}, 1),
+	}
+	s.members[m] = true
+
+	// send what was kept for the subscription
+	m.notify()
+
+	return s, m
+}
+
+// leave gives the events the member didn't acknowledge back to the subscription.
+// The subscription is removed when the last member unsubscribed or didn't come
+// back within the subscription timeout.
+func (h *Handler) leave(s *subscription, m *member, unsubscribe bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	if !s.members[m] {
+		return
+	}
+	delete(s.members, m)
+
+	if len(m.inflight) > 0 {
+		s.pending = append(m.inflight, s.pending...)
+		m.inflight = nil
+	}
+
+	if len(s.members) > 0 {
+		s.notify()
+		return
+	}
+
+	if unsubscribe {
+		delete(h.subscriptions, s.key)
+		return
+	}
+
+	s.expire = time.AfterFunc(h.opts.SubscriptionTimeout, func() {
+		h.Lock()
+		defer h.Unlock()
+
+		if len(s.members) == 0 && h.subscriptions[s.key] == s {
+			log.Debugf("[broker] subscription %s of %s expired with %d events", s.key, s.topic, len(s.pending))
+			delete(h.subscriptions, s.key)
+		}
+	})
+}
+
+// next moves the next pending event to the member's inflight events
+func (h *Handler) next(s *subscription, m *member) *Event {
+	h.Lock()
+	defer h.Unlock()
+
+	if len(s.pending) == 0 || len(m.inflight) >= h.opts.MaxInflight {
+		return nil
+	}
+
+	e := s.pending[0]
+	s.pending = s.pending[1:]
+	m.inflight = append(m.inflight, e)
+
+	return e
+}
+
+func (h *Handler) ack(s *subscription, m *member, ids []string) {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, id := range ids {
+		for i, e := range m.inflight {
+			if e.Id == id {
+				m.inflight = append(m.inflight[:i], m.inflight[i+1:]...)
+				delete(s.failures, id)
+				break
+			}
+		}
+	}
+
+	// room for more events
+	m.notify()
+}
+
+// nack gives the events the member failed to handle back to the subscription
+// so they are delivered again after a backoff, to any of its members. The
+// events which failed MaxDeliveries times are dead.
+func (h *Handler) nack(s *subscription, m *member, ids []string) {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, id := range ids {
+		for i, e := range m.inflight {
+			if e.Id != id {
+				continue
+			}
+			m.inflight = append(m.inflight[:i], m.inflight[i+1:]...)
+
+			s.failures[id]++
+			if n := s.failures[id]; h.opts.MaxDeliveries > 0 && n >= h.opts.MaxDeliveries {
+				delete(s.failures, id)
+				h.dead(s, e)
+			} else {
+				h.redeliver(s, e, n)
+			}
+			break
+		}
+	}
+
+	// room for more events
+	m.notify()
+}
+
+// redeliver gives the event back to the subscription once the backoff of
+// its failed deliveries passed, the lock is held
+func (h *Handler) redeliver(s *subscription, e *Event, failures int) {
+	d := h.opts.RedeliveryBackoff << (failures - 1)
+	if d <= 0 || d > DefaultMaxRedeliveryBackoff {
+		d = DefaultMaxRedeliveryBackoff
+	}
+
+	time.AfterFunc(d, func() {
+		h.Lock()
+		defer h.Unlock()
+
+		// the subscription ended meanwhile
+		if h.subscriptions[s.key] != s {
+			return
+		}
+
+		s.pending = append([]*Event{e}, s.pending...)
+		s.notify()
+	})
+}
+
+// dead publishes the event to the dead letter topic, or drops it, the lock is held
+func (h *Handler) dead(s *subscription, e *Event) {
+	if len(h.opts.DeadLetterTopic) == 0 {
+		log.Warnf("[broker] subscription %s of %s failed event %s %d times, dropping it", s.key, s.topic, e.Id, h.opts.MaxDeliveries)
+		return
+	}
+
+	log.Warnf("[broker] subscription %s of %s failed event %s %d times, publishing it to %s", s.key, s.topic, e.Id, h.opts.MaxDeliveries, h.opts.DeadLetterTopic)
+
+	msg := &Message{Header: map[string]string{OriginalTopicHeader: e.Topic}}
+	if e.Message != nil {
+		for k, v := range e.Message.Header {
+			msg.Header[k] = v
+		}
+		msg.Body = e.Message.Body
+	}
+
+	h.publish(h.opts.DeadLetterTopic, msg)
+}
+
+// match reports whether the topic matches the subscription topic. Topics are
+// dot separated, * matches a single segment and a trailing > matches one or more.
+func match(pattern, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+
+	p := strings.Split(pattern, ".")
+	t := strings.Split(topic, ".")
+
+	for i, seg := range p {
+		if seg == ">" && i == len(p)-1 {
+			return len(t) > i
+		}
+		if i >= len(t) {
+			return false
+		}
+		if seg != "*" && seg != t[i] {
+			return false
+		}
+	}
+
+	return len(p) == len(t)
+}
@@ -0,0 +1,464 @@
+// Package service provides a broker which publishes and subscribes
+// through the broker service, a mini service found in the registry
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/broker"
+	"github.com/sumlookup/mini/builder"
+	"github.com/sumlookup/mini/client"
+	"github.com/sumlookup/mini/registry"
+)
+
+const (
+	contentType = "application/json"
+)
+
+var (
+	// DefaultService is the name the broker service is registered with
+	DefaultService = "mini.broker"
+	// DefaultUnsubscribeTimeout is how long Unsubscribe and Disconnect wait for
+	// the broker service to end the subscriptions
+	DefaultUnsubscribeTimeout = time.Second
+	// MaxBackoff is the longest wait before a broken subscription is opened again
+	MaxBackoff = 5 * time.Second
+)
+
+type clientKey struct{}
+type serviceKey struct{}
+
+// Client sets the client the broker reaches the broker service with
+func Client(c *client.Client) broker.Option {
+	return func(o *broker.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, clientKey{}, c)
+	}
+}
+
+// Service sets the name of the broker service
+func Service(name string) broker.Option {
+	return func(o *broker.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, serviceKey{}, name)
+	}
+}
+
+type serviceBroker struct {
+	opts broker.Options
+
+	sync.RWMutex
+	connected   bool
+	client      *client.Client
+	service     string
+	subscribers map[string]*serviceSubscriber
+}
+
+type serviceEvent struct {
+	topic   string
+	message *broker.Message
+	err     error
+	ack     func() error
+}
+
+type serviceSubscriber struct {
+	id      string
+	topic   string
+	opts    broker.SubscribeOptions
+	handler broker.Handler
+	broker  *serviceBroker
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// closed once the subscription loop returned
+	done chan bool
+	// closed once the subscription ended and was removed from the broker
+	ended chan bool
+
+	sync.Mutex
+	stream       client.Stream
+	unsubscribed bool
+	// the handler is running on the subscription loop
+	handling bool
+}
+
+func (b *serviceBroker) Init(opts ...broker.Option) error {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, o := range opts {
+		o(&b.opts)
+	}
+	b.configure()
+
+	return nil
+}
+
+// configure reads the client and service from the options, it is called with the lock held
+func (b *serviceBroker) configure() {
+	if b.opts.Context != nil {
+		if c, ok := b.opts.Context.Value(clientKey{}).(*client.Client); ok && c != nil {
+			b.client = c
+		}
+		if s, ok := b.opts.Context.Value(serviceKey{}).(string); ok && len(s) > 0 {
+			b.service = s
+		}
+	}
+
+	// default to the registry selector over grpc
+	if b.client == nil {
+		b.client = client.New(
+			client.Selector(builder.BuildSelector("registry", registry.DefaultRegistry)),
+			client.WithTransport(builder.BuildTransport("grpc")),
+		)
+	}
+}
+
+func (b *serviceBroker) Options() broker.Options {
+	return b.opts
+}
+
+func (b *serviceBroker) Address() string {
+	return b.service
+}
+
+func (b *serviceBroker) Connect() error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.connected = true
+	return nil
+}
+
+func (b *serviceBroker) Connected() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.connected
+}
+
+func (b *serviceBroker) Disconnect() error {
+	b.Lock()
+	if !b.connected {
+		b.Unlock()
+		return nil
+	}
+
+	b.connected = false
+	subs := b.subscribers
+	b.subscribers = make(map[string]*serviceSubscriber)
+	b.Unlock()
+
+	// end the subscriptions together so they share the unsubscribe timeout
+	ended := make([]<-chan bool, 0, len(subs))
+	for _, sub := range subs {
+		if e := sub.unsubscribe(); !sub.inHandler() {
+			ended = append(ended, e)
+		}
+	}
+	for _, e := range ended {
+		<-e
+	}
+
+	return nil
+}
+
+func (b *serviceBroker) Publish(topic string, msg *broker.Message, opts ...broker.PublishOption) error {
+	b.RLock()
+	connected := b.connected
+	b.RUnlock()
+
+	if !connected {
+		return broker.ErrNotConnected
+	}
+
+	var options broker.PublishOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	req := &PublishRequest{
+		Topic: topic,
+		Message: &Message{
+			Header: msg.Header,
+			Body:   msg.Body,
+		},
+	}
+
+	return b.client.Call(ctx, b.service, "mini.broker.Broker.Publish", req, new(PublishResponse), client.WithContentType(contentType))
+}
+
+// Subscribe opens a subscription on the broker service which is opened again
+// whenever it breaks. Events the handler didn't acknowledge are delivered again.
+func (b *serviceBroker) Subscribe(topic string, handler broker.Handler, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.connected {
+		return nil, broker.ErrNotConnected
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sub := &serviceSubscriber{
+		id:      uuid.New().String(),
+		topic:   topic,
+		opts:    broker.NewSubscribeOptions(opts...),
+		handler: handler,
+		broker:  b,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan bool),
+		ended:   make(chan bool),
+	}
+
+	b.subscribers[sub.id] = sub
+
+	go sub.run()
+
+	return sub, nil
+}
+
+func (b *serviceBroker) String() string {
+	return "service"
+}
+
+func (e *serviceEvent) Topic() string {
+	return e.topic
+}
+
+func (e *serviceEvent) Message() *broker.Message {
+	return e.message
+}
+
+func (e *serviceEvent) Ack() error {
+	return e.ack()
+}
+
+func (e *serviceEvent) Error() error {
+	return e.err
+}
+
+func (s *serviceSubscriber) Options() broker.SubscribeOptions {
+	return s.opts
+}
+
+func (s *serviceSubscriber) Topic() string {
+	return s.topic
+}
+
+// Unsubscribe ends the subscription on the broker service. Events the
+// handler didn't acknowledge are given to the rest of the queue. It returns
+// once the subscription ended, or straight away when called from the handler,
+// which gets no more events either way.
+func (s *serviceSubscriber) Unsubscribe() error {
+	ended := s.unsubscribe()
+
+	// the subscription can't end before the handler returns
+	if !s.inHandler() {
+		<-ended
+	}
+
+	return nil
+}
+
+// unsubscribe asks the broker service to end the subscription and returns
+// a channel which is closed once it ended
+func (s *serviceSubscriber) unsubscribe() <-chan bool {
+	s.Lock()
+	if s.unsubscribed {
+		s.Unlock()
+		return s.ended
+	}
+	s.unsubscribed = true
+
+	if s.stream != nil {
+		if err := s.stream.Send(&SubscribeRequest{Unsubscribe: true}); err == nil {
+			s.stream.CloseSend()
+		}
+	}
+	s.Unlock()
+
+	go func() {
+		// give the broker service the chance to end the stream
+		select {
+		case <-s.done:
+		case <-time.After(DefaultUnsubscribeTimeout):
+		}
+		s.cancel()
+		<-s.done
+
+		s.broker.Lock()
+		delete(s.broker.subscribers, s.id)
+		s.broker.Unlock()
+
+		close(s.ended)
+	}()
+
+	return s.ended
+}
+
+func (s *serviceSubscriber) inHandler() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.handling
+}
+
+func (s *serviceSubscriber) closed() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.unsubscribed || s.ctx.Err() != nil
+}
+
+// run keeps the subscription open until unsubscribed
+func (s *serviceSubscriber) run() {
+	defer close(s.done)
+
+	backoff := 100 * time.Millisecond
+
+	for {
+		received, err := s.subscribe()
+		if s.closed() {
+			return
+		}
+
+		if received {
+			backoff = 100 * time.Millisecond
+		}
+
+		log.Debugf("[broker] subscription to %s broke, subscribing again in %v: %v", s.topic, backoff, err)
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > MaxBackoff {
+			backoff = MaxBackoff
+		}
+	}
+}
+
+// subscribe opens the subscription and handles the events until it breaks.
+// It reports whether any event was received.
+func (s *serviceSubscriber) subscribe() (bool, error) {
+	stream, err := s.broker.client.Stream(s.ctx, s.broker.service, "mini.broker.Broker.Subscribe", client.WithContentType(contentType))
+	if err != nil {
+		return false, err
+	}
+
+	s.Lock()
+	if s.unsubscribed {
+		s.Unlock()
+		return false, nil
+	}
+	s.stream = stream
+	err = stream.Send(&SubscribeRequest{
+		Id:    s.id,
+		Topic: s.topic,
+		Queue: s.opts.Queue,
+	})
+	s.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+
+	var received bool
+
+	for {
+		e := new(Event)
+		if err := stream.Recv(e); err != nil {
+			return received, err
+		}
+		received = true
+
+		p := &serviceEvent{
+			topic: e.Topic,
+			ack: func() error {
+				s.Lock()
+				defer s.Unlock()
+				return stream.Send(&SubscribeRequest{Ack: []string{e.Id}})
+			},
+		}
+		if e.Message != nil {
+			p.message = &broker.Message{
+				Header: e.Message.Header,
+				Body:   e.Message.Body,
+			}
+		} else {
+			p.message = new(broker.Message)
+		}
+
+		// events received once unsubscribed are left to the rest of the queue
+		if s.closed() {
+			continue
+		}
+
+		s.Lock()
+		s.handling = true
+		s.Unlock()
+
+		p.err = s.handler(p)
+
+		s.Lock()
+		s.handling = false
+		s.Unlock()
+
+		if p.err != nil {
+			if eh := s.broker.opts.ErrorHandler; eh != nil {
+				eh(p)
+			}
+
+			// deliver the event again instead of holding it until the
+			// subscriber disconnects, unless it was acknowledged
+			if err := s.nack(stream, e.Id); err != nil {
+				return received, err
+			}
+			continue
+		}
+
+		if s.opts.AutoAck {
+			if err := p.Ack(); err != nil {
+				return received, err
+			}
+		}
+	}
+}
+
+func (s *serviceSubscriber) nack(stream client.Stream, id string) error {
+	s.Lock()
+	defer s.Unlock()
+	return stream.Send(&SubscribeRequest{Nack: []string{id}})
+}
+
+// NewBroker returns a broker which uses the broker service
+func NewBroker(opts ...broker.Option) broker.Broker {
+	var options broker.Options
+	for _, o := range opts {
+		o(&options)
+	}
+
+	b := &serviceBroker{
+		opts:        options,
+		service:     DefaultService,
+		subscribers: make(map[string]*serviceSubscriber),
+	}
+	b.configure()
+
+	return b
+}
@@ -0,0 +1,434 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/broker"
+	"github.com/sumlookup/mini/client"
+	"github.com/sumlookup/mini/registry/memory"
+	"github.com/sumlookup/mini/selector"
+	sr "github.com/sumlookup/mini/selector/registry"
+	"github.com/sumlookup/mini/server"
+	tm "github.com/sumlookup/mini/transport/memory"
+)
+
+func TestMatch(t *testing.T) {
+	testData := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"foo.*", "foo.bar", true},
+		{"foo.*", "foo", false},
+		{"foo.*", "foo.bar.baz", false},
+		{"*.bar", "foo.bar", true},
+		{"foo.>", "foo.bar", true},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.>", "foo", false},
+		{">", "foo.bar", true},
+		{"foo.*.baz", "foo.bar.baz", true},
+		{"foo.*.baz", "foo.bar.qux", false},
+	}
+
+	for _, d := range testData {
+		if m := match(d.pattern, d.topic); m != d.match {
+			t.Fatalf("Expected %s matching %s to be %v, got %v", d.pattern, d.topic, d.match, m)
+		}
+	}
+}
+
+func newBroker(t *testing.T, opts ...HandlerOption) (broker.Broker, *Handler) {
+	r := memory.NewRegistry()
+
+	srv := server.NewServer(
+		server.ServiceName(DefaultService),
+		server.WithHost(DefaultService),
+		server.WithRegistry(r),
+		server.WithTransport(tm.NewTransport()),
+	)
+	h := NewHandler(opts...)
+	Register(srv, h)
+
+	go srv.Run()
+	<-srv.Ready()
+	t.Cleanup(srv.Stop)
+
+	c := client.New(
+		client.Selector(sr.NewSelector(selector.Registry(r))),
+		client.WithTransport(tm.NewTransport()),
+	)
+
+	b := NewBroker(Client(c))
+	if err := b.Connect(); err != nil {
+		t.Fatalf("Unexpected connect error %v", err)
+	}
+	t.Cleanup(func() { b.Disconnect() })
+
+	return b, h
+}
+
+// members returns the number of subscribers connected to the topic
+func members(h *Handler, topic string) int {
+	h.Lock()
+	defer h.Unlock()
+
+	var n int
+	for _, s := range h.subscriptions {
+		if s.topic == topic {
+			n += len(s.members)
+		}
+	}
+	return n
+}
+
+// receiver collects the events of a subscriber
+type receiver struct {
+	sync.Mutex
+	events []broker.Event
+}
+
+func (r *receiver) handle(e broker.Event) error {
+	r.Lock()
+	r.events = append(r.events, e)
+	r.Unlock()
+	return nil
+}
+
+func (r *receiver) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.events)
+}
+
+func waitFor(t *testing.T, what string, fn func() bool) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		if fn() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+// subscribed publishes to the topic until the subscriber receives a message
+// so the test doesn't depend on when the stream was opened
+func subscribed(t *testing.T, b broker.Broker, topic string, r *receiver) {
+	t.Helper()
+
+	waitFor(t, "subscription", func() bool {
+		if err := b.Publish(topic, &broker.Message{Body: []byte("ping")}); err != nil {
+			t.Fatalf("Unexpected publish error %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		return r.count() > 0
+	})
+
+	waitFor(t, "pings", func() bool {
+		n := r.count()
+		time.Sleep(50 * time.Millisecond)
+		return n == r.count()
+	})
+
+	r.Lock()
+	r.events = nil
+	r.Unlock()
+}
+
+func TestServiceBroker(t *testing.T) {
+	b, _ := newBroker(t)
+
+	all := new(receiver)
+	if _, err := b.Subscribe("foo.>", all.handle); err != nil {
+		t.Fatalf("Unexpected subscribe error %v", err)
+	}
+	subscribed(t, b, "foo.ping", all)
+
+	msg := &broker.Message{
+		Header: map[string]string{"foo": "bar"},
+		Body:   []byte(`hello world`),
+	}
+
+	for _, topic := range []string{"foo.bar", "foo.bar.baz", "bar.foo"} {
+		if err := b.Publish(topic, msg); err != nil {
+			t.Fatalf("Unexpected publish error %v", err)
+		}
+	}
+
+	waitFor(t, "events", func() bool { return all.count() == 2 })
+
+	all.Lock()
+	e := all.events[0]
+	all.Unlock()
+
+	if e.Topic() != "foo.bar" {
+		t.Fatalf("Expected topic foo.bar, got %s", e.Topic())
+	}
+	if string(e.Message().Body) != "hello world" || e.Message().Header["foo"] != "bar" {
+		t.Fatalf("Expected %+v, got %+v", msg, e.Message())
+	}
+}
+
+func TestServiceBrokerQueue(t *testing.T) {
+	b, h := newBroker(t)
+
+	q1 := new(receiver)
+	q2 := new(receiver)
+
+	sub1, err := b.Subscribe("foo", q1.handle, broker.Queue("queue"))
+	if err != nil {
+		t.Fatalf("Unexpected subscribe error %v", err)
+	}
+	subscribed(t, b, "foo", q1)
+
+	if _, err := b.Subscribe("foo", q2.handle, broker.Queue("queue")); err != nil {
+		t.Fatalf("Unexpected subscribe error %v", err)
+	}
+	waitFor(t, "second subscriber", func() bool { return members(h, "foo") == 2 })
+
+	count := 20
+	for i := 0; i < count; i++ {
+		if err := b.Publish("foo", &broker.Message{Body: []byte(`hello world`)}); err != nil {
+			t.Fatalf("Unexpected publish error %v", err)
+		}
+	}
+
+	waitFor(t, "shared events", func() bool { return q1.count()+q2.count() >= count })
+
+	time.Sleep(50 * time.Millisecond)
+	if n := q1.count() + q2.count(); n != count {
+		t.Fatalf("Expected %d events shared by the queue, got %d", count, n)
+	}
+
+	if err := sub1.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected unsubscribe error %v", err)
+	}
+
+	n1, n2 := q1.count(), q2.count()
+	for i := 0; i < count; i++ {
+		if err := b.Publish("foo", &broker.Message{Body: []byte(`hello world`)}); err != nil {
+			t.Fatalf("Unexpected publish error %v", err)
+		}
+	}
+
+	waitFor(t, "remaining subscriber", func() bool { return q2.count() == n2+count })
+	if q1.count() != n1 {
+		t.Fatalf("Expected no events after unsubscribe, got %d", q1.count()-n1)
+	}
+}
+
+func TestServiceBrokerRedelivery(t *testing.T) {
+	b, h := newBroker(t)
+
+	// never acknowledges
+	q1 := new(receiver)
+	sub1, err := b.Subscribe("foo", q1.handle, broker.Queue("queue"), broker.DisableAutoAck())
+	if err != nil {
+		t.Fatalf("Unexpected subscribe error %v", err)
+	}
+	subscribed(t, b, "foo", q1)
+
+	if err := b.Publish("foo", &broker.Message{Body: []byte(`hello world`)}); err != nil {
+		t.Fatalf("Unexpected publish error %v", err)
+	}
+	waitFor(t, "event", func() bool { return q1.count() == 1 })
+
+	q2 := new(receiver)
+	if _, err := b.Subscribe("foo", q2.handle, broker.Queue("queue")); err != nil {
+		t.Fatalf("Unexpected subscribe error %v", err)
+	}
+	waitFor(t, "second subscriber", func() bool { return members(h, "foo") == 2 })
+
+	// the pings and the event were never acknowledged
+	if err := sub1.Unsubscribe(); err != nil {
+		t.Fatalf("Unexpected unsubscribe error %v", err)
+	}
+
+	waitFor(t, "redelivery", func() bool {
+		q2.Lock()
+		defer q2.Unlock()
+		for _, e := range q2.events {
+			if string(e.Message().Body) == "hello world" {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestServiceBrokerNack(t *testing.T) {
+	b, _ := newBroker(t)
+
+	// fails every event the first time, more events than a subscriber may
+	// hold without acknowledging them
+	r := new(receiver)
+	seen := make(map[string]bool)
+	handled := make(map[string]bool)
+
+	fail := func(e broker.Event) error {
+		r.Lock()
+		defer r.Unlock()
+
+		body := string(e.Message().Body)
+		if body == "ping" {
+			r.events = append(r.events, e)
+			return nil
+		}
+		if !seen[body] {
+			seen[body] = true
+			return errors.New("failed")
+		}
+		handled[body] = true
+		return nil
+	}
+
+	if _, err := b.Subscribe("foo", fail); err != nil {
+		t.Fatalf("Unexpected subscribe error %v", err)
+	}
+	subscribed(t, b, "foo", r)
+
+	count := DefaultMaxInflight * 2
+	for i := 0; i < count; i++ {
+		if err := b.Publish("foo", &broker.Message{Body: []byte(fmt.Sprintf("event-%d", i))}); err != nil {
+			t.Fatalf("Unexpected publish error %v", err)
+		}
+	}
+
+	waitFor(t, "the failed events to be delivered again", func() bool {
+		r.Lock()
+		defer r.Unlock()
+		return len(handled) == count
+	})
+}
+
+func TestServiceBrokerDeadLetter(t *testing.T) {
+	b, _ := newBroker(t, MaxDeliveries(3), RedeliveryBackoff(20*time.Millisecond), DeadLetterTopic("dead"))
+
+	r := new(receiver)
+	var deliveries []time.Time
+	fail := func(e broker.Event) error {
+		r.Lock()
+		defer r.Unlock()
+
+		if string(e.Message().Body) == "ping" {
+			r.events = append(r.events, e)
+			return nil
+		}
+		deliveries = append(deliveries, time.Now())
+		return errors.New("failed")
+	}
+
+	if _, err := b.Subscribe("foo", fail); err != nil {
+		t.Fatalf("Unexpected subscribe error %v", err)
+	}
+	subscribed(t, b, "foo", r)
+
+	dead := new(receiver)
+	if _, err := b.Subscribe("dead", dead.handle); err != nil {
+		t.Fatalf("Unexpected subscribe error %v", err)
+	}
+	subscribed(t, b, "dead", dead)
+
+	if err := b.Publish("foo", &broker.Message{Header: map[string]string{"foo": "bar"}, Body: []byte("hello")}); err != nil {
+		t.Fatalf("Unexpected publish error %v", err)
+	}
+
+	waitFor(t, "the dead event", func() bool { return dead.count() == 1 })
+
+	dead.Lock()
+	msg := dead.events[0].Message()
+	dead.Unlock()
+	if string(msg.Body) != "hello" || msg.Header["foo"] != "bar" || msg.Header[OriginalTopicHeader] != "foo" {
+		t.Fatalf("Expected the dead event of foo, got %+v", msg)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if len(deliveries) != 3 {
+		t.Fatalf("Expected 3 deliveries, got %d", len(deliveries))
+	}
+	// the backoff doubles after every failed delivery
+	if d := deliveries[2].Sub(deliveries[1]); d < 40*time.Millisecond {
+		t.Fatalf("Expected the second redelivery to back off for 40ms, took %v", d)
+	}
+}
+
+func TestServiceBrokerUnsubscribeFromHandler(t *testing.T) {
+	b, h := newBroker(t)
+
+	r := new(receiver)
+	unsubscribed := make(chan error, 1)
+
+	var sub broker.Subscriber
+	var once sync.Once
+
+	handler := func(e broker.Event) error {
+		r.handle(e)
+		if string(e.Message().Body) == "stop" {
+			once.Do(func() { unsubscribed <- sub.Unsubscribe() })
+		}
+		return nil
+	}
+
+	sub, err := b.Subscribe("foo", handler)
+	if err != nil {
+		t.Fatalf("Unexpected subscribe error %v", err)
+	}
+	subscribed(t, b, "foo", r)
+
+	if err := b.Publish("foo", &broker.Message{Body: []byte("stop")}); err != nil {
+		t.Fatalf("Unexpected publish error %v", err)
+	}
+
+	select {
+	case err := <-unsubscribed:
+		if err != nil {
+			t.Fatalf("Unexpected unsubscribe error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Unsubscribe not to block the handler")
+	}
+
+	waitFor(t, "the subscription to end", func() bool { return members(h, "foo") == 0 })
+
+	n := r.count()
+	if err := b.Publish("foo", &broker.Message{Body: []byte("after")}); err != nil {
+		t.Fatalf("Unexpected publish error %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if r.count() != n {
+		t.Fatal("Expected no events after unsubscribing")
+	}
+}
+
+func TestServiceBrokerDisconnect(t *testing.T) {
+	b, h := newBroker(t)
+
+	count := 5
+	for i := 0; i < count; i++ {
+		r := new(receiver)
+		if _, err := b.Subscribe("foo", r.handle); err != nil {
+			t.Fatalf("Unexpected subscribe error %v", err)
+		}
+	}
+	waitFor(t, "subscribers", func() bool { return members(h, "foo") == count })
+
+	// the subscriptions end together, not one unsubscribe timeout after the other
+	start := time.Now()
+	if err := b.Disconnect(); err != nil {
+		t.Fatalf("Unexpected disconnect error %v", err)
+	}
+	if d := time.Since(start); d > DefaultUnsubscribeTimeout*2 {
+		t.Fatalf("Expected the subscriptions to end within %v, took %v", DefaultUnsubscribeTimeout*2, d)
+	}
+
+	waitFor(t, "the subscriptions to end", func() bool { return members(h, "foo") == 0 })
+}
@@ -3,6 +3,9 @@ package builder
 import (
 	log "github.com/sirupsen/logrus"
 	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/consul"
+	"github.com/sumlookup/mini/registry/file"
+	"github.com/sumlookup/mini/registry/kubernetes"
 	"github.com/sumlookup/mini/registry/mdns"
 	"github.com/sumlookup/mini/registry/memory"
 	"github.com/sumlookup/mini/selector"
@@ -51,6 +54,12 @@ func BuildRegistry(r string) registry.Registry {
 		reg = mdns.NewRegistry()
 	case "memory":
 		reg = memory.NewRegistry()
+	case "file":
+		reg = file.NewRegistry()
+	case "consul":
+		reg = consul.NewRegistry()
+	case "kubernetes":
+		reg = kubernetes.NewRegistry()
 	default:
 		log.Warnf("Defaulted to registry : mdns")
 		reg = mdns.NewRegistry()
@@ -0,0 +1,303 @@
+// Package balancer provides a grpc balancer which picks nodes using the selector
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/selector"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/health"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+// Name is the name the balancer is registered with in grpc
+const Name = "mini"
+
+var (
+	// ServiceConfig is the grpc service config which enables the balancer
+	ServiceConfig = fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name)
+
+	// HealthCheckServiceConfig enables the balancer and makes grpc probe the
+	// health service of a node before it joins the selection pool
+	HealthCheckServiceConfig = fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}],"healthCheckConfig":{"serviceName":""}}`, Name)
+
+	// RefreshInterval is how long a picker reuses the nodes returned by the selector
+	RefreshInterval = time.Second
+
+	// nodeFailures are the status codes which say something about the node
+	// rather than the request, anything else is marked as a success
+	nodeFailures = map[codes.Code]bool{
+		codes.Unavailable:       true,
+		codes.DeadlineExceeded:  true,
+		codes.ResourceExhausted: true,
+		codes.Internal:          true,
+		codes.Unknown:           true,
+	}
+)
+
+type infoKey struct{}
+
+type triedKey struct{}
+
+type pickedKey struct{}
+
+// Info tells the balancer how to pick nodes for a service. The resolver
+// attaches it to every address it hands over to grpc.
+type Info struct {
+	Service       string
+	Selector      selector.Selector
+	SelectOptions []selector.SelectOption
+	// Namespace the nodes are registered in, the picked nodes are marked in it
+	Namespace string
+}
+
+// NodeFailure returns the error when it says something about the node rather
+// than the request, the selector marks a call failing otherwise as a success
+func NodeFailure(err error) error {
+	if err != nil && !nodeFailures[status.Code(err)] {
+		return nil
+	}
+	return err
+}
+
+// SetInfo returns a copy of the address carrying the balancer info
+func SetInfo(addr resolver.Address, info *Info) resolver.Address {
+	addr.BalancerAttributes = addr.BalancerAttributes.WithValue(infoKey{}, info)
+	return addr
+}
+
+// GetInfo returns the balancer info attached to the address
+func GetInfo(addr resolver.Address) *Info {
+	info, _ := addr.BalancerAttributes.Value(infoKey{}).(*Info)
+	return info
+}
+
+// WithTried returns a context which tells the picker to avoid the given
+// addresses, for example the nodes which already failed a retried call
+func WithTried(ctx context.Context, addrs ...string) context.Context {
+	if len(addrs) == 0 {
+		return ctx
+	}
+	tried := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		tried[addr] = true
+	}
+	return context.WithValue(ctx, triedKey{}, tried)
+}
+
+func getTried(ctx context.Context) map[string]bool {
+	if ctx == nil {
+		return nil
+	}
+	tried, _ := ctx.Value(triedKey{}).(map[string]bool)
+	return tried
+}
+
+// WithPicked returns a context which tells the picker to report the address
+// of the node it picks before the call is sent, for example so that hedged
+// calls avoid the nodes other attempts are still in flight on
+func WithPicked(ctx context.Context, fn func(addr string)) context.Context {
+	return context.WithValue(ctx, pickedKey{}, fn)
+}
+
+func picked(ctx context.Context, addr string) {
+	if ctx == nil {
+		return
+	}
+	if fn, ok := ctx.Value(pickedKey{}).(func(string)); ok {
+		fn(addr)
+	}
+}
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(Name, &pickerBuilder{}, base.Config{HealthCheck: true}))
+}
+
+type pickerBuilder struct{}
+
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	p := &picker{
+		conns: make(map[string]balancer.SubConn, len(info.ReadySCs)),
+	}
+
+	for sc, sci := range info.ReadySCs {
+		p.conns[sci.Address.Addr] = sc
+		if p.info == nil {
+			p.info = GetInfo(sci.Address)
+		}
+	}
+
+	if p.info == nil || p.info.Selector == nil {
+		return base.NewErrPicker(fmt.Errorf("%s balancer requires addresses from the mini resolver", Name))
+	}
+
+	return p
+}
+
+// picker asks the selector for the next node and maps it to a ready connection.
+// The Next returned by the selector is reused across picks so stateful
+// strategies such as round robin keep their order. It is refreshed when
+// a call fails, after RefreshInterval and when grpc rebuilds the picker
+// because the node set changed.
+type picker struct {
+	info  *Info
+	conns map[string]balancer.SubConn
+
+	sync.Mutex
+	next    selector.Next
+	expires time.Time
+}
+
+func (p *picker) getNext(ctx context.Context) (selector.Next, error) {
+	// calls hashed by their key or routed by their metadata are selected one by one
+	var call []selector.SelectOption
+	if hashed, ok := selector.CallHashKey(ctx, p.info.SelectOptions...); ok {
+		call = append(call, hashed)
+	}
+	if selector.Routed(p.info.SelectOptions...) {
+		call = append(call, selector.CallContext(ctx))
+	}
+	if len(call) > 0 {
+		opts := p.info.SelectOptions[:len(p.info.SelectOptions):len(p.info.SelectOptions)]
+		opts = append(opts, selector.WithFilter(p.ready))
+		return p.info.Selector.Select(p.info.Service, append(opts, call...)...)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.next != nil && time.Now().Before(p.expires) {
+		return p.next, nil
+	}
+
+	// only let the strategy choose from the nodes grpc is connected to
+	opts := p.info.SelectOptions[:len(p.info.SelectOptions):len(p.info.SelectOptions)]
+	opts = append(opts, selector.WithFilter(p.ready))
+
+	next, err := p.info.Selector.Select(p.info.Service, opts...)
+	if err != nil {
+		return nil, err
+	}
+	p.next = next
+	p.expires = time.Now().Add(RefreshInterval)
+
+	return next, nil
+}
+
+// ready is a select filter which keeps the nodes with a ready connection
+func (p *picker) ready(old []*registry.Service) []*registry.Service {
+	var services []*registry.Service
+
+	for _, service := range old {
+		var nodes []*registry.Node
+
+		for _, node := range service.Nodes {
+			if _, ok := p.conns[node.Address]; ok {
+				nodes = append(nodes, node)
+			}
+		}
+
+		// only add service if there's some nodes
+		if len(nodes) > 0 {
+			srv := new(registry.Service)
+			// copy
+			*srv = *service
+			srv.Nodes = nodes
+			services = append(services, srv)
+		}
+	}
+
+	return services
+}
+
+func (p *picker) reset() {
+	p.Lock()
+	p.next = nil
+	p.Unlock()
+}
+
+func (p *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	next, err := p.getNext(info.Ctx)
+	if err != nil {
+		return balancer.PickResult{}, status.Errorf(codes.Unavailable, "%s selector could not select %s: %v", p.info.Selector.String(), p.info.Service, err)
+	}
+
+	tried := getTried(info.Ctx)
+
+	// the selector may return nodes the call already tried, give it a few
+	// attempts to land on a fresh one and fall back to a tried one
+	var fallback balancer.SubConn
+	var fallbackNode *registry.Node
+
+	for i := 0; i < len(p.conns)+1; i++ {
+		node, err := next()
+		if err == selector.ErrNoneAvailable {
+			// the nodes left are ejected or probed by other calls already
+			p.reset()
+			return balancer.PickResult{}, status.Errorf(codes.Unavailable, "%s selector has no node of %s available", p.info.Selector.String(), p.info.Service)
+		}
+		if err != nil {
+			p.reset()
+			return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+		}
+
+		sc, ok := p.conns[node.Address]
+		if !ok {
+			continue
+		}
+
+		if tried[node.Address] {
+			if fallback == nil {
+				fallback = sc
+				fallbackNode = node
+			}
+			continue
+		}
+
+		picked(info.Ctx, node.Address)
+		return p.result(sc, node), nil
+	}
+
+	if fallback != nil {
+		picked(info.Ctx, fallbackNode.Address)
+		return p.result(fallback, fallbackNode), nil
+	}
+
+	log.Debugf("[balancer] no ready connection for %s", p.info.Service)
+	p.reset()
+	return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+}
+
+// result picks the connection of the node, a selector tracking the load
+// observes the call until it is done. The outcome is marked against the
+// picked node, the peer of the call may not be written like its address.
+func (p *picker) result(sc balancer.SubConn, node *registry.Node) balancer.PickResult {
+	observed := func(error) {}
+	if o, ok := p.info.Selector.(selector.Observer); ok {
+		observed = o.Observe(p.info.Service, node)
+	}
+
+	return balancer.PickResult{
+		SubConn: sc,
+		Done: func(di balancer.DoneInfo) {
+			err := NodeFailure(di.Err)
+			observed(err)
+			p.info.Selector.Mark(p.info.Service, node, err, selector.MarkNamespace(p.info.Namespace))
+			if di.Err != nil {
+				p.reset()
+			}
+		},
+	}
+}
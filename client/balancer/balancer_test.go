@@ -0,0 +1,129 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+	"github.com/sumlookup/mini/selector"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+type subConn struct {
+	balancer.SubConn
+	addr string
+}
+
+func TestPickerReportsPicked(t *testing.T) {
+	r := memory.NewRegistry()
+	service := &registry.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{Id: "foo-1", Address: "10.0.0.1:8080"},
+			{Id: "foo-2", Address: "10.0.0.2:8080"},
+		},
+	}
+	if err := r.Register(service); err != nil {
+		t.Fatal(err)
+	}
+
+	info := &Info{
+		Service:  "foo",
+		Selector: selector.NewSelector(selector.Registry(r), selector.SetStrategy(selector.RoundRobin)),
+	}
+
+	ready := make(map[balancer.SubConn]base.SubConnInfo)
+	for _, node := range service.Nodes {
+		ready[&subConn{addr: node.Address}] = base.SubConnInfo{
+			Address: SetInfo(resolver.Address{Addr: node.Address}, info),
+		}
+	}
+	p := (&pickerBuilder{}).Build(base.PickerBuildInfo{ReadySCs: ready})
+
+	var inflight []string
+	ctx := WithPicked(context.Background(), func(addr string) {
+		inflight = append(inflight, addr)
+	})
+
+	// a hedged call avoids the node the first attempt is still in flight on
+	for i := 0; i < 10; i++ {
+		inflight = nil
+
+		first, err := p.Pick(balancer.PickInfo{Ctx: ctx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(inflight) != 1 || inflight[0] != first.SubConn.(*subConn).addr {
+			t.Fatalf("Expected the picked node to be reported, got %v", inflight)
+		}
+
+		hedged, err := p.Pick(balancer.PickInfo{Ctx: WithTried(ctx, inflight...)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr := hedged.SubConn.(*subConn).addr; addr == inflight[0] || len(inflight) != 2 || inflight[1] != addr {
+			t.Fatalf("Expected the hedged call to pick the other node, got %s after %v", addr, inflight)
+		}
+	}
+}
+
+func TestPickerMarksPicked(t *testing.T) {
+	r := memory.NewRegistry()
+	service := &registry.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{Id: "foo-1", Address: "foo-1.local:8080"},
+			{Id: "foo-2", Address: "foo-2.local:8080"},
+		},
+	}
+	if err := r.Register(service, registry.RegisterNamespace("dev")); err != nil {
+		t.Fatal(err)
+	}
+
+	info := &Info{
+		Service:       "foo",
+		Selector:      selector.NewSelector(selector.Registry(r), selector.FailureThreshold(1), selector.OpenTimeout(time.Minute)),
+		SelectOptions: []selector.SelectOption{selector.WithNamespace("dev")},
+		Namespace:     "dev",
+	}
+
+	ready := make(map[balancer.SubConn]base.SubConnInfo)
+	for _, node := range service.Nodes {
+		ready[&subConn{addr: node.Address}] = base.SubConnInfo{
+			Address: SetInfo(resolver.Address{Addr: node.Address}, info),
+		}
+	}
+	p := (&pickerBuilder{}).Build(base.PickerBuildInfo{ReadySCs: ready})
+
+	pick := func() (balancer.PickResult, string) {
+		res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, res.SubConn.(*subConn).addr
+	}
+
+	// an error of the request says nothing about the node
+	res, _ := pick()
+	res.Done(balancer.DoneInfo{Err: status.Error(codes.InvalidArgument, "bad request")})
+
+	// a failure of the node ejects the picked node by its registered address
+	res, failed := pick()
+	res.Done(balancer.DoneInfo{Err: status.Error(codes.Unavailable, "gone")})
+
+	for i := 0; i < 10; i++ {
+		res, addr := pick()
+		if addr == failed {
+			t.Fatalf("Expected the failed node %s to be ejected", failed)
+		}
+		res.Done(balancer.DoneInfo{})
+	}
+}
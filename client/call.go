@@ -0,0 +1,305 @@
+package client
+
+import (
+	b "bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/sumlookup/mini/codec"
+	"github.com/sumlookup/mini/codec/bytes"
+	"google.golang.org/grpc"
+)
+
+// Stream is a bidirectional stream created by Client.Stream
+type Stream interface {
+	// Context of the stream
+	Context() context.Context
+	// Send encodes and sends a message
+	Send(interface{}) error
+	// Recv receives and decodes a message
+	Recv(interface{}) error
+	// CloseSend closes the send direction of the stream
+	CloseSend() error
+}
+
+var (
+	// grpc content subtypes the encoded body is sent with
+	contentSubtypes = map[string]string{
+		"application/json":         "json",
+		"application/protobuf":     "proto",
+		"application/octet-stream": "proto",
+	}
+)
+
+// frameCodec passes frames encoded by the client codecs straight through grpc
+type frameCodec struct {
+	name string
+}
+
+func (f frameCodec) Marshal(v interface{}) ([]byte, error) {
+	frame, ok := v.(*bytes.Frame)
+	if !ok {
+		return nil, codec.ErrInvalidMessage
+	}
+	return frame.Data, nil
+}
+
+func (f frameCodec) Unmarshal(data []byte, v interface{}) error {
+	frame, ok := v.(*bytes.Frame)
+	if !ok {
+		return codec.ErrInvalidMessage
+	}
+	frame.Data = data
+	return nil
+}
+
+func (f frameCodec) Name() string {
+	return f.name
+}
+
+// buffer lets the client codecs read from and write to memory
+type buffer struct {
+	*b.Buffer
+}
+
+func (buf *buffer) Close() error {
+	return nil
+}
+
+// methodToGRPC converts an endpoint to the grpc method name. Endpoints are
+// either grpc methods, /pkg.Foo/Bar, or registry endpoints, pkg.Foo.Bar or Foo.Bar.
+func methodToGRPC(endpoint string) string {
+	// no endpoint or already grpc method
+	if len(endpoint) == 0 || endpoint[0] == '/' {
+		return endpoint
+	}
+
+	i := strings.LastIndex(endpoint, ".")
+	if i <= 0 {
+		return endpoint
+	}
+
+	// return /pkg.Foo/Bar
+	return fmt.Sprintf("/%s/%s", endpoint[:i], endpoint[i+1:])
+}
+
+// encoder returns the codec and grpc codec for the content type
+func (c *Client) encoder(contentType string) (codec.NewCodec, grpc.CallOption, error) {
+	cf, err := c.newCodec(contentType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	subtype, ok := contentSubtypes[contentType]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unsupported Content-Type: %s", contentType)
+	}
+
+	return cf, grpc.ForceCodec(frameCodec{name: subtype}), nil
+}
+
+func marshal(cf codec.NewCodec, v interface{}) (*bytes.Frame, error) {
+	buf := &buffer{b.NewBuffer(nil)}
+	if err := cf(buf).Write(&codec.Message{Type: codec.Request, Header: make(map[string]string)}, v); err != nil {
+		return nil, err
+	}
+	return &bytes.Frame{Data: buf.Bytes()}, nil
+}
+
+func unmarshal(cf codec.NewCodec, frame *bytes.Frame, v interface{}) error {
+	return cf(&buffer{b.NewBuffer(frame.Data)}).ReadBody(v)
+}
+
+// conn is a connection of Call and Stream. A released connection is closed
+// once the calls still using it are done.
+type conn struct {
+	grpc.ClientConnInterface
+	users    int
+	released bool
+}
+
+// close closes the connection once released and unused, the client lock is held
+func (cn *conn) close() {
+	if !cn.released || cn.users > 0 {
+		return
+	}
+	if cc, ok := cn.ClientConnInterface.(*grpc.ClientConn); ok {
+		cc.Close()
+	}
+}
+
+// connection returns a connection to the service, creating it through the selector
+// if needed, and the func the call ends with. A connection which isn't load
+// balanced is bound to the node it was created for, it is released once a call
+// fails on the node so the next call selects a node again.
+func (c *Client) connection(service string) (grpc.ClientConnInterface, func(error), error) {
+	if service == c.ServiceName && c.GRPCConnection != nil {
+		return c.GRPCConnection, func(error) {}, nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	cn, ok := c.conns[service]
+	if !ok {
+		cc, err := c.createConnection(service)
+		if err != nil {
+			return nil, nil, err
+		}
+		cn = &conn{ClientConnInterface: cc}
+		c.conns[service] = cn
+	}
+	cn.users++
+
+	var once sync.Once
+	done := func(err error) {
+		once.Do(func() {
+			c.release(service, cn.ClientConnInterface, err)
+
+			c.Lock()
+			defer c.Unlock()
+			cn.users--
+			cn.close()
+		})
+	}
+
+	return cn.ClientConnInterface, done, nil
+}
+
+// release drops the cached connection of the service when the call failed on
+// its node, the calls still using it keep it until they are done
+func (c *Client) release(service string, cc grpc.ClientConnInterface, err error) {
+	if nodeFailure(err) == nil || c.loadBalanced() {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	cn, ok := c.conns[service]
+	if !ok || cn.ClientConnInterface != cc {
+		return
+	}
+	delete(c.conns, service)
+	cn.released = true
+	cn.close()
+}
+
+// Close closes the connections of Call and Stream and the connection created
+// by Connect, the calls in flight on them fail. A connection given with
+// WithGrpcConnection is left to its owner.
+func (c *Client) Close() error {
+	c.Lock()
+	conns := c.conns
+	c.conns = make(map[string]*conn)
+	dialed := c.dialed
+	c.dialed = nil
+	c.Unlock()
+
+	for _, cn := range conns {
+		if cc, ok := cn.ClientConnInterface.(*grpc.ClientConn); ok {
+			cc.Close()
+		}
+	}
+
+	if cc, ok := dialed.(*grpc.ClientConn); ok {
+		if c.GRPCConnection == dialed {
+			c.GRPCConnection = nil
+		}
+		return cc.Close()
+	}
+
+	return nil
+}
+
+// Call invokes the endpoint of the service without generated stubs. The request
+// and response are encoded with the codec of the content type, by default the
+// client's content type, so they may be proto messages, json values or raw bytes.
+func (c *Client) Call(ctx context.Context, service, endpoint string, req, rsp interface{}, opts ...CallOption) error {
+	options := c.newCallOptions(opts...)
+
+	cf, gc, err := c.encoder(options.ContentType)
+	if err != nil {
+		return err
+	}
+
+	in, err := marshal(cf, req)
+	if err != nil {
+		return err
+	}
+
+	conn, done, err := c.connection(service)
+	if err != nil {
+		return err
+	}
+
+	out := new(bytes.Frame)
+	err = conn.Invoke(ctx, methodToGRPC(endpoint), in, out, append(options.CallOptions, gc)...)
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	return unmarshal(cf, out, rsp)
+}
+
+// Stream opens a bidirectional stream to the endpoint of the service without
+// generated stubs. Messages are encoded like in Call.
+func (c *Client) Stream(ctx context.Context, service, endpoint string, opts ...CallOption) (Stream, error) {
+	options := c.newCallOptions(opts...)
+
+	cf, gc, err := c.encoder(options.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, done, err := c.connection(service)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &grpc.StreamDesc{
+		StreamName:    endpoint,
+		ServerStreams: true,
+		ClientStreams: true,
+	}
+
+	s, err := conn.NewStream(ctx, desc, methodToGRPC(endpoint), append(options.CallOptions, gc)...)
+	if err != nil {
+		done(err)
+		return nil, err
+	}
+
+	return &stream{ClientStream: s, codec: cf, done: done}, nil
+}
+
+type stream struct {
+	grpc.ClientStream
+	codec codec.NewCodec
+	// ends the use of the connection, it is released when the stream failed on its node
+	done func(error)
+}
+
+func (s *stream) Send(v interface{}) error {
+	frame, err := marshal(s.codec, v)
+	if err != nil {
+		return err
+	}
+	return s.ClientStream.SendMsg(frame)
+}
+
+func (s *stream) Recv(v interface{}) error {
+	frame := new(bytes.Frame)
+	if err := s.ClientStream.RecvMsg(frame); err != nil {
+		if err == io.EOF {
+			s.done(nil)
+		} else {
+			s.done(err)
+		}
+		return err
+	}
+	return unmarshal(s.codec, frame, v)
+}
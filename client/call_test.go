@@ -0,0 +1,256 @@
+package client
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+	"github.com/sumlookup/mini/selector"
+	sr "github.com/sumlookup/mini/selector/registry"
+	"github.com/sumlookup/mini/server"
+	tm "github.com/sumlookup/mini/transport/memory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+type echoMessage struct {
+	Text string `json:"text"`
+	Node string `json:"node,omitempty"`
+}
+
+// echo answers every message with its text and the name of the node
+type echo struct {
+	node string
+}
+
+func echoHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(echoMessage)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	return &echoMessage{Text: in.Text, Node: srv.(*echo).node}, nil
+}
+
+func chatHandler(srv interface{}, stream grpc.ServerStream) error {
+	for {
+		in := new(echoMessage)
+		if err := stream.RecvMsg(in); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(&echoMessage{Text: in.Text, Node: srv.(*echo).node}); err != nil {
+			return err
+		}
+	}
+}
+
+var echoServiceDesc = grpc.ServiceDesc{
+	ServiceName: "test.Echo",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Echo", Handler: echoHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Chat", Handler: chatHandler, ServerStreams: true, ClientStreams: true},
+	},
+}
+
+// newEchoServer runs an echo node of the service on the memory transport
+func newEchoServer(t *testing.T, r registry.Registry, service, node string) *server.Server {
+	srv := server.NewServer(
+		server.ServiceName(service),
+		server.WithHost(node),
+		server.WithRegistry(r),
+		server.WithTransport(tm.NewTransport()),
+	)
+	srv.Server().RegisterService(&echoServiceDesc, &echo{node: node})
+
+	go srv.Run()
+	<-srv.Ready()
+	t.Cleanup(srv.Stop)
+
+	return srv
+}
+
+func newEchoClient(r registry.Registry) *Client {
+	return New(
+		// keep the selector cache short lived so the tests don't depend on watcher timing
+		Selector(sr.NewSelector(selector.Registry(r), sr.TTL(100*time.Millisecond))),
+		WithTransport(tm.NewTransport()),
+		WithConnectionAttempts(false),
+		ContentType("application/json"),
+	)
+}
+
+func TestCall(t *testing.T) {
+	r := memory.NewRegistry()
+	newEchoServer(t, r, "test.call", "test.call.1")
+	c := newEchoClient(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, endpoint := range []string{"test.Echo.Echo", "/test.Echo/Echo"} {
+		rsp := new(echoMessage)
+		if err := c.Call(ctx, "test.call", endpoint, &echoMessage{Text: "hello"}, rsp); err != nil {
+			t.Fatalf("Unexpected error calling %s: %v", endpoint, err)
+		}
+		if rsp.Text != "hello" || rsp.Node != "test.call.1" {
+			t.Fatalf("Expected the echo of test.call.1, got %+v", rsp)
+		}
+	}
+
+	if err := c.Call(ctx, "test.missing", "test.Echo.Echo", &echoMessage{}, new(echoMessage)); err == nil {
+		t.Fatal("Expected calling a service without nodes to fail")
+	}
+}
+
+func TestStream(t *testing.T) {
+	r := memory.NewRegistry()
+	newEchoServer(t, r, "test.stream", "test.stream.1")
+	c := newEchoClient(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := c.Stream(ctx, "test.stream", "test.Echo.Chat")
+	if err != nil {
+		t.Fatalf("Unexpected stream error %v", err)
+	}
+
+	for _, text := range []string{"foo", "bar", "baz"} {
+		if err := s.Send(&echoMessage{Text: text}); err != nil {
+			t.Fatalf("Unexpected send error %v", err)
+		}
+		rsp := new(echoMessage)
+		if err := s.Recv(rsp); err != nil {
+			t.Fatalf("Unexpected receive error %v", err)
+		}
+		if rsp.Text != text || rsp.Node != "test.stream.1" {
+			t.Fatalf("Expected the echo of %s, got %+v", text, rsp)
+		}
+	}
+
+	if err := s.CloseSend(); err != nil {
+		t.Fatalf("Unexpected close error %v", err)
+	}
+	if err := s.Recv(new(echoMessage)); err != io.EOF {
+		t.Fatalf("Expected the stream to end, got %v", err)
+	}
+
+	// the end of a stream keeps the connection
+	c.RLock()
+	_, ok := c.conns["test.stream"]
+	c.RUnlock()
+	if !ok {
+		t.Fatal("Expected the connection to be kept once the stream ended")
+	}
+}
+
+func TestCallReleaseSharedConnection(t *testing.T) {
+	r := memory.NewRegistry()
+	newEchoServer(t, r, "test.shared", "test.shared.1")
+	c := newEchoClient(r)
+
+	// a stream still uses the connection a failed call releases
+	conn, done, err := c.connection("test.shared")
+	if err != nil {
+		t.Fatalf("Unexpected connection error %v", err)
+	}
+	cc := conn.(*grpc.ClientConn)
+
+	_, failed, err := c.connection("test.shared")
+	if err != nil {
+		t.Fatalf("Unexpected connection error %v", err)
+	}
+	failed(status.Error(codes.Unavailable, "node failure"))
+
+	c.RLock()
+	_, ok := c.conns["test.shared"]
+	c.RUnlock()
+	if ok {
+		t.Fatal("Expected the failed connection to be released")
+	}
+	if s := cc.GetState(); s == connectivity.Shutdown {
+		t.Fatal("Expected the connection to stay open while the stream uses it")
+	}
+
+	done(nil)
+	if s := cc.GetState(); s != connectivity.Shutdown {
+		t.Fatalf("Expected the connection to be closed once unused, got %s", s)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	r := memory.NewRegistry()
+	newEchoServer(t, r, "test.close", "test.close.1")
+	c := newEchoClient(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.Call(ctx, "test.close", "test.Echo.Echo", &echoMessage{Text: "hello"}, new(echoMessage)); err != nil {
+		t.Fatalf("Unexpected call error %v", err)
+	}
+
+	c.RLock()
+	cc := c.conns["test.close"].ClientConnInterface.(*grpc.ClientConn)
+	c.RUnlock()
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Unexpected close error %v", err)
+	}
+	if s := cc.GetState(); s != connectivity.Shutdown {
+		t.Fatalf("Expected the connection to be closed, got %s", s)
+	}
+
+	// the next call connects again
+	if err := c.Call(ctx, "test.close", "test.Echo.Echo", &echoMessage{Text: "hello"}, new(echoMessage)); err != nil {
+		t.Fatalf("Unexpected call error after close %v", err)
+	}
+}
+
+func TestCallNodeFailure(t *testing.T) {
+	r := memory.NewRegistry()
+	first := newEchoServer(t, r, "test.failover", "test.failover.1")
+	c := newEchoClient(r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rsp := new(echoMessage)
+	if err := c.Call(ctx, "test.failover", "test.Echo.Echo", &echoMessage{Text: "hello"}, rsp); err != nil {
+		t.Fatalf("Unexpected call error %v", err)
+	}
+	if rsp.Node != "test.failover.1" {
+		t.Fatalf("Expected the first node, got %+v", rsp)
+	}
+
+	// the first node goes away and another one takes over
+	newEchoServer(t, r, "test.failover", "test.failover.2")
+	first.Stop()
+
+	// the call on the stopped node fails and drops the connection
+	if err := c.Call(ctx, "test.failover", "test.Echo.Echo", &echoMessage{Text: "hello"}, new(echoMessage)); err == nil {
+		t.Fatal("Expected the call to the stopped node to fail")
+	}
+
+	// the selector takes a moment to see the first node is gone
+	for i := 0; ; i++ {
+		rsp = new(echoMessage)
+		err := c.Call(ctx, "test.failover", "test.Echo.Echo", &echoMessage{Text: "hello"}, rsp)
+		if err == nil && rsp.Node == "test.failover.2" {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("Expected the calls to select the other node, got %+v %v", rsp, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -1,17 +1,29 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/sumlookup/mini/builder"
+	"github.com/sumlookup/mini/client/balancer"
+	"github.com/sumlookup/mini/client/resolver"
 	"github.com/sumlookup/mini/codec"
+	"github.com/sumlookup/mini/registry"
 	"github.com/sumlookup/mini/selector"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"sync"
 	"time"
 )
 
-var DefaultClientOptions []Option
+var (
+	DefaultClientOptions []Option
+
+	DefaultHealthCheckTimeout = time.Second
+)
 
 type Client struct {
 	Id             string
@@ -20,6 +32,12 @@ type Client struct {
 	ServiceName    string
 	//once           atomic.Value
 	seq uint64
+
+	// connections used by Call and Stream
+	sync.RWMutex
+	conns map[string]*conn
+	// the connection created by Connect
+	dialed grpc.ClientConnInterface
 }
 
 // NewClient creates a new client with the default options
@@ -47,6 +65,7 @@ func New(opts ...Option) *Client {
 		Id:      fmt.Sprintf("client-%s", uuid.New().String()),
 		Options: o,
 		seq:     0,
+		conns:   make(map[string]*conn),
 	}
 
 	// pass the grpc connection to the client if we have one in options
@@ -122,7 +141,7 @@ func BuildClientOptions(tr, reg, sel string) ([]Option, error) {
 // this is useful for client load balancing in local development
 func (c *Client) connectToService() error {
 
-	conn, err := c.createConnection()
+	conn, err := c.createConnection(c.ServiceName)
 
 	if c.Options.ConnectionAttempts {
 		// if error, try more
@@ -134,7 +153,7 @@ func (c *Client) connectToService() error {
 				select {
 				case <-ticker.C:
 
-					conn, err = c.createConnection()
+					conn, err = c.createConnection(c.ServiceName)
 					if err != nil {
 						log.Debugf(err.Error())
 					} else {
@@ -158,32 +177,85 @@ func (c *Client) connectToService() error {
 		}
 	}
 
+	c.Lock()
+	c.dialed = conn
+	c.Unlock()
+
 	c.GRPCConnection = conn
 	return nil
 }
 
 // createConnection to the service
-func (c *Client) createConnection() (grpc.ClientConnInterface, error) {
+func (c *Client) createConnection(service string) (grpc.ClientConnInterface, error) {
 
-	// return existing connection if availble
-	if c.GRPCConnection != nil {
-		log.Debugf("grpc client returning existig connection to %s", c.ServiceName)
-		return c.GRPCConnection, nil
+	host, node, err := c.getServiceHost(service)
+	if err != nil {
+		log.Warnf("can't get the host, %s", err.Error())
+		return nil, err
+	}
+
+	unaryInts := c.Options.UnaryInts
+	streamInts := c.Options.StreamInts
+
+	// retries wrap mark which runs closest to the call so every attempt is
+	// reported, the retries of a connection bound to a node select another one
+	if len(c.Options.RetryPolicies) > 0 {
+		bound := node
+		if c.loadBalanced() {
+			bound = nil
+		}
+		unaryInts = append(unaryInts[:len(unaryInts):len(unaryInts)], c.retryUnaryInterceptor(service, bound))
 	}
 
-	host, err := c.getServiceHost()
+	conn, err := c.dial(service, host, node, unaryInts, streamInts)
 	if err != nil {
-		log.Warnf("can't get the host, %s", err.Error())
 		return nil, err
 	}
 
-	log.Infof("client dials %s at %s using %s, %v unary interceptors", c.ServiceName, host, c.Options.Transport.String(), len(c.Options.UnaryInts))
+	// balanced connections leave unhealthy nodes out of the pool, a single
+	// node connection is probed once so another node can be tried
+	if c.Options.HealthCheck && !c.loadBalanced() {
+		if err := c.checkHealth(service, node, conn); err != nil {
+			if cc, ok := conn.(*grpc.ClientConn); ok {
+				cc.Close()
+			}
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// dial connects to the host of the service with the interceptors, the node is
+// marked with the outcome of the calls
+func (c *Client) dial(service, host string, node *registry.Node, unaryInts []grpc.UnaryClientInterceptor, streamInts []grpc.StreamClientInterceptor) (grpc.ClientConnInterface, error) {
+	if c.Options.Selector != nil {
+		unaryInts = append(unaryInts[:len(unaryInts):len(unaryInts)], c.markUnaryInterceptor(service, node))
+		streamInts = append(streamInts[:len(streamInts):len(streamInts)], c.markStreamInterceptor(service, node))
+	}
 
 	options := append(c.Options.DialOptions, []grpc.DialOption{
-		grpc.WithChainUnaryInterceptor(c.Options.UnaryInts...),
-		grpc.WithChainStreamInterceptor(c.Options.StreamInts...),
+		grpc.WithChainUnaryInterceptor(unaryInts...),
+		grpc.WithChainStreamInterceptor(streamInts...),
 	}...)
 
+	// the selected host only proves the service is available, the balancer
+	// picks the node for every call from now on
+	if c.loadBalanced() {
+		serviceConfig := balancer.ServiceConfig
+		if c.Options.HealthCheck {
+			serviceConfig = balancer.HealthCheckServiceConfig
+		}
+
+		host = resolver.Target(service)
+		options = append(options,
+			grpc.WithResolvers(resolver.NewBuilder(c.Options.Selector, c.selectOptions()...)),
+			grpc.WithDefaultServiceConfig(serviceConfig),
+		)
+	}
+
+	log.Infof("client dials %s at %s using %s, %v unary interceptors", service, host, c.Options.Transport.String(), len(c.Options.UnaryInts))
+
 	conn, err := c.Options.Transport.Dial(host, options...)
 	if err != nil {
 		log.Warnf("could not establish connection to service %s: %s", host, err.Error())
@@ -191,40 +263,77 @@ func (c *Client) createConnection() (grpc.ClientConnInterface, error) {
 	}
 
 	if conn == nil {
-		return nil, fmt.Errorf("Could not connect to the service %s at %s", c.ServiceName, host)
+		return nil, fmt.Errorf("Could not connect to the service %s at %s", service, host)
 	}
 
 	return conn, nil
 }
 
+// checkHealth probes the health service of the node behind the connection
+func (c *Client) checkHealth(service string, node *registry.Node, conn grpc.ClientConnInterface) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultHealthCheckTimeout)
+	defer cancel()
+
+	rsp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	if err == nil && rsp.Status != healthpb.HealthCheckResponse_SERVING {
+		err = fmt.Errorf("%s is %s", service, rsp.Status.String())
+	}
+
+	if err != nil {
+		if c.Options.Selector != nil && node != nil {
+			c.Options.Selector.Mark(service, node, status.Error(codes.Unavailable, err.Error()), selector.MarkNamespace(c.Options.Namespace))
+		}
+		return fmt.Errorf("grpc client health check of %s failed: %s", service, err.Error())
+	}
+
+	return nil
+}
+
+// loadBalanced reports whether calls should be balanced across the registry nodes.
+// Static selectors and the memory transport address a single target so they
+// keep using the selected host.
+func (c *Client) loadBalanced() bool {
+	if !c.Options.LoadBalancing || c.Options.HostOverride != "" || c.Options.Selector == nil {
+		return false
+	}
+	if c.Options.Transport == nil || c.Options.Transport.String() == "memory" {
+		return false
+	}
+	return c.Options.Selector.Options().Registry != nil
+}
+
 // getServiceHost: Getting service name from registered node
-func (c *Client) getServiceHost() (string, error) {
+func (c *Client) getServiceHost(service string) (string, *registry.Node, error) {
 
 	// force host override for situations where we have to connect to something else
 	if c.Options.HostOverride != "" {
 		log.Infof("overriding host name to %s", c.Options.HostOverride)
-		return c.Options.HostOverride, nil
+		return c.Options.HostOverride, nil, nil
 	}
 
-	host := c.ServiceName
+	host := service
+	var node *registry.Node
 	if c.Options.Selector != nil {
 		log.Debugf("grpc client using selector: %s", c.Options.Selector.String())
-		next, err := c.next(c.ServiceName)
+		next, err := c.next(service)
 		if err != nil {
-			return "", fmt.Errorf("grpc client, %s selector could not select the connection to %s: %s", c.Options.Selector.String(), c.ServiceName, err.Error())
+			return "", nil, fmt.Errorf("grpc client, %s selector could not select the connection to %s: %s", c.Options.Selector.String(), service, err.Error())
 		}
 
 		// retrieve the node details
-		node, err := next()
+		node, err = next()
 		if err != nil {
-			return "", fmt.Errorf("grpc client selector could not retrieve node address to %s: %s", c.ServiceName, err.Error())
+			return "", nil, fmt.Errorf("grpc client selector could not retrieve node address to %s: %s", service, err.Error())
 		}
 
 		host = node.Address
 	}
 
-	log.Debugf("grpc client host used for connection to %s: %s", c.ServiceName, host)
-	return host, nil
+	log.Debugf("grpc client host used for connection to %s: %s", service, host)
+	return host, node, nil
 }
 
 func (c *Client) next(serviceName string) (selector.Next, error) {
@@ -234,7 +343,7 @@ func (c *Client) next(serviceName string) (selector.Next, error) {
 		return nil, nil
 	}
 
-	next, err := c.Options.Selector.Select(serviceName, c.Options.SelectOptions...)
+	next, err := c.Options.Selector.Select(serviceName, c.selectOptions()...)
 
 	if err != nil {
 		if err == selector.ErrNotFound {
@@ -245,6 +354,12 @@ func (c *Client) next(serviceName string) (selector.Next, error) {
 	return next, nil
 }
 
+// selectOptions returns the select options limited to the client namespace
+func (c *Client) selectOptions() []selector.SelectOption {
+	opts := c.Options.SelectOptions
+	return append(opts[:len(opts):len(opts)], selector.WithNamespace(c.Options.Namespace))
+}
+
 // newCodec: checks if codec is defined for given content type
 // and returns appropriate codec from defaultCodecs
 func (c *Client) newCodec(contentType string) (codec.NewCodec, error) {
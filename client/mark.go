@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"io"
+
+	"github.com/sumlookup/mini/client/balancer"
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/selector"
+	"google.golang.org/grpc"
+)
+
+// mark reports the outcome of a call to the selector. The node is the one
+// the connection was created for, the balancer marks the nodes it picks.
+func (c *Client) mark(service string, node *registry.Node, err error) {
+	if c.Options.Selector == nil || node == nil || c.loadBalanced() {
+		return
+	}
+
+	c.Options.Selector.Mark(service, node, nodeFailure(err), selector.MarkNamespace(c.Options.Namespace))
+}
+
+// nodeFailure returns the error when it says something about the node
+func nodeFailure(err error) error {
+	return balancer.NodeFailure(err)
+}
+
+// observe tells a selector tracking the load that a call to the node starts.
+// The balancer observes the calls of balanced connections itself.
+func (c *Client) observe(service string, node *registry.Node) func(error) {
+	o, ok := c.Options.Selector.(selector.Observer)
+	if !ok || node == nil || c.loadBalanced() {
+		return func(error) {}
+	}
+	return o.Observe(service, node)
+}
+
+// markUnaryInterceptor marks the node which served the call
+func (c *Client) markUnaryInterceptor(service string, node *registry.Node) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		done := c.observe(service, node)
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		done(nodeFailure(err))
+		c.mark(service, node, err)
+		return err
+	}
+}
+
+// markStreamInterceptor marks the node which served the stream once it finishes
+func (c *Client) markStreamInterceptor(service string, node *registry.Node) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		done := c.observe(service, node)
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			done(nodeFailure(err))
+			c.mark(service, node, err)
+			return nil, err
+		}
+		return &markStream{ClientStream: stream, service: service, node: node, client: c, done: done}, nil
+	}
+}
+
+type markStream struct {
+	grpc.ClientStream
+	service string
+	node    *registry.Node
+	client  *Client
+	done    func(error)
+}
+
+func (s *markStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch err {
+	case nil:
+	case io.EOF:
+		s.done(nil)
+		s.client.mark(s.service, s.node, nil)
+	default:
+		s.done(nodeFailure(err))
+		s.client.mark(s.service, s.node, err)
+	}
+	return err
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"github.com/sumlookup/mini/selector"
 	"github.com/sumlookup/mini/transport"
+	"github.com/sumlookup/mini/util/env"
 	"google.golang.org/grpc"
 	"time"
 )
@@ -25,6 +26,15 @@ type Options struct {
 	GrpcConnection        grpc.ClientConnInterface
 	ContentType           string
 	HostOverride          string
+	// Namespace the services are selected from, the environment by default
+	Namespace string
+	// LoadBalancing dials mini:///service and picks a node through the
+	// selector on every call. It applies only to registry backed selectors.
+	LoadBalancing bool
+	// HealthCheck probes the health service of a node before it is used
+	HealthCheck bool
+	// RetryPolicies by full method name, the empty name applies to every method
+	RetryPolicies map[string]RetryPolicy
 }
 
 type DialOption grpc.DialOption
@@ -33,6 +43,21 @@ type DialOptions []grpc.DialOption
 // Option used by the Client
 type Option func(*Options)
 
+// CallOptions are used by Call and Stream
+type CallOptions struct {
+	// ContentType selects the codec the request and response are encoded with
+	ContentType string
+	// CallOptions are passed to grpc
+	CallOptions []grpc.CallOption
+
+	// Other options for implementations of the interface
+	// can be stored in a context
+	Context context.Context
+}
+
+// CallOption used by Call and Stream
+type CallOption func(*CallOptions)
+
 func NewOptions(options ...Option) Options {
 
 	opts := Options{
@@ -47,6 +72,8 @@ func NewOptions(options ...Option) Options {
 		//HealthCheckTicker:     5,
 		//ConnectionHealthCheck: false, // this is potentially harmfull as it will keep to call the service even if it has been closed
 		ConnectionAttempts: true,
+		LoadBalancing:      true,
+		Namespace:          env.New().GetEnv(),
 	}
 
 	for _, o := range options {
@@ -68,12 +95,57 @@ func WithDialOptions(n DialOptions) Option {
 	}
 }
 
+// WithHostOverride dials the host for every service instead of selecting a node
+func WithHostOverride(host string) Option {
+	return func(o *Options) {
+		o.HostOverride = host
+	}
+}
+
+// WithNamespace selects the nodes of the services registered in the namespace
+func WithNamespace(ns string) Option {
+	return func(o *Options) {
+		o.Namespace = ns
+	}
+}
+
 func WithConnectionAttempts(h bool) Option {
 	return func(o *Options) {
 		o.ConnectionAttempts = h
 	}
 }
 
+// WithLoadBalancing enables or disables per call load balancing across the service nodes
+func WithLoadBalancing(b bool) Option {
+	return func(o *Options) {
+		o.LoadBalancing = b
+	}
+}
+
+// WithHealthCheck probes the grpc health service of a node before it joins the
+// selection pool. Nodes without the health service are considered healthy.
+func WithHealthCheck(b bool) Option {
+	return func(o *Options) {
+		o.HealthCheck = b
+	}
+}
+
+// WithRetryPolicy retries the given methods, e.g. /pkg.Service/Method, according to
+// the policy. Without methods the policy applies to every method without its own.
+func WithRetryPolicy(p RetryPolicy, methods ...string) Option {
+	return func(o *Options) {
+		if o.RetryPolicies == nil {
+			o.RetryPolicies = make(map[string]RetryPolicy)
+		}
+		if len(methods) == 0 {
+			methods = []string{""}
+		}
+		for _, m := range methods {
+			o.RetryPolicies[m] = p
+		}
+	}
+}
+
 func WithContext(ctx context.Context) Option {
 	return func(o *Options) {
 		o.Context = ctx
@@ -93,6 +165,13 @@ func Selector(s selector.Selector) Option {
 	}
 }
 
+// SelectOption adds options to every select of the client
+func SelectOption(opts ...selector.SelectOption) Option {
+	return func(o *Options) {
+		o.SelectOptions = append(o.SelectOptions, opts...)
+	}
+}
+
 // Specify TLS Config
 func TLSConfig(t *tls.Config) Option {
 	return func(o *Options) {
@@ -105,3 +184,29 @@ func WithTransport(tr transport.Transport) Option {
 		o.Transport = tr
 	}
 }
+
+func (c *Client) newCallOptions(opts ...CallOption) CallOptions {
+	options := CallOptions{
+		ContentType: c.Options.ContentType,
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	return options
+}
+
+// WithContentType sets the content type of a single call
+func WithContentType(ct string) CallOption {
+	return func(o *CallOptions) {
+		o.ContentType = ct
+	}
+}
+
+// WithCallOptions passes grpc call options to a single call
+func WithCallOptions(opts ...grpc.CallOption) CallOption {
+	return func(o *CallOptions) {
+		o.CallOptions = append(o.CallOptions, opts...)
+	}
+}
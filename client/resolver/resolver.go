@@ -0,0 +1,211 @@
+// Package resolver provides a grpc resolver for mini:///service-name targets backed by the registry
+package resolver
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/client/balancer"
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/selector"
+	"google.golang.org/grpc/resolver"
+)
+
+// Scheme is the target scheme handled by the resolver
+const Scheme = "mini"
+
+// Target returns the grpc dial target for the service
+func Target(service string) string {
+	return Scheme + ":///" + service
+}
+
+type builder struct {
+	selector selector.Selector
+	opts     []selector.SelectOption
+}
+
+// NewBuilder returns a resolver builder which resolves service nodes
+// through the selector's registry and hands picking to the mini balancer.
+// The registry may be a cache, in which case lookups are served from it.
+func NewBuilder(s selector.Selector, opts ...selector.SelectOption) resolver.Builder {
+	return &builder{
+		selector: s,
+		opts:     opts,
+	}
+}
+
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	var sopts selector.SelectOptions
+	for _, o := range b.opts {
+		o(&sopts)
+	}
+
+	r := &miniResolver{
+		service:   target.Endpoint(),
+		namespace: sopts.Namespace,
+		registry:  b.selector.Options().Registry,
+		cc:        cc,
+		info: &balancer.Info{
+			Service:       target.Endpoint(),
+			Selector:      b.selector,
+			SelectOptions: b.opts,
+			Namespace:     sopts.Namespace,
+		},
+		refresh: make(chan bool, 1),
+		exit:    make(chan bool),
+	}
+
+	if r.registry == nil {
+		r.registry = registry.DefaultRegistry
+	}
+
+	r.wg.Add(2)
+	go r.run()
+	go r.watch()
+
+	return r, nil
+}
+
+func (b *builder) Scheme() string {
+	return Scheme
+}
+
+type miniResolver struct {
+	service   string
+	namespace string
+	registry  registry.Registry
+	cc        resolver.ClientConn
+	info      *balancer.Info
+
+	refresh chan bool
+	exit    chan bool
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+func backoff(attempts int) time.Duration {
+	if attempts == 0 {
+		return time.Duration(0)
+	}
+	return time.Duration(math.Pow(10, float64(attempts))) * time.Millisecond
+}
+
+// run resolves the service whenever a refresh is requested
+func (r *miniResolver) run() {
+	defer r.wg.Done()
+
+	r.resolve()
+
+	for {
+		select {
+		case <-r.exit:
+			return
+		case <-r.refresh:
+			r.resolve()
+		}
+	}
+}
+
+func (r *miniResolver) resolve() {
+	// a service which is gone has no addresses left, the
+	// connections to its former nodes are closed
+	services, err := r.registry.GetService(r.service, registry.GetNamespace(r.namespace))
+	if err != nil && err != registry.ErrNotFound {
+		log.Debugf("[resolver] could not resolve %s: %v", r.service, err)
+		r.cc.ReportError(err)
+		return
+	}
+
+	var addrs []resolver.Address
+	seen := make(map[string]bool)
+
+	for _, service := range services {
+		for _, node := range service.Nodes {
+			if seen[node.Address] {
+				continue
+			}
+			seen[node.Address] = true
+
+			addrs = append(addrs, balancer.SetInfo(resolver.Address{Addr: node.Address}, r.info))
+		}
+	}
+
+	log.Debugf("[resolver] %s resolved to %v addresses", r.service, len(addrs))
+	if err := r.cc.UpdateState(resolver.State{Addresses: addrs}); err != nil {
+		log.Debugf("[resolver] could not update state for %s: %v", r.service, err)
+	}
+}
+
+// watch triggers a refresh on every registry event for the service
+// and creates a new watcher if there's a problem
+func (r *miniResolver) watch() {
+	defer r.wg.Done()
+
+	var a int
+
+	for {
+		select {
+		case <-r.exit:
+			return
+		default:
+		}
+
+		w, err := r.registry.Watch(registry.WatchService(r.service), registry.WatchNamespace(r.namespace))
+		if err != nil {
+			d := backoff(a)
+			if a < 3 {
+				a++
+			}
+			log.Debugf("[resolver] watch %s: %v, backing off %v", r.service, err, d)
+
+			select {
+			case <-r.exit:
+				return
+			case <-time.After(d):
+			}
+			continue
+		}
+
+		a = 0
+
+		// catch up with anything missed while there was no watcher
+		r.ResolveNow(resolver.ResolveNowOptions{})
+
+		stop := make(chan bool)
+		go func() {
+			select {
+			case <-r.exit:
+			case <-stop:
+			}
+			w.Stop()
+		}()
+
+		for {
+			res, err := w.Next()
+			if err != nil {
+				close(stop)
+				break
+			}
+			if res == nil || res.Service == nil || res.Service.Name != r.service {
+				continue
+			}
+			r.ResolveNow(resolver.ResolveNowOptions{})
+		}
+	}
+}
+
+func (r *miniResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.refresh <- true:
+	default:
+	}
+}
+
+func (r *miniResolver) Close() {
+	r.once.Do(func() {
+		close(r.exit)
+	})
+	r.wg.Wait()
+}
@@ -0,0 +1,153 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/client/balancer"
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+	"github.com/sumlookup/mini/selector"
+	sr "github.com/sumlookup/mini/selector/registry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	pb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+)
+
+func testServer(t *testing.T) (*registry.Node, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := grpc.NewServer()
+	pb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(ln)
+
+	node := &registry.Node{
+		Id:      fmt.Sprintf("foo-%s", ln.Addr().String()),
+		Address: ln.Addr().String(),
+	}
+
+	return node, srv.Stop
+}
+
+func count(t *testing.T, c pb.HealthClient, calls int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < calls; i++ {
+		var p peer.Peer
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := c.Check(ctx, &pb.HealthCheckRequest{}, grpc.Peer(&p))
+		cancel()
+		if err != nil {
+			t.Fatalf("Unexpected error calling service: %v", err)
+		}
+		counts[p.Addr.String()]++
+	}
+	return counts
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("condition not met in time")
+}
+
+func TestResolverBalancesAcrossNodes(t *testing.T) {
+	r := memory.NewRegistry()
+	// keep the selector cache short lived so the test does not depend on watcher timing
+	s := selector.NewSelector(selector.Registry(r), selector.SetStrategy(selector.RoundRobin), sr.TTL(100*time.Millisecond))
+
+	service := &registry.Service{Name: "foo", Version: "1.0.0"}
+	for i := 0; i < 2; i++ {
+		node, stop := testServer(t)
+		defer stop()
+		service.Nodes = append(service.Nodes, node)
+	}
+
+	if err := r.Register(service); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.Dial(Target("foo"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(NewBuilder(s)),
+		grpc.WithDefaultServiceConfig(balancer.ServiceConfig),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := pb.NewHealthClient(conn)
+
+	waitFor(t, func() bool { return len(count(t, c, 10)) == 2 })
+
+	// a new node joins without reconnecting the client
+	node, stop := testServer(t)
+	defer stop()
+	if err := r.Register(&registry.Service{Name: "foo", Version: "1.0.0", Nodes: []*registry.Node{node}}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return count(t, c, 30)[node.Address] > 0 })
+
+	// and a leaving node stops receiving calls
+	gone := service.Nodes[0]
+	if err := r.Deregister(&registry.Service{Name: "foo", Version: "1.0.0", Nodes: []*registry.Node{gone}}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		counts := count(t, c, 30)
+		return counts[gone.Address] == 0 && len(counts) == 2
+	})
+}
+
+func TestResolverServiceGone(t *testing.T) {
+	r := memory.NewRegistry()
+	s := selector.NewSelector(selector.Registry(r), sr.TTL(100*time.Millisecond))
+
+	node, stop := testServer(t)
+	defer stop()
+
+	service := &registry.Service{Name: "foo", Version: "1.0.0", Nodes: []*registry.Node{node}}
+	if err := r.Register(service); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.Dial(Target("foo"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(NewBuilder(s)),
+		grpc.WithDefaultServiceConfig(balancer.ServiceConfig),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := pb.NewHealthClient(conn)
+	count(t, c, 1)
+
+	// the node keeps serving but the service left the registry
+	if err := r.Deregister(service); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := c.Check(ctx, &pb.HealthCheckRequest{})
+		return err != nil
+	})
+}
@@ -0,0 +1,349 @@
+package client
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/client/balancer"
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/selector"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy describes how a failed unary call is retried. Every attempt
+// goes through the selector again and avoids the nodes which already failed,
+// a connection bound to a node is left for another node of the service.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first one
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between retries
+	MaxBackoff time.Duration
+	// BackoffMultiplier grows the backoff after every retry
+	BackoffMultiplier float64
+	// Jitter randomises the backoff by up to the given fraction
+	Jitter float64
+	// RetryableCodes are the status codes which are retried
+	RetryableCodes []codes.Code
+	// PerAttemptTimeout limits every attempt, a timed out attempt is retried
+	// as long as the call's own deadline has not passed
+	PerAttemptTimeout time.Duration
+	// HedgingDelay enables hedging. Instead of waiting for an attempt to fail
+	// another one is sent after the delay and the first answer wins.
+	// Hedging only applies to proto replies, the other replies, like the
+	// frames of Client.Call, are retried without hedging.
+	HedgingDelay time.Duration
+}
+
+var (
+	// DefaultRetryPolicy is a sensible starting point for WithRetryPolicy
+	DefaultRetryPolicy = RetryPolicy{
+		MaxAttempts:       3,
+		InitialBackoff:    100 * time.Millisecond,
+		MaxBackoff:        time.Second,
+		BackoffMultiplier: 2,
+		Jitter:            0.2,
+		RetryableCodes:    []codes.Code{codes.Unavailable},
+	}
+)
+
+// backoff returns the wait before the given retry, the first retry is 1
+func (r RetryPolicy) backoff(retry int) time.Duration {
+	multiplier := r.BackoffMultiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	d := float64(r.InitialBackoff) * math.Pow(multiplier, float64(retry-1))
+	if r.MaxBackoff > 0 && d > float64(r.MaxBackoff) {
+		d = float64(r.MaxBackoff)
+	}
+	if r.Jitter > 0 {
+		d += d * r.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(d)
+}
+
+// retryable checks whether the attempt error should be retried
+func (r RetryPolicy) retryable(ctx context.Context, err error) bool {
+	// the call itself is done
+	if ctx.Err() != nil {
+		return false
+	}
+
+	code := status.Code(err)
+	if code == codes.DeadlineExceeded && r.PerAttemptTimeout > 0 {
+		return true
+	}
+
+	for _, c := range r.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryPolicy returns the policy for the full method name, e.g. /pkg.Service/Method
+func (c *Client) retryPolicy(method string) (RetryPolicy, bool) {
+	if p, ok := c.Options.RetryPolicies[method]; ok {
+		return p, true
+	}
+	p, ok := c.Options.RetryPolicies[""]
+	return p, ok
+}
+
+// untried leaves out the nodes already tried, unless every node was tried
+func untried(tried []string) selector.Filter {
+	return func(old []*registry.Service) []*registry.Service {
+		var services []*registry.Service
+
+		for _, service := range old {
+			var nodes []*registry.Node
+			for _, node := range service.Nodes {
+				if !contains(tried, node.Address) {
+					nodes = append(nodes, node)
+				}
+			}
+
+			if len(nodes) > 0 {
+				serv := new(registry.Service)
+				*serv = *service
+				serv.Nodes = nodes
+				services = append(services, serv)
+			}
+		}
+
+		if len(services) == 0 {
+			return old
+		}
+		return services
+	}
+}
+
+func contains(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// retryConnection selects a node of the service for an attempt which can't
+// use the node of the connection, the caller closes the connection
+func (c *Client) retryConnection(service string, tried []string) (grpc.ClientConnInterface, *registry.Node, error) {
+	next, err := c.Options.Selector.Select(service, append(c.selectOptions(), selector.WithFilter(untried(tried)))...)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unavailable, "grpc client could not select %s again: %v", service, err)
+	}
+
+	node, err := next()
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unavailable, "grpc client could not select %s again: %v", service, err)
+	}
+
+	conn, err := c.dial(service, node.Address, node, nil, nil)
+	if err != nil {
+		return nil, nil, status.Errorf(codes.Unavailable, "grpc client could not connect to %s: %v", node.Address, err)
+	}
+
+	return conn, node, nil
+}
+
+// attempt invokes the call once. The balancer of a balanced connection picks
+// the node, a connection bound to a node serves the attempt until the node was
+// tried and another node is selected then.
+func (c *Client) attempt(ctx context.Context, policy RetryPolicy, service string, node *registry.Node, tried []string, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) (string, error) {
+	ctx = balancer.WithTried(ctx, tried...)
+
+	if policy.PerAttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.PerAttemptTimeout)
+		defer cancel()
+	}
+
+	if node != nil && c.Options.Selector != nil {
+		if !contains(tried, node.Address) {
+			return node.Address, invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		conn, n, err := c.retryConnection(service, tried)
+		if err != nil {
+			return "", err
+		}
+		if cc, ok := conn.(*grpc.ClientConn); ok {
+			defer cc.Close()
+		}
+
+		return n.Address, conn.Invoke(ctx, method, req, reply, opts...)
+	}
+
+	// attempts run concurrently when hedging, never append to the shared options
+	p := new(peer.Peer)
+	err := invoker(ctx, method, req, reply, cc, append(append([]grpc.CallOption(nil), opts...), grpc.Peer(p))...)
+
+	var addr string
+	if p.Addr != nil {
+		addr = p.Addr.String()
+	}
+
+	return addr, err
+}
+
+// retryUnaryInterceptor retries and hedges calls according to the method's
+// retry policy. The node is the one a connection which isn't balanced is
+// bound to, the connection is released once the node failed.
+func (c *Client) retryUnaryInterceptor(service string, node *registry.Node) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		policy, ok := c.retryPolicy(method)
+		if !ok || policy.MaxAttempts <= 1 {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		if rsp, ok := reply.(proto.Message); ok && policy.HedgingDelay > 0 {
+			return c.hedge(ctx, policy, service, node, method, req, rsp, cc, invoker, opts...)
+		}
+
+		var tried []string
+		var err error
+
+		for i := 0; i < policy.MaxAttempts; i++ {
+			if i > 0 {
+				d := policy.backoff(i)
+				log.Debugf("grpc client retrying %s in %v, attempt %v of %v: %v", method, d, i+1, policy.MaxAttempts, err)
+
+				select {
+				case <-ctx.Done():
+					return err
+				case <-time.After(d):
+				}
+			}
+
+			var addr string
+			addr, err = c.attempt(ctx, policy, service, node, tried, method, req, reply, cc, invoker, opts...)
+			if err == nil || !policy.retryable(ctx, err) {
+				return err
+			}
+
+			if node != nil && addr == node.Address {
+				c.release(service, cc, err)
+			}
+			if len(addr) > 0 {
+				tried = append(tried, addr)
+			}
+		}
+
+		return err
+	}
+}
+
+// hedge sends a new attempt every HedgingDelay, or as soon as all in flight
+// attempts failed, until one succeeds or the attempts are exhausted
+func (c *Client) hedge(ctx context.Context, policy RetryPolicy, service string, node *registry.Node, method string, req interface{}, reply proto.Message, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	type result struct {
+		reply proto.Message
+		err   error
+	}
+
+	// cancels the attempts still in flight once we have an answer
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mtx sync.Mutex
+	var tried []string
+
+	record := func(addr string) {
+		mtx.Lock()
+		tried = append(tried, addr)
+		mtx.Unlock()
+	}
+
+	// the balancer reports the node as soon as it is picked so the next
+	// attempts avoid the nodes which are still busy with this one
+	pctx := balancer.WithPicked(ctx, record)
+
+	results := make(chan result, policy.MaxAttempts)
+
+	snapshot := func() []string {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return append([]string(nil), tried...)
+	}
+
+	send := func(tried []string) {
+		rsp := proto.Clone(reply)
+		rsp.Reset()
+
+		addr, err := c.attempt(pctx, policy, service, node, tried, method, req, rsp, cc, invoker, opts...)
+		if err != nil && len(addr) > 0 {
+			record(addr)
+		}
+		if err != nil && node != nil && addr == node.Address {
+			c.release(service, cc, err)
+		}
+
+		results <- result{reply: rsp, err: err}
+	}
+
+	timer := time.NewTimer(policy.HedgingDelay)
+	defer timer.Stop()
+
+	sent, done := 1, 0
+	go send(nil)
+
+	// the node of the connection is busy with the first attempt, the
+	// others select another node straight away
+	if node != nil {
+		record(node.Address)
+	}
+
+	var err error
+
+	for {
+		select {
+		case res := <-results:
+			done++
+			if res.err == nil {
+				reply.Reset()
+				proto.Merge(reply, res.reply)
+				return nil
+			}
+
+			err = res.err
+			if !policy.retryable(ctx, err) || done == policy.MaxAttempts {
+				return err
+			}
+
+			// nothing in flight, don't wait for the hedging delay
+			if sent == done {
+				sent++
+				go send(snapshot())
+				timer.Reset(policy.HedgingDelay)
+			}
+		case <-timer.C:
+			if sent < policy.MaxAttempts {
+				log.Debugf("grpc client hedging %s, attempt %v of %v", method, sent+1, policy.MaxAttempts)
+				sent++
+				go send(snapshot())
+				timer.Reset(policy.HedgingDelay)
+			}
+		case <-ctx.Done():
+			if err != nil {
+				return err
+			}
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+	"github.com/sumlookup/mini/selector"
+	sr "github.com/sumlookup/mini/selector/registry"
+	tm "github.com/sumlookup/mini/transport/memory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// flakyHealth fails the first calls with the given code
+type flakyHealth struct {
+	healthpb.UnimplementedHealthServer
+
+	sync.Mutex
+	calls int
+	fails int
+	code  codes.Code
+	// slow blocks the first call until it is cancelled
+	slow bool
+	// cancelled is closed once the slow call is cancelled
+	cancelled chan struct{}
+}
+
+func (h *flakyHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	h.Lock()
+	h.calls++
+	call := h.calls
+	h.Unlock()
+
+	if h.slow && call == 1 {
+		<-ctx.Done()
+		close(h.cancelled)
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+
+	if call <= h.fails {
+		return nil, status.Error(h.code, "failed")
+	}
+
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+func (h *flakyHealth) count() int {
+	h.Lock()
+	defer h.Unlock()
+	return h.calls
+}
+
+// newRetryClient serves the health service on the memory transport and
+// returns a health client calling it with the retry policy
+func newRetryClient(t *testing.T, name string, h *flakyHealth, policy RetryPolicy) healthpb.HealthClient {
+	tr := tm.NewTransport()
+
+	ln, err := tr.Listen(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, h)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	c := New(
+		WithTransport(tr),
+		WithHostOverride(name),
+		WithConnectionAttempts(false),
+		WithRetryPolicy(policy),
+	)
+
+	conn := c.Connect(name)
+	if conn == nil {
+		t.Fatalf("Expected a connection to %s", name)
+	}
+
+	return healthpb.NewHealthClient(conn)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff:    100 * time.Millisecond,
+		MaxBackoff:        time.Second,
+		BackoffMultiplier: 2,
+	}
+
+	for retry, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second,
+		9: time.Second,
+	} {
+		if d := p.backoff(retry); d != want {
+			t.Fatalf("Expected a backoff of %v before retry %d, got %v", want, retry, d)
+		}
+	}
+
+	p.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if d := p.backoff(2); d < 160*time.Millisecond || d > 240*time.Millisecond {
+			t.Fatalf("Expected the backoff within 20%% of 200ms, got %v", d)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	h := &flakyHealth{fails: 2, code: codes.Unavailable}
+	policy := RetryPolicy{
+		MaxAttempts:       3,
+		InitialBackoff:    50 * time.Millisecond,
+		BackoffMultiplier: 2,
+		RetryableCodes:    []codes.Code{codes.Unavailable},
+	}
+	c := newRetryClient(t, "retry.test:0", h, policy)
+
+	start := time.Now()
+	rsp, err := c.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Expected the call to succeed on the third attempt, got %v", err)
+	}
+	if rsp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Expected serving, got %s", rsp.Status)
+	}
+	if n := h.count(); n != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", n)
+	}
+
+	// 50ms before the first retry and 100ms before the second
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("Expected the retries to back off for 150ms, took %v", d)
+	}
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	h := &flakyHealth{fails: 10, code: codes.Unavailable}
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		RetryableCodes: []codes.Code{codes.Unavailable},
+	}
+	c := newRetryClient(t, "retry.max.test:0", h, policy)
+
+	_, err := c.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected the last attempt error, got %v", err)
+	}
+	if n := h.count(); n != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", n)
+	}
+}
+
+func TestRetryCodes(t *testing.T) {
+	h := &flakyHealth{fails: 1, code: codes.InvalidArgument}
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		RetryableCodes: []codes.Code{codes.Unavailable},
+	}
+	c := newRetryClient(t, "retry.codes.test:0", h, policy)
+
+	_, err := c.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected the error not to be retried, got %v", err)
+	}
+	if n := h.count(); n != 1 {
+		t.Fatalf("Expected a single attempt, got %d", n)
+	}
+}
+
+func TestHedge(t *testing.T) {
+	h := &flakyHealth{slow: true, cancelled: make(chan struct{})}
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		RetryableCodes: []codes.Code{codes.Unavailable},
+		HedgingDelay:   20 * time.Millisecond,
+	}
+	c := newRetryClient(t, "retry.hedge.test:0", h, policy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rsp, err := c.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Expected the hedged attempt to answer, got %v", err)
+	}
+	if rsp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Expected serving, got %s", rsp.Status)
+	}
+	if n := h.count(); n != 2 {
+		t.Fatalf("Expected the slow attempt and a hedged one, got %d attempts", n)
+	}
+
+	// the winner cancels the attempt still in flight
+	select {
+	case <-h.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the slow attempt to be cancelled")
+	}
+}
+
+func TestRetrySelectsAgain(t *testing.T) {
+	r := memory.NewRegistry()
+	newEchoServer(t, r, "test.retry.select", "test.retry.select.1")
+
+	// the node going away fails every call
+	tr := tm.NewTransport()
+	ln, err := tr.Listen("test.retry.select.down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed int
+	down := grpc.NewServer()
+	down.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Echo",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Echo",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				failed++
+				return nil, status.Error(codes.Unavailable, "going away")
+			},
+		}},
+	}, struct{}{})
+	go down.Serve(ln)
+	t.Cleanup(down.Stop)
+
+	c := New(
+		Selector(sr.NewSelector(selector.Registry(r), selector.SetStrategy(func(services []*registry.Service) selector.Next {
+			// the node going away first, as long as it's there
+			return func() (*registry.Node, error) {
+				var node *registry.Node
+				for _, svc := range services {
+					for _, n := range svc.Nodes {
+						if node == nil || n.Id == "test.retry.select.down" {
+							node = n
+						}
+					}
+				}
+				return node, nil
+			}
+		}))),
+		WithTransport(tr),
+		WithConnectionAttempts(false),
+		ContentType("application/json"),
+		WithRetryPolicy(RetryPolicy{
+			MaxAttempts:    2,
+			InitialBackoff: time.Millisecond,
+			RetryableCodes: []codes.Code{codes.Unavailable},
+		}),
+	)
+
+	if err := r.Register(&registry.Service{
+		Name:  "test.retry.select",
+		Nodes: []*registry.Node{{Id: "test.retry.select.down", Address: "test.retry.select.down"}},
+	}, registry.RegisterNamespace(c.Options.Namespace)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rsp := new(echoMessage)
+	if err := c.Call(ctx, "test.retry.select", "test.Echo.Echo", &echoMessage{Text: "hello"}, rsp); err != nil {
+		t.Fatalf("Expected the retry to select the other node, got %v", err)
+	}
+	if rsp.Node != "test.retry.select.1" || failed != 1 {
+		t.Fatalf("Expected a single failure before test.retry.select.1 answered, got %d failures and %s", failed, rsp.Node)
+	}
+
+	// the connection to the failed node is released
+	c.RLock()
+	defer c.RUnlock()
+	if _, ok := c.conns["test.retry.select"]; ok {
+		t.Fatal("Expected the connection to the failed node to be released")
+	}
+}
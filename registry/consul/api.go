@@ -0,0 +1,184 @@
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// errNotFound is returned for the 404 responses of the consul agent
+var errNotFound = errors.New("not found")
+
+// agentCheck is the check registered along with a service
+type agentCheck struct {
+	CheckID                        string `json:"CheckID,omitempty"`
+	TTL                            string `json:"TTL,omitempty"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter,omitempty"`
+}
+
+// agentServiceRegistration is the body of /v1/agent/service/register
+type agentServiceRegistration struct {
+	ID      string      `json:"ID"`
+	Name    string      `json:"Name"`
+	Tags    []string    `json:"Tags,omitempty"`
+	Address string      `json:"Address,omitempty"`
+	Port    int         `json:"Port,omitempty"`
+	Check   *agentCheck `json:"Check,omitempty"`
+}
+
+type agentService struct {
+	ID      string   `json:"ID"`
+	Service string   `json:"Service"`
+	Tags    []string `json:"Tags"`
+	Address string   `json:"Address"`
+	Port    int      `json:"Port"`
+}
+
+type healthCheck struct {
+	CheckID   string `json:"CheckID"`
+	ServiceID string `json:"ServiceID"`
+	Status    string `json:"Status"`
+}
+
+type catalogNode struct {
+	Node    string `json:"Node"`
+	Address string `json:"Address"`
+}
+
+// serviceEntry is an item of /v1/health/service/:service
+type serviceEntry struct {
+	Node    *catalogNode   `json:"Node"`
+	Service *agentService  `json:"Service"`
+	Checks  []*healthCheck `json:"Checks"`
+}
+
+// api calls the http api of the consul agent
+type api struct {
+	client  *http.Client
+	scheme  string
+	address string
+	token   string
+	timeout time.Duration
+}
+
+// do sends the request and decodes the response into out. It returns
+// the X-Consul-Index of the response for the blocking queries.
+func (a *api) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) (uint64, error) {
+	u := url.URL{
+		Scheme:   a.scheme,
+		Host:     a.address,
+		Path:     "/v1/" + path,
+		RawQuery: query.Encode(),
+	}
+
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return 0, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(a.token) > 0 {
+		req.Header.Set("X-Consul-Token", a.token)
+	}
+
+	rsp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusNotFound {
+		return 0, errNotFound
+	}
+	if rsp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(rsp.Body)
+		return 0, fmt.Errorf("consul %s %s: %s: %s", method, path, rsp.Status, bytes.TrimSpace(b))
+	}
+
+	var index uint64
+	if h := rsp.Header.Get("X-Consul-Index"); len(h) > 0 {
+		if index, err = strconv.ParseUint(h, 10, 64); err != nil {
+			return 0, fmt.Errorf("consul %s %s: invalid index %s", method, path, h)
+		}
+	}
+
+	if out == nil {
+		io.Copy(io.Discard, rsp.Body)
+		return index, nil
+	}
+
+	return index, json.NewDecoder(rsp.Body).Decode(out)
+}
+
+// call is a request which isn't expected to block
+func (a *api) call(method, path string, query url.Values, in, out interface{}) (uint64, error) {
+	ctx := context.Background()
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+	return a.do(ctx, method, path, query, in, out)
+}
+
+func (a *api) register(reg *agentServiceRegistration) error {
+	_, err := a.call(http.MethodPut, "agent/service/register", nil, reg, nil)
+	return err
+}
+
+func (a *api) deregister(id string) error {
+	_, err := a.call(http.MethodPut, "agent/service/deregister/"+url.PathEscape(id), nil, nil, nil)
+	return err
+}
+
+func (a *api) pass(checkID string) error {
+	_, err := a.call(http.MethodPut, "agent/check/pass/"+url.PathEscape(checkID), nil, nil, nil)
+	return err
+}
+
+// health returns the entries of the service passing their checks. With an index
+// the query blocks until the entries change or the wait time is over.
+func (a *api) health(ctx context.Context, service string, index uint64, wait time.Duration) ([]*serviceEntry, uint64, error) {
+	var entries []*serviceEntry
+	query := url.Values{"passing": {"true"}}
+	idx, err := a.query(ctx, "health/service/"+url.PathEscape(service), query, index, wait, &entries)
+	return entries, idx, err
+}
+
+// services returns the names and tags of the catalog services, blocking like health
+func (a *api) services(ctx context.Context, index uint64, wait time.Duration) (map[string][]string, uint64, error) {
+	services := make(map[string][]string)
+	idx, err := a.query(ctx, "catalog/services", url.Values{}, index, wait, &services)
+	return services, idx, err
+}
+
+// query gets the path, blocking for the wait time when the index is set
+func (a *api) query(ctx context.Context, path string, query url.Values, index uint64, wait time.Duration, out interface{}) (uint64, error) {
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%dms", wait.Milliseconds()))
+	} else if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+
+	return a.do(ctx, http.MethodGet, path, query, nil, out)
+}
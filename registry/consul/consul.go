@@ -0,0 +1,492 @@
+// Package consul provides a registry which uses the http api of a consul agent.
+// Nodes registered with a ttl get a consul ttl check which the registration
+// heartbeat keeps passing, only the nodes passing their checks are returned.
+// The registry namespaces are kept in a tag of the nodes, the nodes without
+// the tag are in the default namespace.
+package consul
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/registry"
+)
+
+const (
+	// tags of the consul services
+	versionTag   = "version="
+	miniTag      = "mini="
+	namespaceTag = "namespace="
+)
+
+var (
+	// DefaultAddress of the consul agent, CONSUL_HTTP_ADDR overrides it
+	DefaultAddress = "127.0.0.1:8500"
+	// DefaultTimeout of the requests to the consul agent
+	DefaultTimeout = 10 * time.Second
+	// DefaultDeregisterCriticalServiceAfter is how long consul keeps a node whose
+	// ttl check expired, consul doesn't accept less than a minute
+	DefaultDeregisterCriticalServiceAfter = time.Minute
+	// DefaultWaitTime is how long the blocking queries of the watchers wait
+	DefaultWaitTime = 5 * time.Minute
+)
+
+// txt is the part of the service consul has no field for, kept in the mini tag
+type txt struct {
+	Metadata     map[string]string    `json:"metadata,omitempty"`
+	Endpoints    []*registry.Endpoint `json:"endpoints,omitempty"`
+	NodeMetadata map[string]string    `json:"node_metadata,omitempty"`
+}
+
+type consulRegistry struct {
+	opts registry.Options
+
+	sync.RWMutex
+	api             *api
+	deregisterAfter time.Duration
+	waitTime        time.Duration
+	// node id -> hash of the registration, registered nodes only pass their check
+	registered map[string]uint64
+}
+
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	c := &consulRegistry{
+		opts: registry.Options{
+			Context: context.Background(),
+			Timeout: DefaultTimeout,
+		},
+		registered: make(map[string]uint64),
+	}
+	c.configure(opts...)
+	return c
+}
+
+func (c *consulRegistry) configure(opts ...registry.Option) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, o := range opts {
+		o(&c.opts)
+	}
+
+	address := DefaultAddress
+	if a := os.Getenv("CONSUL_HTTP_ADDR"); len(a) > 0 {
+		address = a
+	}
+	if len(c.opts.Addrs) > 0 {
+		address = c.opts.Addrs[0]
+	}
+
+	scheme := "http"
+	if c.opts.Secure || c.opts.TLSConfig != nil {
+		scheme = "https"
+	}
+	if i := strings.Index(address, "://"); i >= 0 {
+		scheme, address = address[:i], address[i+3:]
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if scheme == "https" {
+		config := c.opts.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		tr.TLSClientConfig = config
+	}
+
+	c.api = &api{
+		// no client timeout, the blocking queries wait for the changes
+		client:  &http.Client{Transport: tr},
+		scheme:  scheme,
+		address: address,
+		token:   os.Getenv("CONSUL_HTTP_TOKEN"),
+		timeout: c.opts.Timeout,
+	}
+	c.deregisterAfter = DefaultDeregisterCriticalServiceAfter
+	c.waitTime = DefaultWaitTime
+
+	if c.opts.Context == nil {
+		return
+	}
+	if t, ok := c.opts.Context.Value(tokenKey{}).(string); ok && len(t) > 0 {
+		c.api.token = t
+	}
+	if d, ok := c.opts.Context.Value(deregisterAfterKey{}).(time.Duration); ok && d > 0 {
+		c.deregisterAfter = d
+	}
+	if d, ok := c.opts.Context.Value(waitTimeKey{}).(time.Duration); ok && d > 0 {
+		c.waitTime = d
+	}
+}
+
+func (c *consulRegistry) Init(opts ...registry.Option) error {
+	c.configure(opts...)
+	return nil
+}
+
+func (c *consulRegistry) Options() registry.Options {
+	return c.opts
+}
+
+func (c *consulRegistry) getAPI() *api {
+	c.RLock()
+	defer c.RUnlock()
+	return c.api
+}
+
+// Register registers every node of the service with the agent. A node registered
+// with a ttl gets a ttl check, registering it again with the same service only
+// passes the check.
+func (c *consulRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	var options registry.RegisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	a := c.getAPI()
+
+	for _, n := range s.Nodes {
+		reg, err := c.registration(s, n, namespace(options.Namespace), options.TTL)
+		if err != nil {
+			return err
+		}
+
+		h, err := hash(reg)
+		if err != nil {
+			return err
+		}
+
+		c.RLock()
+		known, ok := c.registered[n.Id]
+		c.RUnlock()
+
+		if ok && known == h && reg.Check != nil {
+			err := a.pass(reg.Check.CheckID)
+			if err == nil {
+				continue
+			}
+			// the agent lost the node, register it again
+			if err != errNotFound {
+				return err
+			}
+		}
+
+		log.Debugf("[consul] registry registering %s node %s at %s in %s", s.Name, n.Id, n.Address, namespaceOf(reg.Tags))
+		if err := a.register(reg); err != nil {
+			return err
+		}
+
+		// the ttl check starts critical
+		if reg.Check != nil {
+			if err := a.pass(reg.Check.CheckID); err != nil {
+				return err
+			}
+		}
+
+		c.Lock()
+		c.registered[n.Id] = h
+		c.Unlock()
+	}
+
+	return nil
+}
+
+func (c *consulRegistry) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
+	a := c.getAPI()
+
+	for _, n := range s.Nodes {
+		c.Lock()
+		delete(c.registered, n.Id)
+		c.Unlock()
+
+		log.Debugf("[consul] registry deregistering %s node %s", s.Name, n.Id)
+		if err := a.deregister(n.Id); err != nil && err != errNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *consulRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	var options registry.GetOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	entries, _, err := c.getAPI().health(context.Background(), name, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	services := toServices(name, namespace(options.Namespace), entries)
+	if len(services) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	result := make([]*registry.Service, 0, len(services))
+	for _, s := range services {
+		result = append(result, s)
+	}
+
+	return result, nil
+}
+
+// ListServices returns the names of the catalog services with nodes in the namespace
+func (c *consulRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	var options registry.ListOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	names, _, err := c.getAPI().services(context.Background(), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	names = inNamespace(names, namespace(options.Namespace))
+
+	services := make([]*registry.Service, 0, len(names))
+	for name := range names {
+		// the agent registers itself
+		if name == "consul" {
+			continue
+		}
+		services = append(services, &registry.Service{Name: name})
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+
+	return services, nil
+}
+
+func (c *consulRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	return newWatcher(c, opts...)
+}
+
+func (c *consulRegistry) String() string {
+	return "consul"
+}
+
+// registration returns the agent registration of the service node
+func (c *consulRegistry) registration(s *registry.Service, n *registry.Node, ns string, ttl time.Duration) (*agentServiceRegistration, error) {
+	host, port := n.Address, 0
+	if h, p, err := net.SplitHostPort(n.Address); err == nil {
+		host = h
+		port, _ = strconv.Atoi(p)
+	}
+
+	tag, err := encode(&txt{
+		Metadata:     s.Metadata,
+		Endpoints:    s.Endpoints,
+		NodeMetadata: n.Metadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reg := &agentServiceRegistration{
+		ID:      n.Id,
+		Name:    s.Name,
+		Tags:    []string{versionTag + s.Version, miniTag + tag, namespaceTag + ns},
+		Address: host,
+		Port:    port,
+	}
+
+	if ttl > 0 {
+		c.RLock()
+		deregisterAfter := c.deregisterAfter
+		c.RUnlock()
+
+		reg.Check = &agentCheck{
+			CheckID:                        "service:" + n.Id,
+			TTL:                            ttl.String(),
+			DeregisterCriticalServiceAfter: deregisterAfter.String(),
+		}
+	}
+
+	return reg, nil
+}
+
+// namespace returns the namespace of the options, the default one when empty
+func namespace(ns string) string {
+	if len(ns) == 0 {
+		return registry.DefaultNamespace
+	}
+	return ns
+}
+
+// namespaceOf returns the namespace of the node tags
+func namespaceOf(tags []string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, namespaceTag) {
+			return namespace(strings.TrimPrefix(tag, namespaceTag))
+		}
+	}
+	return registry.DefaultNamespace
+}
+
+// inNamespace returns the catalog services with nodes in the namespace. The
+// catalog merges the tags of the nodes, a service with a node without the
+// namespace tag may have nodes in the default namespace.
+func inNamespace(names map[string][]string, ns string) map[string][]string {
+	result := make(map[string][]string)
+
+	for name, tags := range names {
+		tagged := false
+		for _, tag := range tags {
+			if !strings.HasPrefix(tag, namespaceTag) {
+				continue
+			}
+			tagged = true
+			if namespace(strings.TrimPrefix(tag, namespaceTag)) == ns {
+				result[name] = tags
+				break
+			}
+		}
+		if !tagged && ns == registry.DefaultNamespace {
+			result[name] = tags
+		}
+	}
+
+	return result
+}
+
+// toServices returns the services of the passing entries of the namespace by version
+func toServices(name, ns string, entries []*serviceEntry) map[string]*registry.Service {
+	services := make(map[string]*registry.Service)
+
+	for _, e := range entries {
+		if e.Service == nil || e.Service.Service != name || !passing(e.Checks) {
+			continue
+		}
+		if namespaceOf(e.Service.Tags) != ns {
+			continue
+		}
+
+		var version string
+		var t txt
+		for _, tag := range e.Service.Tags {
+			switch {
+			case strings.HasPrefix(tag, versionTag):
+				version = strings.TrimPrefix(tag, versionTag)
+			case strings.HasPrefix(tag, miniTag):
+				if err := decode(strings.TrimPrefix(tag, miniTag), &t); err != nil {
+					log.Warnf("[consul] registry could not decode the tag of %s node %s: %v", name, e.Service.ID, err)
+				}
+			}
+		}
+
+		s, ok := services[version]
+		if !ok {
+			s = &registry.Service{
+				Name:      name,
+				Version:   version,
+				Metadata:  t.Metadata,
+				Endpoints: t.Endpoints,
+			}
+			services[version] = s
+		}
+
+		// the service address falls back to the address of the consul node
+		address := e.Service.Address
+		if len(address) == 0 && e.Node != nil {
+			address = e.Node.Address
+		}
+		if e.Service.Port > 0 {
+			address = net.JoinHostPort(address, strconv.Itoa(e.Service.Port))
+		}
+
+		s.Nodes = append(s.Nodes, &registry.Node{
+			Id:       e.Service.ID,
+			Address:  address,
+			Metadata: t.NodeMetadata,
+		})
+	}
+
+	// keep the order stable so the watchers can compare services
+	for _, s := range services {
+		sort.Slice(s.Nodes, func(i, j int) bool {
+			return s.Nodes[i].Id < s.Nodes[j].Id
+		})
+	}
+
+	return services
+}
+
+// passing reports whether none of the checks fail, the agent already filters
+// the entries but a node check may fail while its service check passes
+func passing(checks []*healthCheck) bool {
+	for _, c := range checks {
+		if c.Status != "passing" {
+			return false
+		}
+	}
+	return true
+}
+
+func encode(t *txt) (string, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf.Bytes()), nil
+}
+
+func decode(s string, t *txt) error {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	b, err = io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, t)
+}
+
+func hash(reg *agentServiceRegistration) (uint64, error) {
+	b, err := json.Marshal(reg)
+	if err != nil {
+		return 0, fmt.Errorf("could not hash the registration of %s: %v", reg.ID, err)
+	}
+
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64(), nil
+}
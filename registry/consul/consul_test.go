@@ -0,0 +1,471 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+)
+
+// fakeConsul is the part of the consul http api the registry uses
+type fakeConsul struct {
+	sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	services map[string]*agentServiceRegistration
+	// check id -> status
+	checks map[string]string
+	// registrations received by service id
+	registrations map[string]int
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, string) {
+	f := &fakeConsul{
+		index:         1,
+		changed:       make(chan struct{}),
+		services:      make(map[string]*agentServiceRegistration),
+		checks:        make(map[string]string),
+		registrations: make(map[string]int),
+	}
+
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+
+	return f, strings.TrimPrefix(ts.URL, "http://")
+}
+
+// bump moves the index and wakes the blocking queries, it is called with the lock held
+func (f *fakeConsul) bump() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// fail makes the check of the service critical like an expired ttl
+func (f *fakeConsul) fail(id string) {
+	f.Lock()
+	defer f.Unlock()
+	f.checks["service:"+id] = "critical"
+	f.bump()
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+	f.Lock()
+	defer f.Unlock()
+
+	switch {
+	case r.Method == http.MethodPut && path == "agent/service/register":
+		reg := new(agentServiceRegistration)
+		if err := json.NewDecoder(r.Body).Decode(reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.services[reg.ID] = reg
+		f.registrations[reg.ID]++
+		if reg.Check != nil {
+			f.checks[reg.Check.CheckID] = "critical"
+		}
+		f.bump()
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "agent/service/deregister/"):
+		id := strings.TrimPrefix(path, "agent/service/deregister/")
+		if _, ok := f.services[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.services, id)
+		delete(f.checks, "service:"+id)
+		f.bump()
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "agent/check/pass/"):
+		id := strings.TrimPrefix(path, "agent/check/pass/")
+		if _, ok := f.checks[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f.checks[id] = "passing"
+		f.bump()
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "health/service/"):
+		name := strings.TrimPrefix(path, "health/service/")
+		f.block(r)
+
+		entries := []*serviceEntry{}
+		for _, s := range f.services {
+			if s.Name != name {
+				continue
+			}
+			e := &serviceEntry{
+				Node:    &catalogNode{Node: "node-1", Address: "10.0.0.100"},
+				Service: &agentService{ID: s.ID, Service: s.Name, Tags: s.Tags, Address: s.Address, Port: s.Port},
+			}
+			if s.Check != nil {
+				e.Checks = append(e.Checks, &healthCheck{CheckID: s.Check.CheckID, ServiceID: s.ID, Status: f.checks[s.Check.CheckID]})
+			}
+			if r.URL.Query().Get("passing") == "true" && !passing(e.Checks) {
+				continue
+			}
+			entries = append(entries, e)
+		}
+		f.reply(w, entries)
+	case r.Method == http.MethodGet && path == "catalog/services":
+		f.block(r)
+
+		// the tags of the nodes are merged
+		services := map[string][]string{"consul": {}}
+		for _, s := range f.services {
+			services[s.Name] = append(services[s.Name], s.Tags...)
+		}
+		f.reply(w, services)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// block waits for a change past the index of a blocking query, it is called with the lock held
+func (f *fakeConsul) block(r *http.Request) {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if index == 0 {
+		return
+	}
+
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil {
+		wait = 5 * time.Minute
+	}
+	timeout := time.After(wait)
+
+	for f.index <= index {
+		changed := f.changed
+		f.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+		case <-r.Context().Done():
+		}
+		f.Lock()
+
+		select {
+		case <-timeout:
+			return
+		case <-r.Context().Done():
+			return
+		default:
+		}
+	}
+}
+
+func (f *fakeConsul) reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	json.NewEncoder(w).Encode(v)
+}
+
+func newService(id, address string) *registry.Service {
+	return &registry.Service{
+		Name:     "foo",
+		Version:  "1.0.0",
+		Metadata: map[string]string{"team": "bar"},
+		Endpoints: []*registry.Endpoint{
+			{Name: "Foo.Bar", Metadata: map[string]string{"stream": "false"}},
+		},
+		Nodes: []*registry.Node{
+			{Id: id, Address: address, Metadata: map[string]string{"foo": "bar"}},
+		},
+	}
+}
+
+func TestConsulRegistry(t *testing.T) {
+	f, addr := newFakeConsul(t)
+	r := NewRegistry(registry.Addrs(addr))
+
+	if _, err := r.GetService("foo"); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+
+	s1 := newService("foo-1", "10.0.0.1:8080")
+	s2 := newService("foo-2", "10.0.0.2:8080")
+
+	for _, s := range []*registry.Service{s1, s2} {
+		if err := r.Register(s, registry.RegisterTTL(30*time.Second)); err != nil {
+			t.Fatalf("Unexpected register error %v", err)
+		}
+	}
+
+	f.Lock()
+	reg := f.services["foo-1"]
+	f.Unlock()
+	if reg == nil || reg.Address != "10.0.0.1" || reg.Port != 8080 {
+		t.Fatalf("Expected foo-1 at 10.0.0.1 port 8080, got %+v", reg)
+	}
+	if reg.Check == nil || reg.Check.TTL != "30s" || reg.Check.DeregisterCriticalServiceAfter != "1m0s" {
+		t.Fatalf("Expected a 30s ttl check, got %+v", reg.Check)
+	}
+
+	services, err := r.GetService("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error getting service %v", err)
+	}
+	if len(services) != 1 || len(services[0].Nodes) != 2 {
+		t.Fatalf("Expected 1 service with 2 nodes, got %+v", services)
+	}
+
+	s := services[0]
+	if s.Version != "1.0.0" || s.Metadata["team"] != "bar" || len(s.Endpoints) != 1 || s.Endpoints[0].Name != "Foo.Bar" {
+		t.Fatalf("Expected the service details to survive the tags, got %+v", s)
+	}
+	if s.Nodes[0].Id != "foo-1" || s.Nodes[0].Address != "10.0.0.1:8080" || s.Nodes[0].Metadata["foo"] != "bar" {
+		t.Fatalf("Expected foo-1 at 10.0.0.1:8080, got %+v", s.Nodes[0])
+	}
+
+	list, err := r.ListServices()
+	if err != nil {
+		t.Fatalf("Unexpected error listing services %v", err)
+	}
+	if len(list) != 1 || list[0].Name != "foo" {
+		t.Fatalf("Expected only foo, got %+v", list)
+	}
+
+	if err := r.Deregister(s1); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+	if err := r.Deregister(s2); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+	if _, err := r.GetService("foo"); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+}
+
+func TestConsulRegistryNamespace(t *testing.T) {
+	f, addr := newFakeConsul(t)
+	r := NewRegistry(registry.Addrs(addr))
+
+	w, err := r.Watch(registry.WatchNamespace("staging"))
+	if err != nil {
+		t.Fatalf("Unexpected watch error %v", err)
+	}
+	defer w.Stop()
+
+	if err := r.Register(newService("foo-1", "10.0.0.1:8080")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	if err := r.Register(newService("foo-2", "10.0.0.2:8080"), registry.RegisterNamespace("staging")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	// a node registered before the namespaces has no tag
+	f.Lock()
+	f.services["foo-0"] = &agentServiceRegistration{ID: "foo-0", Name: "foo", Tags: []string{versionTag + "1.0.0"}}
+	f.bump()
+	f.Unlock()
+
+	for ns, ids := range map[string][]string{
+		registry.DefaultNamespace: {"foo-0", "foo-1"},
+		"staging":                 {"foo-2"},
+	} {
+		services, err := r.GetService("foo", registry.GetNamespace(ns))
+		if err != nil {
+			t.Fatalf("Unexpected error getting foo in %s: %v", ns, err)
+		}
+		if len(services) != 1 || len(services[0].Nodes) != len(ids) {
+			t.Fatalf("Expected the nodes %v in %s, got %+v", ids, ns, services)
+		}
+		for i, n := range services[0].Nodes {
+			if n.Id != ids[i] {
+				t.Fatalf("Expected the nodes %v in %s, got %s", ids, ns, n.Id)
+			}
+		}
+
+		list, err := r.ListServices(registry.ListNamespace(ns))
+		if err != nil || len(list) != 1 || list[0].Name != "foo" {
+			t.Fatalf("Expected foo listed in %s, got %+v %v", ns, list, err)
+		}
+	}
+
+	if _, err := r.GetService("foo", registry.GetNamespace("prod")); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v in prod, got %v", registry.ErrNotFound, err)
+	}
+	if list, err := r.ListServices(registry.ListNamespace("prod")); err != nil || len(list) != 0 {
+		t.Fatalf("Expected nothing listed in prod, got %+v %v", list, err)
+	}
+
+	// the watcher of staging only sees foo-2
+	res, err := w.Next()
+	if err != nil {
+		t.Fatalf("Unexpected watcher error %v", err)
+	}
+	if res.Action != registry.Create.String() || len(res.Service.Nodes) != 1 || res.Service.Nodes[0].Id != "foo-2" {
+		t.Fatalf("Expected foo-2 created in staging, got %s of %+v", res.Action, res.Service)
+	}
+}
+
+func TestConsulRegistryPassing(t *testing.T) {
+	f, addr := newFakeConsul(t)
+	r := NewRegistry(registry.Addrs(addr))
+
+	s1 := newService("foo-1", "10.0.0.1:8080")
+	s2 := newService("foo-2", "10.0.0.2:8080")
+
+	for _, s := range []*registry.Service{s1, s2} {
+		if err := r.Register(s, registry.RegisterTTL(30*time.Second)); err != nil {
+			t.Fatalf("Unexpected register error %v", err)
+		}
+	}
+
+	// the ttl of foo-1 expires
+	f.fail("foo-1")
+
+	services, err := r.GetService("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error getting service %v", err)
+	}
+	if len(services[0].Nodes) != 1 || services[0].Nodes[0].Id != "foo-2" {
+		t.Fatalf("Expected only foo-2 passing, got %+v", services[0].Nodes)
+	}
+
+	// the heartbeat passes the check without registering again
+	if err := r.Register(s1, registry.RegisterTTL(30*time.Second)); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	services, err = r.GetService("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error getting service %v", err)
+	}
+	if len(services[0].Nodes) != 2 {
+		t.Fatalf("Expected 2 passing nodes, got %+v", services[0].Nodes)
+	}
+
+	f.Lock()
+	registrations := f.registrations["foo-1"]
+	f.Unlock()
+	if registrations != 1 {
+		t.Fatalf("Expected 1 registration of foo-1, got %d", registrations)
+	}
+
+	// the agent lost the node, the heartbeat registers it again
+	f.Lock()
+	delete(f.services, "foo-1")
+	delete(f.checks, "service:foo-1")
+	f.Unlock()
+
+	if err := r.Register(s1, registry.RegisterTTL(30*time.Second)); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	f.Lock()
+	registrations = f.registrations["foo-1"]
+	status := f.checks["service:foo-1"]
+	f.Unlock()
+	if registrations != 2 || status != "passing" {
+		t.Fatalf("Expected foo-1 registered again and passing, got %d registrations and %s", registrations, status)
+	}
+}
+
+func TestConsulRegistryWatch(t *testing.T) {
+	f, addr := newFakeConsul(t)
+	r := NewRegistry(registry.Addrs(addr), WaitTime(time.Second))
+
+	testData := []struct {
+		name string
+		opts []registry.WatchOption
+	}{
+		{"service", []registry.WatchOption{registry.WatchService("foo")}},
+		{"all", nil},
+	}
+
+	for _, d := range testData {
+		t.Run(d.name, func(t *testing.T) {
+			w, err := r.Watch(d.opts...)
+			if err != nil {
+				t.Fatalf("Unexpected watch error %v", err)
+			}
+			defer w.Stop()
+
+			next := func(action string, nodes int) {
+				res := make(chan *registry.Result, 1)
+				go func() {
+					if r, err := w.Next(); err == nil {
+						res <- r
+					}
+				}()
+
+				select {
+				case r := <-res:
+					if r.Action != action || r.Service.Name != "foo" || len(r.Service.Nodes) != nodes {
+						t.Fatalf("Expected %s of foo with %d nodes, got %s of %+v", action, nodes, r.Action, r.Service)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Timed out waiting for %s", action)
+				}
+			}
+
+			s1 := newService("foo-1", "10.0.0.1:8080")
+			s2 := newService("foo-2", "10.0.0.2:8080")
+
+			// a service without a check is passing straight away
+			if err := r.Register(s1); err != nil {
+				t.Fatalf("Unexpected register error %v", err)
+			}
+			next(registry.Create.String(), 1)
+
+			if err := r.Register(s2); err != nil {
+				t.Fatalf("Unexpected register error %v", err)
+			}
+			next(registry.Update.String(), 2)
+
+			if err := r.Deregister(s1); err != nil {
+				t.Fatalf("Unexpected deregister error %v", err)
+			}
+			next(registry.Update.String(), 1)
+
+			if err := r.Deregister(s2); err != nil {
+				t.Fatalf("Unexpected deregister error %v", err)
+			}
+			next(registry.Delete.String(), 1)
+
+			// nothing left behind for the next watcher
+			f.Lock()
+			n := len(f.services)
+			f.Unlock()
+			if n != 0 {
+				t.Fatalf("Expected no services, got %d", n)
+			}
+		})
+	}
+}
+
+func TestConsulRegistryWatchSnapshot(t *testing.T) {
+	_, addr := newFakeConsul(t)
+	r := NewRegistry(registry.Addrs(addr), WaitTime(time.Second))
+
+	s1 := newService("foo-1", "10.0.0.1:8080")
+	if err := r.Register(s1); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	defer r.Deregister(s1)
+
+	for _, opts := range [][]registry.WatchOption{
+		{registry.WatchService("foo"), registry.WatchSnapshot(true)},
+		{registry.WatchSnapshot(true)},
+	} {
+		w, err := r.Watch(opts...)
+		if err != nil {
+			t.Fatalf("Unexpected watch error %v", err)
+		}
+
+		res, err := w.Next()
+		w.Stop()
+		if err != nil {
+			t.Fatalf("Unexpected watcher error %v", err)
+		}
+		if res.Action != registry.Create.String() || res.Service.Name != "foo" || len(res.Service.Nodes) != 1 {
+			t.Fatalf("Expected the snapshot to create foo with 1 node, got %s of %+v", res.Action, res.Service)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package consul
+
+import (
+	"context"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+)
+
+type tokenKey struct{}
+type deregisterAfterKey struct{}
+type waitTimeKey struct{}
+
+// Token sets the ACL token sent with every request to the consul agent
+func Token(t string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, tokenKey{}, t)
+	}
+}
+
+// DeregisterCriticalServiceAfter sets how long consul keeps a node whose
+// ttl check expired before removing it
+func DeregisterCriticalServiceAfter(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, deregisterAfterKey{}, d)
+	}
+}
+
+// WaitTime sets how long the blocking queries of the watchers wait for a change
+func WaitTime(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, waitTimeKey{}, d)
+	}
+}
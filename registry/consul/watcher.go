@@ -0,0 +1,239 @@
+package consul
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/registry"
+)
+
+// retryWait is how long a watcher waits after a failed query
+var retryWait = time.Second
+
+// watcher runs a blocking query on the health of every watched service. Without
+// a service to watch, a blocking query on the catalog adds and removes them.
+type watcher struct {
+	wo       registry.WatchOptions
+	api      *api
+	waitTime time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	res    chan *registry.Result
+	exit   chan bool
+
+	sync.Mutex
+	// service name -> stops the watch of the service
+	services map[string]context.CancelFunc
+}
+
+func newWatcher(c *consulRegistry, opts ...registry.WatchOption) (*watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	c.RLock()
+	w := &watcher{
+		wo:       wo,
+		api:      c.api,
+		waitTime: c.waitTime,
+		res:      make(chan *registry.Result),
+		exit:     make(chan bool),
+		services: make(map[string]context.CancelFunc),
+	}
+	c.RUnlock()
+
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+
+	// changes are reported against the current services
+	if len(wo.Service) > 0 {
+		services, index, err := w.health(w.ctx, wo.Service, 0)
+		if err != nil {
+			w.cancel()
+			return nil, err
+		}
+		w.watch(wo.Service, services, next(0, index), wo.Snapshot)
+		return w, nil
+	}
+
+	names, index, err := w.api.services(w.ctx, 0, 0)
+	if err != nil {
+		w.cancel()
+		return nil, err
+	}
+	names = inNamespace(names, namespace(wo.Namespace))
+
+	for name := range names {
+		services, idx, err := w.health(w.ctx, name, 0)
+		if err != nil {
+			w.cancel()
+			return nil, err
+		}
+		w.watch(name, services, next(0, idx), wo.Snapshot)
+	}
+
+	go w.catalog(names, next(0, index))
+
+	return w, nil
+}
+
+// health returns the passing services of the name by version
+func (w *watcher) health(ctx context.Context, name string, index uint64) (map[string]*registry.Service, uint64, error) {
+	entries, idx, err := w.api.health(ctx, name, index, w.waitTime)
+	if err != nil {
+		return nil, 0, err
+	}
+	return toServices(name, namespace(w.wo.Namespace), entries), idx, nil
+}
+
+// watch starts watching the service from the given services, they are sent
+// first as created with the snapshot
+func (w *watcher) watch(name string, services map[string]*registry.Service, index uint64, snapshot bool) {
+	ctx, cancel := context.WithCancel(w.ctx)
+
+	w.Lock()
+	w.services[name] = cancel
+	w.Unlock()
+
+	go w.service(ctx, name, services, index, snapshot)
+}
+
+// catalog starts the watch of the services added to the catalog and
+// stops the watch of the services removed from it
+func (w *watcher) catalog(names map[string][]string, index uint64) {
+	for {
+		current, idx, err := w.api.services(w.ctx, index, w.waitTime)
+		if err != nil {
+			if w.ctx.Err() != nil {
+				return
+			}
+			log.Warnf("[consul] registry watcher could not query the catalog: %v", err)
+			if !w.sleep(w.ctx) {
+				return
+			}
+			continue
+		}
+
+		index = next(index, idx)
+		current = inNamespace(current, namespace(w.wo.Namespace))
+
+		for name := range current {
+			if _, ok := names[name]; !ok {
+				w.watch(name, nil, 0, false)
+			}
+		}
+
+		for name := range names {
+			if _, ok := current[name]; ok {
+				continue
+			}
+			w.Lock()
+			if cancel, ok := w.services[name]; ok {
+				cancel()
+				delete(w.services, name)
+			}
+			w.Unlock()
+		}
+
+		names = current
+	}
+}
+
+// service reports the changes of the service until the watch stops. A service
+// removed from the catalog is reported deleted.
+func (w *watcher) service(ctx context.Context, name string, services map[string]*registry.Service, index uint64, snapshot bool) {
+	if snapshot && !w.send(registry.Diff(nil, services)) {
+		return
+	}
+
+	for {
+		current, idx, err := w.health(ctx, name, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Warnf("[consul] registry watcher could not query %s: %v", name, err)
+			if !w.sleep(ctx) {
+				break
+			}
+			continue
+		}
+
+		index = next(index, idx)
+
+		if !w.send(registry.Diff(services, current)) {
+			return
+		}
+
+		services = current
+	}
+
+	// the whole watcher stopped
+	if w.ctx.Err() != nil {
+		return
+	}
+
+	w.send(registry.Diff(services, nil))
+}
+
+func (w *watcher) send(results []*registry.Result) bool {
+	for _, r := range results {
+		select {
+		case w.res <- r:
+		case <-w.exit:
+			return false
+		}
+	}
+	return true
+}
+
+func (w *watcher) sleep(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(retryWait):
+		return true
+	}
+}
+
+// next returns the index of the next blocking query. The index is reset when
+// it goes backwards and never zero, which wouldn't block.
+func next(index, idx uint64) uint64 {
+	if idx < index {
+		return 0
+	}
+	if idx == 0 {
+		return 1
+	}
+	return idx
+}
+
+func (w *watcher) Next() (*registry.Result, error) {
+	for {
+		select {
+		case r := <-w.res:
+			if r = w.wo.Filter(r); r == nil {
+				continue
+			}
+			return r, nil
+		case <-w.exit:
+			return nil, registry.ErrWatcherStopped
+		}
+	}
+}
+
+func (w *watcher) Stop() {
+	w.Lock()
+	defer w.Unlock()
+
+	select {
+	case <-w.exit:
+		return
+	default:
+		close(w.exit)
+		w.cancel()
+	}
+}
@@ -0,0 +1,434 @@
+// Package file provides a registry which stores the services in a json file
+// shared by the processes of a host
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/registry"
+)
+
+var (
+	// DefaultPath is the file used without the Path option
+	DefaultPath = filepath.Join(os.TempDir(), "mini", "registry.json")
+	// DefaultPollInterval is how often the watchers read the file
+	DefaultPollInterval = time.Second
+)
+
+type node struct {
+	Id       string            `json:"id"`
+	Address  string            `json:"address"`
+	Metadata map[string]string `json:"metadata"`
+	// Expires is zero for nodes without a ttl
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+type record struct {
+	Name      string               `json:"name"`
+	Version   string               `json:"version"`
+	Metadata  map[string]string    `json:"metadata"`
+	Endpoints []*registry.Endpoint `json:"endpoints"`
+	Nodes     map[string]*node     `json:"nodes"`
+}
+
+// records are the services of a namespace, name -> version -> record
+type records map[string]map[string]*record
+
+// namespaces are the content of the file, namespace -> records
+type namespaces map[string]records
+
+type fileRegistry struct {
+	options registry.Options
+
+	sync.RWMutex
+	path     string
+	interval time.Duration
+}
+
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	r := &fileRegistry{
+		options: registry.Options{
+			Context: context.Background(),
+		},
+		path:     DefaultPath,
+		interval: DefaultPollInterval,
+	}
+	r.configure(opts...)
+	return r
+}
+
+func (f *fileRegistry) configure(opts ...registry.Option) {
+	f.Lock()
+	defer f.Unlock()
+
+	for _, o := range opts {
+		o(&f.options)
+	}
+
+	if f.options.Context == nil {
+		return
+	}
+	if p, ok := f.options.Context.Value(pathKey{}).(string); ok && len(p) > 0 {
+		f.path = p
+	}
+	if d, ok := f.options.Context.Value(pollIntervalKey{}).(time.Duration); ok && d > 0 {
+		f.interval = d
+	}
+}
+
+func (f *fileRegistry) Init(opts ...registry.Option) error {
+	f.configure(opts...)
+	return nil
+}
+
+func (f *fileRegistry) Options() registry.Options {
+	return f.options
+}
+
+func (f *fileRegistry) getPath() string {
+	f.RLock()
+	defer f.RUnlock()
+	return f.path
+}
+
+// namespace returns the namespace of the options, the default one when blank
+func namespace(ns string) string {
+	if len(ns) == 0 {
+		return registry.DefaultNamespace
+	}
+	return ns
+}
+
+// read returns the namespaces of the file without the expired nodes
+func (f *fileRegistry) read() (namespaces, error) {
+	b, err := os.ReadFile(f.getPath())
+	if os.IsNotExist(err) {
+		return make(namespaces), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nss := make(namespaces)
+	if len(b) == 0 {
+		return nss, nil
+	}
+	if err := json.Unmarshal(b, &nss); err != nil {
+		return nil, fmt.Errorf("could not read registry file %s: %v", f.getPath(), err)
+	}
+
+	now := time.Now()
+	for ns, recs := range nss {
+		recs.prune(now)
+		if len(recs) == 0 {
+			delete(nss, ns)
+		}
+	}
+
+	return nss, nil
+}
+
+// write replaces the file atomically so readers never see a partial write
+func (f *fileRegistry) write(nss namespaces) error {
+	path := f.getPath()
+
+	b, err := json.MarshalIndent(nss, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// update modifies the records of the namespace while holding the lock of
+// the file so the processes sharing the file don't overwrite each other
+func (f *fileRegistry) update(ns string, fn func(records) bool) error {
+	path := f.getPath()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// the data file is replaced on every write, lock a file next to it
+	lf, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	if err := lock(lf); err != nil {
+		return err
+	}
+	defer unlock(lf)
+
+	nss, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	recs, ok := nss[ns]
+	if !ok {
+		recs = make(records)
+		nss[ns] = recs
+	}
+
+	if !fn(recs) {
+		return nil
+	}
+
+	if len(recs) == 0 {
+		delete(nss, ns)
+	}
+
+	return f.write(nss)
+}
+
+func (f *fileRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	var options registry.RegisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	var expires time.Time
+	if options.TTL > 0 {
+		expires = time.Now().Add(options.TTL)
+	}
+
+	ns := namespace(options.Namespace)
+
+	return f.update(ns, func(recs records) bool {
+		versions, ok := recs[s.Name]
+		if !ok {
+			versions = make(map[string]*record)
+			recs[s.Name] = versions
+		}
+
+		r, ok := versions[s.Version]
+		if !ok {
+			log.Debugf("[file] registry added new service: %s, version: %s available in %s", s.Name, s.Version, ns)
+			r = &record{
+				Name:    s.Name,
+				Version: s.Version,
+				Nodes:   make(map[string]*node),
+			}
+			versions[s.Version] = r
+		}
+
+		r.Metadata = copyMetadata(s.Metadata)
+		r.Endpoints = s.Endpoints
+
+		for _, n := range s.Nodes {
+			r.Nodes[n.Id] = &node{
+				Id:       n.Id,
+				Address:  n.Address,
+				Metadata: copyMetadata(n.Metadata),
+				Expires:  expires,
+			}
+		}
+
+		return true
+	})
+}
+
+func (f *fileRegistry) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
+	var options registry.DeregisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	return f.update(namespace(options.Namespace), func(recs records) bool {
+		r, ok := recs[s.Name][s.Version]
+		if !ok {
+			return false
+		}
+
+		for _, n := range s.Nodes {
+			log.Debugf("[file] registry removed node %s from service: %s, version: %s", n.Id, s.Name, s.Version)
+			delete(r.Nodes, n.Id)
+		}
+
+		if len(r.Nodes) == 0 {
+			delete(recs[s.Name], s.Version)
+		}
+		if len(recs[s.Name]) == 0 {
+			delete(recs, s.Name)
+		}
+
+		return true
+	})
+}
+
+func (f *fileRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	var options registry.GetOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	nss, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+
+	versions, ok := nss[namespace(options.Namespace)][name]
+	if !ok || len(versions) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	services := make([]*registry.Service, 0, len(versions))
+	for _, r := range versions {
+		services = append(services, r.service())
+	}
+
+	return services, nil
+}
+
+func (f *fileRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	var options registry.ListOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	nss, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var services []*registry.Service
+	for _, versions := range nss[namespace(options.Namespace)] {
+		for _, r := range versions {
+			services = append(services, r.service())
+		}
+	}
+
+	return services, nil
+}
+
+func (f *fileRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	// changes are reported against the current content
+	nss, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+
+	f.RLock()
+	interval := f.interval
+	f.RUnlock()
+
+	w := &watcher{
+		id:       uuid.New().String(),
+		wo:       wo,
+		registry: f,
+		interval: interval,
+		services: nss[namespace(wo.Namespace)].services(wo.Service),
+		res:      make(chan *registry.Result),
+		exit:     make(chan bool),
+	}
+
+	if wo.Snapshot {
+		w.snapshot = registry.Diff(nil, w.services)
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+func (f *fileRegistry) String() string {
+	return "file"
+}
+
+// prune removes the expired nodes and the versions left without nodes
+func (recs records) prune(now time.Time) {
+	for name, versions := range recs {
+		for version, r := range versions {
+			for id, n := range r.Nodes {
+				if !n.Expires.IsZero() && now.After(n.Expires) {
+					delete(r.Nodes, id)
+				}
+			}
+			if len(r.Nodes) == 0 {
+				delete(versions, version)
+			}
+		}
+		if len(versions) == 0 {
+			delete(recs, name)
+		}
+	}
+}
+
+// services returns the services by name and version, only the named service if set
+func (recs records) services(name string) map[string]*registry.Service {
+	services := make(map[string]*registry.Service)
+
+	for n, versions := range recs {
+		if len(name) > 0 && n != name {
+			continue
+		}
+		for version, r := range versions {
+			services[n+"/"+version] = r.service()
+		}
+	}
+
+	return services
+}
+
+func (r *record) service() *registry.Service {
+	nodes := make([]*registry.Node, 0, len(r.Nodes))
+	for _, n := range r.Nodes {
+		nodes = append(nodes, &registry.Node{
+			Id:       n.Id,
+			Address:  n.Address,
+			Metadata: copyMetadata(n.Metadata),
+		})
+	}
+
+	// keep the order stable so the watchers can compare services
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Id < nodes[j].Id
+	})
+
+	return &registry.Service{
+		Name:      r.Name,
+		Version:   r.Version,
+		Metadata:  copyMetadata(r.Metadata),
+		Endpoints: r.Endpoints,
+		Nodes:     nodes,
+	}
+}
+
+func copyMetadata(md map[string]string) map[string]string {
+	metadata := make(map[string]string, len(md))
+	for k, v := range md {
+		metadata[k] = v
+	}
+	return metadata
+}
@@ -0,0 +1,262 @@
+package file
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+)
+
+func newService(id, address string) *registry.Service {
+	return &registry.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{Id: id, Address: address, Metadata: map[string]string{"foo": "bar"}},
+		},
+	}
+}
+
+func TestFileRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+
+	// two registries share the file like two processes would
+	r1 := NewRegistry(Path(path))
+	r2 := NewRegistry(Path(path))
+
+	if _, err := r1.GetService("foo"); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+
+	s1 := newService("foo-1", "10.0.0.1:8080")
+	s2 := newService("foo-2", "10.0.0.2:8080")
+
+	if err := r1.Register(s1); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	if err := r2.Register(s2); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	for _, r := range []registry.Registry{r1, r2} {
+		services, err := r.GetService("foo")
+		if err != nil {
+			t.Fatalf("Unexpected error getting service %v", err)
+		}
+		if len(services) != 1 || len(services[0].Nodes) != 2 {
+			t.Fatalf("Expected 1 service with 2 nodes, got %+v", services)
+		}
+		if services[0].Nodes[0].Metadata["foo"] != "bar" {
+			t.Fatalf("Expected node metadata, got %+v", services[0].Nodes[0].Metadata)
+		}
+	}
+
+	if err := r2.Deregister(s1); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+
+	services, err := r1.ListServices()
+	if err != nil {
+		t.Fatalf("Unexpected error listing services %v", err)
+	}
+	if len(services) != 1 || len(services[0].Nodes) != 1 || services[0].Nodes[0].Id != "foo-2" {
+		t.Fatalf("Expected only foo-2, got %+v", services)
+	}
+
+	if err := r1.Deregister(s2); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+	if _, err := r1.GetService("foo"); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+}
+
+func TestFileRegistryTTL(t *testing.T) {
+	r := NewRegistry(Path(filepath.Join(t.TempDir(), "registry.json")))
+
+	if err := r.Register(newService("foo-1", "10.0.0.1:8080"), registry.RegisterTTL(50*time.Millisecond)); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	if err := r.Register(newService("foo-2", "10.0.0.2:8080")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	services, err := r.GetService("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error getting service %v", err)
+	}
+	if len(services[0].Nodes) != 1 || services[0].Nodes[0].Id != "foo-2" {
+		t.Fatalf("Expected the expired node to be gone, got %+v", services[0].Nodes)
+	}
+}
+
+func TestFileRegistryWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+
+	r := NewRegistry(Path(path), PollInterval(10*time.Millisecond))
+	// the changes come from another process
+	other := NewRegistry(Path(path))
+
+	w, err := r.Watch(registry.WatchService("foo"))
+	if err != nil {
+		t.Fatalf("Unexpected watch error %v", err)
+	}
+	defer w.Stop()
+
+	next := func(action string) *registry.Service {
+		res, err := w.Next()
+		if err != nil {
+			t.Fatalf("Unexpected watcher error %v", err)
+		}
+		if res.Action != action {
+			t.Fatalf("Expected %s, got %s", action, res.Action)
+		}
+		return res.Service
+	}
+
+	s1 := newService("foo-1", "10.0.0.1:8080")
+	if err := other.Register(s1); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	if s := next("create"); len(s.Nodes) != 1 {
+		t.Fatalf("Expected 1 node, got %d", len(s.Nodes))
+	}
+
+	// other services are not watched
+	if err := other.Register(&registry.Service{Name: "bar", Nodes: []*registry.Node{{Id: "bar-1"}}}); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	if err := other.Register(newService("foo-2", "10.0.0.2:8080")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	if s := next("update"); len(s.Nodes) != 2 {
+		t.Fatalf("Expected 2 nodes, got %d", len(s.Nodes))
+	}
+
+	if err := other.Deregister(s1); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+	if s := next("update"); len(s.Nodes) != 1 {
+		t.Fatalf("Expected 1 node, got %d", len(s.Nodes))
+	}
+
+	if err := other.Deregister(newService("foo-2", "10.0.0.2:8080")); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+	next("delete")
+
+	w.Stop()
+	if _, err := w.Next(); err != registry.ErrWatcherStopped {
+		t.Fatalf("Expected %v, got %v", registry.ErrWatcherStopped, err)
+	}
+}
+
+func TestFileRegistryWatchSnapshot(t *testing.T) {
+	r := NewRegistry(Path(filepath.Join(t.TempDir(), "registry.json")), PollInterval(10*time.Millisecond))
+
+	if err := r.Register(newService("foo-1", "10.0.0.1:8080")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	w, err := r.Watch(registry.WatchService("foo"), registry.WatchSnapshot(true))
+	if err != nil {
+		t.Fatalf("Unexpected watch error %v", err)
+	}
+	defer w.Stop()
+
+	res, err := w.Next()
+	if err != nil {
+		t.Fatalf("Unexpected watcher error %v", err)
+	}
+	if res.Action != registry.Create.String() || len(res.Service.Nodes) != 1 {
+		t.Fatalf("Expected the snapshot to create foo with 1 node, got %s of %+v", res.Action, res.Service)
+	}
+}
+
+func TestFileRegistryConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	count := 20
+
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			r := NewRegistry(Path(path))
+			errs <- r.Register(newService(fmt.Sprintf("foo-%d", i), fmt.Sprintf("10.0.0.%d:8080", i)))
+		}(i)
+	}
+
+	for i := 0; i < count; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Unexpected register error %v", err)
+		}
+	}
+
+	services, err := NewRegistry(Path(path)).GetService("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error getting service %v", err)
+	}
+	if len(services[0].Nodes) != count {
+		t.Fatalf("Expected %d nodes, got %d", count, len(services[0].Nodes))
+	}
+}
+
+func TestFileRegistryNamespace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	r := NewRegistry(Path(path), PollInterval(10*time.Millisecond))
+
+	w, err := r.Watch(registry.WatchNamespace("dev"))
+	if err != nil {
+		t.Fatalf("Unexpected watch error %v", err)
+	}
+	defer w.Stop()
+
+	// a blank namespace is the default one
+	if err := r.Register(newService("foo-1", "10.0.0.1:8080")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	if err := r.Register(newService("foo-2", "10.0.0.2:8080"), registry.RegisterNamespace("dev")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	for ns, id := range map[string]string{registry.DefaultNamespace: "foo-1", "dev": "foo-2"} {
+		services, err := r.GetService("foo", registry.GetNamespace(ns))
+		if err != nil {
+			t.Fatalf("Unexpected error getting service in %s %v", ns, err)
+		}
+		if len(services) != 1 || len(services[0].Nodes) != 1 || services[0].Nodes[0].Id != id {
+			t.Fatalf("Expected only %s in %s, got %+v", id, ns, services)
+		}
+
+		list, err := r.ListServices(registry.ListNamespace(ns))
+		if err != nil {
+			t.Fatalf("Unexpected error listing services in %s %v", ns, err)
+		}
+		if len(list) != 1 {
+			t.Fatalf("Expected 1 service in %s, got %d", ns, len(list))
+		}
+	}
+
+	// the watcher only sees its namespace
+	res, err := w.Next()
+	if err != nil {
+		t.Fatalf("Unexpected watch error %v", err)
+	}
+	if res.Action != registry.Create.String() || res.Service.Nodes[0].Id != "foo-2" {
+		t.Fatalf("Expected the creation of foo-2, got %s of %+v", res.Action, res.Service.Nodes)
+	}
+
+	if err := r.Deregister(newService("foo-2", "10.0.0.2:8080"), registry.DeregisterNamespace("dev")); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+	if _, err := r.GetService("foo", registry.GetNamespace("dev")); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+	if _, err := r.GetService("foo"); err != nil {
+		t.Fatalf("Expected the default namespace to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package file
+
+import (
+	"os"
+)
+
+// lock is a no-op where advisory locks aren't available, the writes
+// are still atomic but concurrent registrations may overwrite each other
+func lock(f *os.File) error {
+	return nil
+}
+
+func unlock(f *os.File) error {
+	return nil
+}
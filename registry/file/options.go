@@ -0,0 +1,31 @@
+package file
+
+import (
+	"context"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+)
+
+type pathKey struct{}
+type pollIntervalKey struct{}
+
+// Path sets the file the services are stored in
+func Path(p string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, pathKey{}, p)
+	}
+}
+
+// PollInterval sets how often the watchers read the file for changes
+func PollInterval(d time.Duration) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, pollIntervalKey{}, d)
+	}
+}
@@ -0,0 +1,88 @@
+package file
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/registry"
+)
+
+// watcher reads the file on every interval and reports the
+// services which were created, updated or deleted since
+type watcher struct {
+	id       string
+	wo       registry.WatchOptions
+	registry *fileRegistry
+	interval time.Duration
+	// name/version -> service
+	services map[string]*registry.Service
+	// the current services sent before the changes
+	snapshot []*registry.Result
+	res      chan *registry.Result
+	exit     chan bool
+}
+
+func (w *watcher) run() {
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+
+	if !w.send(w.snapshot) {
+		return
+	}
+
+	for {
+		select {
+		case <-w.exit:
+			return
+		case <-t.C:
+		}
+
+		nss, err := w.registry.read()
+		if err != nil {
+			log.Warnf("[file] registry watcher could not read the file: %v", err)
+			continue
+		}
+
+		services := nss[namespace(w.wo.Namespace)].services(w.wo.Service)
+
+		if !w.send(registry.Diff(w.services, services)) {
+			return
+		}
+
+		w.services = services
+	}
+}
+
+func (w *watcher) send(results []*registry.Result) bool {
+	for _, r := range results {
+		select {
+		case w.res <- r:
+		case <-w.exit:
+			return false
+		}
+	}
+	return true
+}
+
+func (w *watcher) Next() (*registry.Result, error) {
+	for {
+		select {
+		case r := <-w.res:
+			if r = w.wo.Filter(r); r == nil {
+				continue
+			}
+			return r, nil
+		case <-w.exit:
+			return nil, registry.ErrWatcherStopped
+		}
+	}
+}
+
+func (w *watcher) Stop() {
+	select {
+	case <-w.exit:
+		return
+	default:
+		close(w.exit)
+	}
+}
@@ -0,0 +1,201 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+var (
+	// DefaultHistorySize is how many events a registry keeps by default
+	DefaultHistorySize = 1000
+)
+
+// Historian is implemented by the registries which keep their events
+type Historian interface {
+	// History returns the events since the time, of the service or of all
+	// services when blank, oldest first
+	History(since time.Time, service string) ([]*Event, error)
+}
+
+type historySizeKey struct{}
+
+type historyFileKey struct{}
+
+// HistorySize sets how many events the registry keeps, zero keeps none
+func HistorySize(n int) Option {
+	return func(o *Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, historySizeKey{}, n)
+	}
+}
+
+// HistoryFile appends every event of the registry to the file as a line of json
+func HistoryFile(path string) Option {
+	return func(o *Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, historyFileKey{}, path)
+	}
+}
+
+// History keeps the last events of a registry in a ring buffer. The events
+// are appended to the file in the background, off the locks of the registry.
+type History struct {
+	id string
+
+	sync.RWMutex
+	events []*Event
+	next   int
+	full   bool
+	file   *os.File
+	// recorded but not written to the file yet
+	pending []*Event
+	wake    chan struct{}
+	// closed once the pending events are written
+	written chan struct{}
+}
+
+// NewHistory returns the history of the registry with the id as configured
+// by the options. The history is kept in memory only when the file can't
+// be opened.
+func NewHistory(id string, opts Options) *History {
+	size := DefaultHistorySize
+	var path string
+
+	if opts.Context != nil {
+		if n, ok := opts.Context.Value(historySizeKey{}).(int); ok {
+			size = n
+		}
+		if p, ok := opts.Context.Value(historyFileKey{}).(string); ok {
+			path = p
+		}
+	}
+
+	if size < 0 {
+		size = 0
+	}
+
+	h := &History{
+		id:     id,
+		events: make([]*Event, size),
+	}
+
+	if len(path) > 0 {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logger.Errorf("[registry] could not open the history file %s: %v", path, err)
+		} else {
+			h.file = f
+			h.wake = make(chan struct{}, 1)
+			h.written = make(chan struct{})
+			go h.write(f)
+		}
+	}
+
+	return h
+}
+
+// Record adds the event of the service to the history
+func (h *History) Record(t EventType, s *Service) {
+	e := &Event{
+		Id:        h.id,
+		Type:      t,
+		Timestamp: time.Now(),
+		Service:   copyService(s),
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if len(h.events) > 0 {
+		h.events[h.next] = e
+		h.next = (h.next + 1) % len(h.events)
+		if h.next == 0 {
+			h.full = true
+		}
+	}
+
+	if h.file == nil {
+		return
+	}
+
+	h.pending = append(h.pending, e)
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// write appends the pending events to the file until the history is closed
+func (h *History) write(f *os.File) {
+	defer close(h.written)
+
+	for range h.wake {
+		h.Lock()
+		events := h.pending
+		h.pending = nil
+		h.Unlock()
+
+		for _, e := range events {
+			b, err := json.Marshal(e)
+			if err != nil {
+				logger.Errorf("[registry] could not encode the event of %s: %v", e.Service.Name, err)
+				continue
+			}
+			if _, err := f.Write(append(b, '\n')); err != nil {
+				logger.Errorf("[registry] could not write the event of %s to %s: %v", e.Service.Name, f.Name(), err)
+			}
+		}
+	}
+}
+
+// Events returns the kept events since the time, of the service or of all
+// services when blank, oldest first
+func (h *History) Events(since time.Time, service string) []*Event {
+	h.RLock()
+	defer h.RUnlock()
+
+	ordered := h.events[:h.next]
+	if h.full {
+		ordered = append(h.events[h.next:len(h.events):len(h.events)], h.events[:h.next]...)
+	}
+
+	var events []*Event
+	for _, e := range ordered {
+		if e.Timestamp.Before(since) {
+			continue
+		}
+		if len(service) > 0 && e.Service.Name != service {
+			continue
+		}
+		events = append(events, e)
+	}
+
+	return events
+}
+
+// Close writes the pending events and closes the history file
+func (h *History) Close() error {
+	h.Lock()
+	f := h.file
+	h.file = nil
+	if f != nil {
+		close(h.wake)
+	}
+	h.Unlock()
+
+	if f == nil {
+		return nil
+	}
+
+	<-h.written
+	return f.Close()
+}
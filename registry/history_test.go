@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	var opts Options
+	HistoryFile(path)(&opts)
+
+	h := NewHistory("test", opts)
+	defer h.Close()
+
+	service := func(name, id string) *Service {
+		return &Service{Name: name, Version: "1.0.0", Nodes: []*Node{{Id: id, Address: "10.0.0.1:8080"}}}
+	}
+
+	h.Record(Create, service("foo", "foo-1"))
+	h.Record(Create, service("bar", "bar-1"))
+
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+
+	h.Record(Delete, service("foo", "foo-1"))
+
+	if events := h.Events(time.Time{}, ""); len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+
+	events := h.Events(since, "foo")
+	if len(events) != 1 || events[0].Type != Delete || events[0].Id != "test" {
+		t.Fatalf("Expected the delete of foo-1, got %+v", events)
+	}
+
+	// the file is written in the background until closed
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines []*Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e *Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Unexpected decode error %v", err)
+		}
+		lines = append(lines, e)
+	}
+	if len(lines) != 3 || lines[2].Type != Delete || lines[2].Service.Nodes[0].Id != "foo-1" {
+		t.Fatalf("Expected 3 events in the file ending with the delete of foo-1, got %+v", lines)
+	}
+}
+
+func TestHistoryRing(t *testing.T) {
+	var opts Options
+	HistorySize(2)(&opts)
+	h := NewHistory("test", opts)
+
+	for _, id := range []string{"foo-1", "foo-2", "foo-3"} {
+		h.Record(Create, &Service{Name: "foo", Nodes: []*Node{{Id: id}}})
+	}
+
+	events := h.Events(time.Time{}, "")
+	if len(events) != 2 || events[0].Service.Nodes[0].Id != "foo-2" || events[1].Service.Nodes[0].Id != "foo-3" {
+		t.Fatalf("Expected the last 2 events oldest first, got %+v", events)
+	}
+}
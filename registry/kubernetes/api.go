@@ -0,0 +1,250 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// errNotFound is returned for the 404 responses of the api server
+	errNotFound = errors.New("not found")
+	// errGone is returned when the resource version of a watch is too old
+	errGone = errors.New("resource version gone")
+)
+
+type objectMeta struct {
+	Name            string            `json:"name,omitempty"`
+	Namespace       string            `json:"namespace,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+}
+
+type listMeta struct {
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type objectReference struct {
+	Kind      string `json:"kind,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type endpointConditions struct {
+	Ready       *bool `json:"ready,omitempty"`
+	Serving     *bool `json:"serving,omitempty"`
+	Terminating *bool `json:"terminating,omitempty"`
+}
+
+type endpoint struct {
+	Addresses  []string           `json:"addresses"`
+	Conditions endpointConditions `json:"conditions"`
+	TargetRef  *objectReference   `json:"targetRef,omitempty"`
+	NodeName   string             `json:"nodeName,omitempty"`
+	Zone       string             `json:"zone,omitempty"`
+}
+
+type endpointPort struct {
+	Name     string `json:"name,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// endpointSlice is a discovery.k8s.io/v1 EndpointSlice
+type endpointSlice struct {
+	Metadata    objectMeta     `json:"metadata"`
+	AddressType string         `json:"addressType"`
+	Endpoints   []endpoint     `json:"endpoints"`
+	Ports       []endpointPort `json:"ports"`
+}
+
+type endpointSliceList struct {
+	Metadata listMeta        `json:"metadata"`
+	Items    []endpointSlice `json:"items"`
+}
+
+type pod struct {
+	Metadata objectMeta `json:"metadata"`
+}
+
+type podList struct {
+	Metadata listMeta `json:"metadata"`
+	Items    []pod    `json:"items"`
+}
+
+type serviceSpec struct {
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+// service is a v1 Service, the selector finds its pods
+type service struct {
+	Metadata objectMeta  `json:"metadata"`
+	Spec     serviceSpec `json:"spec"`
+}
+
+// watchEvent is a line of a watch stream
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// status is the object of the ERROR watch events
+type status struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// api calls the kubernetes api server
+type api struct {
+	client  *http.Client
+	host    string
+	token   string
+	timeout time.Duration
+}
+
+func (a *api) request(ctx context.Context, method, path string, query url.Values, contentType string, in interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	u := strings.TrimSuffix(a.host, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if len(a.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	rsp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch rsp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return rsp, nil
+	case http.StatusNotFound:
+		rsp.Body.Close()
+		return nil, errNotFound
+	case http.StatusGone:
+		rsp.Body.Close()
+		return nil, errGone
+	}
+
+	defer rsp.Body.Close()
+	b, _ := io.ReadAll(rsp.Body)
+	return nil, fmt.Errorf("kubernetes %s %s: %s: %s", method, path, rsp.Status, bytes.TrimSpace(b))
+}
+
+// call sends the request and decodes the response into out
+func (a *api) call(method, path string, query url.Values, contentType string, in, out interface{}) error {
+	ctx := context.Background()
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+
+	rsp, err := a.request(ctx, method, path, query, contentType, in)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if out == nil {
+		io.Copy(io.Discard, rsp.Body)
+		return nil
+	}
+
+	return json.NewDecoder(rsp.Body).Decode(out)
+}
+
+func slicesPath(namespace string) string {
+	return "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(namespace) + "/endpointslices"
+}
+
+func podsPath(namespace string) string {
+	return "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods"
+}
+
+func podPath(namespace, name string) string {
+	return podsPath(namespace) + "/" + url.PathEscape(name)
+}
+
+func servicePath(namespace, name string) string {
+	return "/api/v1/namespaces/" + url.PathEscape(namespace) + "/services/" + url.PathEscape(name)
+}
+
+func (a *api) listSlices(namespace, selector string) (*endpointSliceList, error) {
+	list := new(endpointSliceList)
+	err := a.call(http.MethodGet, slicesPath(namespace), url.Values{"labelSelector": {selector}}, "", nil, list)
+	return list, err
+}
+
+// watchSlices streams the changes of the slices after the resource version
+func (a *api) watchSlices(ctx context.Context, namespace, selector, resourceVersion string) (io.ReadCloser, error) {
+	query := url.Values{
+		"labelSelector":       {selector},
+		"watch":               {"true"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+	}
+
+	rsp, err := a.request(ctx, http.MethodGet, slicesPath(namespace), query, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp.Body, nil
+}
+
+func (a *api) getPod(namespace, name string) (*pod, error) {
+	p := new(pod)
+	err := a.call(http.MethodGet, podPath(namespace, name), nil, "", nil, p)
+	return p, err
+}
+
+func (a *api) listPods(namespace, selector string) (*podList, error) {
+	list := new(podList)
+	err := a.call(http.MethodGet, podsPath(namespace), url.Values{"labelSelector": {selector}}, "", nil, list)
+	return list, err
+}
+
+func (a *api) getService(namespace, name string) (*service, error) {
+	s := new(service)
+	err := a.call(http.MethodGet, servicePath(namespace, name), nil, "", nil, s)
+	return s, err
+}
+
+// annotatePod merges the annotations into the pod, nil values remove them
+func (a *api) annotatePod(namespace, name string, annotations map[string]*string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	}
+	return a.call(http.MethodPatch, podPath(namespace, name), nil, "application/merge-patch+json", patch, nil)
+}
@@ -0,0 +1,527 @@
+// Package kubernetes provides a registry which finds the services in the
+// EndpointSlices of the kubernetes api server. Only the services labelled
+// mini/service=true are found, the name of the kubernetes service is the
+// name of the mini service. Register publishes the details the api server
+// doesn't know about, such as the version and endpoints, in an annotation
+// of the pod the service runs in. The registry namespace is kept in the
+// annotation too, the pods without it are in the default namespace.
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/registry"
+)
+
+const (
+	// ServiceLabel marks the kubernetes services which are mini services
+	ServiceLabel = "mini/service"
+	// AnnotationPrefix is the prefix of the pod annotation with the service details
+	AnnotationPrefix = "mini/service-"
+
+	serviceNameLabel = "kubernetes.io/service-name"
+)
+
+var (
+	// DefaultAddress is the api server used outside of a cluster, kubectl proxy
+	DefaultAddress = "http://127.0.0.1:8001"
+	// DefaultTimeout of the requests to the api server
+	DefaultTimeout = 10 * time.Second
+	// DefaultPortName is the port the nodes are addressed with, the first port without it
+	DefaultPortName = "grpc"
+	// LabelSelector selects the EndpointSlices of the mini services
+	LabelSelector = ServiceLabel + "=true"
+
+	serviceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// annotation is the content of the service annotation of a pod
+type annotation struct {
+	Version   string               `json:"version"`
+	Namespace string               `json:"namespace,omitempty"`
+	Metadata  map[string]string    `json:"metadata,omitempty"`
+	Endpoints []*registry.Endpoint `json:"endpoints,omitempty"`
+	// NodeMetadata holds the metadata of the nodes by the port of their address
+	NodeMetadata map[string]map[string]string `json:"node_metadata,omitempty"`
+}
+
+// nodeMetadata returns the metadata of the node at the port, the only node
+// of the pod is at any port
+func (a annotation) nodeMetadata(port int) map[string]string {
+	if md, ok := a.NodeMetadata[strconv.Itoa(port)]; ok {
+		return md
+	}
+	if len(a.NodeMetadata) == 1 {
+		for _, md := range a.NodeMetadata {
+			return md
+		}
+	}
+	return nil
+}
+
+// registryNamespace returns the registry namespace of the options, the
+// default one when empty
+func registryNamespace(ns string) string {
+	if len(ns) == 0 {
+		return registry.DefaultNamespace
+	}
+	return ns
+}
+
+type k8sRegistry struct {
+	opts registry.Options
+
+	sync.RWMutex
+	api       *api
+	namespace string
+	pod       string
+	// service name -> annotation published by Register
+	registered map[string]string
+}
+
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	k := &k8sRegistry{
+		opts: registry.Options{
+			Context: context.Background(),
+			Timeout: DefaultTimeout,
+		},
+		registered: make(map[string]string),
+	}
+	k.configure(opts...)
+	return k
+}
+
+// configure uses the service account of the pod unless the options say otherwise
+func (k *k8sRegistry) configure(opts ...registry.Option) {
+	k.Lock()
+	defer k.Unlock()
+
+	for _, o := range opts {
+		o(&k.opts)
+	}
+
+	host := DefaultAddress
+	if h, p := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"); len(h) > 0 && len(p) > 0 {
+		host = "https://" + net.JoinHostPort(h, p)
+	}
+	if len(k.opts.Addrs) > 0 {
+		host = k.opts.Addrs[0]
+		if !strings.Contains(host, "://") {
+			if k.opts.Secure || k.opts.TLSConfig != nil {
+				host = "https://" + host
+			} else {
+				host = "http://" + host
+			}
+		}
+	}
+
+	config := k.opts.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+		if ca, err := os.ReadFile(filepath.Join(serviceAccountPath, "ca.crt")); err == nil {
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(ca)
+			config.RootCAs = pool
+		}
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = config
+
+	var token string
+	if b, err := os.ReadFile(filepath.Join(serviceAccountPath, "token")); err == nil {
+		token = strings.TrimSpace(string(b))
+	}
+
+	k.namespace = "default"
+	if b, err := os.ReadFile(filepath.Join(serviceAccountPath, "namespace")); err == nil && len(b) > 0 {
+		k.namespace = strings.TrimSpace(string(b))
+	}
+
+	// the hostname of a pod is its name
+	k.pod = os.Getenv("POD_NAME")
+	if len(k.pod) == 0 {
+		k.pod, _ = os.Hostname()
+	}
+
+	if k.opts.Context != nil {
+		if t, ok := k.opts.Context.Value(tokenKey{}).(string); ok && len(t) > 0 {
+			token = t
+		}
+		if ns, ok := k.opts.Context.Value(namespaceKey{}).(string); ok && len(ns) > 0 {
+			k.namespace = ns
+		}
+		if p, ok := k.opts.Context.Value(podKey{}).(string); ok && len(p) > 0 {
+			k.pod = p
+		}
+	}
+
+	k.api = &api{
+		// no client timeout, the watches stream the changes
+		client:  &http.Client{Transport: tr},
+		host:    host,
+		token:   token,
+		timeout: k.opts.Timeout,
+	}
+}
+
+func (k *k8sRegistry) Init(opts ...registry.Option) error {
+	k.configure(opts...)
+	return nil
+}
+
+func (k *k8sRegistry) Options() registry.Options {
+	return k.opts
+}
+
+func (k *k8sRegistry) getAPI() (*api, string) {
+	k.RLock()
+	defer k.RUnlock()
+	return k.api, k.namespace
+}
+
+// Register publishes the service details in the annotation of the pod. The
+// api server knows the address of the pod, the nodes are found once the
+// pod is ready.
+func (k *k8sRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	var options registry.RegisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	a := annotation{
+		Version:      s.Version,
+		Namespace:    registryNamespace(options.Namespace),
+		Metadata:     s.Metadata,
+		Endpoints:    s.Endpoints,
+		NodeMetadata: make(map[string]map[string]string),
+	}
+	for _, n := range s.Nodes {
+		_, port, err := net.SplitHostPort(n.Address)
+		if err != nil {
+			port = ""
+		}
+		a.NodeMetadata[port] = n.Metadata
+	}
+
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	value := string(b)
+
+	k.RLock()
+	pod, published := k.pod, k.registered[s.Name]
+	k.RUnlock()
+
+	if len(pod) == 0 {
+		return fmt.Errorf("could not register %s, the pod name is unknown", s.Name)
+	}
+
+	// the heartbeat only patches the pod when the service changed
+	if published == value {
+		return nil
+	}
+
+	api, namespace := k.getAPI()
+
+	log.Debugf("[kubernetes] registry annotating pod %s with service %s", pod, s.Name)
+	if err := api.annotatePod(namespace, pod, map[string]*string{AnnotationPrefix + s.Name: &value}); err != nil {
+		return err
+	}
+
+	k.Lock()
+	k.registered[s.Name] = value
+	k.Unlock()
+
+	return nil
+}
+
+// Deregister removes the service annotation of the pod
+func (k *k8sRegistry) Deregister(s *registry.Service, opts ...registry.DeregisterOption) error {
+	k.Lock()
+	pod := k.pod
+	delete(k.registered, s.Name)
+	k.Unlock()
+
+	if len(pod) == 0 {
+		return nil
+	}
+
+	api, namespace := k.getAPI()
+
+	log.Debugf("[kubernetes] registry removing service %s from pod %s", s.Name, pod)
+	if err := api.annotatePod(namespace, pod, map[string]*string{AnnotationPrefix + s.Name: nil}); err != nil && err != errNotFound {
+		return err
+	}
+
+	return nil
+}
+
+func (k *k8sRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	var options registry.GetOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	api, namespace := k.getAPI()
+
+	list, err := api.listSlices(namespace, LabelSelector+","+serviceNameLabel+"="+name)
+	if err != nil {
+		return nil, err
+	}
+
+	services := toServices(name, registryNamespace(options.Namespace), list.Items, newPods(api, namespace, name))
+	if len(services) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	result := make([]*registry.Service, 0, len(services))
+	for _, s := range services {
+		result = append(result, s)
+	}
+
+	return result, nil
+}
+
+// ListServices returns the names of the mini services with nodes in the namespace
+func (k *k8sRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	var options registry.ListOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	api, namespace := k.getAPI()
+
+	list, err := api.listSlices(namespace, LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	// name -> slices
+	names := make(map[string][]endpointSlice)
+	for _, s := range list.Items {
+		if name := s.Metadata.Labels[serviceNameLabel]; len(name) > 0 {
+			names[name] = append(names[name], s)
+		}
+	}
+
+	ns := registryNamespace(options.Namespace)
+
+	services := make([]*registry.Service, 0, len(names))
+	for name, slices := range names {
+		if len(toServices(name, ns, slices, newPods(api, namespace, name))) == 0 {
+			continue
+		}
+		services = append(services, &registry.Service{Name: name})
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+
+	return services, nil
+}
+
+func (k *k8sRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	api, namespace := k.getAPI()
+	return newWatcher(api, namespace, opts...)
+}
+
+func (k *k8sRegistry) String() string {
+	return "kubernetes"
+}
+
+// pods gets the pods of the endpoints once. The pods the kubernetes service
+// selects are listed with a single request, the others are got one by one.
+type pods struct {
+	api       *api
+	namespace string
+	service   string
+	listed    bool
+	pods      map[string]*pod
+}
+
+func newPods(api *api, namespace, service string) *pods {
+	return &pods{
+		api:       api,
+		namespace: namespace,
+		service:   service,
+		pods:      make(map[string]*pod),
+	}
+}
+
+// list gets the pods selected by the kubernetes service
+func (p *pods) list() {
+	p.listed = true
+
+	svc, err := p.api.getService(p.namespace, p.service)
+	if err != nil {
+		if err != errNotFound {
+			log.Warnf("[kubernetes] registry could not get service %s: %v", p.service, err)
+		}
+		return
+	}
+
+	// the endpoints of a service without a selector are managed by hand
+	if len(svc.Spec.Selector) == 0 {
+		return
+	}
+
+	list, err := p.api.listPods(p.namespace, labelSelector(svc.Spec.Selector))
+	if err != nil {
+		log.Warnf("[kubernetes] registry could not list the pods of %s: %v", p.service, err)
+		return
+	}
+
+	for i := range list.Items {
+		p.pods[list.Items[i].Metadata.Name] = &list.Items[i]
+	}
+}
+
+func (p *pods) get(name string) *pod {
+	if !p.listed {
+		p.list()
+	}
+
+	if pd, ok := p.pods[name]; ok {
+		return pd
+	}
+
+	pd, err := p.api.getPod(p.namespace, name)
+	if err != nil {
+		// a terminating pod may be gone already
+		if err != errNotFound {
+			log.Warnf("[kubernetes] registry could not get pod %s: %v", name, err)
+		}
+		pd = nil
+	}
+
+	p.pods[name] = pd
+	return pd
+}
+
+// labelSelector returns the equality based selector of the labels
+func labelSelector(labels map[string]string) string {
+	reqs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		reqs = append(reqs, k+"="+v)
+	}
+	sort.Strings(reqs)
+	return strings.Join(reqs, ",")
+}
+
+// toServices returns the services of the ready endpoints of the namespace by
+// version. The nodes get the labels of their pods, the ports of the slice and
+// the node metadata published by Register.
+func toServices(name, ns string, slices []endpointSlice, pods *pods) map[string]*registry.Service {
+	services := make(map[string]*registry.Service)
+
+	for _, sl := range slices {
+		port := pickPort(sl.Ports)
+
+		for _, e := range sl.Endpoints {
+			// unknown readiness counts as ready
+			if len(e.Addresses) == 0 || (e.Conditions.Ready != nil && !*e.Conditions.Ready) {
+				continue
+			}
+
+			metadata := make(map[string]string)
+			var a annotation
+			id := e.Addresses[0]
+
+			if e.TargetRef != nil && e.TargetRef.Kind == "Pod" {
+				id = e.TargetRef.Name
+				if pd := pods.get(e.TargetRef.Name); pd != nil {
+					for k, v := range pd.Metadata.Labels {
+						metadata[k] = v
+					}
+					if v, ok := pd.Metadata.Annotations[AnnotationPrefix+name]; ok {
+						if err := json.Unmarshal([]byte(v), &a); err != nil {
+							log.Warnf("[kubernetes] registry could not read the annotation of %s on pod %s: %v", name, pd.Metadata.Name, err)
+						}
+					}
+				}
+			}
+
+			for _, p := range sl.Ports {
+				key := "port"
+				if len(p.Name) > 0 {
+					key += "." + p.Name
+				}
+				metadata[key] = strconv.Itoa(p.Port)
+			}
+			if len(e.NodeName) > 0 {
+				metadata["node"] = e.NodeName
+			}
+			if len(e.Zone) > 0 {
+				metadata["zone"] = e.Zone
+			}
+			if registryNamespace(a.Namespace) != ns {
+				continue
+			}
+			for k, v := range a.nodeMetadata(port) {
+				metadata[k] = v
+			}
+
+			// consumers only use the first address, the rest are the same endpoint
+			address := e.Addresses[0]
+			if port > 0 {
+				address = net.JoinHostPort(address, strconv.Itoa(port))
+			}
+
+			s, ok := services[a.Version]
+			if !ok {
+				s = &registry.Service{
+					Name:      name,
+					Version:   a.Version,
+					Metadata:  a.Metadata,
+					Endpoints: a.Endpoints,
+				}
+				services[a.Version] = s
+			}
+
+			s.Nodes = append(s.Nodes, &registry.Node{
+				Id:       id,
+				Address:  address,
+				Metadata: metadata,
+			})
+		}
+	}
+
+	// keep the order stable so the watchers can compare services
+	for _, s := range services {
+		sort.Slice(s.Nodes, func(i, j int) bool {
+			return s.Nodes[i].Id < s.Nodes[j].Id
+		})
+	}
+
+	return services
+}
+
+// pickPort returns the default port, the first port without it
+func pickPort(ports []endpointPort) int {
+	for _, p := range ports {
+		if p.Name == DefaultPortName {
+			return p.Port
+		}
+	}
+	if len(ports) > 0 {
+		return ports[0].Port
+	}
+	return 0
+}
@@ -0,0 +1,526 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+)
+
+// fakeAPIServer is the part of the kubernetes api the registry uses
+type fakeAPIServer struct {
+	sync.Mutex
+	version int
+	slices  map[string]endpointSlice
+	pods    map[string]*pod
+	// service name -> pod selector
+	services map[string]map[string]string
+	// number of the single pod gets
+	podGets int
+	// events of the open watches
+	watches map[chan watchEvent]string
+	// authorization header of the last request
+	auth string
+}
+
+func newFakeAPIServer(t *testing.T) (*fakeAPIServer, string) {
+	f := &fakeAPIServer{
+		slices:   make(map[string]endpointSlice),
+		pods:     make(map[string]*pod),
+		services: make(map[string]map[string]string),
+		watches:  make(map[chan watchEvent]string),
+	}
+
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+
+	return f, ts.URL
+}
+
+func (f *fakeAPIServer) addPod(name string, labels map[string]string) {
+	f.Lock()
+	defer f.Unlock()
+	f.pods[name] = &pod{Metadata: objectMeta{Name: name, Namespace: "mini", Labels: labels}}
+}
+
+func (f *fakeAPIServer) addService(name string, selector map[string]string) {
+	f.Lock()
+	defer f.Unlock()
+	f.services[name] = selector
+}
+
+// apply adds or modifies the slice and notifies the watches
+func (f *fakeAPIServer) apply(sl endpointSlice) {
+	f.Lock()
+	defer f.Unlock()
+
+	typ := "MODIFIED"
+	if _, ok := f.slices[sl.Metadata.Name]; !ok {
+		typ = "ADDED"
+	}
+
+	f.version++
+	sl.Metadata.Namespace = "mini"
+	sl.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.slices[sl.Metadata.Name] = sl
+	f.notify(typ, sl)
+}
+
+func (f *fakeAPIServer) remove(name string) {
+	f.Lock()
+	defer f.Unlock()
+
+	sl, ok := f.slices[name]
+	if !ok {
+		return
+	}
+
+	f.version++
+	sl.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	delete(f.slices, name)
+	f.notify("DELETED", sl)
+}
+
+// notify sends the event to the watches, it is called with the lock held
+func (f *fakeAPIServer) notify(typ string, sl endpointSlice) {
+	b, _ := json.Marshal(sl)
+	for ch, selector := range f.watches {
+		if matches(selector, sl.Metadata.Labels) {
+			ch <- watchEvent{Type: typ, Object: b}
+		}
+	}
+}
+
+// matches supports the equality based label selectors
+func matches(selector string, labels map[string]string) bool {
+	for _, req := range strings.Split(selector, ",") {
+		kv := strings.SplitN(req, "=", 2)
+		if len(kv) != 2 || labels[kv[0]] != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	f.auth = r.Header.Get("Authorization")
+	f.Unlock()
+
+	switch {
+	case r.URL.Path == "/apis/discovery.k8s.io/v1/namespaces/mini/endpointslices":
+		selector := r.URL.Query().Get("labelSelector")
+		if r.URL.Query().Get("watch") == "true" {
+			f.watch(w, r, selector)
+			return
+		}
+
+		f.Lock()
+		list := endpointSliceList{Metadata: listMeta{ResourceVersion: strconv.Itoa(f.version)}}
+		for _, sl := range f.slices {
+			if matches(selector, sl.Metadata.Labels) {
+				list.Items = append(list.Items, sl)
+			}
+		}
+		f.Unlock()
+
+		json.NewEncoder(w).Encode(list)
+	case strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/mini/services/"):
+		name := strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/mini/services/")
+
+		f.Lock()
+		selector, ok := f.services[name]
+		f.Unlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(service{
+			Metadata: objectMeta{Name: name, Namespace: "mini"},
+			Spec:     serviceSpec{Selector: selector},
+		})
+	case r.URL.Path == "/api/v1/namespaces/mini/pods":
+		selector := r.URL.Query().Get("labelSelector")
+
+		f.Lock()
+		var list podList
+		for _, p := range f.pods {
+			if matches(selector, p.Metadata.Labels) {
+				list.Items = append(list.Items, *p)
+			}
+		}
+		f.Unlock()
+
+		json.NewEncoder(w).Encode(list)
+	case strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/mini/pods/"):
+		name := strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/mini/pods/")
+
+		f.Lock()
+		defer f.Unlock()
+
+		p, ok := f.pods[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			f.podGets++
+		}
+
+		if r.Method == http.MethodPatch {
+			if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+				http.Error(w, "unsupported patch", http.StatusUnsupportedMediaType)
+				return
+			}
+			var patch struct {
+				Metadata struct {
+					Annotations map[string]*string `json:"annotations"`
+				} `json:"metadata"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if p.Metadata.Annotations == nil {
+				p.Metadata.Annotations = make(map[string]string)
+			}
+			for k, v := range patch.Metadata.Annotations {
+				if v == nil {
+					delete(p.Metadata.Annotations, k)
+				} else {
+					p.Metadata.Annotations[k] = *v
+				}
+			}
+		}
+
+		json.NewEncoder(w).Encode(p)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeAPIServer) watch(w http.ResponseWriter, r *http.Request, selector string) {
+	ch := make(chan watchEvent, 16)
+
+	f.Lock()
+	f.watches[ch] = selector
+	f.Unlock()
+
+	defer func() {
+		f.Lock()
+		delete(f.watches, ch)
+		f.Unlock()
+	}()
+
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-ch:
+			enc.Encode(e)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func newSlice(name string, ready bool, pods ...string) endpointSlice {
+	sl := endpointSlice{
+		Metadata: objectMeta{
+			Name:   name,
+			Labels: map[string]string{ServiceLabel: "true", serviceNameLabel: "foo"},
+		},
+		AddressType: "IPv4",
+		Ports: []endpointPort{
+			{Name: "metrics", Port: 9090, Protocol: "TCP"},
+			{Name: "grpc", Port: 8080, Protocol: "TCP"},
+		},
+	}
+	for i, p := range pods {
+		sl.Endpoints = append(sl.Endpoints, endpoint{
+			Addresses:  []string{"10.0.0." + strconv.Itoa(i+1)},
+			Conditions: endpointConditions{Ready: &ready},
+			TargetRef:  &objectReference{Kind: "Pod", Name: p, Namespace: "mini"},
+			NodeName:   "node-1",
+		})
+	}
+	return sl
+}
+
+func newRegistry(addr, pod string) registry.Registry {
+	return NewRegistry(registry.Addrs(addr), Namespace("mini"), Token("secret"), Pod(pod))
+}
+
+func TestKubernetesRegistry(t *testing.T) {
+	f, addr := newFakeAPIServer(t)
+
+	f.addPod("foo-1", map[string]string{"app": "foo", "track": "stable"})
+	f.addPod("foo-2", map[string]string{"app": "foo", "track": "canary"})
+
+	r := newRegistry(addr, "foo-1")
+
+	if _, err := r.GetService("foo"); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+
+	s := &registry.Service{
+		Name:      "foo",
+		Version:   "1.0.0",
+		Metadata:  map[string]string{"team": "bar"},
+		Endpoints: []*registry.Endpoint{{Name: "Foo.Bar"}},
+		Nodes:     []*registry.Node{{Id: "foo-1", Address: "10.0.0.1:8080", Metadata: map[string]string{"protocol": "grpc"}}},
+	}
+	if err := r.Register(s); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	f.apply(newSlice("foo-abc", true, "foo-1", "foo-2"))
+
+	f.Lock()
+	auth := f.auth
+	f.Unlock()
+	if auth != "Bearer secret" {
+		t.Fatalf("Expected the token to be sent, got %s", auth)
+	}
+
+	services, err := r.GetService("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error getting service %v", err)
+	}
+
+	// foo-2 didn't register so its version is unknown
+	versions := make(map[string]*registry.Service)
+	for _, s := range services {
+		versions[s.Version] = s
+	}
+	if len(versions) != 2 || versions["1.0.0"] == nil || versions[""] == nil {
+		t.Fatalf("Expected versions 1.0.0 and unknown, got %+v", services)
+	}
+
+	v1 := versions["1.0.0"]
+	if v1.Metadata["team"] != "bar" || len(v1.Endpoints) != 1 || len(v1.Nodes) != 1 {
+		t.Fatalf("Expected the registered details, got %+v", v1)
+	}
+
+	n := v1.Nodes[0]
+	if n.Id != "foo-1" || n.Address != "10.0.0.1:8080" {
+		t.Fatalf("Expected foo-1 at 10.0.0.1:8080, got %+v", n)
+	}
+	expected := map[string]string{
+		"app":          "foo",
+		"track":        "stable",
+		"port.grpc":    "8080",
+		"port.metrics": "9090",
+		"node":         "node-1",
+		"protocol":     "grpc",
+	}
+	for k, v := range expected {
+		if n.Metadata[k] != v {
+			t.Fatalf("Expected metadata %s=%s, got %+v", k, v, n.Metadata)
+		}
+	}
+
+	list, err := r.ListServices()
+	if err != nil {
+		t.Fatalf("Unexpected error listing services %v", err)
+	}
+	if len(list) != 1 || list[0].Name != "foo" {
+		t.Fatalf("Expected only foo, got %+v", list)
+	}
+
+	if err := r.Deregister(s); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+
+	f.Lock()
+	_, ok := f.pods["foo-1"].Metadata.Annotations[AnnotationPrefix+"foo"]
+	f.Unlock()
+	if ok {
+		t.Fatal("Expected the annotation to be removed")
+	}
+
+	// not ready endpoints are left out
+	f.apply(newSlice("foo-abc", false, "foo-1", "foo-2"))
+	if _, err := r.GetService("foo"); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+}
+
+func TestKubernetesRegistryNamespace(t *testing.T) {
+	f, addr := newFakeAPIServer(t)
+
+	f.addPod("foo-1", map[string]string{"app": "foo"})
+	f.addPod("foo-2", map[string]string{"app": "foo"})
+
+	r := newRegistry(addr, "foo-1")
+
+	// every node of the service publishes its metadata
+	s := &registry.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{Id: "foo-1-metrics", Address: "10.0.0.1:9090", Metadata: map[string]string{"protocol": "http"}},
+			{Id: "foo-1", Address: "10.0.0.1:8080", Metadata: map[string]string{"protocol": "grpc"}},
+		},
+	}
+	if err := r.Register(s, registry.RegisterNamespace("staging")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	f.apply(newSlice("foo-abc", true, "foo-1", "foo-2"))
+
+	// foo-2 didn't register so it is in the default namespace
+	for ns, id := range map[string]string{"staging": "foo-1", registry.DefaultNamespace: "foo-2"} {
+		services, err := r.GetService("foo", registry.GetNamespace(ns))
+		if err != nil {
+			t.Fatalf("Unexpected error getting foo in %s: %v", ns, err)
+		}
+		if len(services) != 1 || len(services[0].Nodes) != 1 || services[0].Nodes[0].Id != id {
+			t.Fatalf("Expected %s in %s, got %+v", id, ns, services)
+		}
+
+		list, err := r.ListServices(registry.ListNamespace(ns))
+		if err != nil || len(list) != 1 || list[0].Name != "foo" {
+			t.Fatalf("Expected foo listed in %s, got %+v %v", ns, list, err)
+		}
+	}
+
+	// the node is addressed with the grpc port
+	services, _ := r.GetService("foo", registry.GetNamespace("staging"))
+	if md := services[0].Nodes[0].Metadata; md["protocol"] != "grpc" {
+		t.Fatalf("Expected the metadata of the node at the grpc port, got %+v", md)
+	}
+
+	if _, err := r.GetService("foo", registry.GetNamespace("prod")); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v in prod, got %v", registry.ErrNotFound, err)
+	}
+	if list, err := r.ListServices(registry.ListNamespace("prod")); err != nil || len(list) != 0 {
+		t.Fatalf("Expected nothing listed in prod, got %+v %v", list, err)
+	}
+}
+
+func TestKubernetesRegistryPods(t *testing.T) {
+	f, addr := newFakeAPIServer(t)
+
+	f.addService("foo", map[string]string{"app": "foo"})
+	f.addPod("foo-1", map[string]string{"app": "foo", "track": "stable"})
+	f.addPod("foo-2", map[string]string{"app": "foo", "track": "canary"})
+	f.addPod("foo-3", map[string]string{"app": "foo", "track": "canary"})
+	// the endpoints may still point at a pod the service no longer selects
+	f.addPod("bar-1", map[string]string{"app": "bar", "track": "stable"})
+
+	r := newRegistry(addr, "foo-1")
+	f.apply(newSlice("foo-abc", true, "foo-1", "foo-2", "foo-3", "bar-1"))
+
+	services, err := r.GetService("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error getting service %v", err)
+	}
+	if len(services) != 1 || len(services[0].Nodes) != 4 {
+		t.Fatalf("Expected 1 service with 4 nodes, got %+v", services)
+	}
+	for _, n := range services[0].Nodes {
+		if len(n.Metadata["track"]) == 0 {
+			t.Fatalf("Expected the labels of the pod, got %+v", n)
+		}
+	}
+
+	// the selected pods are listed at once, only the other one is got by itself
+	f.Lock()
+	gets := f.podGets
+	f.Unlock()
+	if gets != 1 {
+		t.Fatalf("Expected a single pod get, got %d", gets)
+	}
+}
+
+func TestKubernetesRegistryWatch(t *testing.T) {
+	f, addr := newFakeAPIServer(t)
+
+	f.addPod("foo-1", map[string]string{"app": "foo"})
+	f.addPod("foo-2", map[string]string{"app": "foo"})
+
+	r := newRegistry(addr, "foo-1")
+
+	w, err := r.Watch(registry.WatchService("foo"))
+	if err != nil {
+		t.Fatalf("Unexpected watch error %v", err)
+	}
+	defer w.Stop()
+
+	next := func(action string, nodes int) {
+		res := make(chan *registry.Result, 1)
+		go func() {
+			if r, err := w.Next(); err == nil {
+				res <- r
+			}
+		}()
+
+		select {
+		case r := <-res:
+			if r.Action != action || r.Service.Name != "foo" || len(r.Service.Nodes) != nodes {
+				t.Fatalf("Expected %s of foo with %d nodes, got %s of %+v", action, nodes, r.Action, r.Service)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s", action)
+		}
+	}
+
+	// wait for the watch request before changing the slices
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.Lock()
+		n := len(f.watches)
+		f.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the watch")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	f.apply(newSlice("foo-abc", true, "foo-1"))
+	next(registry.Create.String(), 1)
+
+	f.apply(newSlice("foo-abc", true, "foo-1", "foo-2"))
+	next(registry.Update.String(), 2)
+
+	f.remove("foo-abc")
+	next(registry.Delete.String(), 2)
+
+	// a snapshot starts with the current services
+	f.apply(newSlice("foo-abc", true, "foo-1", "foo-2"))
+	next(registry.Create.String(), 2)
+
+	s, err := r.Watch(registry.WatchService("foo"), registry.WatchSnapshot(true))
+	if err != nil {
+		t.Fatalf("Unexpected watch error %v", err)
+	}
+	defer s.Stop()
+
+	res, err := s.Next()
+	if err != nil {
+		t.Fatalf("Unexpected watcher error %v", err)
+	}
+	if res.Action != registry.Create.String() || len(res.Service.Nodes) != 2 {
+		t.Fatalf("Expected the snapshot to create foo with 2 nodes, got %s of %+v", res.Action, res.Service)
+	}
+
+	w.Stop()
+	if _, err := w.Next(); err != registry.ErrWatcherStopped {
+		t.Fatalf("Expected %v, got %v", registry.ErrWatcherStopped, err)
+	}
+}
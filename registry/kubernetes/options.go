@@ -0,0 +1,43 @@
+package kubernetes
+
+import (
+	"context"
+
+	"github.com/sumlookup/mini/registry"
+)
+
+type namespaceKey struct{}
+type tokenKey struct{}
+type podKey struct{}
+
+// Namespace sets the namespace the services are found in, the namespace
+// of the pod by default
+func Namespace(ns string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, namespaceKey{}, ns)
+	}
+}
+
+// Token sets the bearer token sent to the api server, the token of the
+// pod service account by default
+func Token(t string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, tokenKey{}, t)
+	}
+}
+
+// Pod sets the name of the pod Register annotates, POD_NAME or the hostname by default
+func Pod(name string) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, podKey{}, name)
+	}
+}
@@ -0,0 +1,271 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/registry"
+)
+
+// retryWait is how long a watcher waits after a failed watch
+var retryWait = time.Second
+
+// watcher watches the EndpointSlices of the mini services and reports the
+// services whose nodes changed
+type watcher struct {
+	api       *api
+	namespace string
+	selector  string
+	wo        registry.WatchOptions
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	res    chan *registry.Result
+	exit   chan bool
+	once   sync.Once
+
+	resourceVersion string
+	// namespace/name -> slice
+	slices map[string]endpointSlice
+	// service name -> version -> service
+	services map[string]map[string]*registry.Service
+}
+
+func newWatcher(a *api, namespace string, opts ...registry.WatchOption) (*watcher, error) {
+	var wo registry.WatchOptions
+	for _, o := range opts {
+		o(&wo)
+	}
+
+	selector := LabelSelector
+	if len(wo.Service) > 0 {
+		selector += "," + serviceNameLabel + "=" + wo.Service
+	}
+
+	w := &watcher{
+		api:       a,
+		namespace: namespace,
+		selector:  selector,
+		wo:        wo,
+		res:       make(chan *registry.Result),
+		exit:      make(chan bool),
+		slices:    make(map[string]endpointSlice),
+		services:  make(map[string]map[string]*registry.Service),
+	}
+
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+
+	// changes are reported against the current services
+	if _, err := w.list(); err != nil {
+		w.cancel()
+		return nil, err
+	}
+	for name := range w.names() {
+		w.services[name] = w.current(name)
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// list replaces the slices with the current ones and returns the names of
+// the services before and after
+func (w *watcher) list() (map[string]bool, error) {
+	list, err := w.api.listSlices(w.namespace, w.selector)
+	if err != nil {
+		return nil, err
+	}
+
+	names := w.names()
+
+	w.slices = make(map[string]endpointSlice)
+	for _, sl := range list.Items {
+		w.slices[sliceKey(sl)] = sl
+	}
+	w.resourceVersion = list.Metadata.ResourceVersion
+
+	for name := range w.names() {
+		names[name] = true
+	}
+
+	return names, nil
+}
+
+// names returns the names of the services of the slices
+func (w *watcher) names() map[string]bool {
+	names := make(map[string]bool)
+	for _, sl := range w.slices {
+		if name := sl.Metadata.Labels[serviceNameLabel]; len(name) > 0 {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// current returns the services of the name from the slices
+func (w *watcher) current(name string) map[string]*registry.Service {
+	var slices []endpointSlice
+	for _, sl := range w.slices {
+		if sl.Metadata.Labels[serviceNameLabel] == name {
+			slices = append(slices, sl)
+		}
+	}
+	return toServices(name, registryNamespace(w.wo.Namespace), slices, newPods(w.api, w.namespace, name))
+}
+
+// update reports the changes of the service since it was last reported
+func (w *watcher) update(name string) bool {
+	services := w.current(name)
+
+	for _, r := range registry.Diff(w.services[name], services) {
+		select {
+		case w.res <- r:
+		case <-w.exit:
+			return false
+		}
+	}
+
+	if len(services) == 0 {
+		delete(w.services, name)
+	} else {
+		w.services[name] = services
+	}
+
+	return true
+}
+
+func (w *watcher) run() {
+	// the current services are sent first as created with the snapshot
+	if w.wo.Snapshot {
+		for _, services := range w.services {
+			for _, r := range registry.Diff(nil, services) {
+				select {
+				case w.res <- r:
+				case <-w.exit:
+					return
+				}
+			}
+		}
+	}
+
+	for {
+		err := w.watch()
+		if w.ctx.Err() != nil {
+			return
+		}
+
+		// the resource version is too old to watch from, start over
+		if err == errGone {
+			log.Debugf("[kubernetes] registry watcher listing the slices again")
+			names, err := w.list()
+			if err == nil {
+				for name := range names {
+					if !w.update(name) {
+						return
+					}
+				}
+				continue
+			}
+		}
+
+		if err != nil {
+			log.Warnf("[kubernetes] registry watcher failed, watching again in %v: %v", retryWait, err)
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-time.After(retryWait):
+			}
+		}
+	}
+}
+
+// watch handles the events of a single watch request, the api server ends
+// the watches after a while
+func (w *watcher) watch() error {
+	body, err := w.api.watchSlices(w.ctx, w.namespace, w.selector, w.resourceVersion)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
+
+	for {
+		var e watchEvent
+		if err := dec.Decode(&e); err != nil {
+			// the watch ended normally
+			if w.ctx.Err() == nil && err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		switch e.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			var sl endpointSlice
+			if err := json.Unmarshal(e.Object, &sl); err != nil {
+				return err
+			}
+
+			w.resourceVersion = sl.Metadata.ResourceVersion
+			if e.Type == "DELETED" {
+				delete(w.slices, sliceKey(sl))
+			} else {
+				w.slices[sliceKey(sl)] = sl
+			}
+
+			if name := sl.Metadata.Labels[serviceNameLabel]; len(name) > 0 && !w.update(name) {
+				return nil
+			}
+		case "BOOKMARK":
+			var sl endpointSlice
+			if err := json.Unmarshal(e.Object, &sl); err == nil {
+				w.resourceVersion = sl.Metadata.ResourceVersion
+			}
+		case "ERROR":
+			var st status
+			if err := json.Unmarshal(e.Object, &st); err == nil && st.Code == 410 {
+				return errGone
+			}
+			return &watchError{st}
+		}
+	}
+}
+
+type watchError struct {
+	status status
+}
+
+func (e *watchError) Error() string {
+	return "kubernetes watch: " + e.status.Reason + ": " + e.status.Message
+}
+
+func sliceKey(sl endpointSlice) string {
+	return sl.Metadata.Namespace + "/" + sl.Metadata.Name
+}
+
+func (w *watcher) Next() (*registry.Result, error) {
+	for {
+		select {
+		case r := <-w.res:
+			if r = w.wo.Filter(r); r == nil {
+				continue
+			}
+			return r, nil
+		case <-w.exit:
+			return nil, registry.ErrWatcherStopped
+		}
+	}
+}
+
+func (w *watcher) Stop() {
+	w.once.Do(func() {
+		close(w.exit)
+		w.cancel()
+	})
+}
@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -26,15 +27,20 @@ var (
 )
 
 type mdnsTxt struct {
-	Service   string
-	Version   string
-	Endpoints []*Endpoint
-	Metadata  map[string]string
+	Service         string
+	Version         string
+	Endpoints       []*Endpoint
+	Metadata        map[string]string
+	ServiceMetadata map[string]string `json:",omitempty"`
 }
 
 type mdnsEntry struct {
 	id   string
 	node *mdns.Server
+	// the served records of the node, nil for the wildcard entry
+	zone    *mdns.MDNSService
+	txt     *mdnsTxt
+	address string
 }
 
 type mdnsRegistry struct {
@@ -43,6 +49,7 @@ type mdnsRegistry struct {
 	domain string
 
 	sync.Mutex
+	// the entries by namespace domain and service name
 	services map[string][]*mdnsEntry
 
 	mtx sync.RWMutex
@@ -52,6 +59,12 @@ type mdnsRegistry struct {
 
 	// listener
 	listener chan *mdns.ServiceEntry
+
+	// the revision of the last watch result
+	revision uint64
+
+	// the registrations and deregistrations of this registry
+	history *History
 }
 
 type mdnsWatcher struct {
@@ -59,10 +72,15 @@ type mdnsWatcher struct {
 	wo   WatchOptions
 	ch   chan *mdns.ServiceEntry
 	exit chan struct{}
+	// the txt records of the announced nodes by name
+	seen map[string]string
 	// the mdns domain
 	domain string
 	// the registry
 	registry *mdnsRegistry
+	// the snapshot is sent on the first call to next
+	snapshot bool
+	pending  []*Result
 }
 
 func encode(txt *mdnsTxt) ([]string, error) {
@@ -150,7 +168,17 @@ func newRegistry(opts ...Option) Registry {
 		domain:   domain,
 		services: make(map[string][]*mdnsEntry),
 		watchers: make(map[string]*mdnsWatcher),
+		history:  NewHistory(uuid.New().String(), options),
+	}
+}
+
+// namespaceDomain returns the mdns domain of the namespace. The default
+// namespace uses the registry domain, the others a subdomain of it.
+func (m *mdnsRegistry) namespaceDomain(ns string) string {
+	if len(ns) == 0 || ns == DefaultNamespace {
+		return m.domain
 	}
+	return ns + "." + m.domain
 }
 
 func (m *mdnsRegistry) Init(opts ...Option) error {
@@ -168,13 +196,21 @@ func (m *mdnsRegistry) Register(service *Service, opts ...RegisterOption) error
 	m.Lock()
 	defer m.Unlock()
 
-	entries, ok := m.services[service.Name]
+	var options RegisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	domain := m.namespaceDomain(options.Namespace)
+	key := domain + "/" + service.Name
+
+	entries, ok := m.services[key]
 	// first entry, create wildcard used for list queries
 	if !ok {
 		s, err := mdns.NewMDNSService(
 			service.Name,
 			"_services",
-			m.domain+".",
+			domain+".",
 			"",
 			9999,
 			[]net.IP{net.ParseIP("0.0.0.0")},
@@ -194,6 +230,7 @@ func (m *mdnsRegistry) Register(service *Service, opts ...RegisterOption) error
 	}
 
 	var gerr error
+	var added []*Node
 
 	for _, node := range service.Nodes {
 		var seen bool
@@ -215,12 +252,15 @@ func (m *mdnsRegistry) Register(service *Service, opts ...RegisterOption) error
 			e = &mdnsEntry{}
 		}
 
-		txt, err := encode(&mdnsTxt{
-			Service:   service.Name,
-			Version:   service.Version,
-			Endpoints: service.Endpoints,
-			Metadata:  node.Metadata,
-		})
+		txt := &mdnsTxt{
+			Service:         service.Name,
+			Version:         service.Version,
+			Endpoints:       service.Endpoints,
+			Metadata:        node.Metadata,
+			ServiceMetadata: service.Metadata,
+		}
+
+		record, err := encode(txt)
 
 		if err != nil {
 			gerr = err
@@ -239,11 +279,11 @@ func (m *mdnsRegistry) Register(service *Service, opts ...RegisterOption) error
 		s, err := mdns.NewMDNSService(
 			node.Id,
 			service.Name,
-			m.domain+".",
+			domain+".",
 			"",
 			port,
 			[]net.IP{net.ParseIP(host)},
-			txt,
+			record,
 		)
 		if err != nil {
 			gerr = err
@@ -258,11 +298,21 @@ func (m *mdnsRegistry) Register(service *Service, opts ...RegisterOption) error
 
 		e.id = node.Id
 		e.node = srv
+		e.zone = s
+		e.txt = txt
+		e.address = node.Address
 		entries = append(entries, e)
+		added = append(added, node)
 	}
 
 	// save
-	m.services[service.Name] = entries
+	m.services[key] = entries
+
+	if len(added) > 0 {
+		s := *service
+		s.Nodes = added
+		m.history.Record(Create, &s)
+	}
 
 	return gerr
 }
@@ -276,18 +326,29 @@ func (m *mdnsRegistry) Deregister(service *Service, opts ...DeregisterOption) er
 	if m.services == nil || service == nil {
 		return nil
 	}
+
+	var options DeregisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	key := m.namespaceDomain(options.Namespace) + "/" + service.Name
+
 	// loop existing entries, check if any match, shutdown those that do
-	if _, ok := m.services[service.Name]; !ok {
+	if _, ok := m.services[key]; !ok {
 		return nil
 	}
 
-	for _, entry := range m.services[service.Name] {
+	var removed []*Node
+
+	for _, entry := range m.services[key] {
 		var remove bool
 
 		for _, node := range service.Nodes {
 			if node.Id == entry.id {
 				entry.node.Shutdown()
 				remove = true
+				removed = append(removed, node)
 				break
 			}
 		}
@@ -301,15 +362,27 @@ func (m *mdnsRegistry) Deregister(service *Service, opts ...DeregisterOption) er
 	// last entry is the wildcard for list queries. Remove it.
 	if len(newEntries) == 1 && newEntries[0].id == "*" {
 		newEntries[0].node.Shutdown()
-		delete(m.services, service.Name)
+		delete(m.services, key)
 	} else {
-		m.services[service.Name] = newEntries
+		m.services[key] = newEntries
+	}
+
+	if len(removed) > 0 {
+		s := *service
+		s.Nodes = removed
+		m.history.Record(Delete, &s)
 	}
 
 	return nil
 }
 
 func (m *mdnsRegistry) GetService(service string, opts ...GetOption) ([]*Service, error) {
+	var options GetOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	domain := m.namespaceDomain(options.Namespace)
 
 	serviceMap := make(map[string]*Service)
 	entries := make(chan *mdns.ServiceEntry, 10)
@@ -323,7 +396,7 @@ func (m *mdnsRegistry) GetService(service string, opts ...GetOption) ([]*Service
 	// set entries channel
 	p.Entries = entries
 	// set the domain
-	p.Domain = m.domain
+	p.Domain = domain
 
 	go func() {
 		for {
@@ -333,10 +406,11 @@ func (m *mdnsRegistry) GetService(service string, opts ...GetOption) ([]*Service
 				if p.Service == "_services" {
 					continue
 				}
-				if p.Domain != m.domain {
+				if e.TTL == 0 {
 					continue
 				}
-				if e.TTL == 0 {
+				// skip the nodes of the other namespaces
+				if !strings.HasSuffix(e.Name, "."+p.Service+"."+p.Domain+".") {
 					continue
 				}
 
@@ -354,6 +428,7 @@ func (m *mdnsRegistry) GetService(service string, opts ...GetOption) ([]*Service
 					s = &Service{
 						Name:      txt.Service,
 						Version:   txt.Version,
+						Metadata:  txt.ServiceMetadata,
 						Endpoints: txt.Endpoints,
 					}
 				}
@@ -401,6 +476,11 @@ func (m *mdnsRegistry) GetService(service string, opts ...GetOption) ([]*Service
 }
 
 func (m *mdnsRegistry) ListServices(opts ...ListOption) ([]*Service, error) {
+	var options ListOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
 	serviceMap := make(map[string]bool)
 	entries := make(chan *mdns.ServiceEntry, 10)
 	done := make(chan bool)
@@ -413,7 +493,7 @@ func (m *mdnsRegistry) ListServices(opts ...ListOption) ([]*Service, error) {
 	// set entries channel
 	p.Entries = entries
 	// set domain
-	p.Domain = m.domain
+	p.Domain = m.namespaceDomain(options.Namespace)
 
 	var services []*Service
 
@@ -424,7 +504,8 @@ func (m *mdnsRegistry) ListServices(opts ...ListOption) ([]*Service, error) {
 				if e.TTL == 0 {
 					continue
 				}
-				if !strings.HasSuffix(e.Name, p.Domain+".") {
+				// the suffix leaves out the subdomains of the other namespaces
+				if !strings.HasSuffix(e.Name, "."+p.Service+"."+p.Domain+".") {
 					continue
 				}
 				name := strings.TrimSuffix(e.Name, "."+p.Service+"."+p.Domain+".")
@@ -450,19 +531,28 @@ func (m *mdnsRegistry) ListServices(opts ...ListOption) ([]*Service, error) {
 	return services, nil
 }
 
+// Watch watches the mdns announcements of the namespace. The announcements
+// are not kept so a watch can't resume from a revision, it takes a snapshot
+// instead.
 func (m *mdnsRegistry) Watch(opts ...WatchOption) (Watcher, error) {
 	var wo WatchOptions
 	for _, o := range opts {
 		o(&wo)
 	}
 
+	if wo.Revision > 0 && !wo.Snapshot {
+		return nil, ErrRevisionCompacted
+	}
+
 	md := &mdnsWatcher{
 		id:       uuid.New().String(),
 		wo:       wo,
 		ch:       make(chan *mdns.ServiceEntry, 32),
 		exit:     make(chan struct{}),
-		domain:   m.domain,
+		seen:     make(map[string]string),
+		domain:   m.namespaceDomain(wo.Namespace),
 		registry: m,
+		snapshot: wo.Snapshot,
 	}
 
 	m.mtx.Lock()
@@ -545,11 +635,188 @@ func (m *mdnsRegistry) Watch(opts ...WatchOption) (Watcher, error) {
 	return md, nil
 }
 
+// UpdateNode patches the metadata of the node registered by this registry and
+// announces the records of the node again
+func (m *mdnsRegistry) UpdateNode(service, version, id string, md map[string]string, opts ...UpdateOption) error {
+	m.Lock()
+	defer m.Unlock()
+
+	var options UpdateOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	key := m.namespaceDomain(options.Namespace) + "/" + service
+
+	for _, e := range m.services[key] {
+		if e.txt == nil || e.id != id || e.txt.Version != version {
+			continue
+		}
+
+		txt := *e.txt
+		txt.Metadata = PatchMetadata(e.txt.Metadata, md)
+
+		if err := m.announce(e, &txt); err != nil {
+			return err
+		}
+
+		m.history.Record(Update, &Service{
+			Name:      txt.Service,
+			Version:   txt.Version,
+			Metadata:  txt.ServiceMetadata,
+			Endpoints: txt.Endpoints,
+			Nodes:     []*Node{{Id: e.id, Address: e.address, Metadata: txt.Metadata}},
+		})
+
+		return nil
+	}
+
+	return ErrNotFound
+}
+
+// UpdateService patches the metadata of the service version registered by this
+// registry and announces the records of its nodes again
+func (m *mdnsRegistry) UpdateService(service, version string, md map[string]string, opts ...UpdateOption) error {
+	m.Lock()
+	defer m.Unlock()
+
+	var options UpdateOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	key := m.namespaceDomain(options.Namespace) + "/" + service
+
+	var updated *Service
+	for _, e := range m.services[key] {
+		if e.txt == nil || e.txt.Version != version {
+			continue
+		}
+
+		txt := *e.txt
+		txt.ServiceMetadata = PatchMetadata(e.txt.ServiceMetadata, md)
+
+		if err := m.announce(e, &txt); err != nil {
+			return err
+		}
+
+		if updated == nil {
+			updated = &Service{
+				Name:      txt.Service,
+				Version:   txt.Version,
+				Metadata:  txt.ServiceMetadata,
+				Endpoints: txt.Endpoints,
+			}
+		}
+		updated.Nodes = append(updated.Nodes, &Node{Id: e.id, Address: e.address, Metadata: txt.Metadata})
+	}
+
+	if updated == nil {
+		return ErrNotFound
+	}
+
+	m.history.Record(Update, updated)
+
+	return nil
+}
+
+// announce serves the new txt records of the entry and announces them
+func (m *mdnsRegistry) announce(e *mdnsEntry, txt *mdnsTxt) error {
+	record, err := encode(txt)
+	if err != nil {
+		return err
+	}
+
+	e.zone.SetTXT(record)
+	e.txt = txt
+
+	logger.Debugf("[mdns] registry announce %s@%s node %s", txt.Service, txt.Version, e.id)
+	return e.node.Announce()
+}
+
+// History returns the registrations and deregistrations of this registry since the time
+func (m *mdnsRegistry) History(since time.Time, service string) ([]*Event, error) {
+	return m.history.Events(since, service), nil
+}
+
+// Close closes the history file
+func (m *mdnsRegistry) Close() error {
+	return m.history.Close()
+}
+
 func (m *mdnsRegistry) String() string {
 	return "mdns"
 }
 
+// takeSnapshot queries the current services of the watched namespace
+func (m *mdnsWatcher) takeSnapshot() []*Result {
+	names := []string{m.wo.Service}
+	if len(m.wo.Service) == 0 {
+		list, err := m.registry.ListServices(ListNamespace(m.wo.Namespace))
+		if err != nil {
+			logger.Debugf("[mdns] could not list the services for the snapshot: %v", err)
+			return nil
+		}
+		names = names[:0]
+		for _, s := range list {
+			names = append(names, s.Name)
+		}
+	}
+
+	var results []*Result
+	for _, name := range names {
+		services, err := m.registry.GetService(name, GetNamespace(m.wo.Namespace))
+		if err != nil {
+			logger.Debugf("[mdns] could not get %s for the snapshot: %v", name, err)
+			continue
+		}
+		for _, s := range services {
+			m.see(s)
+			res := m.wo.Filter(&Result{
+				Action:   Create.String(),
+				Service:  s,
+				Revision: atomic.AddUint64(&m.registry.revision, 1),
+			})
+			if res != nil {
+				results = append(results, res)
+			}
+		}
+	}
+
+	return results
+}
+
+// see records the nodes of the service as announced, so their next
+// announcement is only an update when their records changed
+func (m *mdnsWatcher) see(s *Service) {
+	suffix := fmt.Sprintf(".%s.%s.", s.Name, m.domain)
+	for _, n := range s.Nodes {
+		records, err := encode(&mdnsTxt{
+			Service:         s.Name,
+			Version:         s.Version,
+			Endpoints:       s.Endpoints,
+			Metadata:        n.Metadata,
+			ServiceMetadata: s.Metadata,
+		})
+		if err != nil {
+			continue
+		}
+		m.seen[n.Id+suffix] = strings.Join(records, "")
+	}
+}
+
 func (m *mdnsWatcher) Next() (*Result, error) {
+	if m.snapshot {
+		m.snapshot = false
+		m.pending = m.takeSnapshot()
+	}
+
+	if len(m.pending) > 0 {
+		res := m.pending[0]
+		m.pending = m.pending[1:]
+		return res, nil
+	}
+
 	for {
 		select {
 		case e := <-m.ch:
@@ -562,21 +829,10 @@ func (m *mdnsWatcher) Next() (*Result, error) {
 				continue
 			}
 
-			// Filter watch options
-			// wo.Service: Only keep services we care about
-			if len(m.wo.Service) > 0 && txt.Service != m.wo.Service {
-				continue
-			}
-			var action string
-			if e.TTL == 0 {
-				action = "delete"
-			} else {
-				action = "create"
-			}
-
 			service := &Service{
 				Name:      txt.Service,
 				Version:   txt.Version,
+				Metadata:  txt.ServiceMetadata,
 				Endpoints: txt.Endpoints,
 			}
 
@@ -586,6 +842,25 @@ func (m *mdnsWatcher) Next() (*Result, error) {
 				continue
 			}
 
+			// a known node announced again is an update when its records changed
+			var action string
+			records := strings.Join(e.InfoFields, "")
+			prev, seen := m.seen[e.Name]
+
+			switch {
+			case e.TTL == 0:
+				action = "delete"
+				delete(m.seen, e.Name)
+			case !seen:
+				action = "create"
+				m.seen[e.Name] = records
+			case prev != records:
+				action = "update"
+				m.seen[e.Name] = records
+			default:
+				continue
+			}
+
 			var addr string
 			if len(e.AddrV4) > 0 {
 				addr = e.AddrV4.String()
@@ -601,10 +876,18 @@ func (m *mdnsWatcher) Next() (*Result, error) {
 				Metadata: txt.Metadata,
 			})
 
-			return &Result{
+			// Filter watch options
+			res := m.wo.Filter(&Result{
 				Action:  action,
 				Service: service,
-			}, nil
+			})
+			if res == nil {
+				continue
+			}
+
+			res.Revision = atomic.AddUint64(&m.registry.revision, 1)
+
+			return res, nil
 		case <-m.exit:
 			return nil, ErrWatcherStopped
 		}
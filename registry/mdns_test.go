@@ -2,6 +2,7 @@ package registry
 
 import (
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -383,3 +384,120 @@ func TestWatcher(t *testing.T) {
 		}
 	}
 }
+
+func TestWatcherUpdate(t *testing.T) {
+	if travis := os.Getenv("TRAVIS"); travis == "true" {
+		t.Skip()
+	}
+
+	service := &Service{
+		Name:     "test4",
+		Version:  "1.0.4",
+		Metadata: map[string]string{"team": "foo"},
+		Nodes: []*Node{
+			{
+				Id:      "test4-1",
+				Address: "10.0.0.4:10004",
+				Metadata: map[string]string{
+					"foo4": "bar4",
+				},
+			},
+		},
+	}
+
+	r := NewRegistry()
+
+	u, ok := r.(Updater)
+	if !ok {
+		t.Fatal("Expected the mdns registry to update metadata")
+	}
+
+	w, err := r.Watch(WatchService(service.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// next waits for a result of the action matching fn, the announcements
+	// are repeated so stale records may still come in first
+	next := func(action string, fn func(*Service) bool) {
+		timer := time.AfterFunc(10*time.Second, w.Stop)
+		defer timer.Stop()
+
+		for {
+			res, err := w.Next()
+			if err != nil {
+				t.Fatalf("Timed out waiting for %s: %v", action, err)
+			}
+			if res.Action == action && fn(res.Service) {
+				return
+			}
+		}
+	}
+
+	if err := r.Register(service); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Deregister(service)
+	next(Create.String(), func(s *Service) bool { return true })
+
+	// the patched node metadata is announced again
+	if err := u.UpdateNode(service.Name, service.Version, "test4-1", map[string]string{"foo4": "baz4", "zone": "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	next(Update.String(), func(s *Service) bool {
+		return len(s.Nodes) == 1 && s.Nodes[0].Metadata["foo4"] == "baz4" && s.Nodes[0].Metadata["zone"] == "a"
+	})
+
+	// so is the patched service metadata, the node metadata is kept
+	if err := u.UpdateService(service.Name, service.Version, map[string]string{"team": "bar"}); err != nil {
+		t.Fatal(err)
+	}
+
+	next(Update.String(), func(s *Service) bool {
+		return s.Metadata["team"] == "bar" && len(s.Nodes) == 1 && s.Nodes[0].Metadata["foo4"] == "baz4"
+	})
+
+	if err := u.UpdateNode(service.Name, service.Version, "test4-2", map[string]string{"foo": "bar"}); err != ErrNotFound {
+		t.Fatalf("Expected %v for an unknown node, got %v", ErrNotFound, err)
+	}
+}
+
+func TestWatcherSnapshotSeen(t *testing.T) {
+	txt := &mdnsTxt{
+		Service:         "test5",
+		Version:         "1.0.5",
+		Endpoints:       []*Endpoint{{Name: "Foo.Bar", Metadata: map[string]string{"stream": "true"}}},
+		Metadata:        map[string]string{"foo5": "bar5", "zone": "a"},
+		ServiceMetadata: map[string]string{"team": "foo"},
+	}
+
+	// the records the node announces
+	records, err := encode(txt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the service of the snapshot is decoded from them
+	decoded, err := decode(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &Service{
+		Name:      decoded.Service,
+		Version:   decoded.Version,
+		Metadata:  decoded.ServiceMetadata,
+		Endpoints: decoded.Endpoints,
+		Nodes:     []*Node{{Id: "test5-1", Address: "10.0.0.5:10005", Metadata: decoded.Metadata}},
+	}
+
+	w := &mdnsWatcher{seen: make(map[string]string), domain: mdnsDomain}
+	w.see(service)
+
+	// the next announcement of the node is not a change
+	name := "test5-1.test5." + mdnsDomain + "."
+	if got := w.seen[name]; got != strings.Join(records, "") {
+		t.Fatalf("Expected the snapshot to see the announced records of %s, got %q", name, got)
+	}
+}
@@ -12,8 +12,11 @@ import (
 )
 
 var (
-	sendEventTime = 10 * time.Millisecond
-	ttlPruneTime  = time.Second
+	// DefaultWatchHistory is how many changes are kept for the watchers
+	// resuming from a revision
+	DefaultWatchHistory = 1000
+
+	ttlPruneTime = time.Second
 )
 
 type node struct {
@@ -30,12 +33,30 @@ type record struct {
 	Endpoints []*registry.Endpoint
 }
 
+// change is a change of the services of the namespace
+type change struct {
+	namespace string
+	result    *registry.Result
+}
+
 type Registry struct {
 	options registry.Options
 
 	sync.RWMutex
-	records  map[string]map[string]*record
-	watchers map[string]*Watcher
+	// records by namespace, service name and version
+	records map[string]map[string]map[string]*record
+
+	// the last changes ordered by revision
+	revision     uint64
+	changes      []*change
+	watchHistory int
+	// closed and replaced on every change
+	notify chan bool
+
+	// the events kept for the history
+	events *registry.History
+	// stops pruning the expired nodes
+	exit chan bool
 }
 
 func NewRegistry(opts ...registry.Option) registry.Registry {
@@ -52,10 +73,18 @@ func NewRegistry(opts ...registry.Option) registry.Registry {
 		records = make(map[string]map[string]*record)
 	}
 
+	history, ok := options.Context.Value(watchHistoryKey{}).(int)
+	if !ok || history <= 0 {
+		history = DefaultWatchHistory
+	}
+
 	reg := &Registry{
-		options:  options,
-		records:  records,
-		watchers: make(map[string]*Watcher),
+		options:      options,
+		records:      map[string]map[string]map[string]*record{registry.DefaultNamespace: records},
+		watchHistory: history,
+		notify:       make(chan bool),
+		events:       registry.NewHistory(uuid.New().String(), options),
+		exit:         make(chan bool),
 	}
 
 	go reg.ttlPrune()
@@ -69,14 +98,25 @@ func (m *Registry) ttlPrune() {
 
 	for {
 		select {
+		case <-m.exit:
+			return
 		case <-prune.C:
 			m.Lock()
-			for name, records := range m.records {
-				for version, record := range records {
-					for id, n := range record.Nodes {
-						if n.TTL != 0 && time.Since(n.LastSeen) > n.TTL {
-							logger.Debugf("Registry TTL expired for node %s of service %s", n.Id, name)
-							delete(m.records[name][version].Nodes, id)
+			for ns, services := range m.records {
+				for name, records := range services {
+					for version, record := range records {
+						for id, n := range record.Nodes {
+							if n.TTL != 0 && time.Since(n.LastSeen) > n.TTL {
+								logger.Debugf("Registry TTL expired for node %s of service %s in %s", n.Id, name, ns)
+								delete(m.records[ns][name][version].Nodes, id)
+								m.publish(ns, registry.Delete, &registry.Service{
+									Name:      record.Name,
+									Version:   record.Version,
+									Metadata:  record.Metadata,
+									Endpoints: record.Endpoints,
+									Nodes:     []*registry.Node{n.Node},
+								})
+							}
 						}
 					}
 				}
@@ -86,27 +126,43 @@ func (m *Registry) ttlPrune() {
 	}
 }
 
-func (m *Registry) sendEvent(r *registry.Result) {
+// publish records the change of the namespace with the next revision and
+// wakes up the watchers. It must be called with the lock held.
+func (m *Registry) publish(ns string, t registry.EventType, s *registry.Service) {
+	m.events.Record(t, s)
+
+	m.revision++
+	m.changes = append(m.changes, &change{
+		namespace: ns,
+		result: &registry.Result{
+			Action:   t.String(),
+			Service:  s,
+			Revision: m.revision,
+		},
+	})
+
+	if len(m.changes) > m.watchHistory {
+		m.changes = m.changes[len(m.changes)-m.watchHistory:]
+	}
+
+	close(m.notify)
+	m.notify = make(chan bool)
+}
+
+// since returns the changes after the revision and the channel closed on the next change
+func (m *Registry) since(rev uint64) ([]*change, chan bool, error) {
 	m.RLock()
-	watchers := make([]*Watcher, 0, len(m.watchers))
-	for _, w := range m.watchers {
-		watchers = append(watchers, w)
+	defer m.RUnlock()
+
+	if rev >= m.revision {
+		return nil, m.notify, nil
 	}
-	m.RUnlock()
 
-	for _, w := range watchers {
-		select {
-		case <-w.exit:
-			m.Lock()
-			delete(m.watchers, w.id)
-			m.Unlock()
-		default:
-			select {
-			case w.res <- r:
-			case <-time.After(sendEventTime):
-			}
-		}
+	if len(m.changes) == 0 || m.changes[0].result.Revision > rev+1 {
+		return nil, nil, registry.ErrRevisionCompacted
 	}
+
+	return m.changes[rev+1-m.changes[0].result.Revision:], m.notify, nil
 }
 
 func (m *Registry) Init(opts ...registry.Option) error {
@@ -118,17 +174,22 @@ func (m *Registry) Init(opts ...registry.Option) error {
 	m.Lock()
 	defer m.Unlock()
 
+	if _, ok := m.records[registry.DefaultNamespace]; !ok {
+		m.records[registry.DefaultNamespace] = make(map[string]map[string]*record)
+	}
+	services := m.records[registry.DefaultNamespace]
+
 	records := getServiceRecords(m.options.Context)
 	for name, record := range records {
 		// add a whole new service including all of its versions
-		if _, ok := m.records[name]; !ok {
-			m.records[name] = record
+		if _, ok := services[name]; !ok {
+			services[name] = record
 			continue
 		}
 		// add the versions of the service we dont track yet
 		for version, r := range record {
-			if _, ok := m.records[name][version]; !ok {
-				m.records[name][version] = r
+			if _, ok := services[name][version]; !ok {
+				services[name][version] = r
 				continue
 			}
 		}
@@ -151,51 +212,57 @@ func (m *Registry) Register(s *registry.Service, opts ...registry.RegisterOption
 		o(&options)
 	}
 
+	ns := namespace(options.Namespace)
 	r := serviceToRecord(s, options.TTL)
 
-	if _, ok := m.records[s.Name]; !ok {
-		m.records[s.Name] = make(map[string]*record)
+	if _, ok := m.records[ns]; !ok {
+		m.records[ns] = make(map[string]map[string]*record)
+	}
+	records := m.records[ns]
+
+	if _, ok := records[s.Name]; !ok {
+		records[s.Name] = make(map[string]*record)
 	}
 
-	if _, ok := m.records[s.Name][s.Version]; !ok {
-		m.records[s.Name][s.Version] = r
-		logger.Debugf("registry added new service: %s, version: %s available", s.Name, s.Version)
-		go m.sendEvent(&registry.Result{Action: "update", Service: s})
+	if _, ok := records[s.Name][s.Version]; !ok {
+		records[s.Name][s.Version] = r
+		logger.Debugf("registry added new service: %s, version: %s available in %s", s.Name, s.Version, ns)
+		m.publish(ns, registry.Create, s)
 		return nil
 	}
 
 	addedNodes := false
 	for _, n := range s.Nodes {
-		if _, ok := m.records[s.Name][s.Version].Nodes[n.Id]; !ok {
+		if _, ok := records[s.Name][s.Version].Nodes[n.Id]; !ok {
 			addedNodes = true
 			metadata := make(map[string]string)
 			for k, v := range n.Metadata {
 				metadata[k] = v
-				logger.Debugf("registering %s at %s", s.Name, n.Address)
-				m.records[s.Name][s.Version].Nodes[n.Id] = &node{
-					Node: &registry.Node{
-						Id:       n.Id,
-						Address:  n.Address,
-						Metadata: metadata,
-					},
-					TTL:      options.TTL,
-					LastSeen: time.Now(),
-				}
+			}
+			logger.Debugf("registering %s at %s", s.Name, n.Address)
+			records[s.Name][s.Version].Nodes[n.Id] = &node{
+				Node: &registry.Node{
+					Id:       n.Id,
+					Address:  n.Address,
+					Metadata: metadata,
+				},
+				TTL:      options.TTL,
+				LastSeen: time.Now(),
 			}
 		}
 	}
 
 	if addedNodes {
 		logger.Debugf("Registry added new node to service: %s, version: %s", s.Name, s.Version)
-		go m.sendEvent(&registry.Result{Action: "update", Service: s})
+		m.publish(ns, registry.Update, s)
 		return nil
 	}
 
 	// refresh TTL and timestamp
 	for _, n := range s.Nodes {
 		logger.Debugf("Updated registration for service: %s, version: %s", s.Name, s.Version)
-		m.records[s.Name][s.Version].Nodes[n.Id].TTL = options.TTL
-		m.records[s.Name][s.Version].Nodes[n.Id].LastSeen = time.Now()
+		records[s.Name][s.Version].Nodes[n.Id].TTL = options.TTL
+		records[s.Name][s.Version].Nodes[n.Id].LastSeen = time.Now()
 	}
 
 	return nil
@@ -205,24 +272,44 @@ func (m *Registry) Deregister(s *registry.Service, opts ...registry.DeregisterOp
 	m.Lock()
 	defer m.Unlock()
 
-	if _, ok := m.records[s.Name]; ok {
-		if _, ok := m.records[s.Name][s.Version]; ok {
-			for _, n := range s.Nodes {
-				if _, ok := m.records[s.Name][s.Version].Nodes[n.Id]; ok {
+	var options registry.DeregisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	ns := namespace(options.Namespace)
+	records := m.records[ns]
+
+	if _, ok := records[s.Name]; ok {
+		// the deleted nodes as registered so the watchers see their metadata
+		deleted := &registry.Service{
+			Name:      s.Name,
+			Version:   s.Version,
+			Metadata:  s.Metadata,
+			Endpoints: s.Endpoints,
+			Nodes:     s.Nodes,
+		}
+
+		if _, ok := records[s.Name][s.Version]; ok {
+			deleted.Nodes = make([]*registry.Node, len(s.Nodes))
+			for i, n := range s.Nodes {
+				deleted.Nodes[i] = n
+				if cur, ok := records[s.Name][s.Version].Nodes[n.Id]; ok {
 					logger.Debugf("Registry removed node from service: %s, version: %s", s.Name, s.Version)
-					delete(m.records[s.Name][s.Version].Nodes, n.Id)
+					deleted.Nodes[i] = cur.Node
+					delete(records[s.Name][s.Version].Nodes, n.Id)
 				}
 			}
-			if len(m.records[s.Name][s.Version].Nodes) == 0 {
-				delete(m.records[s.Name], s.Version)
+			if len(records[s.Name][s.Version].Nodes) == 0 {
+				delete(records[s.Name], s.Version)
 				logger.Debugf("Registry removed service: %s, version: %s", s.Name, s.Version)
 			}
 		}
-		if len(m.records[s.Name]) == 0 {
-			delete(m.records, s.Name)
+		if len(records[s.Name]) == 0 {
+			delete(records, s.Name)
 			logger.Debugf("Registry removed service: %s", s.Name)
 		}
-		go m.sendEvent(&registry.Result{Action: "delete", Service: s})
+		m.publish(ns, registry.Delete, deleted)
 	}
 
 	return nil
@@ -232,12 +319,17 @@ func (m *Registry) GetService(name string, opts ...registry.GetOption) ([]*regis
 	m.RLock()
 	defer m.RUnlock()
 
-	records, ok := m.records[name]
+	var options registry.GetOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	records, ok := m.records[namespace(options.Namespace)][name]
 	if !ok {
 		return nil, registry.ErrNotFound
 	}
 
-	services := make([]*registry.Service, len(m.records[name]))
+	services := make([]*registry.Service, len(records))
 	i := 0
 	for _, record := range records {
 		services[i] = recordToService(record)
@@ -251,8 +343,13 @@ func (m *Registry) ListServices(opts ...registry.ListOption) ([]*registry.Servic
 	m.RLock()
 	defer m.RUnlock()
 
+	var options registry.ListOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
 	var services []*registry.Service
-	for _, records := range m.records {
+	for _, records := range m.records[namespace(options.Namespace)] {
 		for _, record := range records {
 			services = append(services, recordToService(record))
 		}
@@ -261,24 +358,136 @@ func (m *Registry) ListServices(opts ...registry.ListOption) ([]*registry.Servic
 	return services, nil
 }
 
+// Watch watches the changes of the namespace. A watch resuming from a
+// revision gets the changes after it as long as they are kept.
 func (m *Registry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
 	var wo registry.WatchOptions
 	for _, o := range opts {
 		o(&wo)
 	}
+	wo.Namespace = namespace(wo.Namespace)
+
+	m.RLock()
+	defer m.RUnlock()
+
+	rev := m.revision
+
+	// the current services are sent as of the current revision
+	var snapshot []*registry.Result
+	if wo.Snapshot {
+		for _, records := range m.records[wo.Namespace] {
+			for _, record := range records {
+				if len(record.Nodes) == 0 {
+					continue
+				}
+				snapshot = append(snapshot, &registry.Result{
+					Action:   registry.Create.String(),
+					Service:  recordToService(record),
+					Revision: rev,
+				})
+			}
+		}
+	} else if wo.Revision > 0 {
+		if wo.Revision > m.revision {
+			return nil, registry.ErrRevisionCompacted
+		}
+		if wo.Revision < m.revision && (len(m.changes) == 0 || m.changes[0].result.Revision > wo.Revision+1) {
+			return nil, registry.ErrRevisionCompacted
+		}
+		rev = wo.Revision
+	}
 
 	w := &Watcher{
 		exit: make(chan bool),
 		res:  make(chan *registry.Result),
-		id:   uuid.New().String(),
+		err:  make(chan error, 1),
 		wo:   wo,
 	}
 
+	go w.run(m, rev, snapshot)
+
+	return w, nil
+}
+
+// UpdateNode patches the metadata of the node, the watchers get an update
+// of the service with the node
+func (m *Registry) UpdateNode(service, version, id string, md map[string]string, opts ...registry.UpdateOption) error {
 	m.Lock()
-	m.watchers[w.id] = w
+	defer m.Unlock()
+
+	var options registry.UpdateOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	ns := namespace(options.Namespace)
+
+	r, ok := m.records[ns][service][version]
+	if !ok {
+		return registry.ErrNotFound
+	}
+	n, ok := r.Nodes[id]
+	if !ok {
+		return registry.ErrNotFound
+	}
+
+	logger.Debugf("Registry updated node %s of service: %s, version: %s", id, service, version)
+	n.Node = &registry.Node{
+		Id:       n.Id,
+		Address:  n.Address,
+		Metadata: registry.PatchMetadata(n.Metadata, md),
+	}
+
+	s := recordToService(r)
+	s.Nodes = []*registry.Node{n.Node}
+	m.publish(ns, registry.Update, s)
+
+	return nil
+}
+
+// UpdateService patches the metadata of the service version, the watchers get
+// an update of the service with all of its nodes
+func (m *Registry) UpdateService(service, version string, md map[string]string, opts ...registry.UpdateOption) error {
+	m.Lock()
+	defer m.Unlock()
+
+	var options registry.UpdateOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	ns := namespace(options.Namespace)
+
+	r, ok := m.records[ns][service][version]
+	if !ok {
+		return registry.ErrNotFound
+	}
+
+	logger.Debugf("Registry updated service: %s, version: %s", service, version)
+	r.Metadata = registry.PatchMetadata(r.Metadata, md)
+	m.publish(ns, registry.Update, recordToService(r))
+
+	return nil
+}
+
+// History returns the registrations, deregistrations and expiries since the time
+func (m *Registry) History(since time.Time, service string) ([]*registry.Event, error) {
+	return m.events.Events(since, service), nil
+}
+
+// Close stops pruning the expired nodes and closes the history file
+func (m *Registry) Close() error {
+	m.Lock()
+	select {
+	case <-m.exit:
+		m.Unlock()
+		return nil
+	default:
+		close(m.exit)
+	}
 	m.Unlock()
 
-	return w, nil
+	return m.events.Close()
 }
 
 func (m *Registry) String() string {
@@ -2,7 +2,10 @@ package memory
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -244,3 +247,214 @@ func TestMemoryRegistryTTLConcurrent(t *testing.T) {
 		}
 	}
 }
+
+func TestMemoryRegistryNamespace(t *testing.T) {
+	m := NewRegistry()
+
+	dev, err := m.Watch(registry.WatchNamespace("dev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Stop()
+
+	results := make(chan *registry.Result, 10)
+	go func() {
+		for {
+			res, err := dev.Next()
+			if err != nil {
+				return
+			}
+			results <- res
+		}
+	}()
+
+	service := testData["foo"][0]
+	if err := m.Register(service, registry.RegisterNamespace("uat")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(service, registry.RegisterNamespace("dev")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case res := <-results:
+		if res.Service.Name != service.Name {
+			t.Fatalf("Expected %s, got %s", service.Name, res.Service.Name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the dev registration")
+	}
+
+	// the default namespace is apart from the others
+	if _, err := m.GetService(service.Name); err != registry.ErrNotFound {
+		t.Fatalf("Expected error: %v, got: %v", registry.ErrNotFound, err)
+	}
+	if services, _ := m.ListServices(); len(services) != 0 {
+		t.Fatalf("Expected no services in the default namespace, got %d", len(services))
+	}
+
+	for _, ns := range []string{"dev", "uat"} {
+		services, err := m.GetService(service.Name, registry.GetNamespace(ns))
+		if err != nil {
+			t.Fatalf("Unexpected error getting service from %s: %v", ns, err)
+		}
+		if len(services) != 1 {
+			t.Fatalf("Expected 1 service in %s, got %d", ns, len(services))
+		}
+	}
+
+	if err := m.Deregister(service, registry.DeregisterNamespace("uat")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetService(service.Name, registry.GetNamespace("uat")); err != registry.ErrNotFound {
+		t.Fatalf("Expected error: %v, got: %v", registry.ErrNotFound, err)
+	}
+	if services, _ := m.ListServices(registry.ListNamespace("dev")); len(services) != 1 {
+		t.Fatalf("Expected 1 service in dev, got %d", len(services))
+	}
+
+	// the uat deregistration is not seen by the dev watcher
+	select {
+	case res := <-results:
+		t.Fatalf("Unexpected %s of %s", res.Action, res.Service.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMemoryRegistryHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	m := NewRegistry(registry.HistoryFile(path))
+
+	h, ok := m.(registry.Historian)
+	if !ok {
+		t.Fatal("Expected the memory registry to keep a history")
+	}
+
+	service := testData["bar"][0]
+	if err := m.Register(service); err != nil {
+		t.Fatal(err)
+	}
+
+	// another node of the same version updates the service
+	node := &registry.Service{
+		Name:    service.Name,
+		Version: service.Version,
+		Nodes:   []*registry.Node{{Id: "bar-1.0.0-new", Address: "localhost:9999"}},
+	}
+	if err := m.Register(node); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Deregister(service); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := h.History(time.Time{}, "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].Type != registry.Create || events[1].Type != registry.Update || events[2].Type != registry.Delete {
+		t.Fatalf("Expected the creation, the update and the deregistration, got %+v", events)
+	}
+	if len(events[2].Service.Nodes) != len(service.Nodes) {
+		t.Fatalf("Expected %d deregistered nodes, got %d", len(service.Nodes), len(events[2].Service.Nodes))
+	}
+
+	if events, _ := h.History(time.Now(), ""); len(events) != 0 {
+		t.Fatalf("Expected no events since now, got %d", len(events))
+	}
+
+	c, ok := m.(io.Closer)
+	if !ok {
+		t.Fatal("Expected the memory registry to be closed")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// closing again is a no-op
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the events after the close are no longer written
+	if err := m.Register(testData["foo"][0]); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "\n"); n != 3 {
+		t.Fatalf("Expected 3 events in the file, got %d", n)
+	}
+}
+
+func TestMemoryRegistryUpdate(t *testing.T) {
+	m := NewRegistry()
+
+	u, ok := m.(registry.Updater)
+	if !ok {
+		t.Fatal("Expected the memory registry to update metadata")
+	}
+
+	service := &registry.Service{
+		Name:     "baz",
+		Version:  "1.0.0",
+		Metadata: map[string]string{"owner": "team-a"},
+		Nodes: []*registry.Node{
+			{Id: "baz-1", Address: "localhost:1111", Metadata: map[string]string{"zone": "a", "drain": "false"}},
+			{Id: "baz-2", Address: "localhost:2222"},
+		},
+	}
+	if err := m.Register(service); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := m.Watch(registry.WatchService("baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	if err := u.UpdateNode("baz", "1.0.0", "baz-1", map[string]string{"drain": "true", "zone": ""}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "update" || len(res.Service.Nodes) != 1 || res.Service.Nodes[0].Id != "baz-1" {
+		t.Fatalf("Expected an update of baz-1, got %s %+v", res.Action, res.Service.Nodes)
+	}
+	if md := res.Service.Nodes[0].Metadata; md["drain"] != "true" || len(md) != 1 {
+		t.Fatalf("Expected the patched metadata, got %v", md)
+	}
+
+	if err := u.UpdateService("baz", "1.0.0", map[string]string{"owner": "team-b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = w.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "update" || res.Service.Metadata["owner"] != "team-b" || len(res.Service.Nodes) != 2 {
+		t.Fatalf("Expected an update of the service with all nodes, got %s %+v", res.Action, res.Service)
+	}
+
+	services, err := m.GetService("baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if services[0].Metadata["owner"] != "team-b" {
+		t.Fatalf("Expected the updated service metadata, got %v", services[0].Metadata)
+	}
+
+	if err := u.UpdateNode("baz", "1.0.0", "missing", nil); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v for a missing node, got %v", registry.ErrNotFound, err)
+	}
+	if err := u.UpdateService("baz", "2.0.0", nil); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v for a missing version, got %v", registry.ErrNotFound, err)
+	}
+}
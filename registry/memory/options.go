@@ -8,6 +8,8 @@ import (
 
 type servicesKey struct{}
 
+type watchHistoryKey struct{}
+
 func getServiceRecords(ctx context.Context) map[string]map[string]*record {
 	memServices, ok := ctx.Value(servicesKey{}).(map[string][]*registry.Service)
 	if !ok {
@@ -38,3 +40,14 @@ func Services(s map[string][]*registry.Service) registry.Option {
 		o.Context = context.WithValue(o.Context, servicesKey{}, s)
 	}
 }
+
+// WatchHistory sets how many changes the registry keeps for the watchers
+// resuming from a revision
+func WatchHistory(n int) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, watchHistoryKey{}, n)
+	}
+}
@@ -6,6 +6,14 @@ import (
 	"github.com/sumlookup/mini/registry"
 )
 
+// namespace returns the namespace, the default one when empty
+func namespace(ns string) string {
+	if len(ns) == 0 {
+		return registry.DefaultNamespace
+	}
+	return ns
+}
+
 func serviceToRecord(s *registry.Service, ttl time.Duration) *record {
 	metadata := make(map[string]string, len(s.Metadata))
 	for k, v := range s.Metadata {
@@ -1,28 +1,67 @@
 package memory
 
 import (
-	"errors"
-
 	"github.com/sumlookup/mini/registry"
 )
 
 type Watcher struct {
-	id   string
 	wo   registry.WatchOptions
 	res  chan *registry.Result
+	err  chan error
 	exit chan bool
 }
 
+// run sends the snapshot and then the changes of the namespace after the revision
+func (m *Watcher) run(r *Registry, rev uint64, snapshot []*registry.Result) {
+	for _, res := range snapshot {
+		select {
+		case m.res <- res:
+		case <-m.exit:
+			return
+		}
+	}
+
+	for {
+		changes, notify, err := r.since(rev)
+		if err != nil {
+			// the watcher fell behind the kept changes
+			m.err <- err
+			return
+		}
+
+		for _, c := range changes {
+			rev = c.result.Revision
+			if c.namespace != m.wo.Namespace {
+				continue
+			}
+
+			select {
+			case m.res <- c.result:
+			case <-m.exit:
+				return
+			}
+		}
+
+		select {
+		case <-notify:
+		case <-m.exit:
+			return
+		}
+	}
+}
+
 func (m *Watcher) Next() (*registry.Result, error) {
 	for {
 		select {
 		case r := <-m.res:
-			if len(m.wo.Service) > 0 && m.wo.Service != r.Service.Name {
+			if r = m.wo.Filter(r); r == nil {
 				continue
 			}
 			return r, nil
+		case err := <-m.err:
+			return nil, err
 		case <-m.exit:
-			return nil, errors.New("watcher stopped")
+			return nil, registry.ErrWatcherStopped
 		}
 	}
 }
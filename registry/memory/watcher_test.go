@@ -2,13 +2,13 @@ package memory
 
 import (
 	"testing"
+	"time"
 
 	"github.com/sumlookup/mini/registry"
 )
 
 func TestWatcher(t *testing.T) {
 	w := &Watcher{
-		id:   "test",
 		res:  make(chan *registry.Result),
 		exit: make(chan bool),
 	}
@@ -28,3 +28,92 @@ func TestWatcher(t *testing.T) {
 		t.Fatal("expected error on Next()")
 	}
 }
+
+func TestWatcherRevisions(t *testing.T) {
+	m := NewRegistry(WatchHistory(3))
+
+	next := func(w registry.Watcher) *registry.Result {
+		res := make(chan *registry.Result, 1)
+		go func() {
+			r, err := w.Next()
+			if err != nil {
+				t.Error("unexpected err", err)
+			}
+			res <- r
+		}()
+
+		select {
+		case r := <-res:
+			return r
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a result")
+		}
+		return nil
+	}
+
+	service := func(id, zone string) *registry.Service {
+		return &registry.Service{
+			Name:    "foo",
+			Version: "1.0.0",
+			Nodes: []*registry.Node{
+				{Id: id, Address: "localhost:9999", Metadata: map[string]string{"zone": zone}},
+			},
+		}
+	}
+
+	if err := m.Register(service("foo-0", "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(service("foo-1", "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot comes first, then the filtered changes
+	w, err := m.Watch(registry.WatchSnapshot(true), registry.WatchMetadata("zone", "b"), registry.WatchVersion("1.0.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := next(w)
+	if snapshot.Action != "create" || len(snapshot.Service.Nodes) != 1 || snapshot.Service.Nodes[0].Id != "foo-1" {
+		t.Fatalf("expected the create of foo-1, got %s of %+v", snapshot.Action, snapshot.Service.Nodes)
+	}
+
+	if err := m.Register(service("foo-2", "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Register(service("foo-3", "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	res := next(w)
+	if len(res.Service.Nodes) != 1 || res.Service.Nodes[0].Id != "foo-3" {
+		t.Fatalf("expected foo-3, got %+v", res.Service.Nodes)
+	}
+	if res.Revision <= snapshot.Revision {
+		t.Fatalf("expected the revision to increase from %d, got %d", snapshot.Revision, res.Revision)
+	}
+	w.Stop()
+
+	// the changes after the revision are sent again
+	w, err = m.Watch(registry.WatchRevision(res.Revision - 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := next(w); r.Revision != res.Revision || r.Service.Nodes[0].Id != "foo-3" {
+		t.Fatalf("expected foo-3 at %d, got %+v at %d", res.Revision, r.Service.Nodes, r.Revision)
+	}
+
+	if err := m.Deregister(service("foo-3", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if r := next(w); r.Action != "delete" || r.Revision != res.Revision+1 {
+		t.Fatalf("expected the delete at %d, got %s at %d", res.Revision+1, r.Action, r.Revision)
+	}
+	w.Stop()
+
+	// only the last 3 changes are kept
+	if _, err := m.Watch(registry.WatchRevision(1)); err != registry.ErrRevisionCompacted {
+		t.Fatalf("expected %v, got %v", registry.ErrRevisionCompacted, err)
+	}
+}
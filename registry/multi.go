@@ -0,0 +1,476 @@
+package registry
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Precedence decides which backend of a multi registry wins when
+// the backends disagree about a service
+type Precedence int
+
+const (
+	// PreferPrimary keeps the details and nodes of the primary registry
+	PreferPrimary Precedence = iota
+	// PreferSecondary keeps the details and nodes of the secondary
+	// registries, the first secondary wins
+	PreferSecondary
+)
+
+type precedenceKey struct{}
+
+// MultiPrecedence sets which backend of the multi registry wins
+func MultiPrecedence(p Precedence) Option {
+	return func(o *Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, precedenceKey{}, p)
+	}
+}
+
+// BackendError is the error of a single backend of a multi registry
+type BackendError struct {
+	Registry Registry
+	Err      error
+}
+
+func (e *BackendError) Error() string {
+	return e.Registry.String() + ": " + e.Err.Error()
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError holds the errors of the backends which failed
+type MultiError struct {
+	Errors []*BackendError
+}
+
+func (e *MultiError) Error() string {
+	errs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err.Error())
+	}
+	return "multi registry: " + strings.Join(errs, "; ")
+}
+
+func (e *MultiError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+type multiRegistry struct {
+	opts Options
+
+	sync.RWMutex
+	primary     Registry
+	secondaries []Registry
+	precedence  Precedence
+}
+
+// NewMulti returns a registry which writes to all the registries and merges
+// what they return. It lets services move from one registry to another
+// while both are in use.
+func NewMulti(primary Registry, secondaries ...Registry) Registry {
+	return &multiRegistry{
+		opts: Options{
+			Context: context.Background(),
+		},
+		primary:     primary,
+		secondaries: secondaries,
+	}
+}
+
+func (m *multiRegistry) Init(opts ...Option) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, o := range opts {
+		o(&m.opts)
+	}
+
+	if m.opts.Context != nil {
+		if p, ok := m.opts.Context.Value(precedenceKey{}).(Precedence); ok {
+			m.precedence = p
+		}
+	}
+
+	return nil
+}
+
+func (m *multiRegistry) Options() Options {
+	return m.opts
+}
+
+// backends returns the registries from the lowest precedence to the highest
+func (m *multiRegistry) backends() []Registry {
+	m.RLock()
+	defer m.RUnlock()
+
+	backends := make([]Registry, 0, len(m.secondaries)+1)
+
+	if m.precedence == PreferSecondary {
+		backends = append(backends, m.primary)
+		for i := len(m.secondaries) - 1; i >= 0; i-- {
+			backends = append(backends, m.secondaries[i])
+		}
+		return backends
+	}
+
+	for i := len(m.secondaries) - 1; i >= 0; i-- {
+		backends = append(backends, m.secondaries[i])
+	}
+	return append(backends, m.primary)
+}
+
+// each calls fn with every backend and returns the errors of the failed ones
+func (m *multiRegistry) each(fn func(Registry) error) error {
+	var errs []*BackendError
+
+	for _, r := range m.backends() {
+		if err := fn(r); err != nil {
+			errs = append(errs, &BackendError{Registry: r, Err: err})
+		}
+	}
+
+	if len(errs) > 0 {
+		return &MultiError{Errors: errs}
+	}
+
+	return nil
+}
+
+func (m *multiRegistry) Register(s *Service, opts ...RegisterOption) error {
+	return m.each(func(r Registry) error {
+		return r.Register(s, opts...)
+	})
+}
+
+func (m *multiRegistry) Deregister(s *Service, opts ...DeregisterOption) error {
+	return m.each(func(r Registry) error {
+		return r.Deregister(s, opts...)
+	})
+}
+
+// GetService merges the services of the backends. The backends which fail are
+// logged as long as one of them answered.
+func (m *multiRegistry) GetService(name string, opts ...GetOption) ([]*Service, error) {
+	var services []*Service
+	var answered bool
+
+	err := m.each(func(r Registry) error {
+		s, err := r.GetService(name, opts...)
+		if err == ErrNotFound {
+			answered = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		answered = true
+		services = Merge(services, s)
+		return nil
+	})
+
+	if !answered {
+		return nil, err
+	}
+	if err != nil {
+		log.Warnf("[multi] registry getting %s: %v", name, err)
+	}
+	if len(services) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return services, nil
+}
+
+// ListServices merges the services of the backends by name
+func (m *multiRegistry) ListServices(opts ...ListOption) ([]*Service, error) {
+	var answered bool
+	byName := make(map[string][]*Service)
+
+	err := m.each(func(r Registry) error {
+		services, err := r.ListServices(opts...)
+		if err != nil {
+			return err
+		}
+
+		answered = true
+
+		seen := make(map[string][]*Service)
+		for _, s := range services {
+			seen[s.Name] = append(seen[s.Name], s)
+		}
+		for name, s := range seen {
+			byName[name] = Merge(byName[name], s)
+		}
+		return nil
+	})
+
+	if !answered {
+		return nil, err
+	}
+	if err != nil {
+		log.Warnf("[multi] registry listing services: %v", err)
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var services []*Service
+	for _, name := range names {
+		services = append(services, byName[name]...)
+	}
+
+	return services, nil
+}
+
+func (m *multiRegistry) Watch(opts ...WatchOption) (Watcher, error) {
+	backends := m.backends()
+
+	w := &multiWatcher{
+		backends: backends,
+		state:    make([]map[string]*Service, len(backends)),
+		next:     make(chan *multiResult),
+		exit:     make(chan bool),
+	}
+
+	for i, r := range backends {
+		bw, err := r.Watch(opts...)
+		if err != nil {
+			w.Stop()
+			return nil, &MultiError{Errors: []*BackendError{{Registry: r, Err: err}}}
+		}
+		w.watchers = append(w.watchers, bw)
+		w.state[i] = make(map[string]*Service)
+	}
+
+	for i := range w.watchers {
+		go w.run(i)
+	}
+
+	return w, nil
+}
+
+func (m *multiRegistry) String() string {
+	return "multi"
+}
+
+type multiResult struct {
+	backend int
+	res     *Result
+	err     error
+}
+
+// multiWatcher merges the events of the backends. It keeps the services of
+// every backend so the same change reported by several backends is only
+// reported once.
+type multiWatcher struct {
+	backends []Registry
+	watchers []Watcher
+	next     chan *multiResult
+	exit     chan bool
+	once     sync.Once
+
+	// the services by name/version of each backend, only used by Next
+	state []map[string]*Service
+	// results left to return
+	pending []*Result
+}
+
+func (w *multiWatcher) run(i int) {
+	for {
+		res, err := w.watchers[i].Next()
+		if err == ErrWatcherStopped {
+			return
+		}
+
+		select {
+		case w.next <- &multiResult{backend: i, res: res, err: err}:
+		case <-w.exit:
+			return
+		}
+
+		// the backend watcher is done, the error tells the caller
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Next returns the changes of the merged services. The errors of the backend
+// watchers are returned as a BackendError, the other backends keep going.
+func (w *multiWatcher) Next() (*Result, error) {
+	for len(w.pending) == 0 {
+		select {
+		case r := <-w.next:
+			if r.err != nil {
+				return nil, &BackendError{Registry: w.backends[r.backend], Err: r.err}
+			}
+			w.pending = w.apply(r.backend, r.res)
+		case <-w.exit:
+			return nil, ErrWatcherStopped
+		}
+	}
+
+	res := w.pending[0]
+	w.pending = w.pending[1:]
+	return res, nil
+}
+
+// apply updates the services of the backend with the result and returns the
+// changes of the merged service
+func (w *multiWatcher) apply(backend int, res *Result) []*Result {
+	if res == nil || res.Service == nil {
+		return nil
+	}
+
+	key := res.Service.Name + "/" + res.Service.Version
+	before := w.merged(key)
+
+	state := w.state[backend]
+	switch res.Action {
+	case Delete.String():
+		if s, ok := state[key]; ok {
+			s.Nodes = removeNodes(s.Nodes, res.Service.Nodes)
+			if len(s.Nodes) == 0 {
+				delete(state, key)
+			}
+		}
+	default:
+		state[key] = Merge(service(state[key]), []*Service{res.Service})[0]
+	}
+
+	return changes(before, w.merged(key))
+}
+
+// merged returns the service merged from the backends
+func (w *multiWatcher) merged(key string) *Service {
+	var services []*Service
+	for _, state := range w.state {
+		if s, ok := state[key]; ok {
+			services = Merge(services, []*Service{s})
+		}
+	}
+	if len(services) == 0 {
+		return nil
+	}
+	return services[0]
+}
+
+func service(s *Service) []*Service {
+	if s == nil {
+		return nil
+	}
+	return []*Service{s}
+}
+
+// changes returns the results which turn the service before into the one after.
+// Like the other registries, updates carry the added nodes and deletes the
+// removed ones.
+func changes(before, after *Service) []*Result {
+	switch {
+	case before == nil && after == nil:
+		return nil
+	case before == nil:
+		return []*Result{{Action: Create.String(), Service: after}}
+	case after == nil:
+		return []*Result{{Action: Delete.String(), Service: before}}
+	}
+
+	var results []*Result
+
+	var removed []*Node
+	for _, o := range before.Nodes {
+		if findNode(after.Nodes, o.Id) == nil {
+			removed = append(removed, o)
+		}
+	}
+	if len(removed) > 0 {
+		s := copyService(before)
+		s.Nodes = removed
+		results = append(results, &Result{Action: Delete.String(), Service: s})
+	}
+
+	var updated []*Node
+	for _, n := range after.Nodes {
+		if o := findNode(before.Nodes, n.Id); o == nil || !equalNodes(o, n) {
+			updated = append(updated, n)
+		}
+	}
+	if len(updated) > 0 || !equalDetails(before, after) {
+		s := copyService(after)
+		if len(updated) > 0 {
+			s.Nodes = updated
+		}
+		results = append(results, &Result{Action: Update.String(), Service: s})
+	}
+
+	return results
+}
+
+func findNode(nodes []*Node, id string) *Node {
+	for _, n := range nodes {
+		if n.Id == id {
+			return n
+		}
+	}
+	return nil
+}
+
+func removeNodes(nodes, del []*Node) []*Node {
+	var left []*Node
+	for _, n := range nodes {
+		if findNode(del, n.Id) == nil {
+			left = append(left, n)
+		}
+	}
+	return left
+}
+
+func equalNodes(a, b *Node) bool {
+	return a.Address == b.Address && equalMetadata(a.Metadata, b.Metadata)
+}
+
+func equalDetails(a, b *Service) bool {
+	if len(a.Endpoints) == 0 && len(b.Endpoints) == 0 {
+		return equalMetadata(a.Metadata, b.Metadata)
+	}
+	return equalMetadata(a.Metadata, b.Metadata) && reflect.DeepEqual(a.Endpoints, b.Endpoints)
+}
+
+func equalMetadata(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *multiWatcher) Stop() {
+	w.once.Do(func() {
+		close(w.exit)
+		for _, bw := range w.watchers {
+			bw.Stop()
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package registry_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+)
+
+// failing is a registry whose backend is down
+type failing struct {
+	registry.Registry
+}
+
+var errDown = errors.New("down")
+
+func (f *failing) Register(*registry.Service, ...registry.RegisterOption) error {
+	return errDown
+}
+
+func (f *failing) GetService(string, ...registry.GetOption) ([]*registry.Service, error) {
+	return nil, errDown
+}
+
+func (f *failing) String() string {
+	return "failing"
+}
+
+func newService(id, address string, md map[string]string) *registry.Service {
+	return &registry.Service{
+		Name:     "foo",
+		Version:  "1.0.0",
+		Metadata: md,
+		Nodes: []*registry.Node{
+			{Id: id, Address: address},
+		},
+	}
+}
+
+func TestMultiRegistry(t *testing.T) {
+	primary := memory.NewRegistry()
+	secondary := memory.NewRegistry()
+	m := registry.NewMulti(primary, secondary)
+
+	// a node only the secondary knows about
+	if err := secondary.Register(newService("foo-2", "10.0.0.2:8080", map[string]string{"team": "secondary"})); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	s1 := newService("foo-1", "10.0.0.1:8080", map[string]string{"team": "primary"})
+	if err := m.Register(s1); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	for _, r := range []registry.Registry{primary, secondary} {
+		if _, err := r.GetService("foo"); err != nil {
+			t.Fatalf("Expected foo in %s, got %v", r.String(), err)
+		}
+	}
+
+	services, err := m.GetService("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error getting service %v", err)
+	}
+	if len(services) != 1 || len(services[0].Nodes) != 2 {
+		t.Fatalf("Expected 1 service with 2 nodes, got %+v", services)
+	}
+	if team := services[0].Metadata["team"]; team != "primary" {
+		t.Fatalf("Expected the primary to win, got %s", team)
+	}
+
+	if err := m.Init(registry.MultiPrecedence(registry.PreferSecondary)); err != nil {
+		t.Fatalf("Unexpected init error %v", err)
+	}
+
+	services, err = m.GetService("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error getting service %v", err)
+	}
+	if team := services[0].Metadata["team"]; team != "secondary" {
+		t.Fatalf("Expected the secondary to win, got %s", team)
+	}
+
+	list, err := m.ListServices()
+	if err != nil {
+		t.Fatalf("Unexpected error listing services %v", err)
+	}
+	if len(list) != 1 || list[0].Name != "foo" {
+		t.Fatalf("Expected only foo, got %+v", list)
+	}
+
+	if err := m.Deregister(s1); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+
+	services, err = m.GetService("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error getting service %v", err)
+	}
+	if len(services[0].Nodes) != 1 || services[0].Nodes[0].Id != "foo-2" {
+		t.Fatalf("Expected only foo-2, got %+v", services[0].Nodes)
+	}
+}
+
+func TestMultiRegistryErrors(t *testing.T) {
+	primary := memory.NewRegistry()
+	down := &failing{}
+	m := registry.NewMulti(primary, down)
+
+	err := m.Register(newService("foo-1", "10.0.0.1:8080", nil))
+
+	var merr *registry.MultiError
+	if !errors.As(err, &merr) {
+		t.Fatalf("Expected a multi error, got %v", err)
+	}
+	if len(merr.Errors) != 1 || merr.Errors[0].Registry != down {
+		t.Fatalf("Expected only the failing backend error, got %v", merr)
+	}
+	if !errors.Is(err, errDown) {
+		t.Fatalf("Expected the error of the backend, got %v", err)
+	}
+
+	// the primary still answers
+	services, err := m.GetService("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error getting service %v", err)
+	}
+	if len(services) != 1 || len(services[0].Nodes) != 1 {
+		t.Fatalf("Expected 1 service with 1 node, got %+v", services)
+	}
+
+	// nobody answers
+	if _, err := registry.NewMulti(down).GetService("foo"); !errors.Is(err, errDown) {
+		t.Fatalf("Expected the error of the backend, got %v", err)
+	}
+}
+
+func TestMultiRegistryWatch(t *testing.T) {
+	primary := memory.NewRegistry()
+	secondary := memory.NewRegistry()
+	m := registry.NewMulti(primary, secondary)
+
+	w, err := m.Watch()
+	if err != nil {
+		t.Fatalf("Unexpected watch error %v", err)
+	}
+	defer w.Stop()
+
+	results := make(chan *registry.Result, 10)
+	go func() {
+		for {
+			res, err := w.Next()
+			if err != nil {
+				return
+			}
+			results <- res
+		}
+	}()
+
+	next := func(action string, id string) {
+		select {
+		case res := <-results:
+			if res.Action != action || len(res.Service.Nodes) != 1 || res.Service.Nodes[0].Id != id {
+				t.Fatalf("Expected %s of %s, got %s of %+v", action, id, res.Action, res.Service)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s of %s", action, id)
+		}
+	}
+
+	none := func() {
+		select {
+		case res := <-results:
+			t.Fatalf("Unexpected %s of %+v", res.Action, res.Service)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	s1 := newService("foo-1", "10.0.0.1:8080", nil)
+	s2 := newService("foo-2", "10.0.0.2:8080", nil)
+
+	// both backends report the registration, it is reported once
+	if err := m.Register(s1); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	next(registry.Create.String(), "foo-1")
+	none()
+
+	if err := secondary.Register(s2); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	next(registry.Update.String(), "foo-2")
+	none()
+
+	if err := m.Deregister(s1); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+	next(registry.Delete.String(), "foo-1")
+	none()
+}
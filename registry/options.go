@@ -18,6 +18,8 @@ type Options struct {
 
 type RegisterOptions struct {
 	TTL time.Duration
+	// Namespace the service is registered in
+	Namespace string
 	// Other options for implementations of the interface
 	// can be stored in a context
 	Context context.Context
@@ -27,21 +29,41 @@ type WatchOptions struct {
 	// Specify a service to watch
 	// If blank, the watch is for all services
 	Service string
+	// Namespace to watch
+	Namespace string
+	// Version of the service to watch, all versions if blank
+	Version string
+	// Metadata the watched nodes have, all nodes if empty
+	Metadata map[string]string
+	// Snapshot emits a create event for every current service
+	// before the changes
+	Snapshot bool
+	// Revision resumes the watch with the changes after the revision
+	Revision uint64
 	// Other options for implementations of the interface
 	// can be stored in a context
 	Context context.Context
 }
 
 type DeregisterOptions struct {
-	Context context.Context
+	Namespace string
+	Context   context.Context
 }
 
 type GetOptions struct {
-	Context context.Context
+	Namespace string
+	Context   context.Context
+}
+
+type UpdateOptions struct {
+	// Namespace the service is registered in
+	Namespace string
+	Context   context.Context
 }
 
 type ListOptions struct {
-	Context context.Context
+	Namespace string
+	Context   context.Context
 }
 
 // Addrs is the registry addresses to use
@@ -90,6 +112,40 @@ func WatchService(name string) WatchOption {
 	}
 }
 
+// WatchVersion watches a version of the service
+func WatchVersion(v string) WatchOption {
+	return func(o *WatchOptions) {
+		o.Version = v
+	}
+}
+
+// WatchMetadata watches the nodes whose metadata has the key and value
+func WatchMetadata(key, value string) WatchOption {
+	return func(o *WatchOptions) {
+		if o.Metadata == nil {
+			o.Metadata = make(map[string]string)
+		}
+		o.Metadata[key] = value
+	}
+}
+
+// WatchSnapshot emits a create event for every current service before
+// the changes so that the watcher doesn't have to get the services first
+func WatchSnapshot(b bool) WatchOption {
+	return func(o *WatchOptions) {
+		o.Snapshot = b
+	}
+}
+
+// WatchRevision resumes a watch with the changes after the revision of the
+// last result. The watch fails with ErrRevisionCompacted when the registry
+// no longer has all of them.
+func WatchRevision(rev uint64) WatchOption {
+	return func(o *WatchOptions) {
+		o.Revision = rev
+	}
+}
+
 func WatchContext(ctx context.Context) WatchOption {
 	return func(o *WatchOptions) {
 		o.Context = ctx
@@ -113,3 +169,51 @@ func ListContext(ctx context.Context) ListOption {
 		o.Context = ctx
 	}
 }
+
+// RegisterNamespace registers the service in the namespace
+func RegisterNamespace(ns string) RegisterOption {
+	return func(o *RegisterOptions) {
+		o.Namespace = ns
+	}
+}
+
+// DeregisterNamespace deregisters the service from the namespace
+func DeregisterNamespace(ns string) DeregisterOption {
+	return func(o *DeregisterOptions) {
+		o.Namespace = ns
+	}
+}
+
+// GetNamespace gets the service from the namespace
+func GetNamespace(ns string) GetOption {
+	return func(o *GetOptions) {
+		o.Namespace = ns
+	}
+}
+
+// ListNamespace lists the services of the namespace
+func ListNamespace(ns string) ListOption {
+	return func(o *ListOptions) {
+		o.Namespace = ns
+	}
+}
+
+// WatchNamespace watches the services of the namespace
+func WatchNamespace(ns string) WatchOption {
+	return func(o *WatchOptions) {
+		o.Namespace = ns
+	}
+}
+
+// UpdateNamespace updates the service registered in the namespace
+func UpdateNamespace(ns string) UpdateOption {
+	return func(o *UpdateOptions) {
+		o.Namespace = ns
+	}
+}
+
+func UpdateContext(ctx context.Context) UpdateOption {
+	return func(o *UpdateOptions) {
+		o.Context = ctx
+	}
+}
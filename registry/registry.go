@@ -8,10 +8,17 @@ import (
 var (
 	DefaultRegistry = NewRegistry()
 
+	// DefaultNamespace is the namespace used when none is given. The
+	// namespaces keep the services of the environments sharing a registry apart.
+	DefaultNamespace = "default"
+
 	// Not found error when GetService is called
 	ErrNotFound = errors.New("service not found")
 	// Watcher stopped error when watcher is stopped
 	ErrWatcherStopped = errors.New("watcher stopped")
+	// ErrRevisionCompacted is returned when a watch can't resume from the
+	// revision because the changes after it are no longer known
+	ErrRevisionCompacted = errors.New("revision compacted")
 )
 
 // The registry provides an interface for service discovery
@@ -68,6 +75,8 @@ type GetOption func(*GetOptions)
 
 type ListOption func(*ListOptions)
 
+type UpdateOption func(*UpdateOptions)
+
 // Register a service node. Additionally supply options such as TTL.
 func Register(s *Service, opts ...RegisterOption) error {
 	return DefaultRegistry.Register(s, opts...)
@@ -0,0 +1,200 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+	"google.golang.org/grpc"
+)
+
+// The registry service messages are sent with the json codec so
+// they don't need generated code.
+
+type RegisterRequest struct {
+	Service   *registry.Service `json:"service"`
+	TTL       time.Duration     `json:"ttl,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+}
+
+type RegisterResponse struct{}
+
+type DeregisterRequest struct {
+	Service   *registry.Service `json:"service"`
+	Namespace string            `json:"namespace,omitempty"`
+}
+
+type DeregisterResponse struct{}
+
+type GetServiceRequest struct {
+	Service   string `json:"service"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type GetServiceResponse struct {
+	Services []*registry.Service `json:"services"`
+}
+
+type ListServicesRequest struct {
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type ListServicesResponse struct {
+	Services []*registry.Service `json:"services"`
+}
+
+type WatchRequest struct {
+	// Service to watch, every service when blank
+	Service  string            `json:"service,omitempty"`
+	Version  string            `json:"version,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Snapshot bool              `json:"snapshot,omitempty"`
+	Revision uint64            `json:"revision,omitempty"`
+	// Namespace to watch, the default namespace when blank
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type WatchResponse struct {
+	Action   string            `json:"action"`
+	Service  *registry.Service `json:"service"`
+	Revision uint64            `json:"revision,omitempty"`
+}
+
+// RegistryServer is the server API of the registry service
+type RegistryServer interface {
+	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
+	Deregister(context.Context, *DeregisterRequest) (*DeregisterResponse, error)
+	GetService(context.Context, *GetServiceRequest) (*GetServiceResponse, error)
+	ListServices(context.Context, *ListServicesRequest) (*ListServicesResponse, error)
+	Watch(*WatchRequest, Registry_WatchServer) error
+}
+
+// Registry_WatchServer is the server side of a watch
+type Registry_WatchServer interface {
+	Send(*WatchResponse) error
+	grpc.ServerStream
+}
+
+type registryWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *registryWatchServer) Send(m *WatchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func registerHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mini.registry.Registry/Register",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func deregisterHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeregisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).Deregister(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mini.registry.Registry/Deregister",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).Deregister(ctx, req.(*DeregisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func getServiceHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).GetService(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mini.registry.Registry/GetService",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).GetService(ctx, req.(*GetServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func listServicesHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListServicesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).ListServices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mini.registry.Registry/ListServices",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).ListServices(ctx, req.(*ListServicesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func watchHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RegistryServer).Watch(m, &registryWatchServer{stream})
+}
+
+// serviceDesc describes the mini.registry.Registry grpc service
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "mini.registry.Registry",
+	HandlerType: (*RegistryServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Register",
+			Handler:    registerHandler,
+		},
+		{
+			MethodName: "Deregister",
+			Handler:    deregisterHandler,
+		},
+		{
+			MethodName: "GetService",
+			Handler:    getServiceHandler,
+		},
+		{
+			MethodName: "ListServices",
+			Handler:    listServicesHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       watchHandler,
+			ServerStreams: true,
+		},
+	},
+}
+
+// RegisterRegistryServer registers the registry service on the grpc server
+func RegisterRegistryServer(s *grpc.Server, srv RegistryServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/server"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Handler serves a registry through the registry service
+type Handler struct {
+	registry registry.Registry
+}
+
+// NewHandler returns the registry service handler of the registry
+func NewHandler(r registry.Registry) *Handler {
+	return &Handler{
+		registry: r,
+	}
+}
+
+// Register adds the registry service to the server
+func Register(srv *server.Server, h *Handler) {
+	RegisterRegistryServer(srv.Server(), h)
+	srv.AddHandler(h)
+}
+
+func (h *Handler) Register(ctx context.Context, req *RegisterRequest) (*RegisterResponse, error) {
+	if req.Service == nil {
+		return nil, status.Error(codes.InvalidArgument, "service is required")
+	}
+
+	if err := h.registry.Register(req.Service, registry.RegisterTTL(req.TTL), registry.RegisterNamespace(req.Namespace), registry.RegisterContext(ctx)); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &RegisterResponse{}, nil
+}
+
+func (h *Handler) Deregister(ctx context.Context, req *DeregisterRequest) (*DeregisterResponse, error) {
+	if req.Service == nil {
+		return nil, status.Error(codes.InvalidArgument, "service is required")
+	}
+
+	if err := h.registry.Deregister(req.Service, registry.DeregisterNamespace(req.Namespace), registry.DeregisterContext(ctx)); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &DeregisterResponse{}, nil
+}
+
+func (h *Handler) GetService(ctx context.Context, req *GetServiceRequest) (*GetServiceResponse, error) {
+	services, err := h.registry.GetService(req.Service, registry.GetNamespace(req.Namespace), registry.GetContext(ctx))
+	if err == registry.ErrNotFound {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &GetServiceResponse{Services: services}, nil
+}
+
+func (h *Handler) ListServices(ctx context.Context, req *ListServicesRequest) (*ListServicesResponse, error) {
+	services, err := h.registry.ListServices(registry.ListNamespace(req.Namespace), registry.ListContext(ctx))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &ListServicesResponse{Services: services}, nil
+}
+
+// Watch streams the registry changes until the caller goes away
+func (h *Handler) Watch(req *WatchRequest, stream Registry_WatchServer) error {
+	opts := []registry.WatchOption{
+		registry.WatchVersion(req.Version),
+		registry.WatchSnapshot(req.Snapshot),
+		registry.WatchRevision(req.Revision),
+		registry.WatchNamespace(req.Namespace),
+	}
+	if len(req.Service) > 0 {
+		opts = append(opts, registry.WatchService(req.Service))
+	}
+	for k, v := range req.Metadata {
+		opts = append(opts, registry.WatchMetadata(k, v))
+	}
+
+	w, err := h.registry.Watch(opts...)
+	if err == registry.ErrRevisionCompacted {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	// unblock Next once the stream is done
+	go func() {
+		<-stream.Context().Done()
+		w.Stop()
+	}()
+	defer w.Stop()
+
+	for {
+		res, err := w.Next()
+		if err != nil {
+			if stream.Context().Err() != nil {
+				return nil
+			}
+			if err == registry.ErrRevisionCompacted {
+				return status.Error(codes.OutOfRange, err.Error())
+			}
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		if err := stream.Send(&WatchResponse{Action: res.Action, Service: res.Service, Revision: res.Revision}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// Package service provides a registry which uses the registry service,
+// a grpc server exposing any other registry
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sumlookup/mini/client"
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/transport"
+	tgrpc "github.com/sumlookup/mini/transport/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	contentType = "application/json"
+)
+
+var (
+	// DefaultService is the name the registry service is registered with
+	DefaultService = "mini.registry"
+	// DefaultAddress is used without the registry.Addrs option
+	DefaultAddress = "127.0.0.1:8008"
+	// DefaultTimeout of the registry calls without the registry.Timeout option
+	DefaultTimeout = 5 * time.Second
+)
+
+type transportKey struct{}
+
+// Transport sets the transport the registry service is reached with,
+// transport/grpc by default
+func Transport(t transport.Transport) registry.Option {
+	return func(o *registry.Options) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, transportKey{}, t)
+	}
+}
+
+type serviceRegistry struct {
+	opts registry.Options
+
+	sync.RWMutex
+	address string
+	client  *client.Client
+}
+
+type serviceWatcher struct {
+	stream client.Stream
+	cancel context.CancelFunc
+}
+
+// NewRegistry returns a registry which calls the registry service at
+// the first of the registry addresses
+func NewRegistry(opts ...registry.Option) registry.Registry {
+	r := &serviceRegistry{
+		opts: registry.Options{
+			Context: context.Background(),
+			Timeout: DefaultTimeout,
+		},
+	}
+	r.configure(opts...)
+	return r
+}
+
+func (s *serviceRegistry) configure(opts ...registry.Option) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, o := range opts {
+		o(&s.opts)
+	}
+
+	s.address = DefaultAddress
+	if len(s.opts.Addrs) > 0 {
+		s.address = s.opts.Addrs[0]
+	}
+
+	var tr transport.Transport
+	if s.opts.Context != nil {
+		tr, _ = s.opts.Context.Value(transportKey{}).(transport.Transport)
+	}
+	if tr == nil {
+		tr = tgrpc.NewTransport(transport.Secure(s.opts.Secure), transport.TLSConfig(s.opts.TLSConfig))
+	}
+
+	// the registry service is dialed directly, there is no registry to find it in
+	s.client = client.New(
+		client.WithTransport(tr),
+		client.WithHostOverride(s.address),
+	)
+}
+
+func (s *serviceRegistry) getClient() *client.Client {
+	s.RLock()
+	defer s.RUnlock()
+	return s.client
+}
+
+func (s *serviceRegistry) call(ctx context.Context, method string, req, rsp interface{}) error {
+	if s.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.Timeout)
+		defer cancel()
+	}
+
+	err := s.getClient().Call(ctx, DefaultService, "mini.registry.Registry."+method, req, rsp, client.WithContentType(contentType))
+	if status.Code(err) == codes.NotFound {
+		return registry.ErrNotFound
+	}
+
+	return err
+}
+
+func (s *serviceRegistry) Init(opts ...registry.Option) error {
+	s.configure(opts...)
+	return nil
+}
+
+func (s *serviceRegistry) Options() registry.Options {
+	return s.opts
+}
+
+func (s *serviceRegistry) Register(srv *registry.Service, opts ...registry.RegisterOption) error {
+	var options registry.RegisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return s.call(ctx, "Register", &RegisterRequest{Service: srv, TTL: options.TTL, Namespace: options.Namespace}, new(RegisterResponse))
+}
+
+func (s *serviceRegistry) Deregister(srv *registry.Service, opts ...registry.DeregisterOption) error {
+	var options registry.DeregisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return s.call(ctx, "Deregister", &DeregisterRequest{Service: srv, Namespace: options.Namespace}, new(DeregisterResponse))
+}
+
+func (s *serviceRegistry) GetService(name string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	var options registry.GetOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	rsp := new(GetServiceResponse)
+	if err := s.call(ctx, "GetService", &GetServiceRequest{Service: name, Namespace: options.Namespace}, rsp); err != nil {
+		return nil, err
+	}
+
+	if len(rsp.Services) == 0 {
+		return nil, registry.ErrNotFound
+	}
+
+	return rsp.Services, nil
+}
+
+func (s *serviceRegistry) ListServices(opts ...registry.ListOption) ([]*registry.Service, error) {
+	var options registry.ListOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	rsp := new(ListServicesResponse)
+	if err := s.call(ctx, "ListServices", &ListServicesRequest{Namespace: options.Namespace}, rsp); err != nil {
+		return nil, err
+	}
+
+	return rsp.Services, nil
+}
+
+// Watch streams the changes from the registry service. The watcher fails once
+// the stream breaks, the caller is expected to watch again.
+func (s *serviceRegistry) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	var options registry.WatchOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream, err := s.getClient().Stream(ctx, DefaultService, "mini.registry.Registry.Watch", client.WithContentType(contentType))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	req := &WatchRequest{
+		Service:   options.Service,
+		Version:   options.Version,
+		Metadata:  options.Metadata,
+		Snapshot:  options.Snapshot,
+		Revision:  options.Revision,
+		Namespace: options.Namespace,
+	}
+
+	if err := stream.Send(req); err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &serviceWatcher{
+		stream: stream,
+		cancel: cancel,
+	}, nil
+}
+
+func (s *serviceRegistry) String() string {
+	return "service"
+}
+
+func (w *serviceWatcher) Next() (*registry.Result, error) {
+	rsp := new(WatchResponse)
+	if err := w.stream.Recv(rsp); err != nil {
+		switch status.Code(err) {
+		case codes.Canceled:
+			return nil, registry.ErrWatcherStopped
+		case codes.OutOfRange:
+			return nil, registry.ErrRevisionCompacted
+		}
+		return nil, err
+	}
+
+	return &registry.Result{
+		Action:   rsp.Action,
+		Service:  rsp.Service,
+		Revision: rsp.Revision,
+	}, nil
+}
+
+func (w *serviceWatcher) Stop() {
+	w.cancel()
+}
@@ -0,0 +1,279 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+	"github.com/sumlookup/mini/server"
+	tgrpc "github.com/sumlookup/mini/transport/grpc"
+)
+
+func newService(id, address string) *registry.Service {
+	return &registry.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{Id: id, Address: address, Metadata: map[string]string{"foo": "bar"}},
+		},
+	}
+}
+
+// newRegistry serves a memory registry and returns the registry client of it
+func newRegistry(t *testing.T) (registry.Registry, registry.Registry) {
+	m := memory.NewRegistry()
+
+	srv := server.NewServer(
+		server.ServiceName(DefaultService),
+		server.WithHost("127.0.0.1"),
+		server.WithTransport(tgrpc.NewTransport()),
+	)
+	Register(srv, NewHandler(m))
+
+	go srv.Run()
+	<-srv.Ready()
+	t.Cleanup(srv.Stop)
+
+	r := NewRegistry(registry.Addrs(fmt.Sprintf("127.0.0.1:%d", srv.GetPort())))
+
+	return r, m
+}
+
+func TestServiceRegistry(t *testing.T) {
+	r, m := newRegistry(t)
+
+	if _, err := r.GetService("foo"); err != registry.ErrNotFound {
+		t.Fatalf("Expected %v, got %v", registry.ErrNotFound, err)
+	}
+
+	s1 := newService("foo-1", "10.0.0.1:8080")
+	s2 := newService("foo-2", "10.0.0.2:8080")
+
+	if err := r.Register(s1); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	if err := r.Register(s2); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	// the served registry and its client agree
+	for _, reg := range []registry.Registry{r, m} {
+		services, err := reg.GetService("foo")
+		if err != nil {
+			t.Fatalf("Unexpected error getting service %v", err)
+		}
+		if len(services) != 1 || len(services[0].Nodes) != 2 {
+			t.Fatalf("Expected 1 service with 2 nodes, got %+v", services)
+		}
+		if services[0].Nodes[0].Metadata["foo"] != "bar" {
+			t.Fatalf("Expected node metadata, got %+v", services[0].Nodes[0].Metadata)
+		}
+	}
+
+	if err := r.Deregister(s1); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+
+	services, err := r.ListServices()
+	if err != nil {
+		t.Fatalf("Unexpected error listing services %v", err)
+	}
+
+	var nodes []*registry.Node
+	for _, s := range services {
+		if s.Name == "foo" {
+			nodes = append(nodes, s.Nodes...)
+		}
+	}
+	if len(nodes) != 1 || nodes[0].Id != "foo-2" {
+		t.Fatalf("Expected only foo-2, got %+v", nodes)
+	}
+}
+
+func TestServiceRegistryTTL(t *testing.T) {
+	r, m := newRegistry(t)
+
+	if err := r.Register(newService("foo-1", "10.0.0.1:8080"), registry.RegisterTTL(time.Minute)); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	if _, err := m.GetService("foo"); err != nil {
+		t.Fatalf("Unexpected error getting service %v", err)
+	}
+}
+
+func TestServiceRegistryWatch(t *testing.T) {
+	r, _ := newRegistry(t)
+
+	w, err := r.Watch(registry.WatchService("foo"))
+	if err != nil {
+		t.Fatalf("Unexpected watch error %v", err)
+	}
+
+	results := make(chan *registry.Result, 10)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			res, err := w.Next()
+			if err != nil {
+				errs <- err
+				return
+			}
+			results <- res
+		}
+	}()
+
+	// next skips the late changes of the nodes added while waiting for the watcher
+	next := func(action string) *registry.Result {
+		for {
+			select {
+			case res := <-results:
+				if res.Action == action {
+					return res
+				}
+			case err := <-errs:
+				t.Fatalf("Unexpected watcher error %v", err)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for %s", action)
+			}
+		}
+	}
+
+	// the watcher of the served registry is set up once the request reached
+	// the server, add nodes until the first change comes through
+	var s *registry.Service
+	deadline := time.After(5 * time.Second)
+	for i := 0; s == nil; i++ {
+		n := newService(fmt.Sprintf("foo-%d", i), fmt.Sprintf("10.0.0.%d:8080", i))
+		if err := r.Register(n); err != nil {
+			t.Fatalf("Unexpected register error %v", err)
+		}
+
+		select {
+		case res := <-results:
+			if res.Service.Name != "foo" || len(res.Service.Nodes) != 1 {
+				t.Fatalf("Expected a foo node, got %+v", res.Service)
+			}
+			s = res.Service
+		case err := <-errs:
+			t.Fatalf("Unexpected watcher error %v", err)
+		case <-deadline:
+			t.Fatal("Timed out waiting for the watcher")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	if err := r.Deregister(s); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+
+	res := next(registry.Delete.String())
+	if res.Service.Nodes[0].Id != s.Nodes[0].Id {
+		t.Fatalf("Expected %s to be deleted, got %+v", s.Nodes[0].Id, res.Service.Nodes[0])
+	}
+
+	w.Stop()
+
+	select {
+	case err := <-errs:
+		if err != registry.ErrWatcherStopped {
+			t.Fatalf("Expected %v, got %v", registry.ErrWatcherStopped, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the watcher to stop")
+	}
+}
+
+func TestServiceRegistryNamespace(t *testing.T) {
+	r, m := newRegistry(t)
+
+	w, err := r.Watch(registry.WatchService("foo"), registry.WatchNamespace("prod"))
+	if err != nil {
+		t.Fatalf("Unexpected watch error %v", err)
+	}
+	defer w.Stop()
+
+	results := make(chan *registry.Result, 10)
+	go func() {
+		for {
+			res, err := w.Next()
+			if err != nil {
+				return
+			}
+			results <- res
+		}
+	}()
+
+	// register the same service in both namespaces until the watcher of
+	// the served registry is set up and reports the first change
+	deadline := time.After(5 * time.Second)
+	for i := 0; ; i++ {
+		staging := newService(fmt.Sprintf("staging-%d", i), fmt.Sprintf("10.0.1.%d:8080", i))
+		if err := r.Register(staging, registry.RegisterNamespace("staging")); err != nil {
+			t.Fatalf("Unexpected register error %v", err)
+		}
+		prod := newService(fmt.Sprintf("prod-%d", i), fmt.Sprintf("10.0.2.%d:8080", i))
+		if err := r.Register(prod, registry.RegisterNamespace("prod")); err != nil {
+			t.Fatalf("Unexpected register error %v", err)
+		}
+
+		select {
+		case res := <-results:
+			if id := res.Service.Nodes[0].Id; !strings.HasPrefix(id, "prod") {
+				t.Fatalf("Expected only the prod changes, got %s", id)
+			}
+		case <-deadline:
+			t.Fatal("Timed out waiting for the watcher")
+		case <-time.After(100 * time.Millisecond):
+			continue
+		}
+		break
+	}
+
+	// each namespace only holds its own nodes, on both sides of the service
+	for _, reg := range []registry.Registry{r, m} {
+		for _, ns := range []string{"staging", "prod"} {
+			services, err := reg.GetService("foo", registry.GetNamespace(ns))
+			if err != nil {
+				t.Fatalf("Unexpected error getting service %v", err)
+			}
+			for _, n := range services[0].Nodes {
+				if !strings.HasPrefix(n.Id, ns) {
+					t.Fatalf("Expected only the %s nodes, got %s", ns, n.Id)
+				}
+			}
+
+			listed, err := reg.ListServices(registry.ListNamespace(ns))
+			if err != nil {
+				t.Fatalf("Unexpected error listing services %v", err)
+			}
+			if len(listed) != 1 || listed[0].Name != "foo" {
+				t.Fatalf("Expected foo to be listed in %s, got %+v", ns, listed)
+			}
+		}
+
+		if _, err := reg.GetService("foo"); err != registry.ErrNotFound {
+			t.Fatalf("Expected nothing in the default namespace, got %v", err)
+		}
+	}
+
+	// deregistering from one namespace leaves the other alone
+	services, err := r.GetService("foo", registry.GetNamespace("staging"))
+	if err != nil {
+		t.Fatalf("Unexpected error getting service %v", err)
+	}
+	for _, n := range services[0].Nodes {
+		if err := r.Deregister(&registry.Service{Name: "foo", Version: "1.0.0", Nodes: []*registry.Node{n}}, registry.DeregisterNamespace("staging")); err != nil {
+			t.Fatalf("Unexpected deregister error %v", err)
+		}
+	}
+	if _, err := r.GetService("foo", registry.GetNamespace("staging")); err != registry.ErrNotFound {
+		t.Fatalf("Expected staging to be empty, got %v", err)
+	}
+	if _, err := r.GetService("foo", registry.GetNamespace("prod")); err != nil {
+		t.Fatalf("Expected prod to be left alone, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package sync
+
+import (
+	"time"
+)
+
+type Options struct {
+	// Include are the patterns of the service names to mirror, all by default
+	Include []string
+	// Exclude are the patterns of the service names never mirrored
+	Exclude []string
+	// TTL of the mirrored nodes, they age out when the sync stops refreshing them
+	TTL time.Duration
+	// RefreshInterval is how often the mirrored nodes are registered again
+	RefreshInterval time.Duration
+	// RetryWait is how long the sync waits before watching a failed source again
+	RetryWait time.Duration
+	// Namespaces to mirror, each one into the same namespace of the
+	// destination. Only the default namespace by default.
+	Namespaces []string
+}
+
+type Option func(*Options)
+
+// Include mirrors only the services whose name matches one of the patterns,
+// the patterns are matched with path.Match
+func Include(patterns ...string) Option {
+	return func(o *Options) {
+		o.Include = append(o.Include, patterns...)
+	}
+}
+
+// Exclude never mirrors the services whose name matches one of the patterns
+func Exclude(patterns ...string) Option {
+	return func(o *Options) {
+		o.Exclude = append(o.Exclude, patterns...)
+	}
+}
+
+// TTL sets the ttl of the mirrored nodes
+func TTL(d time.Duration) Option {
+	return func(o *Options) {
+		o.TTL = d
+	}
+}
+
+// RefreshInterval sets how often the mirrored nodes are registered again,
+// half of the ttl by default
+func RefreshInterval(d time.Duration) Option {
+	return func(o *Options) {
+		o.RefreshInterval = d
+	}
+}
+
+// RetryWait sets how long the sync waits before watching a failed source again
+func RetryWait(d time.Duration) Option {
+	return func(o *Options) {
+		o.RetryWait = d
+	}
+}
+
+// Namespaces mirrors the services of the namespaces instead of the default one
+func Namespaces(ns ...string) Option {
+	return func(o *Options) {
+		o.Namespaces = append(o.Namespaces, ns...)
+	}
+}
@@ -0,0 +1,433 @@
+// Package sync mirrors the services of a registry into another one, for example
+// the mdns services of a subnet into a file or service registry reachable from
+// elsewhere. The mirrored nodes are registered with a ttl so they age out once
+// the sync stops, and they are marked so they are never mirrored back.
+package sync
+
+import (
+	"path"
+	gosync "sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/registry"
+	util "github.com/sumlookup/mini/util/registry"
+)
+
+const (
+	// MetadataKey is the node metadata set on the mirrored nodes, its value is
+	// the id of the sync which mirrored the node
+	MetadataKey = "sync"
+)
+
+var (
+	// DefaultTTL of the mirrored nodes
+	DefaultTTL = time.Minute
+	// DefaultRetryWait is how long the sync waits before watching a failed source again
+	DefaultRetryWait = time.Second
+)
+
+// Sync mirrors the services of the source registry into the destination
+type Sync struct {
+	Id   string
+	opts Options
+
+	src registry.Registry
+	dst registry.Registry
+
+	exit chan bool
+	done chan bool
+	once gosync.Once
+
+	// the mirrored services by namespace and name/version, only used by
+	// the sync loop and by Stop once the loop is done
+	mirrored map[string]map[string]*registry.Service
+	watchers []*watcher
+	started  bool
+}
+
+// watcher watches one namespace of the source
+type watcher struct {
+	registry.Watcher
+	namespace string
+}
+
+// change is a change of the source in a namespace
+type change struct {
+	*registry.Result
+	namespace string
+}
+
+// New returns a sync from the source registry to the destination registry
+func New(src, dst registry.Registry, opts ...Option) *Sync {
+	options := Options{
+		TTL:       DefaultTTL,
+		RetryWait: DefaultRetryWait,
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if options.RefreshInterval <= 0 {
+		options.RefreshInterval = options.TTL / 2
+	}
+	if len(options.Namespaces) == 0 {
+		options.Namespaces = []string{registry.DefaultNamespace}
+	}
+
+	return &Sync{
+		Id:       uuid.New().String(),
+		opts:     options,
+		src:      src,
+		dst:      dst,
+		exit:     make(chan bool),
+		done:     make(chan bool),
+		mirrored: make(map[string]map[string]*registry.Service),
+	}
+}
+
+func (s *Sync) Options() Options {
+	return s.opts
+}
+
+// Start mirrors the current services and keeps mirroring the changes
+// of the source until stopped
+func (s *Sync) Start() error {
+	watchers, err := s.watch()
+	if err != nil {
+		return err
+	}
+
+	if err := s.resync(); err != nil {
+		stop(watchers)
+		return err
+	}
+
+	s.watchers = watchers
+	s.started = true
+	go s.run()
+
+	return nil
+}
+
+// Stop stops mirroring and removes the mirrored nodes from the destination
+func (s *Sync) Stop() {
+	s.once.Do(func() {
+		close(s.exit)
+		if !s.started {
+			return
+		}
+		<-s.done
+
+		for ns, mirrored := range s.mirrored {
+			for _, svc := range mirrored {
+				if err := s.dst.Deregister(svc, registry.DeregisterNamespace(ns)); err != nil {
+					log.Warnf("[sync] could not deregister %s from %s: %v", svc.Name, s.dst.String(), err)
+				}
+			}
+		}
+		s.mirrored = make(map[string]map[string]*registry.Service)
+	})
+}
+
+func (s *Sync) run() {
+	defer close(s.done)
+
+	refresh := time.NewTicker(s.opts.RefreshInterval)
+	defer refresh.Stop()
+
+	for {
+		err := s.changes(s.watchers, refresh.C)
+
+		if s.stopped() {
+			return
+		}
+
+		log.Warnf("[sync] watching %s failed, watching again in %v: %v", s.src.String(), s.opts.RetryWait, err)
+
+		// changes are missed while disconnected, mirror everything again
+		for {
+			select {
+			case <-s.exit:
+				return
+			case <-time.After(s.opts.RetryWait):
+			}
+
+			watchers, err := s.watch()
+			if err != nil {
+				log.Warnf("[sync] could not watch %s: %v", s.src.String(), err)
+				continue
+			}
+			if err := s.resync(); err != nil {
+				log.Warnf("[sync] could not resync %s: %v", s.src.String(), err)
+				stop(watchers)
+				continue
+			}
+
+			s.watchers = watchers
+			break
+		}
+	}
+}
+
+// watch watches every namespace of the source
+func (s *Sync) watch() ([]*watcher, error) {
+	var watchers []*watcher
+
+	for _, ns := range s.opts.Namespaces {
+		w, err := s.src.Watch(registry.WatchNamespace(ns))
+		if err != nil {
+			stop(watchers)
+			return nil, err
+		}
+		watchers = append(watchers, &watcher{Watcher: w, namespace: ns})
+	}
+
+	return watchers, nil
+}
+
+func stop(watchers []*watcher) {
+	for _, w := range watchers {
+		w.Stop()
+	}
+}
+
+// changes mirrors the changes of the watchers until one of them fails, the
+// watchers are stopped when it returns
+func (s *Sync) changes(watchers []*watcher, refresh <-chan time.Time) error {
+	results := make(chan change)
+	errs := make(chan error, len(watchers))
+	done := make(chan bool)
+
+	defer func() {
+		close(done)
+		stop(watchers)
+	}()
+
+	for _, w := range watchers {
+		go func(w *watcher) {
+			for {
+				res, err := w.Next()
+				if err != nil {
+					errs <- err
+					return
+				}
+				select {
+				case results <- change{Result: res, namespace: w.namespace}:
+				case <-done:
+					return
+				}
+			}
+		}(w)
+	}
+
+	for {
+		select {
+		case <-s.exit:
+			return nil
+		case err := <-errs:
+			return err
+		case c := <-results:
+			s.apply(c.namespace, c.Result)
+		case <-refresh:
+			s.refresh()
+		}
+	}
+}
+
+func (s *Sync) stopped() bool {
+	select {
+	case <-s.exit:
+		return true
+	default:
+		return false
+	}
+}
+
+// included reports whether the service name passes the filters
+func (s *Sync) included(name string) bool {
+	for _, p := range s.opts.Exclude {
+		if ok, _ := path.Match(p, name); ok {
+			return false
+		}
+	}
+
+	if len(s.opts.Include) == 0 {
+		return true
+	}
+
+	for _, p := range s.opts.Include {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mirror returns the copy of the service registered in the destination. The
+// nodes mirrored by any sync are left out so nodes never go round in circles.
+func (s *Sync) mirror(svc *registry.Service) *registry.Service {
+	if svc == nil || !s.included(svc.Name) {
+		return nil
+	}
+
+	m := util.CopyService(svc)
+	m.Nodes = nil
+
+	for _, n := range svc.Nodes {
+		if _, ok := n.Metadata[MetadataKey]; ok {
+			continue
+		}
+
+		md := make(map[string]string, len(n.Metadata)+1)
+		for k, v := range n.Metadata {
+			md[k] = v
+		}
+		md[MetadataKey] = s.Id
+
+		m.Nodes = append(m.Nodes, &registry.Node{
+			Id:       n.Id,
+			Address:  n.Address,
+			Metadata: md,
+		})
+	}
+
+	if len(m.Nodes) == 0 {
+		return nil
+	}
+
+	return m
+}
+
+func key(svc *registry.Service) string {
+	return svc.Name + "/" + svc.Version
+}
+
+// apply mirrors the change of the namespace of the source
+func (s *Sync) apply(ns string, res *registry.Result) {
+	m := s.mirror(res.Service)
+	if m == nil {
+		return
+	}
+
+	k := key(m)
+	mirrored, ok := s.mirrored[ns]
+	if !ok {
+		mirrored = make(map[string]*registry.Service)
+		s.mirrored[ns] = mirrored
+	}
+
+	switch res.Action {
+	case registry.Delete.String():
+		if err := s.dst.Deregister(m, registry.DeregisterNamespace(ns)); err != nil {
+			log.Warnf("[sync] could not deregister %s from %s: %v", m.Name, s.dst.String(), err)
+		}
+
+		if cur, ok := mirrored[k]; ok {
+			if left := util.Remove([]*registry.Service{cur}, []*registry.Service{m}); len(left) > 0 {
+				mirrored[k] = left[0]
+			} else {
+				delete(mirrored, k)
+			}
+		}
+	default:
+		if err := s.dst.Register(m, registry.RegisterTTL(s.opts.TTL), registry.RegisterNamespace(ns)); err != nil {
+			log.Warnf("[sync] could not register %s with %s: %v", m.Name, s.dst.String(), err)
+		}
+
+		var cur []*registry.Service
+		if c, ok := mirrored[k]; ok {
+			cur = append(cur, c)
+		}
+		mirrored[k] = util.Merge(cur, []*registry.Service{m})[0]
+	}
+}
+
+// refresh registers the mirrored services again before their ttl runs out
+func (s *Sync) refresh() {
+	for ns, mirrored := range s.mirrored {
+		for _, m := range mirrored {
+			if err := s.dst.Register(m, registry.RegisterTTL(s.opts.TTL), registry.RegisterNamespace(ns)); err != nil {
+				log.Warnf("[sync] could not refresh %s with %s: %v", m.Name, s.dst.String(), err)
+			}
+		}
+	}
+}
+
+// resync mirrors all the services of the namespaces of the source and
+// removes the mirrored nodes which are gone from it
+func (s *Sync) resync() error {
+	all := make(map[string]map[string]*registry.Service)
+
+	for _, ns := range s.opts.Namespaces {
+		mirrored, err := s.resyncNamespace(ns)
+		if err != nil {
+			return err
+		}
+		all[ns] = mirrored
+	}
+
+	s.mirrored = all
+
+	return nil
+}
+
+// resyncNamespace mirrors all the services of the namespace and returns them
+func (s *Sync) resyncNamespace(ns string) (map[string]*registry.Service, error) {
+	list, err := s.src.ListServices(registry.ListNamespace(ns))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, svc := range list {
+		if s.included(svc.Name) {
+			names[svc.Name] = true
+		}
+	}
+
+	mirrored := make(map[string]*registry.Service)
+
+	for name := range names {
+		services, err := s.src.GetService(name, registry.GetNamespace(ns))
+		if err == registry.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, svc := range services {
+			m := s.mirror(svc)
+			if m == nil {
+				continue
+			}
+
+			if err := s.dst.Register(m, registry.RegisterTTL(s.opts.TTL), registry.RegisterNamespace(ns)); err != nil {
+				return nil, err
+			}
+			mirrored[key(m)] = m
+		}
+	}
+
+	// remove what went away while the source wasn't watched
+	for k, old := range s.mirrored[ns] {
+		left := old
+		if cur, ok := mirrored[k]; ok {
+			gone := util.Remove([]*registry.Service{old}, []*registry.Service{cur})
+			if len(gone) == 0 {
+				continue
+			}
+			left = gone[0]
+		}
+
+		if err := s.dst.Deregister(left, registry.DeregisterNamespace(ns)); err != nil {
+			log.Warnf("[sync] could not deregister %s from %s: %v", left.Name, s.dst.String(), err)
+		}
+	}
+
+	return mirrored, nil
+}
@@ -0,0 +1,352 @@
+package sync
+
+import (
+	"errors"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+)
+
+func newService(name, id string) *registry.Service {
+	return &registry.Service{
+		Name:    name,
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{Id: id, Address: "10.0.0.1:8080", Metadata: map[string]string{"foo": "bar"}},
+		},
+	}
+}
+
+// nodes returns the nodes of the service in the registry
+func nodes(r registry.Registry, name string) []*registry.Node {
+	services, err := r.GetService(name)
+	if err != nil {
+		return nil
+	}
+
+	var nodes []*registry.Node
+	for _, s := range services {
+		nodes = append(nodes, s.Nodes...)
+	}
+	return nodes
+}
+
+func waitFor(t *testing.T, what string, fn func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// recorder records the ttl the nodes are registered with
+type recorder struct {
+	registry.Registry
+
+	gosync.Mutex
+	ttl time.Duration
+}
+
+func (r *recorder) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	var options registry.RegisterOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	r.Lock()
+	r.ttl = options.TTL
+	r.Unlock()
+
+	return r.Registry.Register(s, opts...)
+}
+
+func TestSync(t *testing.T) {
+	src := memory.NewRegistry()
+	dst := &recorder{Registry: memory.NewRegistry()}
+
+	if err := src.Register(newService("foo", "foo-1")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	if err := src.Register(newService("internal.bar", "bar-1")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	s := New(src, dst, Exclude("internal.*"), TTL(30*time.Second))
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unexpected start error %v", err)
+	}
+	defer s.Stop()
+
+	// the current services are mirrored straight away
+	n := nodes(dst, "foo")
+	if len(n) != 1 || n[0].Metadata[MetadataKey] != s.Id || n[0].Metadata["foo"] != "bar" {
+		t.Fatalf("Expected foo-1 mirrored, got %+v", n)
+	}
+	if n := nodes(dst, "internal.bar"); len(n) != 0 {
+		t.Fatalf("Expected internal.bar to be excluded, got %+v", n)
+	}
+
+	dst.Lock()
+	ttl := dst.ttl
+	dst.Unlock()
+	if ttl != 30*time.Second {
+		t.Fatalf("Expected the mirrored nodes to have a ttl of 30s, got %v", ttl)
+	}
+
+	// changes are mirrored as they happen
+	if err := src.Register(newService("foo", "foo-2")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	waitFor(t, "foo-2", func() bool { return len(nodes(dst, "foo")) == 2 })
+
+	if err := src.Deregister(newService("foo", "foo-1")); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+	waitFor(t, "foo-1 to go", func() bool { return len(nodes(dst, "foo")) == 1 })
+
+	// the mirrored nodes are removed once stopped
+	s.Stop()
+	if n := nodes(dst, "foo"); len(n) != 0 {
+		t.Fatalf("Expected no mirrored nodes, got %+v", n)
+	}
+}
+
+func TestSyncLoop(t *testing.T) {
+	a := memory.NewRegistry()
+	b := memory.NewRegistry()
+
+	ab := New(a, b)
+	ba := New(b, a)
+
+	for _, s := range []*Sync{ab, ba} {
+		if err := s.Start(); err != nil {
+			t.Fatalf("Unexpected start error %v", err)
+		}
+		defer s.Stop()
+	}
+
+	if err := a.Register(newService("foo", "foo-1")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	waitFor(t, "foo-1 in b", func() bool { return len(nodes(b, "foo")) == 1 })
+
+	// give the sync from b the chance to mirror foo-1 back
+	time.Sleep(100 * time.Millisecond)
+
+	n := nodes(a, "foo")
+	if len(n) != 1 {
+		t.Fatalf("Expected foo-1 once in a, got %+v", n)
+	}
+	if _, ok := n[0].Metadata[MetadataKey]; ok {
+		t.Fatalf("Expected foo-1 in a to be the original, got %+v", n[0])
+	}
+}
+
+// flaky is a registry whose watchers can be broken
+type flaky struct {
+	registry.Registry
+
+	gosync.Mutex
+	paused  bool
+	broken  bool
+	watches int
+	stops   int
+}
+
+type flakyWatcher struct {
+	registry.Watcher
+	r *flaky
+}
+
+var errBroken = errors.New("broken")
+
+func (f *flaky) Watch(opts ...registry.WatchOption) (registry.Watcher, error) {
+	w, err := f.Registry.Watch(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	f.watches++
+	f.Unlock()
+
+	return &flakyWatcher{Watcher: w, r: f}, nil
+}
+
+func (f *flaky) set(paused, broken bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.paused = paused
+	f.broken = broken
+}
+
+func (f *flaky) count() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.watches
+}
+
+func (f *flaky) stopped() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.stops
+}
+
+func (w *flakyWatcher) Stop() {
+	w.r.Lock()
+	w.r.stops++
+	w.r.Unlock()
+	w.Watcher.Stop()
+}
+
+// Next drops the changes while paused and fails the next change once broken
+func (w *flakyWatcher) Next() (*registry.Result, error) {
+	for {
+		res, err := w.Watcher.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		w.r.Lock()
+		paused, broken := w.r.paused, w.r.broken
+		w.r.broken = false
+		w.r.Unlock()
+
+		if broken {
+			return nil, errBroken
+		}
+		if !paused {
+			return res, nil
+		}
+	}
+}
+
+func TestSyncResync(t *testing.T) {
+	src := &flaky{Registry: memory.NewRegistry()}
+	dst := memory.NewRegistry()
+
+	for _, id := range []string{"foo-1", "foo-2"} {
+		if err := src.Register(newService("foo", id)); err != nil {
+			t.Fatalf("Unexpected register error %v", err)
+		}
+	}
+
+	s := New(src, dst, RetryWait(10*time.Millisecond))
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unexpected start error %v", err)
+	}
+	defer s.Stop()
+
+	if n := nodes(dst, "foo"); len(n) != 2 {
+		t.Fatalf("Expected 2 mirrored nodes, got %+v", n)
+	}
+
+	// foo-1 goes away unnoticed
+	src.set(true, false)
+	if err := src.Deregister(newService("foo", "foo-1")); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// the next change breaks the watcher, watching again mirrors everything
+	src.set(false, true)
+	if err := src.Register(newService("bar", "bar-1")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	waitFor(t, "the watcher to reconnect", func() bool { return src.count() == 2 })
+	waitFor(t, "the resync", func() bool {
+		n := nodes(dst, "foo")
+		return len(n) == 1 && n[0].Id == "foo-2" && len(nodes(dst, "bar")) == 1
+	})
+}
+
+func TestSyncStopsWatchers(t *testing.T) {
+	src := &flaky{Registry: memory.NewRegistry()}
+	dst := memory.NewRegistry()
+
+	s := New(src, dst, Namespaces("staging", "prod"), RetryWait(10*time.Millisecond))
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unexpected start error %v", err)
+	}
+	defer s.Stop()
+
+	// the staging watcher breaks, the prod one is stopped along with it
+	src.set(false, true)
+	if err := src.Register(newService("foo", "foo-1"), registry.RegisterNamespace("staging")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+
+	waitFor(t, "the watchers to reconnect", func() bool { return src.count() == 4 })
+	if n := src.stopped(); n != 2 {
+		t.Fatalf("Expected both watchers to be stopped, got %d stops", n)
+	}
+}
+
+func TestSyncNamespaces(t *testing.T) {
+	src := memory.NewRegistry()
+	dst := memory.NewRegistry()
+
+	for _, ns := range []string{"staging", "prod", "dev"} {
+		if err := src.Register(newService("foo", ns+"-1"), registry.RegisterNamespace(ns)); err != nil {
+			t.Fatalf("Unexpected register error %v", err)
+		}
+	}
+
+	s := New(src, dst, Namespaces("staging", "prod"))
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unexpected start error %v", err)
+	}
+
+	// namespaced returns the node ids of foo in the namespace of the destination
+	namespaced := func(ns string) []string {
+		services, err := dst.GetService("foo", registry.GetNamespace(ns))
+		if err != nil {
+			return nil
+		}
+		var ids []string
+		for _, svc := range services {
+			for _, n := range svc.Nodes {
+				ids = append(ids, n.Id)
+			}
+		}
+		return ids
+	}
+
+	for _, ns := range []string{"staging", "prod"} {
+		if ids := namespaced(ns); len(ids) != 1 || ids[0] != ns+"-1" {
+			t.Fatalf("Expected %s-1 mirrored into %s, got %v", ns, ns, ids)
+		}
+	}
+	if ids := namespaced("dev"); len(ids) != 0 {
+		t.Fatalf("Expected dev not to be mirrored, got %v", ids)
+	}
+	if ids := namespaced(registry.DefaultNamespace); len(ids) != 0 {
+		t.Fatalf("Expected nothing in the default namespace, got %v", ids)
+	}
+
+	// the changes of every namespace are mirrored into the same namespace
+	if err := src.Register(newService("foo", "prod-2"), registry.RegisterNamespace("prod")); err != nil {
+		t.Fatalf("Unexpected register error %v", err)
+	}
+	waitFor(t, "prod-2 to be mirrored", func() bool { return len(namespaced("prod")) == 2 })
+	if ids := namespaced("staging"); len(ids) != 1 {
+		t.Fatalf("Expected staging to be left alone, got %v", ids)
+	}
+
+	if err := src.Deregister(newService("foo", "staging-1"), registry.DeregisterNamespace("staging")); err != nil {
+		t.Fatalf("Unexpected deregister error %v", err)
+	}
+	waitFor(t, "staging-1 to be removed", func() bool { return len(namespaced("staging")) == 0 })
+
+	s.Stop()
+
+	if ids := namespaced("prod"); len(ids) != 0 {
+		t.Fatalf("Expected no mirrored nodes, got %v", ids)
+	}
+}
@@ -0,0 +1,27 @@
+package registry
+
+// Updater is implemented by the registries which can change the metadata of
+// a registration in place. The watchers get an update event of the change.
+type Updater interface {
+	// UpdateNode patches the metadata of the registered node of the service version
+	UpdateNode(service, version, id string, md map[string]string, opts ...UpdateOption) error
+	// UpdateService patches the metadata of the registered service version
+	UpdateService(service, version string, md map[string]string, opts ...UpdateOption) error
+}
+
+// PatchMetadata returns a copy of the metadata with the patch applied, the
+// keys patched with an empty value are removed
+func PatchMetadata(md, patch map[string]string) map[string]string {
+	patched := make(map[string]string, len(md)+len(patch))
+	for k, v := range md {
+		patched[k] = v
+	}
+	for k, v := range patch {
+		if len(v) == 0 {
+			delete(patched, k)
+			continue
+		}
+		patched[k] = v
+	}
+	return patched
+}
@@ -0,0 +1,105 @@
+package registry
+
+import (
+	"reflect"
+)
+
+// Merge merges two lists of services and returns a new copy. The services of
+// nlist take precedence, they replace the details of the olist service with
+// the same version and their nodes replace the nodes with the same id.
+func Merge(olist []*Service, nlist []*Service) []*Service {
+	srv := make([]*Service, 0, len(olist)+len(nlist))
+	for _, o := range olist {
+		srv = append(srv, copyService(o))
+	}
+
+	for _, n := range nlist {
+		var seen bool
+		for i, o := range srv {
+			if o.Version == n.Version {
+				sp := copyService(n)
+				sp.Nodes = mergeNodes(o.Nodes, n.Nodes)
+				srv[i] = sp
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			srv = append(srv, copyService(n))
+		}
+	}
+
+	return srv
+}
+
+// mergeNodes returns copies of the new nodes followed by the old nodes
+// without a new node of the same id
+func mergeNodes(old, neu []*Node) []*Node {
+	nodes := make([]*Node, 0, len(old)+len(neu))
+	for _, n := range neu {
+		node := *n
+		nodes = append(nodes, &node)
+	}
+
+	for _, o := range old {
+		var exists bool
+		for _, n := range neu {
+			if o.Id == n.Id {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			node := *o
+			nodes = append(nodes, &node)
+		}
+	}
+
+	return nodes
+}
+
+func copyService(service *Service) *Service {
+	s := new(Service)
+	*s = *service
+
+	s.Nodes = make([]*Node, len(service.Nodes))
+	for i, node := range service.Nodes {
+		n := *node
+		s.Nodes[i] = &n
+	}
+
+	s.Endpoints = make([]*Endpoint, len(service.Endpoints))
+	for i, ep := range service.Endpoints {
+		e := *ep
+		s.Endpoints[i] = &e
+	}
+
+	return s
+}
+
+// Diff returns the results which turn the old services into the new ones.
+// Both maps hold the services by a key which is stable across reads, the
+// services under a new key are created, under a gone key deleted and the
+// ones which changed updated.
+func Diff(old, services map[string]*Service) []*Result {
+	var results []*Result
+
+	for k, s := range services {
+		o, ok := old[k]
+		if !ok {
+			results = append(results, &Result{Action: Create.String(), Service: s})
+			continue
+		}
+		if !reflect.DeepEqual(o, s) {
+			results = append(results, &Result{Action: Update.String(), Service: s})
+		}
+	}
+
+	for k, o := range old {
+		if _, ok := services[k]; !ok {
+			results = append(results, &Result{Action: Delete.String(), Service: o})
+		}
+	}
+
+	return results
+}
@@ -1,6 +1,9 @@
 package registry
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 // Watcher is an interface that returns updates
 // about services within the registry.
@@ -15,6 +18,60 @@ type Watcher interface {
 type Result struct {
 	Action  string
 	Service *Service
+	// Revision increases with every change of the registry, a watcher
+	// can resume after it. Zero when the registry has no revisions.
+	Revision uint64
+}
+
+// Filter returns the part of the result the watch is interested in, the
+// nodes without the watched metadata are left out. It returns nil when
+// nothing is left.
+func (o WatchOptions) Filter(r *Result) *Result {
+	if r == nil || r.Service == nil {
+		return r
+	}
+	if len(o.Service) > 0 && r.Service.Name != o.Service {
+		return nil
+	}
+	if len(o.Version) > 0 && r.Service.Version != o.Version {
+		return nil
+	}
+	if len(o.Metadata) == 0 || len(r.Service.Nodes) == 0 {
+		return r
+	}
+
+	var nodes []*Node
+	for _, n := range r.Service.Nodes {
+		if hasMetadata(n.Metadata, o.Metadata) {
+			nodes = append(nodes, n)
+		}
+	}
+
+	switch len(nodes) {
+	case 0:
+		return nil
+	case len(r.Service.Nodes):
+		return r
+	}
+
+	s := copyService(r.Service)
+	s.Nodes = nodes
+
+	return &Result{
+		Action:   r.Action,
+		Service:  s,
+		Revision: r.Revision,
+	}
+}
+
+// hasMetadata reports whether the metadata contains all of the wanted keys and values
+func hasMetadata(md, want map[string]string) bool {
+	for k, v := range want {
+		if mv, ok := md[k]; !ok || mv != v {
+			return false
+		}
+	}
+	return true
 }
 
 // EventType defines registry event type
@@ -43,14 +100,34 @@ func (t EventType) String() string {
 	}
 }
 
+// MarshalText encodes the event type by its name
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText decodes the event type from its name
+func (t *EventType) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "create":
+		*t = Create
+	case "delete":
+		*t = Delete
+	case "update":
+		*t = Update
+	default:
+		return fmt.Errorf("unknown event type %q", b)
+	}
+	return nil
+}
+
 // Event is registry event
 type Event struct {
 	// Id is registry id
-	Id string
+	Id string `json:"id"`
 	// Type defines type of event
-	Type EventType
+	Type EventType `json:"type"`
 	// Timestamp is event timestamp
-	Timestamp time.Time
+	Timestamp time.Time `json:"timestamp"`
 	// Service is registry service
-	Service *Service
+	Service *Service `json:"service"`
 }
@@ -0,0 +1,293 @@
+package selector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+)
+
+// CircuitState is the state of a node circuit
+type CircuitState int
+
+const (
+	// CircuitClosed lets calls through to the node
+	CircuitClosed CircuitState = iota
+	// CircuitOpen ejects the node from selection
+	CircuitOpen
+	// CircuitHalfOpen lets calls probe the node after the open timeout
+	CircuitHalfOpen
+)
+
+// String returns human readable circuit state
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerOptions are the thresholds of the per node circuit breaker
+type BreakerOptions struct {
+	// FailureThreshold is the number of consecutive failures which open the circuit
+	FailureThreshold int
+	// OpenTimeout is how long a node stays ejected before it is probed again
+	OpenTimeout time.Duration
+	// HalfOpenSuccesses is the number of successful probes which close the circuit
+	HalfOpenSuccesses int
+	// HalfOpenProbes is the number of calls probing a half-open node at once
+	HalfOpenProbes int
+}
+
+var (
+	DefaultBreakerOptions = BreakerOptions{
+		FailureThreshold:  5,
+		OpenTimeout:       10 * time.Second,
+		HalfOpenSuccesses: 1,
+		HalfOpenProbes:    1,
+	}
+)
+
+type circuit struct {
+	state     CircuitState
+	failures  int
+	successes int
+	opened    time.Time
+	// the calls let through to probe the half-open node, not marked yet
+	probes int
+	probed time.Time
+}
+
+// Breaker tracks failures per node and ejects the nodes whose circuit is open.
+// Nodes are tracked by namespace and address so that callers which only know
+// the peer of a call can mark them, without ejecting the node at the same
+// address in another namespace.
+type Breaker struct {
+	opts BreakerOptions
+
+	sync.Mutex
+	// service -> namespace/node address -> circuit
+	circuits map[string]map[string]*circuit
+}
+
+// NewBreaker returns a breaker, zero thresholds fall back to the defaults
+func NewBreaker(opts BreakerOptions) *Breaker {
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = DefaultBreakerOptions.FailureThreshold
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = DefaultBreakerOptions.OpenTimeout
+	}
+	if opts.HalfOpenSuccesses <= 0 {
+		opts.HalfOpenSuccesses = DefaultBreakerOptions.HalfOpenSuccesses
+	}
+	if opts.HalfOpenProbes <= 0 {
+		opts.HalfOpenProbes = DefaultBreakerOptions.HalfOpenProbes
+	}
+
+	return &Breaker{
+		opts:     opts,
+		circuits: make(map[string]map[string]*circuit),
+	}
+}
+
+// circuitKey returns the key of the node address in the namespace
+func circuitKey(ns, address string) string {
+	if len(ns) == 0 {
+		ns = registry.DefaultNamespace
+	}
+	return ns + "/" + address
+}
+
+// state moves an open circuit to half-open once the open timeout passed
+func (b *Breaker) state(c *circuit) CircuitState {
+	if c.state == CircuitOpen && time.Since(c.opened) >= b.opts.OpenTimeout {
+		c.state = CircuitHalfOpen
+		c.successes = 0
+		c.probes = 0
+	}
+	// the probes never marked, the selected node may not have been called
+	if c.state == CircuitHalfOpen && c.probes > 0 && time.Since(c.probed) >= b.opts.OpenTimeout {
+		c.probes = 0
+	}
+	return c.state
+}
+
+// Mark records the outcome of a call to the node of the namespace
+func (b *Breaker) Mark(ns, service string, node *registry.Node, err error) {
+	if node == nil || len(node.Address) == 0 {
+		return
+	}
+	key := circuitKey(ns, node.Address)
+
+	b.Lock()
+	defer b.Unlock()
+
+	nodes, ok := b.circuits[service]
+	if !ok {
+		// nothing to record for a healthy node we don't track
+		if err == nil {
+			return
+		}
+		nodes = make(map[string]*circuit)
+		b.circuits[service] = nodes
+	}
+
+	c, ok := nodes[key]
+	if !ok {
+		if err == nil {
+			return
+		}
+		c = &circuit{}
+		nodes[key] = c
+	}
+
+	switch b.state(c) {
+	case CircuitClosed:
+		if err == nil {
+			c.failures = 0
+			return
+		}
+		c.failures++
+		if c.failures >= b.opts.FailureThreshold {
+			c.state = CircuitOpen
+			c.opened = time.Now()
+		}
+	case CircuitHalfOpen:
+		if c.probes > 0 {
+			c.probes--
+		}
+		if err != nil {
+			c.state = CircuitOpen
+			c.opened = time.Now()
+			return
+		}
+		c.successes++
+		if c.successes >= b.opts.HalfOpenSuccesses {
+			delete(nodes, key)
+		}
+	case CircuitOpen:
+		// calls that were in flight when the circuit opened
+		if err != nil {
+			c.opened = time.Now()
+		}
+	}
+}
+
+// State returns the circuit state of the node of the namespace
+func (b *Breaker) State(ns, service string, node *registry.Node) CircuitState {
+	b.Lock()
+	defer b.Unlock()
+
+	c, ok := b.circuits[service][circuitKey(ns, node.Address)]
+	if !ok {
+		return CircuitClosed
+	}
+	return b.state(c)
+}
+
+// Reset clears the state of every node of the service in every namespace
+func (b *Breaker) Reset(service string) {
+	b.Lock()
+	delete(b.circuits, service)
+	b.Unlock()
+}
+
+// Filter returns a filter which removes the nodes of the service in the namespace
+// whose circuit is open, or half-open without a probe left
+func (b *Breaker) Filter(ns, service string) Filter {
+	return func(old []*registry.Service) []*registry.Service {
+		b.Lock()
+		defer b.Unlock()
+
+		nodes, ok := b.circuits[service]
+		if !ok {
+			return old
+		}
+
+		var services []*registry.Service
+
+		for _, s := range old {
+			var available []*registry.Node
+
+			for _, node := range s.Nodes {
+				if c, ok := nodes[circuitKey(ns, node.Address)]; ok {
+					switch b.state(c) {
+					case CircuitOpen:
+						continue
+					case CircuitHalfOpen:
+						if c.probes >= b.opts.HalfOpenProbes {
+							continue
+						}
+					}
+				}
+				available = append(available, node)
+			}
+
+			// only add service if there's some nodes
+			if len(available) > 0 {
+				srv := new(registry.Service)
+				// copy
+				*srv = *s
+				srv.Nodes = available
+				services = append(services, srv)
+			}
+		}
+
+		return services
+	}
+}
+
+// Next wraps the next function of a selection so that picking a half-open
+// node takes one of its probes. The nodes without a probe left, or whose
+// circuit opened since the selection, are skipped.
+func (b *Breaker) Next(ns, service string, services []*registry.Service, next Next) Next {
+	var count int
+	for _, s := range services {
+		count += len(s.Nodes)
+	}
+
+	return func() (*registry.Node, error) {
+		for i := 0; i <= count; i++ {
+			node, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if b.probe(ns, service, node) {
+				return node, nil
+			}
+		}
+		return nil, ErrNoneAvailable
+	}
+}
+
+// probe reports whether the node may be called, a half-open node only when
+// it has a probe left which the call then takes
+func (b *Breaker) probe(ns, service string, node *registry.Node) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	c, ok := b.circuits[service][circuitKey(ns, node.Address)]
+	if !ok {
+		return true
+	}
+
+	switch b.state(c) {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		if c.probes >= b.opts.HalfOpenProbes {
+			return false
+		}
+		c.probes++
+		c.probed = time.Now()
+	}
+
+	return true
+}
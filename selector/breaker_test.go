@@ -0,0 +1,207 @@
+package selector
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+)
+
+func TestBreaker(t *testing.T) {
+	b := NewBreaker(BreakerOptions{
+		FailureThreshold:  2,
+		OpenTimeout:       50 * time.Millisecond,
+		HalfOpenSuccesses: 1,
+	})
+
+	node := &registry.Node{Id: "foo-1", Address: "localhost:9999"}
+	fail := errors.New("unavailable")
+
+	b.Mark("", "foo", node, fail)
+	if s := b.State("", "foo", node); s != CircuitClosed {
+		t.Fatalf("Expected %s circuit, got %s", CircuitClosed, s)
+	}
+
+	b.Mark("", "foo", node, fail)
+	if s := b.State("", "foo", node); s != CircuitOpen {
+		t.Fatalf("Expected %s circuit, got %s", CircuitOpen, s)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if s := b.State("", "foo", node); s != CircuitHalfOpen {
+		t.Fatalf("Expected %s circuit, got %s", CircuitHalfOpen, s)
+	}
+
+	// a failed probe opens the circuit again
+	b.Mark("", "foo", node, fail)
+	if s := b.State("", "foo", node); s != CircuitOpen {
+		t.Fatalf("Expected %s circuit, got %s", CircuitOpen, s)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	b.Mark("", "foo", node, nil)
+	if s := b.State("", "foo", node); s != CircuitClosed {
+		t.Fatalf("Expected %s circuit, got %s", CircuitClosed, s)
+	}
+
+	// a success resets the consecutive failures
+	b.Mark("", "foo", node, fail)
+	b.Mark("", "foo", node, nil)
+	b.Mark("", "foo", node, fail)
+	if s := b.State("", "foo", node); s != CircuitClosed {
+		t.Fatalf("Expected %s circuit, got %s", CircuitClosed, s)
+	}
+
+	b.Mark("", "foo", node, fail)
+	b.Reset("foo")
+	if s := b.State("", "foo", node); s != CircuitClosed {
+		t.Fatalf("Expected %s circuit after reset, got %s", CircuitClosed, s)
+	}
+}
+
+func TestBreakerNamespace(t *testing.T) {
+	b := NewBreaker(BreakerOptions{FailureThreshold: 1, OpenTimeout: time.Minute})
+
+	node := &registry.Node{Id: "foo-1", Address: "localhost:9999"}
+	b.Mark("dev", "foo", node, errors.New("unavailable"))
+
+	if s := b.State("dev", "foo", node); s != CircuitOpen {
+		t.Fatalf("Expected %s circuit in dev, got %s", CircuitOpen, s)
+	}
+
+	// the same address in another namespace is another node
+	for _, ns := range []string{"", registry.DefaultNamespace, "prod"} {
+		if s := b.State(ns, "foo", node); s != CircuitClosed {
+			t.Fatalf("Expected %s circuit in %q, got %s", CircuitClosed, ns, s)
+		}
+	}
+
+	services := []*registry.Service{{Name: "foo", Nodes: []*registry.Node{node}}}
+	if got := b.Filter("dev", "foo")(services); len(got) != 0 {
+		t.Fatalf("Expected the node to be ejected in dev, got %+v", got)
+	}
+	if got := b.Filter("prod", "foo")(services); len(got) != 1 {
+		t.Fatalf("Expected the node to be kept in prod, got %+v", got)
+	}
+}
+
+func TestBreakerHalfOpenProbes(t *testing.T) {
+	b := NewBreaker(BreakerOptions{
+		FailureThreshold:  1,
+		OpenTimeout:       50 * time.Millisecond,
+		HalfOpenSuccesses: 2,
+		HalfOpenProbes:    1,
+	})
+
+	node := &registry.Node{Id: "foo-1", Address: "localhost:9999"}
+	other := &registry.Node{Id: "foo-2", Address: "localhost:9998"}
+	services := []*registry.Service{{Name: "foo", Nodes: []*registry.Node{node, other}}}
+
+	b.Mark("", "foo", node, errors.New("unavailable"))
+	time.Sleep(60 * time.Millisecond)
+
+	// selecting the half-open node doesn't take its probe, picking it does
+	next := b.Next("", "foo", services, RoundRobin(b.Filter("", "foo")(services)))
+	for i := 0; i < 3; i++ {
+		if got := b.Filter("", "foo")(services); len(got) != 1 || len(got[0].Nodes) != 2 {
+			t.Fatalf("Expected the half-open node to be selected, got %+v", got)
+		}
+	}
+
+	var picked int
+	for i := 0; i < 10; i++ {
+		n, err := next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Id == node.Id {
+			picked++
+		}
+	}
+	if picked != 1 {
+		t.Fatalf("Expected a single probe of the half-open node, got %d", picked)
+	}
+	if got := b.Filter("", "foo")(services); len(got[0].Nodes) != 1 {
+		t.Fatalf("Expected the probed node to be left out until marked, got %+v", got[0].Nodes)
+	}
+
+	// the marked probe lets the next one through
+	b.Mark("", "foo", node, nil)
+	if s := b.State("", "foo", node); s != CircuitHalfOpen {
+		t.Fatalf("Expected %s circuit, got %s", CircuitHalfOpen, s)
+	}
+
+	// a probe which is never marked is given up after the open timeout
+	only := []*registry.Service{{Name: "foo", Nodes: []*registry.Node{node}}}
+	next = b.Next("", "foo", only, RoundRobin(only))
+	if _, err := next(); err != nil {
+		t.Fatalf("Expected the node to be probed again, got %v", err)
+	}
+	if _, err := next(); err != ErrNoneAvailable {
+		t.Fatalf("Expected %v while the probe runs, got %v", ErrNoneAvailable, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := next(); err != nil {
+		t.Fatalf("Expected the lost probe to be given up, got %v", err)
+	}
+
+	b.Mark("", "foo", node, nil)
+	if s := b.State("", "foo", node); s != CircuitClosed {
+		t.Fatalf("Expected %s circuit, got %s", CircuitClosed, s)
+	}
+}
+
+func TestRegistrySelectorMark(t *testing.T) {
+	services := []*registry.Service{
+		{
+			Name:    "foo",
+			Version: "1.0.0",
+			Nodes: []*registry.Node{
+				{Id: "foo-1", Address: "10.0.0.1:8080"},
+				{Id: "foo-2", Address: "10.0.0.2:8080"},
+			},
+		},
+		{
+			Name:    "foo",
+			Version: "1.0.1",
+			Nodes: []*registry.Node{
+				{Id: "foo-3", Address: "10.0.0.3:8080"},
+			},
+		},
+	}
+
+	r := memory.NewRegistry(memory.Services(map[string][]*registry.Service{"foo": services}))
+	s := NewSelector(Registry(r), FailureThreshold(1), OpenTimeout(time.Minute))
+
+	// eject everything but a single node
+	keep := services[0].Nodes[0]
+	s.Mark("foo", services[0].Nodes[1], errors.New("unavailable"))
+	s.Mark("foo", services[1].Nodes[0], errors.New("unavailable"))
+
+	next, err := s.Select("foo")
+	if err != nil {
+		t.Fatalf("Unexpected error calling select: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		node, err := next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Address != keep.Address {
+			t.Fatalf("Expected node %s, got ejected node %s", keep.Address, node.Address)
+		}
+	}
+
+	s.Mark("foo", keep, errors.New("unavailable"))
+	if _, err := s.Select("foo"); err != ErrNoneAvailable {
+		t.Fatalf("Expected %v, got %v", ErrNoneAvailable, err)
+	}
+
+	s.Reset("foo")
+	if _, err := s.Select("foo"); err != nil {
+		t.Fatalf("Unexpected error after reset: %v", err)
+	}
+}
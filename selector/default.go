@@ -10,6 +10,8 @@ import (
 type registrySelector struct {
 	so Options
 	rc cache.Cache
+	cb *Breaker
+	lt *Load
 }
 
 func (c *registrySelector) newCache() cache.Cache {
@@ -29,6 +31,8 @@ func (c *registrySelector) Init(opts ...Option) error {
 
 	c.rc.Stop()
 	c.rc = c.newCache()
+	c.cb = c.so.Breaker()
+	c.lt = c.so.Load()
 
 	return nil
 }
@@ -49,7 +53,7 @@ func (c *registrySelector) Select(service string, opts ...SelectOption) (Next, e
 	// get the service
 	// try the cache first
 	// if that fails go directly to the registry
-	services, err := c.rc.GetService(service)
+	services, err := c.rc.GetService(service, registry.GetNamespace(sopts.Namespace))
 	if err != nil {
 		if err == registry.ErrNotFound {
 			return nil, ErrNotFound
@@ -62,18 +66,37 @@ func (c *registrySelector) Select(service string, opts ...SelectOption) (Next, e
 		services = filter(services)
 	}
 
+	// eject the nodes with an open circuit
+	services = c.cb.Filter(sopts.Namespace, service)(services)
+
+	// split the traffic across the versions of the available nodes
+	if r, ok := getRouter(sopts.Context); ok {
+		services = r.Filter(getCallContext(sopts.Context))(services)
+	}
+
 	// if there's nothing left, return
 	if len(services) == 0 {
 		return nil, ErrNoneAvailable
 	}
 
-	return sopts.Strategy(services), nil
+	return c.cb.Next(sopts.Namespace, service, services, sopts.Strategy(services)), nil
+}
+
+func (c *registrySelector) Mark(service string, node *registry.Node, err error, opts ...MarkOption) {
+	var options MarkOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	c.cb.Mark(options.Namespace, service, node, err)
 }
 
-func (c *registrySelector) Mark(service string, node *registry.Node, err error) {
+func (c *registrySelector) Observe(service string, node *registry.Node) func(err error) {
+	return c.lt.Observe(service, node)
 }
 
 func (c *registrySelector) Reset(service string) {
+	c.cb.Reset(service)
+	c.lt.Reset(service)
 }
 
 // Close stops the watcher and destroys the cache
@@ -104,6 +127,8 @@ func NewSelector(opts ...Option) Selector {
 		so: sopts,
 	}
 	s.rc = s.newCache()
+	s.cb = sopts.Breaker()
+	s.lt = sopts.Load()
 
 	return s
 }
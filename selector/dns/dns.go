@@ -13,6 +13,7 @@ import (
 type dnsSelector struct {
 	options selector.Options
 	domain  string
+	breaker *selector.Breaker
 }
 
 var (
@@ -23,6 +24,7 @@ func (d *dnsSelector) Init(opts ...selector.Option) error {
 	for _, o := range opts {
 		o(&d.options)
 	}
+	d.breaker = d.options.Breaker()
 	return nil
 }
 
@@ -91,17 +93,28 @@ func (d *dnsSelector) Select(service string, opts ...selector.SelectOption) (sel
 		services = filter(services)
 	}
 
+	// eject the nodes with an open circuit
+	services = d.breaker.Filter(sopts.Namespace, service)(services)
+
 	// if there's nothing left, return
 	if len(services) == 0 {
 		return nil, selector.ErrNoneAvailable
 	}
 
-	return sopts.Strategy(services), nil
+	return d.breaker.Next(sopts.Namespace, service, services, sopts.Strategy(services)), nil
 }
 
-func (d *dnsSelector) Mark(service string, node *registry.Node, err error) {}
+func (d *dnsSelector) Mark(service string, node *registry.Node, err error, opts ...selector.MarkOption) {
+	var options selector.MarkOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	d.breaker.Mark(options.Namespace, service, node, err)
+}
 
-func (d *dnsSelector) Reset(service string) {}
+func (d *dnsSelector) Reset(service string) {
+	d.breaker.Reset(service)
+}
 
 func (d *dnsSelector) Close() error {
 	return nil
@@ -120,5 +133,9 @@ func NewSelector(opts ...selector.Option) selector.Selector {
 		o(&options)
 	}
 
-	return &dnsSelector{options: options, domain: DefaultDomain}
+	return &dnsSelector{
+		options: options,
+		domain:  DefaultDomain,
+		breaker: options.Breaker(),
+	}
 }
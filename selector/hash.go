@@ -0,0 +1,685 @@
+package selector
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/util/meta"
+)
+
+// HashOptions configure the consistent hashes
+type HashOptions struct {
+	// Replicas is the number of points a node has on the ring
+	Replicas int
+	// TableSize is the size of the maglev lookup table. It is rounded up
+	// to a prime and should be much larger than the number of nodes.
+	TableSize int
+	// LoadFactor bounds the outstanding calls of a node to the factor times
+	// the average of the nodes, the keys of a full node go to the next one.
+	// Zero disables the bound, a bound requires the Load.
+	LoadFactor float64
+	// Load tracks the outstanding calls of the nodes for the bound
+	Load *Load
+	// Registry is watched to update the tables when nodes are added or
+	// removed. Without it the tables follow the nodes of the selections.
+	Registry registry.Registry
+	// Namespace of the services watched in the registry
+	Namespace string
+	// OnChange is told about every change of the nodes
+	OnChange func(*Change)
+}
+
+var (
+	DefaultHashOptions = HashOptions{
+		Replicas:  100,
+		TableSize: 65537,
+	}
+
+	// DefaultHashRetry is the wait before the registry is watched again
+	// after the watcher failed
+	DefaultHashRetry = time.Second
+)
+
+// table maps the hash of a key to the nodes, a table is never modified
+// once built so a change can compare the old and the new one
+type table interface {
+	// walk calls fn with the nodes in order of preference for the hash
+	// until it returns false
+	walk(hash uint64, fn func(*registry.Node) bool)
+}
+
+// hashTable is the table of the nodes of a service
+type hashTable struct {
+	nodes map[string]*registry.Node
+	table table
+}
+
+// Hash is a consistent hash of the nodes of services, it maps a key to the
+// same node of a service as long as the node is available. Every service
+// has its own table and nodes are tracked by address.
+type Hash struct {
+	opts HashOptions
+	// build returns the table of the nodes sorted by address, it may reuse
+	// the previous table to only process the added and removed nodes
+	build func(o HashOptions, prev table, nodes, added, removed []*registry.Node) table
+
+	// orders the updates from the registry
+	updates sync.Mutex
+	exit    chan bool
+	once    sync.Once
+
+	sync.RWMutex
+	// service -> table of its nodes
+	tables map[string]*hashTable
+}
+
+// Change is a change of the nodes of a service
+type Change struct {
+	Service string
+	Added   []*registry.Node
+	Removed []*registry.Node
+
+	before table
+	after  table
+}
+
+// Moved reports whether the key is owned by another node after the change
+func (c *Change) Moved(key string) (from, to *registry.Node, moved bool) {
+	h := hashString(key)
+	from = owner(c.before, h)
+	to = owner(c.after, h)
+
+	switch {
+	case from == nil || to == nil:
+		return from, to, from != to
+	default:
+		return from, to, from.Address != to.Address
+	}
+}
+
+func newHash(opts HashOptions, build func(HashOptions, table, []*registry.Node, []*registry.Node, []*registry.Node) table) *Hash {
+	if opts.Replicas <= 0 {
+		opts.Replicas = DefaultHashOptions.Replicas
+	}
+	if opts.TableSize <= 0 {
+		opts.TableSize = DefaultHashOptions.TableSize
+	}
+	opts.TableSize = nextPrime(opts.TableSize)
+	if opts.LoadFactor > 0 && opts.LoadFactor < 1 {
+		opts.LoadFactor = 1
+	}
+
+	h := &Hash{
+		opts:   opts,
+		build:  build,
+		exit:   make(chan bool),
+		tables: make(map[string]*hashTable),
+	}
+
+	if opts.Registry != nil {
+		go h.run()
+	}
+
+	return h
+}
+
+// NewRing returns a ring hash. Every node is placed on the ring several
+// times and a key belongs to the next node on the ring, adding or removing
+// a node only adds or removes its own points.
+func NewRing(opts HashOptions) *Hash {
+	return newHash(opts, func(o HashOptions, prev table, _, added, removed []*registry.Node) table {
+		r, _ := prev.(ring)
+		return r.update(o.Replicas, added, removed)
+	})
+}
+
+// NewMaglev returns a maglev hash. Its lookup table spreads the keys evenly
+// and moves few keys when the nodes change, the table is filled again on
+// every change from the permutations of the nodes.
+func NewMaglev(opts HashOptions) *Hash {
+	return newHash(opts, func(o HashOptions, _ table, nodes, _, _ []*registry.Node) table {
+		return newMaglev(nodes, o.TableSize)
+	})
+}
+
+// Sync updates the table of the service to the nodes of its versions and
+// returns the change, nil when the nodes didn't change
+func (h *Hash) Sync(services []*registry.Service) *Change {
+	if len(services) == 0 {
+		return nil
+	}
+	return h.sync(services[0].Name, services)
+}
+
+func (h *Hash) sync(service string, services []*registry.Service) *Change {
+	nodes := make(map[string]*registry.Node)
+	for _, s := range services {
+		for _, n := range s.Nodes {
+			nodes[n.Address] = n
+		}
+	}
+
+	h.Lock()
+
+	t, ok := h.tables[service]
+	if !ok {
+		t = &hashTable{}
+		h.tables[service] = t
+	}
+
+	c := &Change{Service: service}
+	for addr, n := range nodes {
+		if _, ok := t.nodes[addr]; !ok {
+			c.Added = append(c.Added, n)
+		}
+	}
+	for addr, n := range t.nodes {
+		if _, ok := nodes[addr]; !ok {
+			c.Removed = append(c.Removed, n)
+		}
+	}
+
+	if len(c.Added) == 0 && len(c.Removed) == 0 {
+		// keep the latest details of the nodes
+		t.nodes = nodes
+		h.Unlock()
+		return nil
+	}
+
+	sorted := make([]*registry.Node, 0, len(nodes))
+	for _, n := range nodes {
+		sorted = append(sorted, n)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Address < sorted[j].Address
+	})
+
+	c.before = t.table
+	c.after = h.build(h.opts, t.table, sorted, c.Added, c.Removed)
+	t.nodes = nodes
+	t.table = c.after
+
+	h.Unlock()
+
+	if h.opts.OnChange != nil {
+		h.opts.OnChange(c)
+	}
+
+	return c
+}
+
+// refresh updates the table of the service to its nodes in the registry
+func (h *Hash) refresh(service string) error {
+	h.updates.Lock()
+	defer h.updates.Unlock()
+
+	services, err := h.opts.Registry.GetService(service, registry.GetNamespace(h.opts.Namespace))
+	switch err {
+	case nil, registry.ErrNotFound:
+		h.sync(service, services)
+		return nil
+	default:
+		return err
+	}
+}
+
+// refreshAll refreshes the table of every service
+func (h *Hash) refreshAll() {
+	h.RLock()
+	services := make([]string, 0, len(h.tables))
+	for service := range h.tables {
+		services = append(services, service)
+	}
+	h.RUnlock()
+
+	for _, service := range services {
+		if err := h.refresh(service); err != nil {
+			log.Debugf("hash: failed to get the nodes of %s: %v", service, err)
+		}
+	}
+}
+
+// run updates the tables of the selected services from the registry
+// watcher until the hash is closed
+func (h *Hash) run() {
+	for {
+		w, err := h.opts.Registry.Watch(registry.WatchNamespace(h.opts.Namespace))
+		if err == nil {
+			// catch up with the changes made while nothing was watching
+			h.refreshAll()
+			err = h.watch(w)
+		}
+
+		select {
+		case <-h.exit:
+			return
+		default:
+		}
+
+		log.Debugf("hash: watching the registry failed, retrying in %v: %v", DefaultHashRetry, err)
+
+		select {
+		case <-h.exit:
+			return
+		case <-time.After(DefaultHashRetry):
+		}
+	}
+}
+
+// watch refreshes the table of every changed service which has a table,
+// it returns when the watcher fails
+func (h *Hash) watch(w registry.Watcher) error {
+	stop := make(chan bool)
+	defer close(stop)
+
+	go func() {
+		defer w.Stop()
+
+		select {
+		case <-h.exit:
+		case <-stop:
+		}
+	}()
+
+	for {
+		res, err := w.Next()
+		if err != nil {
+			return err
+		}
+		if res == nil || res.Service == nil {
+			continue
+		}
+
+		h.RLock()
+		_, ok := h.tables[res.Service.Name]
+		h.RUnlock()
+
+		if !ok {
+			continue
+		}
+		if err := h.refresh(res.Service.Name); err != nil {
+			log.Debugf("hash: failed to get the nodes of %s: %v", res.Service.Name, err)
+		}
+	}
+}
+
+// Close stops watching the registry
+func (h *Hash) Close() error {
+	h.once.Do(func() {
+		close(h.exit)
+	})
+	return nil
+}
+
+// Owner returns the node of the service owning the key
+func (h *Hash) Owner(service, key string) (*registry.Node, error) {
+	h.RLock()
+	defer h.RUnlock()
+
+	t, ok := h.tables[service]
+	if !ok {
+		return nil, ErrNoneAvailable
+	}
+	if n := owner(t.table, hashString(key)); n != nil {
+		return t.current(n), nil
+	}
+	return nil, ErrNoneAvailable
+}
+
+// current returns the latest details of the node, the tables keep the
+// details of when the node was added
+func (t *hashTable) current(n *registry.Node) *registry.Node {
+	if cur, ok := t.nodes[n.Address]; ok {
+		return cur
+	}
+	return n
+}
+
+// track makes sure the table of the service is built. With a registry the
+// table is built from the registry on first use and the watcher keeps it
+// up to date, without one it follows the nodes of every selection.
+func (h *Hash) track(service string, services []*registry.Service) {
+	if h.opts.Registry == nil {
+		h.sync(service, services)
+		return
+	}
+
+	h.RLock()
+	_, ok := h.tables[service]
+	h.RUnlock()
+
+	if ok {
+		return
+	}
+
+	if err := h.refresh(service); err != nil {
+		h.sync(service, services)
+	}
+}
+
+// Strategy returns a strategy algorithm which picks the node owning the key.
+// The keys of the nodes left out of the selection, such as the ejected ones,
+// go to the next node. With a load bound the key also goes to the next node
+// when its owner is full.
+func (h *Hash) Strategy(key string) Strategy {
+	return func(services []*registry.Service) Next {
+		var service string
+		available := make(map[string]bool)
+		for _, s := range services {
+			service = s.Name
+			for _, n := range s.Nodes {
+				available[n.Address] = true
+			}
+		}
+
+		if len(service) > 0 {
+			h.track(service, services)
+		}
+
+		return func() (*registry.Node, error) {
+			h.RLock()
+			defer h.RUnlock()
+
+			t, ok := h.tables[service]
+			if !ok || t.table == nil {
+				return nil, ErrNoneAvailable
+			}
+
+			hash := hashString(key)
+			if h.opts.LoadFactor == 0 || h.opts.Load == nil {
+				var found *registry.Node
+				t.table.walk(hash, func(n *registry.Node) bool {
+					if !available[n.Address] {
+						return true
+					}
+					found = n
+					return false
+				})
+				if found == nil {
+					return nil, ErrNoneAvailable
+				}
+				return t.current(found), nil
+			}
+
+			return h.bounded(service, t, available, hash)
+		}
+	}
+}
+
+// bounded returns the first available node of the service for the hash
+// which is below the load bound
+func (h *Hash) bounded(service string, t *hashTable, available map[string]bool, hash uint64) (*registry.Node, error) {
+	l := h.opts.Load
+
+	l.Lock()
+	defer l.Unlock()
+
+	var total, count int
+	for addr := range t.nodes {
+		if !available[addr] {
+			continue
+		}
+		count++
+		if n, ok := l.loads[service][addr]; ok {
+			total += n.outstanding
+		}
+	}
+	if count == 0 {
+		return nil, ErrNoneAvailable
+	}
+
+	capacity := int(math.Ceil(h.opts.LoadFactor * float64(total+1) / float64(count)))
+
+	var found *registry.Node
+	t.table.walk(hash, func(node *registry.Node) bool {
+		if !available[node.Address] {
+			return true
+		}
+		if n, ok := l.loads[service][node.Address]; ok && n.outstanding >= capacity {
+			return true
+		}
+		found = node
+		return false
+	})
+
+	if found == nil {
+		return nil, ErrNoneAvailable
+	}
+	return t.current(found), nil
+}
+
+func owner(t table, hash uint64) *registry.Node {
+	if t == nil {
+		return nil
+	}
+
+	var found *registry.Node
+	t.walk(hash, func(n *registry.Node) bool {
+		found = n
+		return false
+	})
+	return found
+}
+
+type point struct {
+	hash uint64
+	node *registry.Node
+}
+
+// ring is the sorted points of the nodes
+type ring []point
+
+func (r ring) walk(hash uint64, fn func(*registry.Node) bool) {
+	if len(r) == 0 {
+		return
+	}
+
+	start := sort.Search(len(r), func(i int) bool {
+		return r[i].hash >= hash
+	})
+
+	seen := make(map[string]bool)
+	for i := 0; i < len(r); i++ {
+		p := r[(start+i)%len(r)]
+		if seen[p.node.Address] {
+			continue
+		}
+		seen[p.node.Address] = true
+		if !fn(p.node) {
+			return
+		}
+	}
+}
+
+// update returns a new ring without the points of the removed nodes and
+// with the points of the added nodes merged in
+func (r ring) update(replicas int, added, removed []*registry.Node) ring {
+	gone := make(map[string]bool, len(removed))
+	for _, n := range removed {
+		gone[n.Address] = true
+	}
+
+	points := make(ring, 0, len(added)*replicas)
+	for _, n := range added {
+		for i := 0; i < replicas; i++ {
+			points = append(points, point{hashString(n.Address + "-" + strconv.Itoa(i)), n})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+
+	merged := make(ring, 0, len(r)+len(points))
+	i, j := 0, 0
+	for i < len(r) || j < len(points) {
+		if i < len(r) && gone[r[i].node.Address] {
+			i++
+			continue
+		}
+		if j >= len(points) || (i < len(r) && r[i].hash <= points[j].hash) {
+			merged = append(merged, r[i])
+			i++
+			continue
+		}
+		merged = append(merged, points[j])
+		j++
+	}
+
+	return merged
+}
+
+// maglev is the lookup table of the nodes
+type maglev struct {
+	nodes []*registry.Node
+	table []int
+}
+
+func newMaglev(nodes []*registry.Node, size int) *maglev {
+	m := &maglev{
+		nodes: nodes,
+		table: make([]int, size),
+	}
+
+	if len(nodes) == 0 {
+		return m
+	}
+
+	offsets := make([]uint64, len(nodes))
+	skips := make([]uint64, len(nodes))
+	next := make([]uint64, len(nodes))
+
+	for i, n := range nodes {
+		offsets[i] = hashString(n.Address) % uint64(size)
+		skips[i] = hashString(n.Address+"-skip")%uint64(size-1) + 1
+	}
+
+	for i := range m.table {
+		m.table[i] = -1
+	}
+
+	for filled := 0; ; {
+		for i := range nodes {
+			c := (offsets[i] + next[i]*skips[i]) % uint64(size)
+			for m.table[c] >= 0 {
+				next[i]++
+				c = (offsets[i] + next[i]*skips[i]) % uint64(size)
+			}
+			m.table[c] = i
+			next[i]++
+
+			if filled++; filled == size {
+				return m
+			}
+		}
+	}
+}
+
+func (m *maglev) walk(hash uint64, fn func(*registry.Node) bool) {
+	if len(m.nodes) == 0 {
+		return
+	}
+
+	seen := make(map[int]bool)
+	for i := 0; i < len(m.table) && len(seen) < len(m.nodes); i++ {
+		n := m.table[(hash+uint64(i))%uint64(len(m.table))]
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		if !fn(m.nodes[n]) {
+			return
+		}
+	}
+}
+
+// hashString hashes the string with fnv and mixes the bits so that similar
+// strings spread over the whole range
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func nextPrime(n int) int {
+	if n < 2 {
+		return 2
+	}
+	for ; ; n++ {
+		prime := true
+		for i := 2; i*i <= n; i++ {
+			if n%i == 0 {
+				prime = false
+				break
+			}
+		}
+		if prime {
+			return n
+		}
+	}
+}
+
+type hashByKey struct{}
+
+type hashBy struct {
+	hash *Hash
+	key  string
+}
+
+// WithHashKey selects the node of the hash owning the key
+func WithHashKey(h *Hash, key string) SelectOption {
+	return func(o *SelectOptions) {
+		o.Strategy = h.Strategy(key)
+	}
+}
+
+// HashBy selects the node of the hash owning the value of the metadata key
+// of every call. The balancer reads the value from the call's context, the
+// calls without it use the strategy.
+func HashBy(h *Hash, key string) SelectOption {
+	return func(o *SelectOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, hashByKey{}, &hashBy{hash: h, key: key})
+	}
+}
+
+// CallHashKey returns the select option picking the owner of the call's key
+// when the select options hash by the metadata of the calls and the context
+// carries the key
+func CallHashKey(ctx context.Context, opts ...SelectOption) (SelectOption, bool) {
+	var options SelectOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if options.Context == nil || ctx == nil {
+		return nil, false
+	}
+
+	hb, ok := options.Context.Value(hashByKey{}).(*hashBy)
+	if !ok {
+		return nil, false
+	}
+
+	key, ok := meta.Get(ctx, hb.key)
+	if !ok || len(key) == 0 {
+		return nil, false
+	}
+
+	return WithHashKey(hb.hash, key), true
+}
@@ -0,0 +1,294 @@
+package selector
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+	"github.com/sumlookup/mini/util/meta"
+)
+
+func hashServices(n int) []*registry.Service {
+	s := &registry.Service{Name: "foo", Version: "1.0.0"}
+	for i := 0; i < n; i++ {
+		s.Nodes = append(s.Nodes, &registry.Node{
+			Id:      fmt.Sprintf("foo-%d", i),
+			Address: fmt.Sprintf("10.0.0.%d:8080", i),
+		})
+	}
+	return []*registry.Service{s}
+}
+
+func TestHashes(t *testing.T) {
+	const keys = 10000
+
+	// maglev trades a few keys moving between the other nodes for an even spread
+	strays := map[string]int{"ring": 0, "maglev": keys / 50}
+
+	for name, newHash := range map[string]func(HashOptions) *Hash{"ring": NewRing, "maglev": NewMaglev} {
+		h := newHash(HashOptions{})
+
+		if _, err := h.Owner("foo", "key"); err != ErrNoneAvailable {
+			t.Fatalf("%s: expected %v without nodes, got %v", name, ErrNoneAvailable, err)
+		}
+
+		if c := h.Sync(hashServices(5)); c == nil || len(c.Added) != 5 {
+			t.Fatalf("%s: expected 5 added nodes, got %+v", name, c)
+		}
+		if c := h.Sync(hashServices(5)); c != nil {
+			t.Fatalf("%s: expected no change for the same nodes, got %+v", name, c)
+		}
+
+		// the services have their own tables
+		bar := hashServices(2)
+		bar[0].Name = "bar"
+		if c := h.Sync(bar); c == nil || c.Service != "bar" || len(c.Added) != 2 || len(c.Removed) != 0 {
+			t.Fatalf("%s: expected bar to be added on its own, got %+v", name, c)
+		}
+		if c := h.Sync(hashServices(5)); c != nil {
+			t.Fatalf("%s: expected no change of foo after bar, got %+v", name, c)
+		}
+
+		owners := make(map[string]string)
+		counts := make(map[string]int)
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("tenant-%d", i)
+			node, err := h.Owner("foo", key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			owners[key] = node.Id
+			counts[node.Id]++
+		}
+
+		for id, count := range counts {
+			if count < keys/5/2 || count > keys/5*2 {
+				t.Fatalf("%s: expected the keys to spread evenly, %s owns %d: %v", name, id, count, counts)
+			}
+		}
+
+		// a new node only takes keys, the other keys stay where they were
+		c := h.Sync(hashServices(6))
+		if c == nil || len(c.Added) != 1 || c.Added[0].Id != "foo-5" {
+			t.Fatalf("%s: expected foo-5 to be added, got %+v", name, c)
+		}
+
+		var moved, stray int
+		for key, before := range owners {
+			node, _ := h.Owner("foo", key)
+			from, to, ok := c.Moved(key)
+			if from.Id != before || to.Id != node.Id {
+				t.Fatalf("%s: expected %s to move from %s to %s, got %s to %s", name, key, before, node.Id, from.Id, to.Id)
+			}
+			if !ok {
+				continue
+			}
+			moved++
+			if node.Id != "foo-5" {
+				stray++
+			}
+		}
+		if stray > strays[name] {
+			t.Fatalf("%s: expected the keys to move to the new node, %d moved elsewhere", name, stray)
+		}
+		if moved < keys/6/2 || moved > keys/6*2 {
+			t.Fatalf("%s: expected about a sixth of the keys to move, got %d", name, moved)
+		}
+
+		// removing a node only moves its keys
+		services := hashServices(6)
+		services[0].Nodes = services[0].Nodes[1:]
+
+		c = h.Sync(services)
+		if c == nil || len(c.Removed) != 1 || c.Removed[0].Id != "foo-0" {
+			t.Fatalf("%s: expected foo-0 to be removed, got %+v", name, c)
+		}
+		stray = 0
+		for key := range owners {
+			if from, _, ok := c.Moved(key); ok && from.Id != "foo-0" {
+				stray++
+			}
+		}
+		if stray > strays[name] {
+			t.Fatalf("%s: expected only the keys of foo-0 to move, %d others moved", name, stray)
+		}
+	}
+}
+
+func TestHashBounded(t *testing.T) {
+	load := NewLoad(LoadOptions{})
+	services := hashServices(3)
+
+	for name, newHash := range map[string]func(HashOptions) *Hash{"ring": NewRing, "maglev": NewMaglev} {
+		h := newHash(HashOptions{LoadFactor: 1.25, Load: load})
+		next := h.Strategy("tenant-1")(services)
+
+		owner, err := h.Owner("foo", "tenant-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		node, err := next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Id != owner.Id {
+			t.Fatalf("%s: expected the owner %s, got %s", name, owner.Id, node.Id)
+		}
+
+		// the owner is full, the key goes to the next node
+		var done []func(error)
+		for i := 0; i < 10; i++ {
+			done = append(done, load.Observe("foo", owner))
+		}
+
+		node, err = next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Id == owner.Id {
+			t.Fatalf("%s: expected another node than the loaded owner", name)
+		}
+
+		for _, d := range done {
+			d(nil)
+		}
+
+		if node, _ := next(); node.Id != owner.Id {
+			t.Fatalf("%s: expected the key to return to its owner, got %s", name, node.Id)
+		}
+	}
+}
+
+func TestHashSelect(t *testing.T) {
+	r := memory.NewRegistry()
+	for _, s := range hashServices(4) {
+		if err := r.Register(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewSelector(Registry(r))
+	defer s.Close()
+
+	h := NewMaglev(HashOptions{})
+
+	for i := 0; i < 20; i++ {
+		next, err := s.Select("foo", WithHashKey(h, "tenant-7"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, err := next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		owner, _ := h.Owner("foo", "tenant-7")
+		if node.Id != owner.Id {
+			t.Fatalf("Expected the owner %s of the key, got %s", owner.Id, node.Id)
+		}
+	}
+
+	opts := []SelectOption{HashBy(h, "Tenant")}
+	if _, ok := CallHashKey(context.Background(), opts...); ok {
+		t.Fatal("Expected no hash key without the metadata")
+	}
+	if _, ok := CallHashKey(meta.Set(context.Background(), "Tenant", "tenant-7")); ok {
+		t.Fatal("Expected no hash key without hashing by the metadata")
+	}
+
+	hashed, ok := CallHashKey(meta.Set(context.Background(), "Tenant", "tenant-7"), opts...)
+	if !ok {
+		t.Fatal("Expected the hash key of the call")
+	}
+
+	next, err := s.Select("foo", hashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, _ := next()
+	owner, _ := h.Owner("foo", "tenant-7")
+	if node.Id != owner.Id {
+		t.Fatalf("Expected the owner %s of the call's key, got %s", owner.Id, node.Id)
+	}
+}
+
+func TestHashWatch(t *testing.T) {
+	r := memory.NewRegistry()
+	services := hashServices(3)
+	if err := r.Register(services[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan *Change, 10)
+	h := NewRing(HashOptions{
+		Registry: r,
+		OnChange: func(c *Change) {
+			changes <- c
+		},
+	})
+	defer h.Close()
+
+	change := func() *Change {
+		select {
+		case c := <-changes:
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the change of the nodes")
+			return nil
+		}
+	}
+
+	next := h.Strategy("tenant-1")(services)
+	if c := change(); len(c.Added) != 3 {
+		t.Fatalf("Expected the nodes of the registry to be added, got %+v", c)
+	}
+	owner, err := next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a registered node is added without selecting
+	added := &registry.Service{Name: "foo", Version: "1.0.0", Nodes: []*registry.Node{
+		{Id: "foo-3", Address: "10.0.0.3:8080"},
+	}}
+	if err := r.Register(added); err != nil {
+		t.Fatal(err)
+	}
+	if c := change(); len(c.Added) != 1 || c.Added[0].Id != "foo-3" {
+		t.Fatalf("Expected foo-3 to be added, got %+v", c)
+	}
+
+	// a deregistered node is removed without selecting
+	gone := &registry.Service{Name: "foo", Version: "1.0.0", Nodes: []*registry.Node{owner}}
+	if err := r.Deregister(gone); err != nil {
+		t.Fatal(err)
+	}
+	if c := change(); len(c.Removed) != 1 || c.Removed[0].Id != owner.Id {
+		t.Fatalf("Expected %s to be removed, got %+v", owner.Id, c)
+	}
+	if node, _ := h.Owner("foo", "tenant-1"); node == nil || node.Id == owner.Id {
+		t.Fatalf("Expected the key to move away from %s, got %+v", owner.Id, node)
+	}
+
+	// the keys of the nodes left out of the selection go to the next node
+	selected := hashServices(3)
+	selected[0].Nodes = []*registry.Node{selected[0].Nodes[0]}
+	if owner.Id == "foo-0" {
+		selected[0].Nodes = []*registry.Node{hashServices(3)[0].Nodes[1]}
+	}
+	node, err := h.Strategy("tenant-1")(selected)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Id != selected[0].Nodes[0].Id {
+		t.Fatalf("Expected the only selected node %s, got %s", selected[0].Nodes[0].Id, node.Id)
+	}
+	select {
+	case c := <-changes:
+		t.Fatalf("Expected the selection to leave the table alone, got %+v", c)
+	default:
+	}
+}
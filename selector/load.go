@@ -0,0 +1,186 @@
+package selector
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+)
+
+// LoadOptions configure how the load of the nodes is tracked
+type LoadOptions struct {
+	// Decay is the time constant of the latency average. The average of a
+	// node without new calls decays towards zero so that it is tried again.
+	Decay time.Duration
+	// Penalty is the latency recorded for a failed call which failed faster
+	Penalty time.Duration
+}
+
+var (
+	DefaultLoadOptions = LoadOptions{
+		Decay:   10 * time.Second,
+		Penalty: time.Second,
+	}
+)
+
+type load struct {
+	// peak sensitive moving average of the latency in nanoseconds
+	ewma        float64
+	updated     time.Time
+	outstanding int
+}
+
+// Load tracks the latency and the outstanding calls of every node and
+// provides a power of two choices strategy picking the less loaded node.
+// Nodes are tracked by address like the breaker.
+type Load struct {
+	opts LoadOptions
+
+	sync.Mutex
+	// service -> node address -> load
+	loads map[string]map[string]*load
+}
+
+// NewLoad returns a load tracker, zero options fall back to the defaults
+func NewLoad(opts LoadOptions) *Load {
+	if opts.Decay <= 0 {
+		opts.Decay = DefaultLoadOptions.Decay
+	}
+	if opts.Penalty <= 0 {
+		opts.Penalty = DefaultLoadOptions.Penalty
+	}
+
+	return &Load{
+		opts:  opts,
+		loads: make(map[string]map[string]*load),
+	}
+}
+
+func (l *Load) get(service, address string) *load {
+	nodes, ok := l.loads[service]
+	if !ok {
+		nodes = make(map[string]*load)
+		l.loads[service] = nodes
+	}
+
+	n, ok := nodes[address]
+	if !ok {
+		n = &load{}
+		nodes[address] = n
+	}
+	return n
+}
+
+// decay returns the weight of the old average after the elapsed time
+func (l *Load) decay(elapsed time.Duration) float64 {
+	return math.Exp(-float64(elapsed) / float64(l.opts.Decay))
+}
+
+// Observe records the start of a call to the node, the returned function
+// records its latency and outcome once it finished
+func (l *Load) Observe(service string, node *registry.Node) func(err error) {
+	if node == nil || len(node.Address) == 0 {
+		return func(error) {}
+	}
+
+	l.Lock()
+	l.get(service, node.Address).outstanding++
+	l.Unlock()
+
+	start := time.Now()
+	var once sync.Once
+
+	return func(err error) {
+		once.Do(func() {
+			now := time.Now()
+			latency := now.Sub(start)
+			if err != nil && latency < l.opts.Penalty {
+				latency = l.opts.Penalty
+			}
+
+			l.Lock()
+			defer l.Unlock()
+
+			n := l.get(service, node.Address)
+			if n.outstanding > 0 {
+				n.outstanding--
+			}
+
+			// a slower call is taken at once, faster ones bring the average down over time
+			if n.updated.IsZero() || float64(latency) > n.ewma {
+				n.ewma = float64(latency)
+			} else {
+				w := l.decay(now.Sub(n.updated))
+				n.ewma = n.ewma*w + float64(latency)*(1-w)
+			}
+			n.updated = now
+		})
+	}
+}
+
+// Cost returns the load of the node, its decayed latency average weighted
+// by the outstanding calls. Nodes without calls cost nothing.
+func (l *Load) Cost(service string, node *registry.Node) float64 {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.cost(l.loads[service][node.Address], time.Now())
+}
+
+func (l *Load) cost(n *load, now time.Time) float64 {
+	if n == nil {
+		return 0
+	}
+
+	ewma := n.ewma
+	if !n.updated.IsZero() {
+		ewma *= l.decay(now.Sub(n.updated))
+	}
+
+	return ewma * float64(n.outstanding+1)
+}
+
+// Reset clears the load of every node of the service
+func (l *Load) Reset(service string) {
+	l.Lock()
+	delete(l.loads, service)
+	l.Unlock()
+}
+
+// Strategy is a power of two choices strategy algorithm, it picks two
+// random nodes and returns the one with the lower cost
+func (l *Load) Strategy(services []*registry.Service) Next {
+	var nodes []*registry.Node
+	var service string
+
+	for _, s := range services {
+		service = s.Name
+		nodes = append(nodes, s.Nodes...)
+	}
+
+	return func() (*registry.Node, error) {
+		switch len(nodes) {
+		case 0:
+			return nil, ErrNoneAvailable
+		case 1:
+			return nodes[0], nil
+		}
+
+		i := rand.Intn(len(nodes))
+		j := rand.Intn(len(nodes) - 1)
+		if j >= i {
+			j++
+		}
+
+		l.Lock()
+		defer l.Unlock()
+
+		now := time.Now()
+		if l.cost(l.loads[service][nodes[j].Address], now) < l.cost(l.loads[service][nodes[i].Address], now) {
+			return nodes[j], nil
+		}
+		return nodes[i], nil
+	}
+}
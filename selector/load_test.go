@@ -0,0 +1,133 @@
+package selector
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+)
+
+func TestLoadObserve(t *testing.T) {
+	l := NewLoad(LoadOptions{Penalty: time.Minute})
+	node := &registry.Node{Id: "a", Address: "10.0.0.1:1001"}
+
+	if cost := l.Cost("foo", node); cost != 0 {
+		t.Fatalf("Expected no cost for an unknown node, got %v", cost)
+	}
+
+	done := l.Observe("foo", node)
+	time.Sleep(10 * time.Millisecond)
+	done(nil)
+	// a second call is ignored
+	done(nil)
+
+	cost := l.Cost("foo", node)
+	if cost < float64(10*time.Millisecond) || cost > float64(time.Second) {
+		t.Fatalf("Expected the cost to be about the latency, got %v", time.Duration(cost))
+	}
+
+	// outstanding calls make the node more expensive
+	pending := l.Observe("foo", node)
+	if c := l.Cost("foo", node); c < 1.9*cost {
+		t.Fatalf("Expected the outstanding call to double the cost, got %v for %v", c, cost)
+	}
+	pending(errors.New("unavailable"))
+
+	// failures are penalised
+	if c := l.Cost("foo", node); c < float64(time.Second) {
+		t.Fatalf("Expected the failure to be penalised, got %v", time.Duration(c))
+	}
+
+	l.Reset("foo")
+	if cost := l.Cost("foo", node); cost != 0 {
+		t.Fatalf("Expected no cost after the reset, got %v", cost)
+	}
+}
+
+func TestLoadStrategy(t *testing.T) {
+	l := NewLoad(LoadOptions{Decay: 100 * time.Millisecond, Penalty: time.Second})
+
+	fast := &registry.Node{Id: "fast", Address: "10.0.0.1:1001"}
+	slow := &registry.Node{Id: "slow", Address: "10.0.0.2:1002"}
+	services := []*registry.Service{{Name: "foo", Nodes: []*registry.Node{fast, slow}}}
+
+	l.Observe("foo", fast)(nil)
+	l.Observe("foo", slow)(errors.New("timeout"))
+
+	next := l.Strategy(services)
+	for i := 0; i < 100; i++ {
+		node, err := next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Id != "fast" {
+			t.Fatalf("Expected the fast node to be picked, got %s", node.Id)
+		}
+	}
+
+	// the average of the slow node decays until it is tried again
+	time.Sleep(time.Second)
+	done := l.Observe("foo", fast)
+	time.Sleep(20 * time.Millisecond)
+	done(nil)
+	for i := 0; i < 10; i++ {
+		l.Observe("foo", fast)
+	}
+
+	if node, _ := next(); node.Id != "slow" {
+		t.Fatalf("Expected the stale slow node to be retried, got %s", node.Id)
+	}
+
+	if _, err := l.Strategy(nil)(); err != ErrNoneAvailable {
+		t.Fatalf("Expected %v without nodes, got %v", ErrNoneAvailable, err)
+	}
+}
+
+func TestP2CSelector(t *testing.T) {
+	r := memory.NewRegistry()
+	if err := r.Register(&registry.Service{
+		Name:    "foo",
+		Version: "1.0.0",
+		Nodes: []*registry.Node{
+			{Id: "foo-1", Address: "10.0.0.1:1001"},
+			{Id: "foo-2", Address: "10.0.0.2:1002"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSelector(Registry(r), P2C(LoadOptions{}))
+	defer s.Close()
+
+	o, ok := s.(Observer)
+	if !ok {
+		t.Fatal("Expected the registry selector to observe the calls")
+	}
+
+	for _, address := range []string{"10.0.0.1:1001", "10.0.0.2:1002"} {
+		done := o.Observe("foo", &registry.Node{Address: address})
+		time.Sleep(10 * time.Millisecond)
+		done(nil)
+	}
+
+	// the calls to foo-1 never finish
+	for i := 0; i < 10; i++ {
+		o.Observe("foo", &registry.Node{Address: "10.0.0.1:1001"})
+	}
+
+	next, err := s.Select("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		node, err := next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Id != "foo-2" {
+			t.Fatalf("Expected the node without outstanding calls, got %s", node.Id)
+		}
+	}
+}
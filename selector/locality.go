@@ -0,0 +1,264 @@
+package selector
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/util/env"
+)
+
+const (
+	// RegionKey is the node metadata key holding the region of the node
+	RegionKey = "region"
+	// ZoneKey is the node metadata key holding the zone of the node
+	ZoneKey = "zone"
+)
+
+// Tier is how far the locality spilled over
+type Tier string
+
+const (
+	// TierZone selects the nodes of the local zone
+	TierZone Tier = "zone"
+	// TierRegion selects the nodes of the local region
+	TierRegion Tier = "region"
+	// TierAny selects the nodes of every zone
+	TierAny Tier = "any"
+)
+
+// LocalityOptions configure the locality aware selection
+type LocalityOptions struct {
+	// Region and Zone of the client, from the environment by default. Without
+	// a zone the nodes of every zone are selected.
+	Region string
+	Zone   string
+	// MinNodes is how many nodes a tier needs, fewer spill over to the next tier
+	MinNodes int
+	// MaxLoad is the average of outstanding calls per node above which a
+	// tier spills over to the next one. Zero disables it, it requires the Load.
+	MaxLoad float64
+	// Load tracks the outstanding calls of the nodes
+	Load *Load
+}
+
+var (
+	DefaultLocalityOptions = LocalityOptions{
+		MinNodes: 1,
+	}
+)
+
+// ZoneSplit is the split of the nodes of a service by zone as of the last selection
+type ZoneSplit struct {
+	Service string `json:"service"`
+	// Nodes is the number of available nodes by zone, blank for the
+	// nodes without a zone
+	Nodes map[string]int `json:"nodes"`
+	// Tier is the tier the nodes were selected from
+	Tier Tier `json:"tier"`
+	// Selected is the number of nodes selected from
+	Selected int       `json:"selected"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Locality prefers the nodes of the local zone and spills over to the
+// local region and then to every zone when the local nodes aren't enough
+type Locality struct {
+	opts LocalityOptions
+
+	sync.RWMutex
+	splits map[string]*ZoneSplit
+}
+
+// NewLocality returns the locality of the client, the region and the zone
+// default to the environment
+func NewLocality(opts LocalityOptions) *Locality {
+	e := env.New()
+	if len(opts.Region) == 0 {
+		opts.Region = e.GetRegion()
+	}
+	if len(opts.Zone) == 0 {
+		opts.Zone = e.GetZone()
+	}
+	if opts.MinNodes <= 0 {
+		opts.MinNodes = DefaultLocalityOptions.MinNodes
+	}
+
+	return &Locality{
+		opts:   opts,
+		splits: make(map[string]*ZoneSplit),
+	}
+}
+
+// tier returns the tier of the node relative to the client
+func (l *Locality) tier(n *registry.Node) Tier {
+	zone := n.Metadata[ZoneKey]
+	region := n.Metadata[RegionKey]
+
+	switch {
+	case len(zone) > 0 && zone == l.opts.Zone && (len(region) == 0 || region == l.opts.Region):
+		return TierZone
+	case len(region) > 0 && region == l.opts.Region:
+		return TierRegion
+	default:
+		return TierAny
+	}
+}
+
+// overloaded reports whether the nodes have too many outstanding calls
+func (l *Locality) overloaded(service string, nodes []*registry.Node) bool {
+	if l.opts.MaxLoad <= 0 || l.opts.Load == nil || len(nodes) == 0 {
+		return false
+	}
+
+	lt := l.opts.Load
+	lt.Lock()
+	defer lt.Unlock()
+
+	var total int
+	for _, node := range nodes {
+		if n, ok := lt.loads[service][node.Address]; ok {
+			total += n.outstanding
+		}
+	}
+
+	return float64(total)/float64(len(nodes)) > l.opts.MaxLoad
+}
+
+// Strategy wraps the strategy so that it picks from the nodes of the nearest
+// tier with enough nodes which isn't overloaded. The selector leaves out the
+// unhealthy nodes before the strategy runs.
+func (l *Locality) Strategy(strategy Strategy) Strategy {
+	return func(services []*registry.Service) Next {
+		split := &ZoneSplit{
+			Nodes:   make(map[string]int),
+			Tier:    TierAny,
+			Updated: time.Now(),
+		}
+
+		for _, service := range services {
+			split.Service = service.Name
+			for _, node := range service.Nodes {
+				split.Nodes[node.Metadata[ZoneKey]]++
+			}
+		}
+
+		// spill over until a tier is good enough
+		if len(l.opts.Zone) > 0 {
+			for _, tier := range []Tier{TierZone, TierRegion} {
+				nodes := l.nodes(services, tier)
+				if len(nodes) >= l.opts.MinNodes && !l.overloaded(split.Service, nodes) {
+					split.Tier = tier
+					break
+				}
+			}
+		}
+
+		selected := services
+		if split.Tier != TierAny {
+			selected = l.services(services, split.Tier)
+		}
+		for _, service := range selected {
+			split.Selected += len(service.Nodes)
+		}
+
+		if len(split.Service) > 0 {
+			l.Lock()
+			l.splits[split.Service] = split
+			l.Unlock()
+		}
+
+		return strategy(selected)
+	}
+}
+
+// nodes returns the nodes of the tier and of the nearer tiers
+func (l *Locality) nodes(services []*registry.Service, tier Tier) []*registry.Node {
+	var nodes []*registry.Node
+	for _, service := range l.services(services, tier) {
+		nodes = append(nodes, service.Nodes...)
+	}
+	return nodes
+}
+
+// services returns the services with the nodes of the tier and of the nearer tiers
+func (l *Locality) services(old []*registry.Service, tier Tier) []*registry.Service {
+	var services []*registry.Service
+
+	for _, service := range old {
+		var nodes []*registry.Node
+		for _, node := range service.Nodes {
+			switch l.tier(node) {
+			case TierZone:
+			case TierRegion:
+				if tier == TierZone {
+					continue
+				}
+			default:
+				if tier != TierAny {
+					continue
+				}
+			}
+			nodes = append(nodes, node)
+		}
+
+		// only add service if there's some nodes
+		if len(nodes) > 0 {
+			srv := new(registry.Service)
+			// copy
+			*srv = *service
+			srv.Nodes = nodes
+			services = append(services, srv)
+		}
+	}
+
+	return services
+}
+
+// Split returns the zone split of the service as of its last selection
+func (l *Locality) Split(service string) (*ZoneSplit, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	split, ok := l.splits[service]
+	return split, ok
+}
+
+// Splits returns the zone splits of every selected service ordered by name
+func (l *Locality) Splits() []*ZoneSplit {
+	l.RLock()
+	defer l.RUnlock()
+
+	splits := make([]*ZoneSplit, 0, len(l.splits))
+	for _, split := range l.splits {
+		splits = append(splits, split)
+	}
+	sort.Slice(splits, func(i, j int) bool {
+		return splits[i].Service < splits[j].Service
+	})
+
+	return splits
+}
+
+// ServeHTTP writes the zone splits as json for debugging, the service
+// query parameter limits them to one service
+func (l *Locality) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var v interface{} = l.Splits()
+
+	if service := r.URL.Query().Get("service"); len(service) > 0 {
+		split, ok := l.Split(service)
+		if !ok {
+			http.Error(w, "service not selected", http.StatusNotFound)
+			return
+		}
+		v = split
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,118 @@
+package selector
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sumlookup/mini/registry"
+)
+
+func localityServices() []*registry.Service {
+	node := func(id, region, zone string) *registry.Node {
+		return &registry.Node{
+			Id:       id,
+			Address:  id + ":8080",
+			Metadata: map[string]string{RegionKey: region, ZoneKey: zone},
+		}
+	}
+
+	return []*registry.Service{{
+		Name: "foo",
+		Nodes: []*registry.Node{
+			node("a1", "eu", "eu-a"),
+			node("a2", "eu", "eu-a"),
+			node("b1", "eu", "eu-b"),
+			node("c1", "us", "us-a"),
+		},
+	}}
+}
+
+func picked(t *testing.T, next Next, n int) map[string]bool {
+	ids := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		node, err := next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[node.Id] = true
+	}
+	return ids
+}
+
+func TestLocality(t *testing.T) {
+	l := NewLocality(LocalityOptions{Region: "eu", Zone: "eu-a"})
+
+	ids := picked(t, l.Strategy(RoundRobin)(localityServices()), 20)
+	if len(ids) != 2 || !ids["a1"] || !ids["a2"] {
+		t.Fatalf("Expected the nodes of the local zone, got %v", ids)
+	}
+
+	split, ok := l.Split("foo")
+	if !ok {
+		t.Fatal("Expected the zone split of foo")
+	}
+	if split.Tier != TierZone || split.Selected != 2 || split.Nodes["eu-a"] != 2 || split.Nodes["us-a"] != 1 {
+		t.Fatalf("Expected the split to select the local zone, got %+v", split)
+	}
+
+	// one of the local nodes is ejected, too few are left
+	l = NewLocality(LocalityOptions{Region: "eu", Zone: "eu-a", MinNodes: 2})
+	services := localityServices()
+	services[0].Nodes = services[0].Nodes[1:]
+
+	ids = picked(t, l.Strategy(RoundRobin)(services), 20)
+	if len(ids) != 2 || !ids["a2"] || !ids["b1"] {
+		t.Fatalf("Expected the nodes of the local region, got %v", ids)
+	}
+
+	// nothing left in the region
+	services[0].Nodes = services[0].Nodes[2:]
+	ids = picked(t, l.Strategy(RoundRobin)(services), 20)
+	if len(ids) != 1 || !ids["c1"] {
+		t.Fatalf("Expected the nodes of every zone, got %v", ids)
+	}
+	if split, _ := l.Split("foo"); split.Tier != TierAny {
+		t.Fatalf("Expected the split to spill over to every zone, got %+v", split)
+	}
+
+	// without a zone every node is selected
+	ids = picked(t, NewLocality(LocalityOptions{Zone: "-"}).Strategy(RoundRobin)(localityServices()), 20)
+	if len(ids) != 4 {
+		t.Fatalf("Expected every node without a local one, got %v", ids)
+	}
+}
+
+func TestLocalityLoad(t *testing.T) {
+	load := NewLoad(LoadOptions{})
+	l := NewLocality(LocalityOptions{Region: "eu", Zone: "eu-a", MaxLoad: 2, Load: load})
+	services := localityServices()
+
+	for _, node := range services[0].Nodes[:2] {
+		for i := 0; i < 3; i++ {
+			load.Observe("foo", node)
+		}
+	}
+
+	ids := picked(t, l.Strategy(RoundRobin)(services), 20)
+	if len(ids) != 3 || ids["c1"] {
+		t.Fatalf("Expected the overloaded zone to spill over to the region, got %v", ids)
+	}
+
+	rec := httptest.NewRecorder()
+	l.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/zones?service=foo", nil))
+
+	var split ZoneSplit
+	if err := json.Unmarshal(rec.Body.Bytes(), &split); err != nil {
+		t.Fatal(err)
+	}
+	if split.Service != "foo" || split.Tier != TierRegion || split.Selected != 3 {
+		t.Fatalf("Expected the debug split of foo, got %+v", split)
+	}
+
+	rec = httptest.NewRecorder()
+	l.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/zones?service=bar", nil))
+	if rec.Code != 404 {
+		t.Fatalf("Expected 404 for a service never selected, got %d", rec.Code)
+	}
+}
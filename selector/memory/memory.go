@@ -30,7 +30,7 @@ func (s *memorySelector) Select(service string, opts ...selector.SelectOption) (
 	}, nil
 }
 
-func (s *memorySelector) Mark(service string, node *registry.Node, err error) {
+func (s *memorySelector) Mark(service string, node *registry.Node, err error, opts ...selector.MarkOption) {
 	return
 }
 
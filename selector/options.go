@@ -2,6 +2,7 @@ package selector
 
 import (
 	"context"
+	"time"
 
 	"github.com/sumlookup/mini/registry"
 )
@@ -18,18 +19,32 @@ type Options struct {
 type SelectOptions struct {
 	Filters  []Filter
 	Strategy Strategy
+	// Namespace the service is selected from
+	Namespace string
 
 	// Other options for implementations of the interface
 	// can be stored in a context
 	Context context.Context
 }
 
+type breakerOptionsKey struct{}
+
+type loadKey struct{}
+
 // Option used to initialise the selector
 type Option func(*Options)
 
 // SelectOption used when making a select call
 type SelectOption func(*SelectOptions)
 
+type MarkOptions struct {
+	// Namespace the node is registered in
+	Namespace string
+}
+
+// MarkOption used when marking a node
+type MarkOption func(*MarkOptions)
+
 // Registry sets the registry used by the selector
 func Registry(r registry.Registry) Option {
 	return func(o *Options) {
@@ -52,9 +67,105 @@ func WithFilter(fn ...Filter) SelectOption {
 	}
 }
 
+// WithNamespace selects the nodes of the service registered in the namespace
+func WithNamespace(ns string) SelectOption {
+	return func(o *SelectOptions) {
+		o.Namespace = ns
+	}
+}
+
+// MarkNamespace marks the node of the service registered in the namespace
+func MarkNamespace(ns string) MarkOption {
+	return func(o *MarkOptions) {
+		o.Namespace = ns
+	}
+}
+
 // Strategy sets the selector strategy
 func WithStrategy(fn Strategy) SelectOption {
 	return func(o *SelectOptions) {
 		o.Strategy = fn
 	}
 }
+
+func getBreakerOptions(ctx context.Context) BreakerOptions {
+	if ctx != nil {
+		if bo, ok := ctx.Value(breakerOptionsKey{}).(BreakerOptions); ok {
+			return bo
+		}
+	}
+	return DefaultBreakerOptions
+}
+
+func setBreakerOptions(o *Options, fn func(*BreakerOptions)) {
+	if o.Context == nil {
+		o.Context = context.Background()
+	}
+	bo := getBreakerOptions(o.Context)
+	fn(&bo)
+	o.Context = context.WithValue(o.Context, breakerOptionsKey{}, bo)
+}
+
+// Breaker returns a new circuit breaker configured by the options
+func (o Options) Breaker() *Breaker {
+	return NewBreaker(getBreakerOptions(o.Context))
+}
+
+// FailureThreshold sets the consecutive failures after which a node is ejected
+func FailureThreshold(n int) Option {
+	return func(o *Options) {
+		setBreakerOptions(o, func(bo *BreakerOptions) {
+			bo.FailureThreshold = n
+		})
+	}
+}
+
+// OpenTimeout sets how long an ejected node waits before it is probed again
+func OpenTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		setBreakerOptions(o, func(bo *BreakerOptions) {
+			bo.OpenTimeout = d
+		})
+	}
+}
+
+// HalfOpenSuccesses sets the successful probes needed to bring a node back
+func HalfOpenSuccesses(n int) Option {
+	return func(o *Options) {
+		setBreakerOptions(o, func(bo *BreakerOptions) {
+			bo.HalfOpenSuccesses = n
+		})
+	}
+}
+
+// HalfOpenProbes sets how many calls may probe a half-open node at once
+func HalfOpenProbes(n int) Option {
+	return func(o *Options) {
+		setBreakerOptions(o, func(bo *BreakerOptions) {
+			bo.HalfOpenProbes = n
+		})
+	}
+}
+
+// P2C tracks the load of the nodes and sets the default strategy to pick the
+// less loaded of two random nodes
+func P2C(opts LoadOptions) Option {
+	return func(o *Options) {
+		l := NewLoad(opts)
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, loadKey{}, l)
+		o.Strategy = l.Strategy
+	}
+}
+
+// Load returns the load tracker configured by the options or a new one
+func (o Options) Load() *Load {
+	if o.Context != nil {
+		if l, ok := o.Context.Value(loadKey{}).(*Load); ok {
+			return l
+		}
+	}
+	return NewLoad(DefaultLoadOptions)
+}
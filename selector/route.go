@@ -0,0 +1,200 @@
+package selector
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/util/meta"
+)
+
+// Route splits the traffic of a service across its versions
+type Route struct {
+	Service string
+	// Weights is the share of the traffic of every version, e.g. 95 for v1
+	// and 5 for v2. The versions without a weight get no traffic, the share
+	// of a version without nodes goes to the others. Without weights every
+	// version is selected.
+	Weights map[string]int
+	// Header is the metadata key of the calls pinning them to the version
+	// in its value, calls pinned to a version without nodes are split
+	Header string
+	// Sticky is the metadata key of the calls whose value always assigns
+	// them to the same version as long as the weights don't change
+	Sticky string
+}
+
+// Router holds the routes of the services, they can be changed at any time
+// and apply to the next selection
+type Router struct {
+	sync.RWMutex
+	routes map[string]*Route
+}
+
+// NewRouter returns a router with the routes
+func NewRouter(routes ...*Route) *Router {
+	r := &Router{
+		routes: make(map[string]*Route),
+	}
+	for _, route := range routes {
+		r.routes[route.Service] = route
+	}
+	return r
+}
+
+// Set adds or replaces the route of its service, a route is not modified
+// once it is set
+func (r *Router) Set(route *Route) {
+	r.Lock()
+	r.routes[route.Service] = route
+	r.Unlock()
+}
+
+// Delete removes the route of the service
+func (r *Router) Delete(service string) {
+	r.Lock()
+	delete(r.routes, service)
+	r.Unlock()
+}
+
+// Route returns the route of the service
+func (r *Router) Route(service string) (*Route, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	route, ok := r.routes[service]
+	return route, ok
+}
+
+// Filter returns a filter which keeps the version the call is routed to,
+// the call's metadata is read from the context
+func (r *Router) Filter(ctx context.Context) Filter {
+	return func(old []*registry.Service) []*registry.Service {
+		if len(old) == 0 {
+			return old
+		}
+
+		route, ok := r.Route(old[0].Name)
+		if !ok {
+			return old
+		}
+
+		version, ok := route.version(ctx, old)
+		if !ok {
+			return old
+		}
+
+		var services []*registry.Service
+		for _, service := range old {
+			if service.Version == version {
+				services = append(services, service)
+			}
+		}
+		return services
+	}
+}
+
+// version returns the version of the services the call is routed to
+func (r *Route) version(ctx context.Context, services []*registry.Service) (string, bool) {
+	available := make(map[string]bool)
+	for _, service := range services {
+		if len(service.Nodes) > 0 {
+			available[service.Version] = true
+		}
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if len(r.Header) > 0 {
+		if v, ok := meta.Get(ctx, r.Header); ok && available[v] {
+			return v, true
+		}
+	}
+
+	// the available weighted versions in a stable order
+	var versions []string
+	var total int
+	for v, w := range r.Weights {
+		if w > 0 && available[v] {
+			versions = append(versions, v)
+			total += w
+		}
+	}
+	if total == 0 {
+		return "", false
+	}
+	sort.Strings(versions)
+
+	var bucket int
+	if key, ok := meta.Get(ctx, r.Sticky); len(r.Sticky) > 0 && ok && len(key) > 0 {
+		bucket = int(hashString(r.Service+"/"+key) % uint64(total))
+	} else {
+		bucket = rand.Intn(total)
+	}
+
+	for _, v := range versions {
+		if bucket < r.Weights[v] {
+			return v, true
+		}
+		bucket -= r.Weights[v]
+	}
+
+	return versions[len(versions)-1], true
+}
+
+type routerKey struct{}
+
+type callKey struct{}
+
+// RouteBy splits the traffic of the selected services by the routes of the router
+func RouteBy(r *Router) SelectOption {
+	return func(o *SelectOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, routerKey{}, r)
+	}
+}
+
+// CallContext sets the context of the call the node is selected for, the
+// routes read the call's metadata from it
+func CallContext(ctx context.Context) SelectOption {
+	return func(o *SelectOptions) {
+		if o.Context == nil {
+			o.Context = context.Background()
+		}
+		o.Context = context.WithValue(o.Context, callKey{}, ctx)
+	}
+}
+
+// Routed reports whether the select options route every call
+func Routed(opts ...SelectOption) bool {
+	var options SelectOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	_, ok := getRouter(options.Context)
+	return ok
+}
+
+func getRouter(ctx context.Context) (*Router, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	r, ok := ctx.Value(routerKey{}).(*Router)
+	return r, ok
+}
+
+func getCallContext(ctx context.Context) context.Context {
+	if ctx != nil {
+		if call, ok := ctx.Value(callKey{}).(context.Context); ok {
+			return call
+		}
+	}
+	return context.Background()
+}
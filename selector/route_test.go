@@ -0,0 +1,139 @@
+package selector
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+	"github.com/sumlookup/mini/util/meta"
+)
+
+func routeServices() []*registry.Service {
+	return []*registry.Service{
+		{
+			Name:    "foo",
+			Version: "v1",
+			Nodes:   []*registry.Node{{Id: "foo-v1", Address: "10.0.0.1:8080"}},
+		},
+		{
+			Name:    "foo",
+			Version: "v2",
+			Nodes:   []*registry.Node{{Id: "foo-v2", Address: "10.0.0.2:8080"}},
+		},
+	}
+}
+
+func routed(t *testing.T, filter Filter) string {
+	services := filter(routeServices())
+	if len(services) != 1 {
+		t.Fatalf("Expected a single version, got %d", len(services))
+	}
+	return services[0].Version
+}
+
+func TestRouterSplit(t *testing.T) {
+	r := NewRouter(&Route{Service: "foo", Weights: map[string]int{"v1": 95, "v2": 5}})
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[routed(t, r.Filter(context.Background()))]++
+	}
+	if counts["v2"] < 300 || counts["v2"] > 700 {
+		t.Fatalf("Expected about 5%% of the calls on v2, got %v", counts)
+	}
+
+	// the rules change at runtime
+	r.Set(&Route{Service: "foo", Weights: map[string]int{"v2": 100}})
+	for i := 0; i < 100; i++ {
+		if v := routed(t, r.Filter(context.Background())); v != "v2" {
+			t.Fatalf("Expected every call on v2, got %s", v)
+		}
+	}
+
+	// the share of a version without nodes goes to the others
+	services := routeServices()
+	services[1].Nodes = nil
+	if got := r.Filter(context.Background())(services); len(got) != 2 {
+		t.Fatalf("Expected every version without an available weighted one, got %d", len(got))
+	}
+
+	r.Delete("foo")
+	if got := r.Filter(context.Background())(routeServices()); len(got) != 2 {
+		t.Fatalf("Expected every version without a route, got %d", len(got))
+	}
+}
+
+func TestRouterOverrides(t *testing.T) {
+	r := NewRouter(&Route{
+		Service: "foo",
+		Weights: map[string]int{"v1": 50, "v2": 50},
+		Header:  "X-Version",
+		Sticky:  "X-Tenant",
+	})
+
+	pinned := meta.Set(context.Background(), "X-Version", "v2")
+	for i := 0; i < 100; i++ {
+		if v := routed(t, r.Filter(pinned)); v != "v2" {
+			t.Fatalf("Expected the call to be pinned to v2, got %s", v)
+		}
+	}
+
+	// a pin to an unknown version is split
+	unknown := meta.Set(context.Background(), "X-Version", "v3")
+	if v := routed(t, r.Filter(unknown)); v != "v1" && v != "v2" {
+		t.Fatalf("Expected a split version, got %s", v)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		ctx := meta.Set(context.Background(), "X-Tenant", fmt.Sprintf("tenant-%d", i))
+		v := routed(t, r.Filter(ctx))
+		for j := 0; j < 10; j++ {
+			if again := routed(t, r.Filter(ctx)); again != v {
+				t.Fatalf("Expected tenant-%d to stick to %s, got %s", i, v, again)
+			}
+		}
+		counts[v]++
+	}
+	if counts["v1"] < 25 || counts["v2"] < 25 {
+		t.Fatalf("Expected the tenants to be split, got %v", counts)
+	}
+}
+
+func TestRouteSelect(t *testing.T) {
+	reg := memory.NewRegistry()
+	for _, s := range routeServices() {
+		if err := reg.Register(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewSelector(Registry(reg))
+	defer s.Close()
+
+	r := NewRouter(&Route{Service: "foo", Weights: map[string]int{"v1": 100}, Header: "X-Version"})
+	opts := []SelectOption{RouteBy(r)}
+
+	if !Routed(opts...) || Routed() {
+		t.Fatal("Expected only the options with a router to be routed")
+	}
+
+	next, err := s.Select("foo", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node, _ := next(); node.Id != "foo-v1" {
+		t.Fatalf("Expected the split to v1, got %s", node.Id)
+	}
+
+	call := meta.Set(context.Background(), "X-Version", "v2")
+	next, err = s.Select("foo", append(opts, CallContext(call))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node, _ := next(); node.Id != "foo-v2" {
+		t.Fatalf("Expected the call to be pinned to v2, got %s", node.Id)
+	}
+}
@@ -15,8 +15,10 @@ type Selector interface {
 	Options() Options
 	// Select returns a function which should return the next node
 	Select(service string, opts ...SelectOption) (Next, error)
-	// Mark sets the success/error against a node
-	Mark(service string, node *registry.Node, err error)
+	// Mark sets the success/error against a node. The selectors which only
+	// know a single address for a service, such as static, fixed and memory,
+	// ignore it as there is no other node to eject it in favour of.
+	Mark(service string, node *registry.Node, err error, opts ...MarkOption)
 	// Reset returns state back to zero for a service
 	Reset(service string)
 	// Close renders the selector unusable
@@ -25,6 +27,14 @@ type Selector interface {
 	String() string
 }
 
+// Observer is implemented by the selectors which track the load of the
+// nodes. The client tells it about every call to a selected node.
+type Observer interface {
+	// Observe is called when a call to the node starts, the returned
+	// function is called with the outcome once the call finished
+	Observe(service string, node *registry.Node) func(err error)
+}
+
 // Next is a function that returns the next node
 // based on the selector's strategy
 type Next func() (*registry.Node, error)
@@ -55,7 +55,7 @@ func (s *staticSelector) Select(service string, opts ...selector.SelectOption) (
 	}, nil
 }
 
-func (s *staticSelector) Mark(service string, node *registry.Node, err error) {
+func (s *staticSelector) Mark(service string, node *registry.Node, err error, opts ...selector.MarkOption) {
 	return
 }
 
@@ -0,0 +1,149 @@
+package selector
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/sumlookup/mini/registry"
+)
+
+const (
+	// WeightKey is the node metadata key holding the weight of the node
+	WeightKey = "weight"
+	// PriorityKey is the node metadata key holding the priority tier of the node
+	PriorityKey = "priority"
+)
+
+var (
+	// DefaultWeight is the weight of the nodes without a valid weight
+	DefaultWeight = 100
+	// DefaultPriority is the priority of the nodes without a valid priority
+	DefaultPriority = 0
+)
+
+// NodeWeight returns the weight of the node, DefaultWeight when the
+// node has no weight or it isn't a positive integer
+func NodeWeight(n *registry.Node) int {
+	w, err := strconv.Atoi(n.Metadata[WeightKey])
+	if err != nil || w <= 0 {
+		return DefaultWeight
+	}
+	return w
+}
+
+// NodePriority returns the priority tier of the node, DefaultPriority when
+// the node has no priority or it isn't a non negative integer. The lower
+// the priority the higher the tier.
+func NodePriority(n *registry.Node) int {
+	p, err := strconv.Atoi(n.Metadata[PriorityKey])
+	if err != nil || p < 0 {
+		return DefaultPriority
+	}
+	return p
+}
+
+// WeightedRandom is a random strategy algorithm picking the nodes in
+// proportion to their weight
+func WeightedRandom(services []*registry.Service) Next {
+	var nodes []*registry.Node
+	var cumulative []int
+	var total int
+
+	for _, service := range services {
+		for _, node := range service.Nodes {
+			total += NodeWeight(node)
+			nodes = append(nodes, node)
+			cumulative = append(cumulative, total)
+		}
+	}
+
+	return func() (*registry.Node, error) {
+		if len(nodes) == 0 {
+			return nil, ErrNoneAvailable
+		}
+
+		r := rand.Intn(total)
+		i := sort.Search(len(cumulative), func(i int) bool {
+			return cumulative[i] > r
+		})
+		return nodes[i], nil
+	}
+}
+
+// WeightedRoundRobin is a smooth weighted roundrobin strategy algorithm, the
+// nodes are picked in proportion to their weight and interleaved evenly
+func WeightedRoundRobin(services []*registry.Service) Next {
+	var nodes []*registry.Node
+	var weights []int
+	var total int
+
+	for _, service := range services {
+		for _, node := range service.Nodes {
+			w := NodeWeight(node)
+			total += w
+			nodes = append(nodes, node)
+			weights = append(weights, w)
+		}
+	}
+
+	current := make([]int, len(nodes))
+	var mtx sync.Mutex
+
+	return func() (*registry.Node, error) {
+		if len(nodes) == 0 {
+			return nil, ErrNoneAvailable
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		best := 0
+		for i, w := range weights {
+			current[i] += w
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+
+		return nodes[best], nil
+	}
+}
+
+// Prioritized wraps the strategy so that it only picks from the nodes of the
+// highest priority tier. The selector leaves out the unhealthy nodes before
+// the strategy runs, so a lower tier is used only when no node of the
+// higher tiers is available.
+func Prioritized(strategy Strategy) Strategy {
+	return func(services []*registry.Service) Next {
+		best := -1
+		for _, service := range services {
+			for _, node := range service.Nodes {
+				if p := NodePriority(node); best < 0 || p < best {
+					best = p
+				}
+			}
+		}
+
+		tier := make([]*registry.Service, 0, len(services))
+		for _, service := range services {
+			var nodes []*registry.Node
+			for _, node := range service.Nodes {
+				if NodePriority(node) == best {
+					nodes = append(nodes, node)
+				}
+			}
+			if len(nodes) == 0 {
+				continue
+			}
+
+			s := *service
+			s.Nodes = nodes
+			tier = append(tier, &s)
+		}
+
+		return strategy(tier)
+	}
+}
@@ -0,0 +1,151 @@
+package selector
+
+import (
+	"testing"
+
+	"github.com/sumlookup/mini/registry"
+)
+
+func weightedNode(id, weight, priority string) *registry.Node {
+	md := make(map[string]string)
+	if len(weight) > 0 {
+		md[WeightKey] = weight
+	}
+	if len(priority) > 0 {
+		md[PriorityKey] = priority
+	}
+	return &registry.Node{Id: id, Address: id + ":1000", Metadata: md}
+}
+
+func TestNodeWeight(t *testing.T) {
+	testData := map[string]int{
+		"":     DefaultWeight,
+		"abc":  DefaultWeight,
+		"-5":   DefaultWeight,
+		"0":    DefaultWeight,
+		"1.5":  DefaultWeight,
+		"7":    7,
+		"1000": 1000,
+	}
+
+	for weight, want := range testData {
+		if got := NodeWeight(weightedNode("a", weight, "")); got != want {
+			t.Fatalf("Expected weight %d for %q, got %d", want, weight, got)
+		}
+	}
+
+	if got := NodePriority(weightedNode("a", "", "x")); got != DefaultPriority {
+		t.Fatalf("Expected the default priority for an invalid one, got %d", got)
+	}
+}
+
+func TestWeightedStrategies(t *testing.T) {
+	testData := []*registry.Service{
+		{
+			Name:    "test1",
+			Version: "latest",
+			Nodes: []*registry.Node{
+				weightedNode("a", "1", ""),
+				weightedNode("b", "3", ""),
+			},
+		},
+		{
+			Name:    "test1",
+			Version: "default",
+			Nodes: []*registry.Node{
+				weightedNode("c", "6", ""),
+			},
+		},
+	}
+
+	for name, strategy := range map[string]Strategy{"weightedrandom": WeightedRandom, "weightedroundrobin": WeightedRoundRobin} {
+		next := strategy(testData)
+		counts := make(map[string]int)
+
+		for i := 0; i < 10000; i++ {
+			node, err := next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[node.Id]++
+		}
+
+		for id, want := range map[string]int{"a": 1000, "b": 3000, "c": 6000} {
+			if diff := counts[id] - want; diff > want/10 || diff < -want/10 {
+				t.Fatalf("%s: expected about %d picks of %s, got %d", name, want, id, counts[id])
+			}
+		}
+	}
+
+	if _, err := WeightedRandom(nil)(); err != ErrNoneAvailable {
+		t.Fatalf("Expected %v without nodes, got %v", ErrNoneAvailable, err)
+	}
+	if _, err := WeightedRoundRobin(nil)(); err != ErrNoneAvailable {
+		t.Fatalf("Expected %v without nodes, got %v", ErrNoneAvailable, err)
+	}
+}
+
+func TestWeightedRoundRobinSmooth(t *testing.T) {
+	next := WeightedRoundRobin([]*registry.Service{{
+		Name: "test1",
+		Nodes: []*registry.Node{
+			weightedNode("a", "5", ""),
+			weightedNode("b", "1", ""),
+			weightedNode("c", "1", ""),
+		},
+	}})
+
+	var picks string
+	for i := 0; i < 7; i++ {
+		node, err := next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks += node.Id
+	}
+
+	if picks != "aabacaa" {
+		t.Fatalf("Expected the picks to be interleaved, got %s", picks)
+	}
+}
+
+func TestPrioritized(t *testing.T) {
+	testData := []*registry.Service{
+		{
+			Name: "test1",
+			Nodes: []*registry.Node{
+				weightedNode("a", "", "1"),
+				weightedNode("b", "", "0"),
+				weightedNode("c", "", ""),
+				weightedNode("d", "", "2"),
+			},
+		},
+	}
+
+	next := Prioritized(RoundRobin)(testData)
+	for i := 0; i < 100; i++ {
+		node, err := next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Id != "b" && node.Id != "c" {
+			t.Fatalf("Expected a node of the highest tier, got %s", node.Id)
+		}
+	}
+
+	// the higher tiers have no available nodes left
+	testData[0].Nodes = testData[0].Nodes[:1:1]
+	testData[0].Nodes = append(testData[0].Nodes, weightedNode("d", "", "2"))
+
+	node, err := Prioritized(WeightedRandom)(testData)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Id != "a" {
+		t.Fatalf("Expected the node of the next tier, got %s", node.Id)
+	}
+
+	if _, err := Prioritized(Random)(nil)(); err != ErrNoneAvailable {
+		t.Fatalf("Expected %v without nodes, got %v", ErrNoneAvailable, err)
+	}
+}
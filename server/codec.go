@@ -37,6 +37,12 @@ var (
 	}
 )
 
+func init() {
+	// grpc only knows the proto codec, register json so that callers
+	// without generated stubs can send application/grpc+json
+	encoding.RegisterCodec(jsonCodec{})
+}
+
 func (w wrapCodec) String() string {
 	return w.Codec.Name()
 }
@@ -0,0 +1,122 @@
+package server
+
+import (
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// healthStatus reports the serving status of the server and every grpc
+// service registered on it through the grpc health service. The server as a
+// whole, the empty name and the service name, only serves while every grpc
+// service serves.
+type healthStatus struct {
+	server *health.Server
+	// grpc service name, e.g. pkg.Foo -> serving
+	handlers map[string]bool
+	stopped  bool
+}
+
+func newHealthStatus() *healthStatus {
+	return &healthStatus{
+		server:   health.NewServer(),
+		handlers: make(map[string]bool),
+	}
+}
+
+// Health returns the grpc health server registered on the grpc server
+func (s *Server) Health() *health.Server {
+	return s.health.server
+}
+
+// SetServingStatus reports a grpc service, by the service name of its
+// grpc.ServiceDesc, e.g. pkg.Foo, as serving or degraded. A degraded
+// service makes the whole server report NOT_SERVING.
+func (s *Server) SetServingStatus(handler string, serving bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.health.stopped {
+		return
+	}
+
+	if !serving {
+		log.Warnf("[health] %s handler %s is not serving", s.Options.ServiceName, handler)
+	}
+
+	s.health.handlers[handler] = serving
+	s.updateHealth()
+}
+
+// IsServing reports whether the server and all its handlers are serving
+func (s *Server) IsServing() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.health.stopped {
+		return false
+	}
+
+	for _, serving := range s.health.handlers {
+		if !serving {
+			return false
+		}
+	}
+
+	return true
+}
+
+// initHealth marks the grpc services which did not report otherwise as
+// serving, the clients probe them by the name they are registered with
+func (s *Server) initHealth() {
+	s.Lock()
+	defer s.Unlock()
+
+	for name := range s.GRPCServer.GetServiceInfo() {
+		if name == healthpb.Health_ServiceDesc.ServiceName {
+			continue
+		}
+		if _, ok := s.health.handlers[name]; !ok {
+			s.health.handlers[name] = true
+		}
+	}
+
+	s.updateHealth()
+}
+
+// updateHealth publishes the status, it is called with the lock held
+func (s *Server) updateHealth() {
+	serving := true
+
+	for name, ok := range s.health.handlers {
+		status := healthpb.HealthCheckResponse_SERVING
+		if !ok {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+			serving = false
+		}
+		s.health.server.SetServingStatus(name, status)
+	}
+
+	status := healthpb.HealthCheckResponse_SERVING
+	if !serving {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+
+	s.health.server.SetServingStatus("", status)
+	if len(s.Options.ServiceName) > 0 {
+		s.health.server.SetServingStatus(s.Options.ServiceName, status)
+	}
+}
+
+// stopHealth reports NOT_SERVING for everything and ignores further updates
+func (s *Server) stopHealth() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.health.stopped {
+		return
+	}
+
+	s.health.stopped = true
+	s.health.server.Shutdown()
+}
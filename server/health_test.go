@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry/memory"
+	tm "github.com/sumlookup/mini/transport/memory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+type fooHandler struct{}
+
+func (f *fooHandler) Bar(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	return &healthpb.HealthCheckResponse{}, nil
+}
+
+var fooServiceDesc = grpc.ServiceDesc{
+	ServiceName: "test.v1.Foo",
+	HandlerType: (*interface{})(nil),
+}
+
+func TestHealth(t *testing.T) {
+	r := memory.NewRegistry()
+
+	srv := NewServer(
+		ServiceName("test.health"),
+		WithHost("test.health"),
+		WithRegistry(r),
+		WithTransport(tm.NewTransport()),
+	)
+	srv.Server().RegisterService(&fooServiceDesc, &fooHandler{})
+	srv.AddHandler(&fooHandler{})
+
+	go srv.Run()
+	<-srv.Ready()
+	t.Cleanup(srv.Stop)
+
+	conn := newTestClient(r).Connect("test.health")
+	if conn == nil {
+		t.Fatal("Expected the client to connect to the server")
+	}
+	c := healthpb.NewHealthClient(conn)
+
+	check := func(service string) (healthpb.HealthCheckResponse_ServingStatus, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		rsp, err := c.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			return healthpb.HealthCheckResponse_UNKNOWN, err
+		}
+		return rsp.Status, nil
+	}
+
+	// the grpc services are probed by their registered name
+	for _, name := range []string{"", "test.health", "test.v1.Foo"} {
+		st, err := check(name)
+		if err != nil {
+			t.Fatalf("Unexpected error probing %q: %v", name, err)
+		}
+		if st != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("Expected %q to be serving, got %s", name, st)
+		}
+	}
+
+	// not by the go type of the handler
+	if _, err := check("fooHandler"); status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected the go type name to be unknown, got %v", err)
+	}
+
+	// a degraded service takes the whole server out
+	srv.SetServingStatus("test.v1.Foo", false)
+	for _, name := range []string{"", "test.health", "test.v1.Foo"} {
+		if st, _ := check(name); st != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Fatalf("Expected %q not to be serving, got %s", name, st)
+		}
+	}
+	if srv.IsServing() {
+		t.Fatal("Expected the server not to be serving")
+	}
+
+	srv.SetServingStatus("test.v1.Foo", true)
+	if st, _ := check(""); st != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Expected the server to serve again, got %s", st)
+	}
+}
@@ -3,9 +3,12 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"github.com/sumlookup/mini/broker"
 	"github.com/sumlookup/mini/registry"
 	"github.com/sumlookup/mini/transport"
+	"github.com/sumlookup/mini/util/env"
 	"google.golang.org/grpc"
+	"time"
 )
 
 type Option func(*Options)
@@ -26,10 +29,36 @@ type Options struct {
 	OwnerEmail    string
 	ServerOptions *ServerOptions
 	Registry      registry.Registry
+	Broker        broker.Broker
 	TLSConfig     *tls.Config
 	Context       context.Context
 	Transport     transport.Transport
 	Tracer        string
+	// Namespace the service is registered in, the environment by default
+	Namespace string
+	// Weight and Priority are published in the node metadata for the
+	// weighted and prioritized selection, unset when zero
+	Weight   int
+	Priority int
+	// Region and Zone are published in the node metadata for the locality
+	// aware selection, from the environment by default
+	Region string
+	Zone   string
+
+	// RegisterTTL is the time the registry keeps the node after it was registered
+	RegisterTTL time.Duration
+	// RegisterInterval is how often the node is registered again
+	RegisterInterval time.Duration
+
+	// PropagationDelay is how long the server keeps serving after it
+	// deregistered so that the clients notice before it stops
+	PropagationDelay time.Duration
+	// ShutdownTimeout is how long in flight calls are given to finish
+	ShutdownTimeout time.Duration
+	// ShutdownHooks are told about the shutdown progress
+	ShutdownHooks []ShutdownHook
+	// Closers run in reverse order once the server stopped
+	Closers []func()
 }
 
 type Handler interface {
@@ -78,7 +107,11 @@ func newOptions(opt ...Option) Options {
 
 	// default options
 	opts := Options{
-		Version: "v0.0.1",
+		Version:         "v0.0.1",
+		Namespace:       env.New().GetEnv(),
+		Region:          env.New().GetRegion(),
+		Zone:            env.New().GetZone(),
+		ShutdownTimeout: DefaultShutdownTimeout,
 		ServerOptions: &ServerOptions{
 			Port:        0,
 			Host:        "0.0.0.0",
@@ -139,6 +172,52 @@ func ServiceName(name string) Option {
 	}
 }
 
+// Namespace registers the service in the namespace so that only the
+// clients of the same namespace select it
+func Namespace(ns string) Option {
+	return func(o *Options) {
+		o.Namespace = ns
+	}
+}
+
+// Weight publishes the weight of the node, the weighted strategies of the
+// clients pick it in proportion to the weight of the other nodes
+func Weight(n int) Option {
+	return func(o *Options) {
+		o.Weight = n
+	}
+}
+
+// Priority publishes the priority tier of the node, the prioritized clients
+// pick the nodes of a lower tier only when no node of a higher tier is available
+func Priority(n int) Option {
+	return func(o *Options) {
+		o.Priority = n
+	}
+}
+
+// Region publishes the region of the node
+func Region(r string) Option {
+	return func(o *Options) {
+		o.Region = r
+	}
+}
+
+// Zone publishes the zone of the node, the locality aware clients of the
+// same zone prefer it
+func Zone(z string) Option {
+	return func(o *Options) {
+		o.Zone = z
+	}
+}
+
+// WithBroker sets the broker the subscribers receive messages from
+func WithBroker(b broker.Broker) Option {
+	return func(o *Options) {
+		o.Broker = b
+	}
+}
+
 func WithTransport(tr transport.Transport) Option {
 	return func(o *Options) {
 		o.Transport = tr
@@ -158,3 +237,50 @@ func Tracer(name string) Option {
 		o.Tracer = name
 	}
 }
+
+// RegisterTTL lets the registry expire the node when it isn't registered
+// again within the ttl
+func RegisterTTL(t time.Duration) Option {
+	return func(o *Options) {
+		o.RegisterTTL = t
+	}
+}
+
+// RegisterInterval registers the node again on every interval. Without an
+// interval a node with a ttl is registered again twice per ttl.
+func RegisterInterval(t time.Duration) Option {
+	return func(o *Options) {
+		o.RegisterInterval = t
+	}
+}
+
+// PropagationDelay keeps the server serving for the given time after it
+// deregistered so that the clients stop selecting it before it stops
+func PropagationDelay(d time.Duration) Option {
+	return func(o *Options) {
+		o.PropagationDelay = d
+	}
+}
+
+// ShutdownTimeout is how long the in flight calls are given to finish
+// before they are cancelled
+func ShutdownTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.ShutdownTimeout = d
+	}
+}
+
+// OnShutdown adds a hook which is told about the shutdown progress
+func OnShutdown(h ShutdownHook) Option {
+	return func(o *Options) {
+		o.ShutdownHooks = append(o.ShutdownHooks, h)
+	}
+}
+
+// WithCloser adds functions which run once the server stopped. The closers
+// run in reverse order so the last one added is closed first.
+func WithCloser(fn ...func()) Option {
+	return func(o *Options) {
+		o.Closers = append(o.Closers, fn...)
+	}
+}
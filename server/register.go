@@ -0,0 +1,70 @@
+package server
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/registry"
+)
+
+var (
+	// DefaultRegisterRetry is the first wait before a failed registration is retried
+	DefaultRegisterRetry = 100 * time.Millisecond
+)
+
+// registerInterval returns how often the node is registered again. A ttl
+// without an interval refreshes the registration twice per ttl.
+func (s *Server) registerInterval() time.Duration {
+	if s.Options.RegisterInterval > 0 {
+		return s.Options.RegisterInterval
+	}
+	return s.Options.RegisterTTL / 2
+}
+
+// register registers the node with the options ttl in the options namespace
+func (s *Server) register() error {
+	return s.Options.Registry.Register(s.RegistryService,
+		registry.RegisterTTL(s.Options.RegisterTTL),
+		registry.RegisterNamespace(s.Options.Namespace),
+	)
+}
+
+// heartbeat registers the node on every interval until the server stops so that
+// the registry doesn't expire it. Nothing is registered while the server is not
+// serving, the registry lets the node expire instead. Failed registrations are
+// retried with a growing wait which never exceeds the interval.
+func (s *Server) heartbeat(interval time.Duration) {
+	defer s.wg.Done()
+
+	wait := interval
+	retry := DefaultRegisterRetry
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.exit:
+			return
+		case <-t.C:
+		}
+
+		wait = interval
+
+		if !s.IsServing() {
+			log.Debugf("%s is not serving, skipping registration", s.Options.ServiceName)
+		} else if err := s.register(); err != nil {
+			log.Errorf("[grpc] Could not register service %s with %s, retrying in %v: %s", s.Options.ServiceName, s.Options.Registry.String(), retry, err.Error())
+
+			wait = retry
+			retry *= 2
+			if retry > interval {
+				retry = interval
+			}
+		} else {
+			retry = DefaultRegisterRetry
+		}
+
+		t.Reset(wait)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+)
+
+// flakyRegistry fails the registrations while failing is set
+type flakyRegistry struct {
+	registry.Registry
+
+	sync.Mutex
+	failing  bool
+	attempts []time.Time
+}
+
+func (r *flakyRegistry) Register(s *registry.Service, opts ...registry.RegisterOption) error {
+	r.Lock()
+	r.attempts = append(r.attempts, time.Now())
+	failing := r.failing
+	r.Unlock()
+
+	if failing {
+		return errors.New("registry unavailable")
+	}
+	return r.Registry.Register(s, opts...)
+}
+
+func (r *flakyRegistry) setFailing(b bool) {
+	r.Lock()
+	r.failing = b
+	r.attempts = nil
+	r.Unlock()
+}
+
+func (r *flakyRegistry) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.attempts)
+}
+
+func (r *flakyRegistry) gaps() []time.Duration {
+	r.Lock()
+	defer r.Unlock()
+
+	var gaps []time.Duration
+	for i := 1; i < len(r.attempts); i++ {
+		gaps = append(gaps, r.attempts[i].Sub(r.attempts[i-1]))
+	}
+	return gaps
+}
+
+func TestHeartbeat(t *testing.T) {
+	retry := DefaultRegisterRetry
+	DefaultRegisterRetry = 10 * time.Millisecond
+	t.Cleanup(func() { DefaultRegisterRetry = retry })
+
+	r := &flakyRegistry{Registry: memory.NewRegistry()}
+	interval := 100 * time.Millisecond
+	srv := newTestServer(t, r, "test.heartbeat", RegisterTTL(200*time.Millisecond), RegisterInterval(interval))
+
+	registered := func() bool {
+		services, err := r.GetService("test.heartbeat", registry.GetNamespace(srv.Options.Namespace))
+		return err == nil && len(services) > 0 && len(services[0].Nodes) > 0
+	}
+
+	// registered again on every interval
+	waitFor(t, "the heartbeat", func() bool { return r.count() >= 3 })
+
+	// failed registrations are retried sooner, with a growing wait capped by the interval
+	r.setFailing(true)
+	waitFor(t, "the retries", func() bool { return r.count() >= 6 })
+
+	gaps := r.gaps()
+	for i := 1; i < len(gaps); i++ {
+		if gaps[i] < gaps[i-1]-5*time.Millisecond {
+			t.Fatalf("Expected the retries to back off, got %v", gaps)
+		}
+		if gaps[i] > interval+50*time.Millisecond {
+			t.Fatalf("Expected the retries to wait at most %v, got %v", interval, gaps)
+		}
+	}
+	if gaps[0] >= interval {
+		t.Fatalf("Expected the first retry before the next interval, got %v", gaps)
+	}
+
+	// not serving, the node is left to expire
+	srv.SetServingStatus("test.v1.Foo", false)
+	r.setFailing(false)
+
+	waitFor(t, "the node to expire", func() bool { return !registered() })
+	if n := r.count(); n != 0 {
+		t.Fatalf("Expected no registration while not serving, got %d", n)
+	}
+
+	// serving again, the node is registered again
+	srv.SetServingStatus("test.v1.Foo", true)
+	waitFor(t, "the node to be registered again", registered)
+}
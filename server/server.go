@@ -1,26 +1,24 @@
 package server
 
 import (
-	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
 	"github.com/google/uuid"
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
-	"github.com/phayes/freeport"
 	log "github.com/sirupsen/logrus"
 	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/selector"
 	"github.com/sumlookup/mini/util/addr"
 	"github.com/sumlookup/mini/util/meta"
 	mnet "github.com/sumlookup/mini/util/net"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/encoding"
-	"os"
-	"os/signal"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"strconv"
 	"sync"
-	"syscall"
-	"time"
 )
 
 const (
@@ -45,8 +43,21 @@ type Server struct {
 	Port int
 	// Available Handlers
 	handlers map[string]Handler
+	// serving status reported by the health service
+	health *healthStatus
+	// closed once the server listens and is registered
+	ready chan struct{}
+	// closed when the server stops
+	exit chan struct{}
+	// broker subscriptions
+	subscribers []*subscriber
+	subscribed  bool
+	// connected is set when the server connected the broker itself
+	connected bool
+	inflight  *inflight
 	sync.RWMutex
-	wg *sync.WaitGroup
+	wg       *sync.WaitGroup
+	stopOnce sync.Once
 }
 
 func NewServer(opts ...Option) *Server {
@@ -58,6 +69,11 @@ func NewServer(opts ...Option) *Server {
 		Options:  options,
 		Name:     options.ServiceName,
 		handlers: make(map[string]Handler),
+		health:   newHealthStatus(),
+		ready:    make(chan struct{}),
+		exit:     make(chan struct{}),
+		wg:       new(sync.WaitGroup),
+		inflight: new(inflight),
 	}
 
 	s.createGrpcServer()
@@ -68,22 +84,47 @@ func (s *Server) Server() *grpc.Server {
 	return s.GRPCServer
 }
 
-// GetPort returns the grpc server port.
+// GetPort returns the grpc server port. It is 0 until the server listens.
 func (s *Server) GetPort() int {
+	s.RLock()
+	defer s.RUnlock()
 	return s.Port
 }
 
+// Ready is closed once the server listens and is registered
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
 func (s *Server) ServeGRPC(host string, port int) error {
-	//err := s.createSubscriptionHandlers()
-	//if err != nil {
-	//	return err
-	//}
+	listener, err := s.listen(host, port)
+	if err != nil {
+		return err
+	}
+	return s.serve(listener)
+}
 
+// listen binds the listener and sets the port it is bound to
+func (s *Server) listen(host string, port int) (net.Listener, error) {
 	listener, err := s.Options.Transport.Listen(mnet.HostPort(host, port))
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// port 0 binds any free port, the memory transport has no ports
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		port = addr.Port
 	}
-	log.Infof("[grpc] Serving on %s", fmt.Sprintf("%s:%v", host, port))
+
+	s.Lock()
+	s.Port = port
+	s.Unlock()
+
+	return listener, nil
+}
+
+func (s *Server) serve(listener net.Listener) error {
+	log.Infof("[grpc] Serving on %s", listener.Addr().String())
 	return s.Server().Serve(listener)
 }
 
@@ -107,6 +148,9 @@ func (s *Server) createGrpcServer() {
 	s.GRPCServer = grpc.NewServer(
 		s.Options.ServerOptions.GRPCOptions...,
 	)
+
+	// every server reports its serving status
+	healthpb.RegisterHealthServer(s.GRPCServer, s.health.server)
 }
 
 func (s *Server) AddHandler(h interface{}, opts ...HandlerOption) {
@@ -119,23 +163,28 @@ func (s *Server) Run() error {
 
 	var serviceRegistry *registry.Service
 
-	var err error
-	port := s.Options.ServerOptions.Port
+	host := s.Options.ServerOptions.Host
 
-	// find open port it's a port 0. The reason for that is we need to know the port
-	// before we start the service so we can register it.
-	// this might be refactored in the future. I'm not sure whethere the service
-	// registration should happen before we start the service.
-	if port == 0 && s.Options.Transport.String() != "memory" {
-		port, err = freeport.GetFreePort()
-		if err != nil {
-			log.Fatal("Could not obtain free port, ", err)
-		}
-		s.Options.ServerOptions.Port = port
+	// listen before registering so the registry only ever advertises
+	// the address the server is actually bound to
+	listener, err := s.listen(host, s.Options.ServerOptions.Port)
+	if err != nil {
+		return err
 	}
+	port := s.GetPort()
 
-	host := s.Options.ServerOptions.Host
-	s.Port = port
+	// abort undoes the subscriptions when the server can't run
+	abort := func(err error) error {
+		s.unsubscribe()
+		s.disconnectBroker()
+		listener.Close()
+		return err
+	}
+
+	// subscribe before registering so no message waits for a registered node
+	if err := s.subscribe(); err != nil {
+		return abort(err)
+	}
 
 	// register the service if the registry is in place
 	if s.Options.Registry != nil {
@@ -143,7 +192,7 @@ func (s *Server) Run() error {
 		// extract the ip. This is required so that other services know where this specific service is palced
 		ip, err := addr.Extract(host)
 		if err != nil {
-			return err
+			return abort(err)
 		}
 
 		// make copy of metadata
@@ -162,6 +211,18 @@ func (s *Server) Run() error {
 
 		node.Metadata["registry"] = s.Options.Registry.String()
 		node.Metadata["protocol"] = "grpc" // we don't have anything else for the moment
+		if s.Options.Weight > 0 {
+			node.Metadata[selector.WeightKey] = strconv.Itoa(s.Options.Weight)
+		}
+		if s.Options.Priority > 0 {
+			node.Metadata[selector.PriorityKey] = strconv.Itoa(s.Options.Priority)
+		}
+		if len(s.Options.Region) > 0 {
+			node.Metadata[selector.RegionKey] = s.Options.Region
+		}
+		if len(s.Options.Zone) > 0 {
+			node.Metadata[selector.ZoneKey] = s.Options.Zone
+		}
 
 		var handlerList []string
 
@@ -189,58 +250,28 @@ func (s *Server) Run() error {
 		s.RegistryService = serviceRegistry
 
 		log.Infof("%s registry, registering service %s", s.Options.Registry.String(), serviceRegistry.Name)
-		err = s.Options.Registry.Register(serviceRegistry)
+		err = s.register()
 		if err != nil {
-			return err
+			return abort(err)
+		}
+
+		if interval := s.registerInterval(); interval > 0 {
+			s.wg.Add(1)
+			go s.heartbeat(interval)
 		}
 	} else {
 		log.Debugf("no registry set for %s", s.Options.ServiceName)
 	}
 
-	go s.signalHandler()
-	err = s.ServeGRPC(host, port)
-	s.disconnect()
-	return err
-}
-
-// Stop allows to stop the server gracefully
-func (s *Server) Stop() {
-	log.Infof("grpc requested server stop")
-	s.disconnect()
-	log.Debugf("%s grpc initiating graceful stop", s.Options.ServiceName)
-	s.GRPCServer.GracefulStop()
-}
-
-func (s *Server) signalHandler() {
-	sigs := make(chan os.Signal, 1)
-	///done := make(chan bool, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-
-	go func() {
-		<-sigs
-		s.disconnect()
-		if os.Getenv("ENV") != "test" {
-			os.Exit(0)
-		}
-	}()
-}
-
-// disconnect handles the deregistration of the Registry and Subscriber disconnection
-func (s *Server) disconnect() {
-
-	ctxt, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	s.initHealth()
+	// the signals stop the server gracefully as soon as it is ready
+	s.signalHandler()
+	close(s.ready)
 
-	if s.Options.Registry != nil {
-		log.Debugf("grpc deregistering")
-		err := s.Options.Registry.Deregister(s.RegistryService,
-			registry.DeregisterContext(ctxt),
-		)
-
-		if err != nil {
-			log.Errorf("[grpc] Could not deregister service. %s from %s: %s", s.Options.ServiceName, s.Options.Registry.String(), err.Error())
-		}
-	}
+	err = s.serve(listener)
+	// serve returns as soon as the stop begins, wait for it to complete
+	s.Stop()
+	return err
 }
 
 // newGRPCCodec: checks if codec is defined for given content type
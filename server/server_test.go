@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/client"
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+	rsync "github.com/sumlookup/mini/registry/sync"
+	"github.com/sumlookup/mini/selector"
+	sr "github.com/sumlookup/mini/selector/registry"
+	tgrpc "github.com/sumlookup/mini/transport/grpc"
+	tm "github.com/sumlookup/mini/transport/memory"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// newTestServer runs a server on the memory transport until the test ends
+func newTestServer(t *testing.T, r registry.Registry, name string, opts ...Option) *Server {
+	t.Helper()
+
+	srv := NewServer(append([]Option{
+		ServiceName(name),
+		WithHost(name),
+		WithRegistry(r),
+		WithTransport(tm.NewTransport()),
+	}, opts...)...)
+
+	go srv.Run()
+
+	select {
+	case <-srv.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for %s to be ready", name)
+	}
+	t.Cleanup(srv.Stop)
+
+	return srv
+}
+
+// newTestClient returns a client selecting the nodes of the registry
+func newTestClient(r registry.Registry, opts ...client.Option) *client.Client {
+	return client.New(append([]client.Option{
+		client.Selector(sr.NewSelector(selector.Registry(r))),
+		client.WithTransport(tm.NewTransport()),
+		client.WithConnectionAttempts(false),
+	}, opts...)...)
+}
+
+func waitFor(t *testing.T, what string, fn func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEnvNamespace(t *testing.T) {
+	t.Setenv("ENV", "uat")
+
+	r := memory.NewRegistry()
+	srv := newTestServer(t, r, "test.namespace.env")
+
+	if srv.Options.Namespace != "uat" {
+		t.Fatalf("Expected the namespace of the environment by default, got %s", srv.Options.Namespace)
+	}
+	if o := newOptions(Namespace("dev")); o.Namespace != "dev" {
+		t.Fatalf("Expected the namespace to be overridden, got %s", o.Namespace)
+	}
+
+	if _, err := r.GetService("test.namespace.env"); err != registry.ErrNotFound {
+		t.Fatalf("Expected the server to be kept out of the default namespace, got %v", err)
+	}
+	services, err := r.ListServices(registry.ListNamespace("uat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].Name != "test.namespace.env" {
+		t.Fatalf("Expected the server to be listed in its namespace, got %+v", services)
+	}
+
+	// a sync of the namespace mirrors the server
+	dst := memory.NewRegistry()
+	s := rsync.New(r, dst, rsync.Namespaces("uat"))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	waitFor(t, "the server to be mirrored", func() bool {
+		services, err := dst.GetService("test.namespace.env", registry.GetNamespace("uat"))
+		return err == nil && len(services) == 1
+	})
+
+	// a client of the same environment selects the server
+	c := newTestClient(r)
+	if c.Options.Namespace != "uat" {
+		t.Fatalf("Expected the client to select from the namespace of the environment, got %s", c.Options.Namespace)
+	}
+	if o := client.NewOptions(client.WithNamespace("dev")); o.Namespace != "dev" {
+		t.Fatalf("Expected the client namespace to be overridden, got %s", o.Namespace)
+	}
+
+	conn := c.Connect("test.namespace.env")
+	if conn == nil {
+		t.Fatal("Expected the client to connect to the server")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rsp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Expected the server to be serving, got %s", rsp.Status)
+	}
+}
+
+func TestListenAnyPort(t *testing.T) {
+	r := memory.NewRegistry()
+
+	srv := NewServer(
+		ServiceName("test.port"),
+		WithHost("127.0.0.1"),
+		WithPort(0),
+		WithRegistry(r),
+		WithTransport(tgrpc.NewTransport()),
+	)
+
+	go srv.Run()
+	select {
+	case <-srv.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the server to be ready")
+	}
+	t.Cleanup(srv.Stop)
+
+	port := srv.GetPort()
+	if port == 0 {
+		t.Fatal("Expected the port the listener is bound to")
+	}
+
+	services, err := r.GetService("test.port", registry.GetNamespace(srv.Options.Namespace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	if n := services[0].Nodes[0]; n.Address != address {
+		t.Fatalf("Expected the node to be registered at %s, got %s", address, n.Address)
+	}
+
+	// the registered address is the one serving
+	c := client.New(
+		client.WithTransport(tgrpc.NewTransport()),
+		client.WithHostOverride(address),
+		client.WithConnectionAttempts(false),
+	)
+	conn := c.Connect("test.port")
+	if conn == nil {
+		t.Fatal("Expected the client to connect to the registered address")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rsp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Expected the server to be serving, got %s", rsp.Status)
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/registry"
+)
+
+// ShutdownStage is a step of the graceful shutdown
+type ShutdownStage int
+
+const (
+	// ShutdownDeregister removes the node from the registry
+	ShutdownDeregister ShutdownStage = iota
+	// ShutdownPropagate waits for the clients to see the node is gone
+	ShutdownPropagate
+	// ShutdownNotServing flips the health service to NOT_SERVING
+	ShutdownNotServing
+	// ShutdownUnsubscribe stops delivering broker messages to the subscribers
+	ShutdownUnsubscribe
+	// ShutdownDrain waits for the in flight calls to finish
+	ShutdownDrain
+	// ShutdownForceStop cancels the calls still running after the shutdown timeout
+	ShutdownForceStop
+	// ShutdownClose runs the closers
+	ShutdownClose
+	// ShutdownDone is reported once the server is stopped
+	ShutdownDone
+)
+
+// String returns human readable shutdown stage
+func (s ShutdownStage) String() string {
+	switch s {
+	case ShutdownDeregister:
+		return "deregister"
+	case ShutdownPropagate:
+		return "propagate"
+	case ShutdownNotServing:
+		return "not-serving"
+	case ShutdownUnsubscribe:
+		return "unsubscribe"
+	case ShutdownDrain:
+		return "drain"
+	case ShutdownForceStop:
+		return "force-stop"
+	case ShutdownClose:
+		return "close"
+	case ShutdownDone:
+		return "done"
+	default:
+		return "unknown"
+	}
+}
+
+// ShutdownHook is called when the shutdown reaches a stage
+type ShutdownHook func(stage ShutdownStage)
+
+var (
+	// DefaultShutdownTimeout is how long in flight calls are given to finish
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+// Stop stops the server gracefully. The node is deregistered, the clients are
+// given the propagation delay to notice, the health service flips to
+// NOT_SERVING and the in flight calls are drained before the closers run.
+// Calls still running after the shutdown timeout are cancelled.
+// Stop may be called more than once, every call returns once the server stopped.
+func (s *Server) Stop() {
+	s.stopOnce.Do(s.shutdown)
+}
+
+func (s *Server) shutdown() {
+	log.Infof("grpc requested server stop")
+
+	// stop the heartbeat so it doesn't register the node again
+	close(s.exit)
+	s.wg.Wait()
+
+	s.shutdownStage(ShutdownDeregister)
+	registered := s.disconnect()
+
+	if registered && s.Options.PropagationDelay > 0 {
+		s.shutdownStage(ShutdownPropagate)
+		log.Debugf("%s grpc waiting %v for the deregistration to propagate", s.Options.ServiceName, s.Options.PropagationDelay)
+		time.Sleep(s.Options.PropagationDelay)
+	}
+
+	s.shutdownStage(ShutdownNotServing)
+	s.stopHealth()
+
+	s.shutdownStage(ShutdownUnsubscribe)
+	s.unsubscribe()
+
+	s.shutdownStage(ShutdownDrain)
+	log.Debugf("%s grpc initiating graceful stop", s.Options.ServiceName)
+
+	stopped := make(chan bool)
+	go func() {
+		s.GRPCServer.GracefulStop()
+		close(stopped)
+	}()
+
+	done := make(chan bool)
+	go func() {
+		<-stopped
+		// the subscriber handlers still running
+		s.inflight.drain()
+		close(done)
+	}()
+
+	timeout := s.Options.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		s.shutdownStage(ShutdownForceStop)
+		log.Warnf("%s grpc graceful stop timed out after %v, stopping", s.Options.ServiceName, timeout)
+		s.GRPCServer.Stop()
+		<-stopped
+	}
+
+	s.shutdownStage(ShutdownClose)
+	s.disconnectBroker()
+
+	// the last closer added depends on the ones added before
+	for i := len(s.Options.Closers) - 1; i >= 0; i-- {
+		s.close(s.Options.Closers[i])
+	}
+
+	s.shutdownStage(ShutdownDone)
+	log.Infof("%s grpc server stopped", s.Options.ServiceName)
+}
+
+// close runs the closer, a panic doesn't prevent the other closers from running
+func (s *Server) close(fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("[grpc] %s closer panic: %v", s.Options.ServiceName, r)
+		}
+	}()
+	fn()
+}
+
+func (s *Server) shutdownStage(stage ShutdownStage) {
+	log.Debugf("%s grpc shutdown stage %s", s.Options.ServiceName, stage)
+	for _, h := range s.Options.ShutdownHooks {
+		h(stage)
+	}
+}
+
+// signalHandler stops the server on SIGINT or SIGTERM. The signals are
+// released once the server stops either way, so a later signal ends the process.
+func (s *Server) signalHandler() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-s.exit:
+			signal.Stop(sigs)
+		case sig := <-sigs:
+			signal.Stop(sigs)
+			log.Infof("%s grpc received signal %s", s.Options.ServiceName, sig)
+			s.Stop()
+		}
+	}()
+}
+
+// disconnect handles the deregistration of the Registry and reports whether the node was registered
+func (s *Server) disconnect() bool {
+	if s.Options.Registry == nil || s.RegistryService == nil {
+		return false
+	}
+
+	ctxt, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	log.Debugf("grpc deregistering")
+	err := s.Options.Registry.Deregister(s.RegistryService,
+		registry.DeregisterContext(ctxt),
+		registry.DeregisterNamespace(s.Options.Namespace),
+	)
+
+	if err != nil {
+		log.Errorf("[grpc] Could not deregister service. %s from %s: %s", s.Options.ServiceName, s.Options.Registry.String(), err.Error())
+	}
+
+	return true
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sumlookup/mini/registry"
+	"github.com/sumlookup/mini/registry/memory"
+	tm "github.com/sumlookup/mini/transport/memory"
+	"github.com/sumlookup/mini/util/env"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// waitHandler blocks the call until it is cancelled
+func waitHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(healthpb.HealthCheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	close(srv.(*slowHandler).started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type slowHandler struct {
+	started chan struct{}
+}
+
+var slowServiceDesc = grpc.ServiceDesc{
+	ServiceName: "test.v1.Slow",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Wait", Handler: waitHandler},
+	},
+}
+
+// stages records the shutdown stages
+type stages struct {
+	sync.Mutex
+	stages []ShutdownStage
+}
+
+func (s *stages) hook(stage ShutdownStage) {
+	s.Lock()
+	s.stages = append(s.stages, stage)
+	s.Unlock()
+}
+
+func (s *stages) get() []ShutdownStage {
+	s.Lock()
+	defer s.Unlock()
+	return append([]ShutdownStage(nil), s.stages...)
+}
+
+func TestShutdown(t *testing.T) {
+	r := memory.NewRegistry()
+	st := new(stages)
+
+	var closed []int
+	var registered bool
+
+	slow := &slowHandler{started: make(chan struct{})}
+	srv := NewServer(
+		ServiceName("test.shutdown"),
+		WithHost("test.shutdown"),
+		WithRegistry(r),
+		WithTransport(tm.NewTransport()),
+		PropagationDelay(10*time.Millisecond),
+		ShutdownTimeout(100*time.Millisecond),
+		OnShutdown(st.hook),
+		OnShutdown(func(stage ShutdownStage) {
+			// the node is gone from the registry before the delay starts
+			if stage == ShutdownPropagate {
+				_, err := r.GetService("test.shutdown", registry.GetNamespace(env.New().GetEnv()))
+				registered = err != registry.ErrNotFound
+			}
+		}),
+		WithCloser(func() { closed = append(closed, 1) }, func() { closed = append(closed, 2) }),
+	)
+	srv.Server().RegisterService(&slowServiceDesc, slow)
+
+	go srv.Run()
+	<-srv.Ready()
+
+	conn := newTestClient(r).Connect("test.shutdown")
+	if conn == nil {
+		t.Fatal("Expected the client to connect to the server")
+	}
+
+	// a call which never finishes by itself
+	called := make(chan error, 1)
+	go func() {
+		called <- conn.Invoke(context.Background(), "/test.v1.Slow/Wait", &healthpb.HealthCheckRequest{}, new(healthpb.HealthCheckResponse))
+	}()
+	<-slow.started
+
+	start := time.Now()
+	srv.Stop()
+
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("Expected the stop to wait for the shutdown timeout, took %v", d)
+	}
+
+	want := []ShutdownStage{
+		ShutdownDeregister,
+		ShutdownPropagate,
+		ShutdownNotServing,
+		ShutdownUnsubscribe,
+		ShutdownDrain,
+		ShutdownForceStop,
+		ShutdownClose,
+		ShutdownDone,
+	}
+	got := st.get()
+	if len(got) != len(want) {
+		t.Fatalf("Expected the stages %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected the stages %v, got %v", want, got)
+		}
+	}
+
+	if registered {
+		t.Fatal("Expected the node to be deregistered before the propagation delay")
+	}
+
+	select {
+	case err := <-called:
+		if err == nil {
+			t.Fatal("Expected the forced stop to cancel the call")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the call to be cancelled")
+	}
+
+	if len(closed) != 2 || closed[0] != 2 || closed[1] != 1 {
+		t.Fatalf("Expected the closers to run in reverse order, got %v", closed)
+	}
+
+	// stopping again returns straight away
+	srv.Stop()
+	if n := len(st.get()); n != len(want) {
+		t.Fatalf("Expected a single shutdown, got %d stages", n)
+	}
+}
+
+func TestShutdownSignal(t *testing.T) {
+	st := new(stages)
+	srv := newTestServer(t, memory.NewRegistry(), "test.shutdown.signal", OnShutdown(st.hook))
+
+	// the process keeps running, only the server stops
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the server to stop", func() bool {
+		stages := st.get()
+		return len(stages) > 0 && stages[len(stages)-1] == ShutdownDone
+	})
+
+	if srv.IsServing() {
+		t.Fatal("Expected the server to stop serving")
+	}
+}
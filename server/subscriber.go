@@ -0,0 +1,317 @@
+package server
+
+import (
+	b "bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sumlookup/mini/broker"
+	"github.com/sumlookup/mini/codec"
+	raw "github.com/sumlookup/mini/codec/bytes"
+	"github.com/sumlookup/mini/codec/json"
+	"github.com/sumlookup/mini/codec/proto"
+)
+
+const (
+	// ContentTypeHeader is the broker message header with the payload content type
+	ContentTypeHeader = "Content-Type"
+	// defaultSubscriberContentType is used for messages without a content type
+	defaultSubscriberContentType = "application/protobuf"
+)
+
+var (
+	subscriberCodecs = map[string]codec.NewCodec{
+		"application/json":         json.NewCodec,
+		"application/protobuf":     proto.NewCodec,
+		"application/proto":        proto.NewCodec,
+		"application/octet-stream": raw.NewCodec,
+	}
+
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfMessage = reflect.TypeOf((*Message)(nil)).Elem()
+
+	// ErrDraining is returned to the broker for the messages delivered
+	// once the server drains its subscribers
+	ErrDraining = errors.New("server is draining its subscribers")
+)
+
+// inflight counts the subscriber handlers running. Once it drains no
+// handler starts any more, the broker may still deliver a message while
+// the subscribers are being unsubscribed.
+type inflight struct {
+	sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+}
+
+// add counts a handler about to run, it reports false once draining
+func (i *inflight) add() bool {
+	i.Lock()
+	defer i.Unlock()
+
+	if i.draining {
+		return false
+	}
+	i.wg.Add(1)
+	return true
+}
+
+func (i *inflight) done() {
+	i.wg.Done()
+}
+
+// drain stops new handlers from running and waits for the running ones
+func (i *inflight) drain() {
+	i.Lock()
+	i.draining = true
+	i.Unlock()
+
+	i.wg.Wait()
+}
+
+// subscriber is a handler subscribed to a broker topic
+type subscriber struct {
+	topic   string
+	handler reflect.Value
+	// the type of the handler payload argument
+	typ  reflect.Type
+	opts []broker.SubscribeOption
+	sub  broker.Subscriber
+	// handlers in flight, drained on shutdown
+	inflight *inflight
+}
+
+// message is the Message given to the subscriber handlers
+type message struct {
+	topic       string
+	contentType string
+	payload     interface{}
+	header      map[string]string
+	body        []byte
+}
+
+func (m *message) Topic() string {
+	return m.topic
+}
+
+func (m *message) Payload() interface{} {
+	return m.payload
+}
+
+func (m *message) ContentType() string {
+	return m.contentType
+}
+
+func (m *message) Header() map[string]string {
+	return m.header
+}
+
+func (m *message) Body() []byte {
+	return m.body
+}
+
+// buffer lets the codecs read the message body
+type buffer struct {
+	*b.Buffer
+}
+
+func (buf *buffer) Close() error {
+	return nil
+}
+
+func newSubscriber(topic string, h interface{}, in *inflight, opts ...broker.SubscribeOption) (*subscriber, error) {
+	handler := reflect.ValueOf(h)
+	typ := handler.Type()
+
+	if typ.Kind() != reflect.Func {
+		return nil, fmt.Errorf("subscriber of %s is not a function", topic)
+	}
+	if typ.NumIn() != 2 || typ.In(0) != typeOfContext {
+		return nil, fmt.Errorf("subscriber of %s should be func(context.Context, payload) error", topic)
+	}
+	if typ.NumOut() != 1 || typ.Out(0) != typeOfError {
+		return nil, fmt.Errorf("subscriber of %s should return an error", topic)
+	}
+
+	return &subscriber{
+		topic:    topic,
+		handler:  handler,
+		typ:      typ.In(1),
+		opts:     opts,
+		inflight: in,
+	}, nil
+}
+
+// decode reads the message body into a new value of the handler payload type
+func (s *subscriber) decode(msg *broker.Message) (reflect.Value, error) {
+	ct := msg.Header[ContentTypeHeader]
+	if len(ct) == 0 {
+		ct = defaultSubscriberContentType
+	}
+
+	// the handler takes the raw message
+	if s.typ == typeOfMessage {
+		return reflect.ValueOf(&message{
+			topic:       s.topic,
+			contentType: ct,
+			payload:     msg.Body,
+			header:      msg.Header,
+			body:        msg.Body,
+		}), nil
+	}
+
+	cf, ok := subscriberCodecs[ct]
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("Unsupported Content-Type: %s", ct)
+	}
+
+	var v reflect.Value
+	if s.typ.Kind() == reflect.Ptr {
+		v = reflect.New(s.typ.Elem())
+	} else {
+		v = reflect.New(s.typ)
+	}
+
+	if err := cf(&buffer{b.NewBuffer(msg.Body)}).ReadBody(v.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+
+	if s.typ.Kind() != reflect.Ptr {
+		v = v.Elem()
+	}
+
+	return v, nil
+}
+
+// handle decodes the event and calls the handler
+func (s *subscriber) handle(e broker.Event) error {
+	if !s.inflight.add() {
+		return ErrDraining
+	}
+	defer s.inflight.done()
+
+	v, err := s.decode(e.Message())
+	if err != nil {
+		log.Errorf("[broker] could not decode %s message: %v", s.topic, err)
+		return err
+	}
+
+	out := s.handler.Call([]reflect.Value{reflect.ValueOf(context.Background()), v})
+	if err, ok := out[0].Interface().(error); ok && err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// subscribe subscribes the handler to the broker
+func (s *subscriber) subscribe(br broker.Broker) error {
+	sub, err := br.Subscribe(s.topic, s.handle, s.opts...)
+	if err != nil {
+		return err
+	}
+	s.sub = sub
+	return nil
+}
+
+// Subscribe calls the handler with every message published to the topic. The
+// handler is a func(context.Context, T) error, the message body is decoded into
+// T with the codec of the message content type. A handler of
+// func(context.Context, Message) error gets the raw message instead.
+// Subscribers with the same broker.Queue share the messages of the topic.
+func (s *Server) Subscribe(topic string, h interface{}, opts ...broker.SubscribeOption) error {
+	if s.Options.Broker == nil {
+		return fmt.Errorf("no broker set for %s", s.Options.ServiceName)
+	}
+
+	sub, err := newSubscriber(topic, h, s.inflight, opts...)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// already running, subscribe straight away
+	if s.subscribed {
+		if err := sub.subscribe(s.Options.Broker); err != nil {
+			return err
+		}
+	}
+
+	s.subscribers = append(s.subscribers, sub)
+
+	return nil
+}
+
+// subscribe connects the broker and subscribes the handlers
+func (s *Server) subscribe() error {
+	if s.Options.Broker == nil {
+		return nil
+	}
+
+	// a broker connected already is shared, it's left connected on stop
+	c, ok := s.Options.Broker.(broker.Connectivity)
+	connected := ok && c.Connected()
+
+	if err := s.Options.Broker.Connect(); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.connected = !connected
+
+	for _, sub := range s.subscribers {
+		log.Debugf("%s subscribing to %s", s.Options.ServiceName, sub.topic)
+		if err := sub.subscribe(s.Options.Broker); err != nil {
+			return err
+		}
+	}
+
+	s.subscribed = true
+
+	return nil
+}
+
+// unsubscribe stops delivering messages to the handlers, including the ones
+// subscribed before a subscription failed
+func (s *Server) unsubscribe() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, sub := range s.subscribers {
+		if sub.sub == nil {
+			continue
+		}
+		if err := sub.sub.Unsubscribe(); err != nil {
+			log.Errorf("[broker] could not unsubscribe %s from %s: %v", s.Options.ServiceName, sub.topic, err)
+		}
+		sub.sub = nil
+	}
+
+	s.subscribed = false
+}
+
+// disconnectBroker disconnects the broker once the handlers are unsubscribed,
+// a broker the server didn't connect itself keeps the other subscribers
+func (s *Server) disconnectBroker() {
+	s.Lock()
+	connected := s.connected
+	s.connected = false
+	s.Unlock()
+
+	if s.Options.Broker == nil || !connected {
+		return
+	}
+
+	if err := s.Options.Broker.Disconnect(); err != nil {
+		log.Errorf("[broker] could not disconnect %s from %s: %v", s.Options.ServiceName, s.Options.Broker.String(), err)
+	}
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sumlookup/mini/broker"
+	bm "github.com/sumlookup/mini/broker/memory"
+	"github.com/sumlookup/mini/registry/memory"
+	tm "github.com/sumlookup/mini/transport/memory"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type event struct {
+	topic string
+	msg   *broker.Message
+}
+
+func (e *event) Topic() string            { return e.topic }
+func (e *event) Message() *broker.Message { return e.msg }
+func (e *event) Ack() error               { return nil }
+func (e *event) Error() error             { return nil }
+
+// newBroker returns a connected memory broker
+func newBroker(t *testing.T) broker.Broker {
+	b := bm.NewBroker()
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSubscribeDecode(t *testing.T) {
+	b := newBroker(t)
+	srv := newTestServer(t, memory.NewRegistry(), "test.subscribe.decode", WithBroker(b))
+
+	type payload struct {
+		Name string `json:"name"`
+	}
+
+	jsons := make(chan payload, 1)
+	protos := make(chan *healthpb.HealthCheckResponse, 1)
+	raws := make(chan Message, 1)
+
+	if err := srv.Subscribe("json", func(ctx context.Context, p payload) error {
+		jsons <- p
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Subscribe("proto", func(ctx context.Context, p *healthpb.HealthCheckResponse) error {
+		protos <- p
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Subscribe("raw", func(ctx context.Context, m Message) error {
+		raws <- m
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.Subscribe("invalid", func(p payload) error { return nil }); err == nil {
+		t.Fatal("Expected a handler without a context to be rejected")
+	}
+
+	// json
+	if err := b.Publish("json", &broker.Message{
+		Header: map[string]string{ContentTypeHeader: "application/json"},
+		Body:   []byte(`{"name":"foo"}`),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-jsons; p.Name != "foo" {
+		t.Fatalf("Expected the json payload to be decoded, got %+v", p)
+	}
+
+	// proto is the default content type
+	body, err := proto.Marshal(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("proto", &broker.Message{Body: body}); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-protos; p.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Expected the proto payload to be decoded, got %+v", p)
+	}
+
+	// raw messages are handed over as they are
+	if err := b.Publish("raw", &broker.Message{
+		Header: map[string]string{ContentTypeHeader: "text/plain", "foo": "bar"},
+		Body:   []byte("hello"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	m := <-raws
+	if m.Topic() != "raw" || m.ContentType() != "text/plain" || string(m.Body()) != "hello" || m.Header()["foo"] != "bar" {
+		t.Fatalf("Expected the raw message, got %s %s %q %v", m.Topic(), m.ContentType(), m.Body(), m.Header())
+	}
+
+	// a content type without a codec fails the delivery
+	if err := b.Publish("json", &broker.Message{
+		Header: map[string]string{ContentTypeHeader: "text/plain"},
+		Body:   []byte("foo"),
+	}); err == nil {
+		t.Fatal("Expected an unsupported content type to fail")
+	}
+}
+
+func TestSubscribeQueue(t *testing.T) {
+	b := newBroker(t)
+	r := memory.NewRegistry()
+
+	var mtx sync.Mutex
+	counts := make(map[string]int)
+
+	handler := func(name string) func(context.Context, Message) error {
+		return func(ctx context.Context, m Message) error {
+			mtx.Lock()
+			counts[name]++
+			mtx.Unlock()
+			return nil
+		}
+	}
+
+	for _, name := range []string{"test.subscribe.queue.a", "test.subscribe.queue.b"} {
+		srv := newTestServer(t, r, name, WithBroker(b))
+		if err := srv.Subscribe("events", handler(name), broker.Queue("workers")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := newTestServer(t, r, "test.subscribe.queue.all", WithBroker(b))
+	if err := srv.Subscribe("events", handler("all")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := b.Publish("events", &broker.Message{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if counts["all"] != 20 {
+		t.Fatalf("Expected the subscriber without a queue to get every message, got %d", counts["all"])
+	}
+	if n := counts["test.subscribe.queue.a"] + counts["test.subscribe.queue.b"]; n != 20 {
+		t.Fatalf("Expected the queue to get every message once, got %v", counts)
+	}
+}
+
+func TestSubscribeSharedBroker(t *testing.T) {
+	b := newBroker(t)
+	r := memory.NewRegistry()
+
+	received := make(chan string, 2)
+	handler := func(name string) func(context.Context, Message) error {
+		return func(ctx context.Context, m Message) error {
+			received <- name
+			return nil
+		}
+	}
+
+	a := newTestServer(t, r, "test.subscribe.shared.a", WithBroker(b))
+	if err := a.Subscribe("events", handler("a")); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestServer(t, r, "test.subscribe.shared.b", WithBroker(b))
+	if err := c.Subscribe("events", handler("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	// stopping a only removes its own subscriber
+	a.Stop()
+
+	if err := b.Publish("events", &broker.Message{}); err != nil {
+		t.Fatalf("Expected the shared broker to stay connected, got %v", err)
+	}
+	if name := <-received; name != "b" {
+		t.Fatalf("Expected b to receive the message, got %s", name)
+	}
+	select {
+	case name := <-received:
+		t.Fatalf("Expected a single delivery, %s received the message", name)
+	default:
+	}
+
+	// a broker the server connected itself is disconnected on stop
+	own := bm.NewBroker()
+	srv := newTestServer(t, r, "test.subscribe.shared.own", WithBroker(own))
+	srv.Stop()
+	if own.(broker.Connectivity).Connected() {
+		t.Fatal("Expected the broker connected by the server to be disconnected")
+	}
+}
+
+func TestSubscribeDrain(t *testing.T) {
+	b := newBroker(t)
+
+	var mtx sync.Mutex
+	var stages []ShutdownStage
+	hook := func(stage ShutdownStage) {
+		mtx.Lock()
+		stages = append(stages, stage)
+		mtx.Unlock()
+	}
+	reached := func(stage ShutdownStage) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, s := range stages {
+			if s == stage {
+				return true
+			}
+		}
+		return false
+	}
+
+	srv := newTestServer(t, memory.NewRegistry(), "test.subscribe.drain", WithBroker(b), OnShutdown(hook))
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var handled int
+
+	if err := srv.Subscribe("events", func(ctx context.Context, m Message) error {
+		handled++
+		started <- struct{}{}
+		<-release
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	published := make(chan error, 1)
+	go func() {
+		published <- b.Publish("events", &broker.Message{})
+	}()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.Stop()
+		close(stopped)
+	}()
+
+	// the running handler holds the shutdown in the drain stage
+	waitFor(t, "the drain stage", func() bool { return reached(ShutdownDrain) })
+	select {
+	case <-stopped:
+		t.Fatal("Expected the shutdown to wait for the running handler")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a delivery racing the unsubscribe is refused instead of starting late
+	sub := srv.subscribers[0]
+	if err := sub.handle(&event{topic: "events", msg: &broker.Message{}}); err != ErrDraining {
+		t.Fatalf("Expected %v once draining, got %v", ErrDraining, err)
+	}
+
+	close(release)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the server to stop")
+	}
+
+	if err := <-published; err != nil {
+		t.Fatalf("Expected the running handler to complete, got %v", err)
+	}
+	if handled != 1 {
+		t.Fatalf("Expected a single handled message, got %d", handled)
+	}
+	if reached(ShutdownForceStop) {
+		t.Fatal("Expected the handler to drain without forcing the stop")
+	}
+}
+
+func TestSubscribeRegisterFailure(t *testing.T) {
+	b := newBroker(t)
+	r := &flakyRegistry{Registry: memory.NewRegistry(), failing: true}
+
+	received := make(chan Message, 1)
+	srv := NewServer(
+		ServiceName("test.subscribe.register"),
+		WithHost("test.subscribe.register"),
+		WithRegistry(r),
+		WithTransport(tm.NewTransport()),
+		WithBroker(b),
+	)
+	if err := srv.Subscribe("events", func(ctx context.Context, m Message) error {
+		received <- m
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.Run(); err == nil {
+		t.Fatal("Expected the run to fail when the registration fails")
+	}
+
+	if err := b.Publish("events", &broker.Message{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+		t.Fatal("Expected the subscriber to be unsubscribed")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -1,9 +1,11 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strconv"
+	"sync"
 
 	//"honnef.co/go/tools/config"
 
@@ -40,6 +42,7 @@ type Service struct {
 }
 
 type Closer struct {
+	sync.Mutex
 	closers []func()
 }
 
@@ -67,6 +70,9 @@ func NewService(name, transport, registry string) *Service {
 		log.Error(err)
 	}
 
+	// run the closers once the server stopped
+	srvOpts = append(srvOpts, server.WithCloser(closer.Close))
+
 	start = true
 
 	// create the server
@@ -117,6 +123,7 @@ func (s *Service) GetSrv() *server.Server {
 	return s.Srv
 }
 
+// Close stops the server gracefully and runs the closers
 func (s *Service) Close() {
 	s.Srv.Stop()
 }
@@ -131,56 +138,57 @@ func (s *Service) Server() *grpc.Server {
 	return s.Srv.Server()
 }
 
+// Append adds a function which runs when the service stops
 func (c *Closer) Append(closer func()) {
+	c.Lock()
+	defer c.Unlock()
 	c.closers = append(c.closers, closer)
 }
 
-// GetPort is blocking until the server port is set
-// Background: server.Run is blocking therefore accessing generated port
-// will be 0 unless we wait for the server to start and then ask for port
-// by default this function will wait 120 seconds for the server to be available
-// after that it will return an error so that the code which uses this function can fallback
-// on other methods
-func (s *Service) GetPort() (int, error) {
+// Close runs the closers in reverse order, the last one appended runs first
+func (c *Closer) Close() {
+	c.Lock()
+	closers := c.closers
+	c.closers = nil
+	c.Unlock()
 
-	// return if it's already set
-	if s.GetSrv().GetPort() != 0 {
-		return s.GetSrv().GetPort(), nil
+	for i := len(closers) - 1; i >= 0; i-- {
+		closers[i]()
 	}
+}
 
-	// this needs to wait for the port allocation because grpc is blocking
-	ticker := time.NewTicker(200 * time.Millisecond)
-	done := make(chan bool)
+// Ready returns a channel which receives the server port once the server
+// listens and is registered. The channel is closed without a port when the
+// context is done first.
+func (s *Service) Ready(ctx context.Context) <-chan int {
+	ch := make(chan int, 1)
 
-	timeout := 120
-	// port -1 and wait for the port to be set, return when done
-	port := -1
-	i := 0
 	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				i++
-				if s.GetSrv().GetPort() != 0 {
-					port = s.GetSrv().GetPort()
-					done <- true
-					return
-				}
-
-				if i >= 5*timeout { //120 seconds
-					done <- true
-					log.Warn("grpc server port is not available")
-					return
-				}
-			}
+		defer close(ch)
+
+		select {
+		case <-s.GetSrv().Ready():
+			ch <- s.GetSrv().GetPort()
+		case <-ctx.Done():
 		}
 	}()
 
-	<-done
-	ticker.Stop()
-	if port == -1 {
+	return ch
+}
+
+// GetPort is blocking until the server port is set or 120 seconds passed
+//
+// Deprecated: use Ready
+func (s *Service) GetPort() (int, error) {
+	timeout := 120 * time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	port, ok := <-s.Ready(ctx)
+	if !ok {
 		log.Warn("can't wait no longer for the port, falling back to the standard service resolution")
-		return 0, fmt.Errorf("can't retrieve port in the last %v seconds", timeout)
+		return 0, fmt.Errorf("can't retrieve port in the last %v seconds", timeout.Seconds())
 	}
 	return port, nil
 }
@@ -4,6 +4,7 @@ package cache
 import (
 	"math"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
@@ -31,7 +32,7 @@ type cache struct {
 	registry.Registry
 	opts Options
 
-	// registry cache
+	// registry cache by namespace and service name
 	sync.RWMutex
 	cache   map[string][]*registry.Service
 	ttls    map[string]time.Time
@@ -40,8 +41,13 @@ type cache struct {
 	// used to stop the cache
 	exit chan bool
 
-	// indicate whether its running
-	running bool
+	// indicate whether the watcher of the namespace is running
+	running map[string]bool
+	// the revision of the last result of the namespace watcher
+	revision map[string]uint64
+	// the number of results of each service, a lookup racing with
+	// a result is not cached
+	changes map[string]uint64
 	// status of the registry
 	// used to hold onto the cache
 	// in failure state
@@ -52,6 +58,11 @@ var (
 	DefaultTTL = time.Minute
 )
 
+// key returns the cache key of the service in the namespace
+func key(ns, service string) string {
+	return ns + "/" + service
+}
+
 func backoff(attempts int) time.Duration {
 	if attempts == 0 {
 		return time.Duration(0)
@@ -101,24 +112,26 @@ func (c *cache) quit() bool {
 	}
 }
 
-func (c *cache) del(service string) {
+func (c *cache) del(k string) {
 	// don't blow away cache in error state
 	if err := c.status; err != nil {
 		return
 	}
 	// otherwise delete entries
-	delete(c.cache, service)
-	delete(c.ttls, service)
+	delete(c.cache, k)
+	delete(c.ttls, k)
 }
 
-func (c *cache) get(service string) ([]*registry.Service, error) {
+func (c *cache) get(ns, service string) ([]*registry.Service, error) {
+	k := key(ns, service)
+
 	// read lock
 	c.RLock()
 
 	// check the cache first
-	services := c.cache[service]
+	services := c.cache[k]
 	// get cache ttl
-	ttl := c.ttls[service]
+	ttl := c.ttls[k]
 	// make a copy
 	cp := util.Copy(services)
 
@@ -131,8 +144,12 @@ func (c *cache) get(service string) ([]*registry.Service, error) {
 
 	// get does the actual request for a service and cache it
 	get := func(service string, cached []*registry.Service) ([]*registry.Service, error) {
+		c.RLock()
+		changes := c.changes[k]
+		c.RUnlock()
+
 		// ask the registry
-		services, err := c.Registry.GetService(service)
+		services, err := c.Registry.GetService(service, registry.GetNamespace(ns))
 		if err != nil {
 			// check the cache
 			if len(cached) > 0 {
@@ -151,16 +168,19 @@ func (c *cache) get(service string) ([]*registry.Service, error) {
 			c.setStatus(nil)
 		}
 
-		// cache results
+		// cache results unless the service changed meanwhile,
+		// the next lookup asks the registry again
 		c.Lock()
-		c.set(service, util.Copy(services))
+		if c.changes[k] == changes {
+			c.set(k, util.Copy(services))
+		}
 		c.Unlock()
 
 		return services, nil
 	}
 
 	// watch service if not watched
-	_, ok := c.watched[service]
+	_, ok := c.watched[k]
 
 	// unlock the read lock
 	c.RUnlock()
@@ -170,11 +190,11 @@ func (c *cache) get(service string) ([]*registry.Service, error) {
 		c.Lock()
 
 		// set to watched
-		c.watched[service] = true
+		c.watched[k] = true
 
 		// only kick it off if not running
-		if !c.running {
-			go c.run()
+		if !c.running[ns] {
+			go c.run(ns)
 		}
 
 		c.Unlock()
@@ -184,12 +204,13 @@ func (c *cache) get(service string) ([]*registry.Service, error) {
 	return get(service, cp)
 }
 
-func (c *cache) set(service string, services []*registry.Service) {
-	c.cache[service] = services
-	c.ttls[service] = time.Now().Add(c.opts.TTL)
+func (c *cache) set(k string, services []*registry.Service) {
+	c.cache[k] = services
+	c.ttls[k] = time.Now().Add(c.opts.TTL)
 }
 
-func (c *cache) update(res *registry.Result) {
+// update applies the result of the namespace watcher
+func (c *cache) update(ns string, res *registry.Result) {
 	if res == nil || res.Service == nil {
 		return
 	}
@@ -197,12 +218,20 @@ func (c *cache) update(res *registry.Result) {
 	c.Lock()
 	defer c.Unlock()
 
+	if res.Revision > c.revision[ns] {
+		c.revision[ns] = res.Revision
+	}
+
+	k := key(ns, res.Service.Name)
+
 	// only save watched services
-	if _, ok := c.watched[res.Service.Name]; !ok {
+	if _, ok := c.watched[k]; !ok {
 		return
 	}
 
-	services, ok := c.cache[res.Service.Name]
+	c.changes[k]++
+
+	services, ok := c.cache[k]
 	if !ok {
 		// we're not going to cache anything
 		// unless there was already a lookup
@@ -212,7 +241,7 @@ func (c *cache) update(res *registry.Result) {
 	if len(res.Service.Nodes) == 0 {
 		switch res.Action {
 		case "delete":
-			c.del(res.Service.Name)
+			c.del(k)
 		}
 		return
 	}
@@ -230,7 +259,7 @@ func (c *cache) update(res *registry.Result) {
 	switch res.Action {
 	case "create", "update":
 		if service == nil {
-			c.set(res.Service.Name, append(services, res.Service))
+			c.set(k, append(services, res.Service))
 			return
 		}
 
@@ -249,7 +278,7 @@ func (c *cache) update(res *registry.Result) {
 		}
 
 		services[index] = res.Service
-		c.set(res.Service.Name, services)
+		c.set(k, services)
 	case "delete":
 		if service == nil {
 			return
@@ -275,7 +304,7 @@ func (c *cache) update(res *registry.Result) {
 		if len(nodes) > 0 {
 			service.Nodes = nodes
 			services[index] = service
-			c.set(service.Name, services)
+			c.set(k, services)
 			return
 		}
 
@@ -284,7 +313,7 @@ func (c *cache) update(res *registry.Result) {
 		// only have one thing to delete
 		// nuke the thing
 		if len(services) == 1 {
-			c.del(service.Name)
+			c.del(k)
 			return
 		}
 
@@ -298,22 +327,26 @@ func (c *cache) update(res *registry.Result) {
 		}
 
 		// save
-		c.set(service.Name, srvs)
+		c.set(k, srvs)
 	}
 }
 
-// run starts the cache watcher loop
+// run starts the cache watcher loop of the namespace
 // it creates a new watcher if there's a problem
-func (c *cache) run() {
+func (c *cache) run(ns string) {
 	c.Lock()
-	c.running = true
+	c.running[ns] = true
 	c.Unlock()
 
 	// reset watcher on exit
 	defer func() {
 		c.Lock()
-		c.watched = make(map[string]bool)
-		c.running = false
+		for k := range c.watched {
+			if strings.HasPrefix(k, key(ns, "")) {
+				delete(c.watched, k)
+			}
+		}
+		delete(c.running, ns)
 		c.Unlock()
 	}()
 
@@ -329,8 +362,18 @@ func (c *cache) run() {
 		j := rand.Int63n(100)
 		time.Sleep(time.Duration(j) * time.Millisecond)
 
-		// create new watcher
-		w, err := c.Registry.Watch()
+		// create new watcher, resuming after the last result
+		opts := []registry.WatchOption{registry.WatchNamespace(ns)}
+		if rev := c.getRevision(ns); rev > 0 {
+			opts = append(opts, registry.WatchRevision(rev))
+		}
+
+		w, err := c.Registry.Watch(opts...)
+		if err == registry.ErrRevisionCompacted {
+			// the missed changes are gone, start over
+			c.reset(ns)
+			continue
+		}
 		if err != nil {
 			if c.quit() {
 				return
@@ -354,11 +397,16 @@ func (c *cache) run() {
 		a = 0
 
 		// watch for events
-		if err := c.watch(w); err != nil {
+		if err := c.watch(ns, w); err != nil {
 			if c.quit() {
 				return
 			}
 
+			if err == registry.ErrRevisionCompacted {
+				c.reset(ns)
+				continue
+			}
+
 			d := backoff(b)
 			c.setStatus(err)
 
@@ -378,9 +426,29 @@ func (c *cache) run() {
 	}
 }
 
+func (c *cache) getRevision(ns string) uint64 {
+	c.RLock()
+	defer c.RUnlock()
+	return c.revision[ns]
+}
+
+// reset drops the cached services of the namespace and its revision
+func (c *cache) reset(ns string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for k := range c.cache {
+		if strings.HasPrefix(k, key(ns, "")) {
+			delete(c.cache, k)
+			delete(c.ttls, k)
+		}
+	}
+	delete(c.revision, ns)
+}
+
 // watch loops the next event and calls update
 // it returns if there's an error
-func (c *cache) watch(w registry.Watcher) error {
+func (c *cache) watch(ns string, w registry.Watcher) error {
 	// used to stop the watch
 	stop := make(chan bool)
 
@@ -411,13 +479,23 @@ func (c *cache) watch(w registry.Watcher) error {
 			c.setStatus(nil)
 		}
 
-		c.update(res)
+		c.update(ns, res)
 	}
 }
 
 func (c *cache) GetService(service string, opts ...registry.GetOption) ([]*registry.Service, error) {
+	var options registry.GetOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	ns := options.Namespace
+	if len(ns) == 0 {
+		ns = registry.DefaultNamespace
+	}
+
 	// get the service
-	services, err := c.get(service)
+	services, err := c.get(ns, service)
 	if err != nil {
 		return nil, err
 	}
@@ -462,6 +540,9 @@ func New(r registry.Registry, opts ...Option) Cache {
 		Registry: r,
 		opts:     options,
 		watched:  make(map[string]bool),
+		running:  make(map[string]bool),
+		revision: make(map[string]uint64),
+		changes:  make(map[string]uint64),
 		cache:    make(map[string][]*registry.Service),
 		ttls:     make(map[string]time.Time),
 		exit:     make(chan bool),
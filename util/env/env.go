@@ -15,6 +15,13 @@ type Env interface {
 	IsEnv(env string) bool
 }
 
+// Locality is implemented by the environments which know where the process
+// runs, the region and the zone are empty when unknown
+type Locality interface {
+	GetRegion() string
+	GetZone() string
+}
+
 type env struct{}
 
 func (e *env) GetEnv() string {
@@ -36,6 +43,14 @@ func (e *env) IsEnv(env string) bool {
 	return e.GetEnv() == env
 }
 
+func (e *env) GetRegion() string {
+	return os.Getenv("REGION")
+}
+
+func (e *env) GetZone() string {
+	return os.Getenv("ZONE")
+}
+
 func New() *env {
 	return &env{}
 }
@@ -376,7 +376,7 @@ func (s *Server) probe() {
 			Class:  dns.ClassINET,
 			Ttl:    defaultTTL,
 		},
-		Txt: sd.TXT,
+		Txt: sd.txt(),
 	}
 	q.Ns = []dns.RR{srv, txt}
 
@@ -423,6 +423,26 @@ func (s *Server) probe() {
 	}
 }
 
+// Announce sends the records of the service once more, e.g. after its TXT
+// records changed, so that the listeners don't wait for the next query
+func (s *Server) Announce() error {
+	sd, ok := s.config.Zone.(*MDNSService)
+	if !ok {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s.%s.%s.", sd.Instance, trimDot(sd.Service), trimDot(sd.Domain))
+
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeANY)
+
+	resp := new(dns.Msg)
+	resp.MsgHdr.Response = true
+	resp.Answer = append(resp.Answer, s.config.Zone.Records(q.Question[0])...)
+
+	return s.SendMulticast(resp)
+}
+
 // SendMulticast us used to send a multicast response packet
 func (s *Server) SendMulticast(msg *dns.Msg) error {
 	buf, err := msg.Pack()
@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/miekg/dns"
@@ -30,8 +31,9 @@ type MDNSService struct {
 	HostName     string   // Host machine DNS name (e.g. "mymachine.net.")
 	Port         int      // Service Port
 	IPs          []net.IP // IP addresses for the service's host
-	TXT          []string // Service TXT records
+	TXT          []string // Service TXT records, use SetTXT once served
 	TTL          uint32
+	txtLock      sync.RWMutex
 	serviceAddr  string // Fully qualified service address
 	instanceAddr string // Fully qualified instance address
 	enumAddr     string // _services._dns-sd._udp.<domain>
@@ -133,6 +135,19 @@ func NewMDNSService(instance, service, domain, hostName string, port int, ips []
 	}, nil
 }
 
+// SetTXT replaces the TXT records of the service while it is served
+func (m *MDNSService) SetTXT(txt []string) {
+	m.txtLock.Lock()
+	m.TXT = txt
+	m.txtLock.Unlock()
+}
+
+func (m *MDNSService) txt() []string {
+	m.txtLock.RLock()
+	defer m.txtLock.RUnlock()
+	return m.TXT
+}
+
 // trimDot is used to trim the dots from the start or end of a string
 func trimDot(s string) string {
 	return strings.Trim(s, ".")
@@ -304,7 +319,7 @@ func (m *MDNSService) instanceRecords(q dns.Question) []dns.RR {
 				Class:  dns.ClassINET,
 				Ttl:    atomic.LoadUint32(&m.TTL),
 			},
-			Txt: m.TXT,
+			Txt: m.txt(),
 		}
 		return []dns.RR{txt}
 	}
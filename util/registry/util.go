@@ -4,37 +4,6 @@ import (
 	"github.com/sumlookup/mini/registry"
 )
 
-func addNodes(old, neu []*registry.Node) []*registry.Node {
-	nodes := make([]*registry.Node, len(neu))
-	// add all new nodes
-	for i, n := range neu {
-		node := *n
-		nodes[i] = &node
-	}
-
-	// look at old nodes
-	for _, o := range old {
-		var exists bool
-
-		// check against new nodes
-		for _, n := range nodes {
-			// ids match then skip
-			if o.Id == n.Id {
-				exists = true
-				break
-			}
-		}
-
-		// keep old node
-		if !exists {
-			node := *o
-			nodes = append(nodes, &node)
-		}
-	}
-
-	return nodes
-}
-
 func delNodes(old, del []*registry.Node) []*registry.Node {
 	var nodes []*registry.Node
 	for _, o := range old {
@@ -87,36 +56,10 @@ func Copy(current []*registry.Service) []*registry.Service {
 	return services
 }
 
-// Merge merges two lists of services and returns a new copy
+// Merge merges two lists of services and returns a new copy, the services
+// of nlist take precedence
 func Merge(olist []*registry.Service, nlist []*registry.Service) []*registry.Service {
-	var srv []*registry.Service
-
-	for _, n := range nlist {
-		var seen bool
-		for _, o := range olist {
-			if o.Version == n.Version {
-				sp := new(registry.Service)
-				// make copy
-				*sp = *o
-				// set nodes
-				sp.Nodes = addNodes(o.Nodes, n.Nodes)
-
-				// mark as seen
-				seen = true
-				srv = append(srv, sp)
-				break
-			} else {
-				sp := new(registry.Service)
-				// make copy
-				*sp = *o
-				srv = append(srv, sp)
-			}
-		}
-		if !seen {
-			srv = append(srv, Copy([]*registry.Service{n})...)
-		}
-	}
-	return srv
+	return registry.Merge(olist, nlist)
 }
 
 // Remove removes services and returns a new copy
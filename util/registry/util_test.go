@@ -76,3 +76,63 @@ func TestRemoveNodes(t *testing.T) {
 		t.Logf("Nodes %+v", nodes)
 	}
 }
+
+func TestMerge(t *testing.T) {
+	olist := []*registry.Service{
+		{
+			Name:     "foo",
+			Version:  "1.0.0",
+			Metadata: map[string]string{"team": "old"},
+			Nodes: []*registry.Node{
+				{Id: "foo-123", Address: "localhost:9999"},
+				{Id: "foo-321", Address: "localhost:6666"},
+			},
+		},
+		{
+			Name:    "foo",
+			Version: "2.0.0",
+			Nodes: []*registry.Node{
+				{Id: "foo-456", Address: "localhost:7777"},
+			},
+		},
+	}
+	nlist := []*registry.Service{
+		{
+			Name:     "foo",
+			Version:  "1.0.0",
+			Metadata: map[string]string{"team": "new"},
+			Nodes: []*registry.Node{
+				{Id: "foo-123", Address: "localhost:8888"},
+			},
+		},
+		{
+			Name:    "foo",
+			Version: "3.0.0",
+			Nodes: []*registry.Node{
+				{Id: "foo-789", Address: "localhost:5555"},
+			},
+		},
+	}
+
+	servs := Merge(olist, nlist)
+	if i := len(servs); i != 3 {
+		t.Fatalf("Expected 3 services, got %d: %+v", i, servs)
+	}
+
+	v1 := servs[0]
+	if v1.Version != "1.0.0" || v1.Metadata["team"] != "new" || len(v1.Nodes) != 2 {
+		t.Fatalf("Expected 1.0.0 of the new list with 2 nodes, got %+v", v1)
+	}
+	if v1.Nodes[0].Id != "foo-123" || v1.Nodes[0].Address != "localhost:8888" {
+		t.Fatalf("Expected the new foo-123 node, got %+v", v1.Nodes[0])
+	}
+	if servs[1].Version != "2.0.0" || servs[2].Version != "3.0.0" {
+		t.Fatalf("Expected 2.0.0 and 3.0.0 to be kept, got %+v", servs)
+	}
+
+	// the lists are copied
+	servs[1].Nodes[0].Address = "localhost:1111"
+	if olist[1].Nodes[0].Address != "localhost:7777" {
+		t.Fatal("Expected the merged services to be a copy")
+	}
+}